@@ -93,6 +93,20 @@ func (repo *Repo) downloadIndex(id string, context map[string]interface{}) (down
 	if skippedLazy > 0 {
 		logging.LogInfof("[Lazy Load] skip downloading chunks for [%d] files during index download", skippedLazy)
 	}
+	if nil != repo.LazyCheckoutPredicate {
+		// 检出时需要立即检出的懒加载文件也要下载分块，这些文件可能已经在本地但是分块在上传后被清理了
+		indexFiles, getErr := repo.getFiles(index.Files)
+		if nil != getErr {
+			err = getErr
+			logging.LogErrorf("get index files failed: %s", err)
+			return
+		}
+		for _, f := range indexFiles {
+			if repo.isLazyLoadingFile(f.Path) && !repo.deferLazyFile(f) {
+				nonLazyFetched = append(nonLazyFetched, f)
+			}
+		}
+	}
 	// 从非懒加载文件列表中得到去重后的分块列表
 	cloudChunkIDs := repo.getChunks(nonLazyFetched)
 
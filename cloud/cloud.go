@@ -19,10 +19,13 @@ package cloud
 import (
 	"errors"
 	"strings"
+	"sync"
 
 	"github.com/dgraph-io/ristretto"
 	"github.com/klauspost/compress/zstd"
+	"github.com/panjf2000/ants/v2"
 	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/logging"
 )
 
 // Conf 用于描述云端存储服务配置信息。
@@ -140,6 +143,69 @@ type Cloud interface {
 	GetConcurrentReqs() int
 }
 
+// BatchDownloader 是云端存储服务可选实现的接口，支持一次请求下载多个对象的服务实现该接口可以减少请求往返次数。
+type BatchDownloader interface {
+
+	// DownloadObjects 用于批量下载对象数据，返回结果以对象路径为键。
+	DownloadObjects(filePaths []string) (ret map[string][]byte, err error)
+}
+
+// DownloadObjects 用于批量下载对象数据，返回结果以对象路径为键。
+// 云端存储服务实现了 BatchDownloader 时使用批量下载，否则按照配置的并发请求数并发逐个下载，任意一个对象下载失败时返回错误。
+func DownloadObjects(cloud Cloud, filePaths []string) (ret map[string][]byte, err error) {
+	if batch, ok := cloud.(BatchDownloader); ok {
+		return batch.DownloadObjects(filePaths)
+	}
+
+	ret = map[string][]byte{}
+	if 1 > len(filePaths) {
+		return
+	}
+
+	poolSize := cloud.GetConcurrentReqs()
+	if poolSize > len(filePaths) {
+		poolSize = len(filePaths)
+	}
+
+	lock := &sync.Mutex{}
+	waitGroup := &sync.WaitGroup{}
+	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
+		defer waitGroup.Done()
+		filePath := arg.(string)
+		data, downloadErr := cloud.DownloadObject(filePath)
+		lock.Lock()
+		defer lock.Unlock()
+		if nil != downloadErr {
+			if nil == err {
+				err = downloadErr
+			}
+			return
+		}
+		ret[filePath] = data
+	})
+	if nil != err {
+		return
+	}
+
+	for _, filePath := range filePaths {
+		waitGroup.Add(1)
+		if invokeErr := p.Invoke(filePath); nil != invokeErr {
+			waitGroup.Done()
+			logging.LogErrorf("invoke failed: %s", invokeErr)
+			lock.Lock()
+			err = invokeErr
+			lock.Unlock()
+			break
+		}
+	}
+	waitGroup.Wait()
+	p.Release()
+	if nil != err {
+		ret = nil
+	}
+	return
+}
+
 // Traffic 描述了流量信息。
 type Traffic struct {
 	UploadBytes   int64 // 上传字节数
@@ -25,11 +25,12 @@ import (
 
 // File 描述了文件。
 type File struct {
-	ID      string   `json:"id"`      // Hash
-	Path    string   `json:"path"`    // 文件路径
-	Size    int64    `json:"size"`    // 文件大小
-	Updated int64    `json:"updated"` // 最后更新时间
-	Chunks  []string `json:"chunks"`  // 文件分块列表
+	ID      string   `json:"id"`             // Hash
+	Path    string   `json:"path"`           // 文件路径
+	Size    int64    `json:"size"`           // 文件大小
+	Updated int64    `json:"updated"`        // 最后更新时间
+	Chunks  []string `json:"chunks"`         // 文件分块列表
+	Mode    uint32   `json:"mode,omitempty"` // 文件权限，仅记录懒加载文件，为 0 时表示未记录
 }
 
 func NewFile(path string, size int64, updated int64) (ret *File) {
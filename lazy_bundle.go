@@ -0,0 +1,139 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/restic/chunker"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/logging"
+)
+
+// 分块包是一个 tar 流，每个条目的名称是分块 ID，内容是本地存储中的分块数据（已压缩加密）。
+// 分块包可以通过 U 盘等介质在设备之间传递，只有使用相同密钥的仓库才能导入。
+
+// ExportChunkBundle 将本地存储中的分块 chunkIDs 打包写入 w，本地缺少的分块会返回错误。
+func (repo *Repo) ExportChunkBundle(chunkIDs []string, w io.Writer) (err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	chunkIDs = gulu.Str.RemoveDuplicatedElem(chunkIDs)
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, chunkID := range chunkIDs {
+		_, file := repo.store.AbsPath(chunkID)
+		var data []byte
+		if data, err = os.ReadFile(file); nil != err {
+			logging.LogErrorf("read chunk [%s] failed: %s", chunkID, err)
+			return fmt.Errorf("read chunk [%s] failed: %w", chunkID, err)
+		}
+
+		header := &tar.Header{Name: chunkID, Mode: 0644, Size: int64(len(data)), ModTime: now}
+		if err = tw.WriteHeader(header); nil != err {
+			return
+		}
+		if _, err = tw.Write(data); nil != err {
+			return
+		}
+	}
+	if err = tw.Close(); nil != err {
+		return
+	}
+	logging.LogInfof("exported [%d] chunks to bundle", len(chunkIDs))
+	return
+}
+
+// maxChunkBundleEntrySize 是分块包中单个条目的最大字节数：分块的最大大小加上压缩和加密的额外开销。
+const maxChunkBundleEntrySize = chunker.MaxSize + 64*1024
+
+// ErrChunkBundleEntryTooLarge 表示分块包中的条目超过了分块可能的最大大小，分块包可能已损坏或者不是 ExportChunkBundle 生成的。
+var ErrChunkBundleEntryTooLarge = errors.New("chunk bundle entry too large")
+
+// ImportChunkBundle 从 r 读取 ExportChunkBundle 生成的分块包并写入本地存储，返回新写入的分块数。
+// 之后懒加载这些分块对应的文件时直接使用本地分块，不需要从云端下载。无法解密或者内容与分块 ID 不一致的分块会返回错误，
+// 超过 maxChunkBundleEntrySize 的条目返回 ErrChunkBundleEntryTooLarge。读取和校验分块时不持有仓库锁，只在写入存储时持有。
+func (repo *Repo) ImportChunkBundle(r io.Reader) (imported int, err error) {
+	tr := tar.NewReader(r)
+	for {
+		header, nextErr := tr.Next()
+		if errors.Is(nextErr, io.EOF) {
+			break
+		}
+		if nil != nextErr {
+			err = fmt.Errorf("read chunk bundle failed: %w", nextErr)
+			return
+		}
+		if tar.TypeReg != header.Typeflag {
+			continue
+		}
+
+		chunkID := header.Name
+		if maxChunkBundleEntrySize < header.Size {
+			err = fmt.Errorf("chunk [%s] from bundle has [%d] bytes: %w", chunkID, header.Size, ErrChunkBundleEntryTooLarge)
+			return
+		}
+		var data []byte
+		if data, err = io.ReadAll(io.LimitReader(tr, maxChunkBundleEntrySize+1)); nil != err {
+			err = fmt.Errorf("read chunk [%s] from bundle failed: %w", chunkID, err)
+			return
+		}
+		if maxChunkBundleEntrySize < len(data) {
+			err = fmt.Errorf("chunk [%s] from bundle exceeds [%d] bytes: %w", chunkID, maxChunkBundleEntrySize, ErrChunkBundleEntryTooLarge)
+			return
+		}
+		if data, err = repo.store.decodeData(data); nil != err {
+			err = fmt.Errorf("decode chunk [%s] from bundle failed: %w", chunkID, err)
+			return
+		}
+		if chunkID != util.Hash(data) {
+			err = fmt.Errorf("chunk [%s] from bundle: %w", chunkID, ErrLazyHashMismatch)
+			return
+		}
+
+		var put bool
+		if put, err = repo.putBundleChunk(&entity.Chunk{ID: chunkID, Data: data}); nil != err {
+			return
+		}
+		if put {
+			imported++
+		}
+	}
+	logging.LogInfof("imported [%d] chunks from bundle", imported)
+	return
+}
+
+// putBundleChunk 持有仓库锁将分块包中已经校验过的分块写入本地存储，本地已有该分块时不写入并返回 false。
+func (repo *Repo) putBundleChunk(chunk *entity.Chunk) (put bool, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, statErr := repo.store.Stat(chunk.ID); nil == statErr {
+		return false, nil
+	}
+	if err = repo.store.PutChunk(chunk); nil != err {
+		return
+	}
+	return true, nil
+}
@@ -0,0 +1,97 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"github.com/siyuan-note/eventbus"
+)
+
+// 懒加载事件，通过 eventbus 发布。
+// 和其他仓库事件一样，第一个参数是调用时传入的上下文，第二个参数是对应的事件结构体指针，
+// 订阅函数的签名需要与之一致，比如 func(context map[string]interface{}, event *LazyDownloadStartEvent)。
+const (
+	EvtLazyDownloadStart    = "repo.lazyDownloadStart"    // 开始加载懒加载文件，事件为 *LazyDownloadStartEvent
+	EvtLazyDownloadProgress = "repo.lazyDownloadProgress" // 下载了懒加载文件的一个分块，事件为 *LazyDownloadProgressEvent
+	EvtLazyDownloadEnd      = "repo.lazyDownloadEnd"      // 懒加载文件加载结束（无论成功与否），事件为 *LazyDownloadEndEvent
+	EvtLazyFileMiss         = "repo.lazyFileMiss"         // 访问的懒加载文件不在本地，需要按需加载，事件为 *LazyFileMissEvent
+	EvtLazyAssetError       = "repo.lazyAssetError"       // 懒加载文件加载失败，事件为 *LazyAssetErrorEvent
+	EvtLazyUploadProgress   = "repo.lazyUploadProgress"   // 后台上传了延迟上传的懒加载文件的一个分块，事件为 *LazyUploadProgressEvent
+)
+
+// LazyDownloadStartEvent 是 EvtLazyDownloadStart 事件。
+type LazyDownloadStartEvent struct {
+	Path         string // 与索引一致的相对路径
+	Size         int64  // 文件大小
+	Chunks       int    // 文件分块数
+	CachedChunks int    // 本地已有的分块数，这些分块不需要下载
+}
+
+// LazyDownloadProgressEvent 是 EvtLazyDownloadProgress 事件。
+type LazyDownloadProgressEvent struct {
+	Path   string // 与索引一致的相对路径
+	Done   int    // 本次加载已下载的分块数
+	Total  int    // 本次加载需要下载的分块数
+	Length int64  // 本次加载已下载的字节数
+}
+
+// LazyDownloadEndEvent 是 EvtLazyDownloadEnd 事件。
+type LazyDownloadEndEvent struct {
+	Path    string // 与索引一致的相对路径
+	Success bool   // 是否加载成功
+	Err     error  // 加载失败时的错误
+}
+
+// LazyFileMissEvent 是 EvtLazyFileMiss 事件。
+type LazyFileMissEvent struct {
+	Path string // 与索引一致的相对路径
+}
+
+// LazyAssetErrorEvent 是 EvtLazyAssetError 事件。
+type LazyAssetErrorEvent struct {
+	Path string // 与索引一致的相对路径
+	Err  error  // 加载失败的原因
+}
+
+// LazyUploadProgressEvent 是 EvtLazyUploadProgress 事件。
+type LazyUploadProgressEvent struct {
+	Path   string // 与索引一致的相对路径
+	Done   int    // 已上传的分块数
+	Total  int    // 需要上传的分块数
+	Length int64  // 已上传的字节数
+}
+
+// ctxLazyPath 是懒加载时在调用上下文中记录文件路径的键，分块下载据此发布 EvtLazyDownloadProgress 事件。
+const ctxLazyPath = "lazyPath"
+
+// lazyEventContext 复制调用上下文并记录懒加载文件路径，不修改调用方传入的上下文。
+func lazyEventContext(context map[string]interface{}, relPath string) (ret map[string]interface{}) {
+	ret = make(map[string]interface{}, len(context)+1)
+	for k, v := range context {
+		ret[k] = v
+	}
+	ret[ctxLazyPath] = relPath
+	return
+}
+
+// publishLazyDownloadProgress 在懒加载的分块下载中发布 EvtLazyDownloadProgress 事件，非懒加载的下载不发布。
+func publishLazyDownloadProgress(context map[string]interface{}, done, total int, length int64) {
+	relPath, ok := context[ctxLazyPath].(string)
+	if !ok {
+		return
+	}
+	eventbus.Publish(EvtLazyDownloadProgress, context, &LazyDownloadProgressEvent{Path: relPath, Done: done, Total: total, Length: length})
+}
@@ -18,54 +18,102 @@ package dejavu
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/88250/gulu"
 	"github.com/sabhiram/go-gitignore"
 	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
 	"github.com/siyuan-note/logging"
 )
 
+// ErrLazyIndexNotWritable 表示懒加载索引无法写入磁盘（比如仓库文件夹是只读的），此时索引仅保留在内存中，调用方可以选择忽略该错误。
+var ErrLazyIndexNotWritable = errors.New("lazy index is not writable")
+
+// DefaultLazyIndexName 是懒加载索引文件的默认文件名。
+const DefaultLazyIndexName = "lazy-index.json"
+
+// LazyConflictDecision 是懒加载索引记录冲突时的处理决定。
+type LazyConflictDecision int
+
+const (
+	LazyConflictMerge        LazyConflictDecision = iota // 使用默认规则合并，即更新时间较新的记录优先
+	LazyConflictKeepExisting                             // 保留已有记录
+	LazyConflictUseIncoming                              // 使用新记录
+)
+
+// LazyConflictMode 是判断懒加载索引中同一路径的两条记录是否冲突的规则。
+type LazyConflictMode int
+
+const (
+	LazyConflictStrict      LazyConflictMode = iota // 文件 ID（由路径和更新时间计算）不同即为冲突，默认规则
+	LazyConflictContentOnly                         // 只比较大小和分块，内容相同只有更新时间不同时不算冲突，保留已有记录，适用于时间戳精度不可靠的文件系统
+)
+
+// LazyConflictHandler 在懒加载索引中同一路径的已有记录 existing 和新记录 incoming 不一致时调用，返回处理决定。
+// 调用时持有懒加载索引管理器的锁，处理函数中不能再调用管理器的方法。
+type LazyConflictHandler func(existing, incoming *entity.File) LazyConflictDecision
+
 // LazyIndexManager 管理懒加载文件的索引
 // 核心思想：将懒加载文件索引与普通文件索引分离，避免在索引构建时的复杂补丁操作
 type LazyIndexManager struct {
-	repoPath    string                  // 仓库路径
-	dataPath    string                  // 数据文件夹路径
-	patterns    []string                // 懒加载模式
-	matcher     *ignore.GitIgnore       // 懒加载匹配器
-	lazyFiles   map[string]*entity.File // 懒加载文件映射 path -> file
-	mutex       sync.RWMutex            // 读写锁
-	lastCloudID string                  // 最后同步的云端索引ID
+	repoPath     string                  // 仓库路径
+	name         string                  // 懒加载索引文件名
+	dataPath     string                  // 数据文件夹路径
+	patterns     []string                // 懒加载模式
+	excludes     []string                // 懒加载排除模式，在懒加载模式之后评估
+	keepSystem   bool                    // 是否不排除系统生成的隐藏文件（如 .DS_Store）
+	subroot      string                  // 懒加载根目录，为空时为整个数据文件夹
+	neverLazy    []string                // 永不懒加载模式，优先级最高
+	matcher      *lazyMatcher            // 懒加载匹配器
+	lazyFiles    map[string]*entity.File // 懒加载文件映射 path -> file
+	mutex        sync.RWMutex            // 读写锁
+	lastCloudID  string                  // 最后同步的云端索引ID
+	onConflict   LazyConflictHandler     // 记录冲突处理函数，为空时使用默认规则
+	conflictMode LazyConflictMode        // 记录冲突判断规则
+	evicted      map[string]bool         // 已驱逐的懒加载文件路径，本地副本已删除但仍保留在之后的索引中
+	origins      map[string]*lazyOrigin  // 懒加载文件分块列表的来源索引 path -> origin
+	localMtimes  map[string]*lazyMtime   // 下载后本地副本的更新时间与记录不一致的文件 path -> mtime
+	compact      bool                    // 是否以紧凑格式（无缩进）写入磁盘
+	dirty        bool                    // 是否有尚未写入磁盘的修改
+	saveTimer    *time.Timer             // 合并写入的定时器，为空时没有等待中的写入
+	writes       int                     // 写入磁盘的次数
+	closed       bool                    // 是否已关闭，关闭后的修改立即写入磁盘
+	inMemory     bool                    // 是否只保存在内存中，不读写磁盘
 }
 
+// lazyIndexSaveDelay 是懒加载索引修改后延迟写入磁盘的时间，这段时间内的多次修改合并为一次写入。
+const lazyIndexSaveDelay = 500 * time.Millisecond
+
 // NewLazyIndexManager 创建懒加载索引管理器
 func NewLazyIndexManager(repoPath, dataPath string, patterns []string) *LazyIndexManager {
-	// 创建匹配器，使用与repo相同的逻辑
-	var matcher *ignore.GitIgnore
-	if len(patterns) == 0 {
-		matcher = ignore.CompileIgnoreLines() // 返回空匹配器
-	} else {
-		// 统一移除前导 '/'，以消除路径格式差异
-		var normalized []string
-		for _, p := range patterns {
-			if strings.HasPrefix(p, "/") {
-				normalized = append(normalized, p[1:])
-			} else {
-				normalized = append(normalized, p)
-			}
-		}
-		matcher = ignore.CompileIgnoreLines(normalized...)
-	}
+	return NewLazyIndexManagerWithName(repoPath, dataPath, DefaultLazyIndexName, patterns)
+}
 
+// NewLazyIndexManagerWithName 创建使用指定索引文件名的懒加载索引管理器，name 为空时使用 DefaultLazyIndexName。
+// 使用不同文件名的管理器可以在同一个仓库下共存，互不覆盖。
+func NewLazyIndexManagerWithName(repoPath, dataPath, name string, patterns []string) *LazyIndexManager {
+	if "" == name {
+		name = DefaultLazyIndexName
+	}
 	manager := &LazyIndexManager{
 		repoPath:  repoPath,
+		name:      name,
 		dataPath:  dataPath,
 		patterns:  patterns,
-		matcher:   matcher,
+		matcher:   newLazyMatcher(patterns, nil, true),
 		lazyFiles: make(map[string]*entity.File),
+		evicted:   make(map[string]bool),
+		origins:   make(map[string]*lazyOrigin),
 	}
 
 	// 加载现有的懒加载索引
@@ -77,6 +125,256 @@ func NewLazyIndexManager(repoPath, dataPath string, patterns []string) *LazyInde
 	return manager
 }
 
+// NewInMemoryLazyIndexManager 创建只保存在内存中的懒加载索引管理器，不读取也不写入懒加载索引文件，
+// 适用于测试、临时使用以及只读的仓库文件夹，其他操作与 NewLazyIndexManager 创建的管理器一致。
+func NewInMemoryLazyIndexManager(dataPath string, patterns []string) *LazyIndexManager {
+	return &LazyIndexManager{
+		name:      DefaultLazyIndexName,
+		dataPath:  dataPath,
+		patterns:  patterns,
+		matcher:   newLazyMatcher(patterns, nil, true),
+		lazyFiles: make(map[string]*entity.File),
+		evicted:   make(map[string]bool),
+		origins:   make(map[string]*lazyOrigin),
+		inMemory:  true,
+	}
+}
+
+// SetInMemory 将管理器切换为只保存在内存中，已加载的记录保留，之后的修改不再写入磁盘，尚未写入磁盘的修改也会被丢弃。
+func (m *LazyIndexManager) SetInMemory() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.inMemory = true
+	if nil != m.saveTimer {
+		m.saveTimer.Stop()
+		m.saveTimer = nil
+	}
+	m.dirty = false
+}
+
+// newLazyLoadingMatcher 创建懒加载模式匹配器，Repo 和 LazyIndexManager 使用相同的逻辑
+func newLazyLoadingMatcher(patterns []string) *ignore.GitIgnore {
+	if len(patterns) == 0 {
+		return ignore.CompileIgnoreLines() // 返回空匹配器
+	}
+
+	// 统一移除前导 '/'，以消除路径格式差异
+	var normalized []string
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "/") {
+			normalized = append(normalized, p[1:])
+		} else {
+			normalized = append(normalized, p)
+		}
+	}
+	return ignore.CompileIgnoreLines(normalized...)
+}
+
+// lazySystemFilePatterns 是默认排除的系统生成的隐藏文件，这些文件即使匹配懒加载模式也不作为懒加载文件。
+var lazySystemFilePatterns = []string{
+	".DS_Store",
+	"._*",
+	".Spotlight-V100/",
+	".Trashes/",
+	".fseventsd/",
+	"Thumbs.db",
+	"ehthumbs.db",
+	"desktop.ini",
+	"$RECYCLE.BIN/",
+}
+
+// lazyMatcher 组合懒加载模式和排除模式：文件先按懒加载模式（包括 ! 取反模式）匹配，匹配后再按排除模式过滤。
+// 排除模式中系统文件模式在前、自定义排除模式在后，所以自定义排除模式可以用 ! 取反重新包含某个系统文件。
+// 设置了懒加载根目录时只有根目录下的文件可能是懒加载文件，模式按相对于根目录的路径匹配。
+// 永不懒加载模式的优先级最高，匹配的文件总是正常同步，不受其他模式（包括 ! 取反模式）影响。
+type lazyMatcher struct {
+	patterns *ignore.GitIgnore
+	excludes *ignore.GitIgnore
+	never    *ignore.GitIgnore // 永不懒加载模式，按相对于数据文件夹的路径匹配，为空时没有
+	subroot  string            // 懒加载根目录，相对于数据文件夹，不带前后 '/'，为空时为整个数据文件夹
+}
+
+func newLazyMatcher(patterns, excludes []string, excludeSystemFiles bool) *lazyMatcher {
+	var excludeLines []string
+	if excludeSystemFiles {
+		excludeLines = append(excludeLines, lazySystemFilePatterns...)
+	}
+	excludeLines = append(excludeLines, excludes...)
+	return &lazyMatcher{
+		patterns: newLazyLoadingMatcher(patterns),
+		excludes: newLazyLoadingMatcher(excludeLines),
+	}
+}
+
+// compileLazyMatcher 编译包括排除模式、懒加载根目录和永不懒加载模式在内的完整匹配器。
+func compileLazyMatcher(patterns, excludes []string, excludeSystemFiles bool, subroot string, never []string) (ret *lazyMatcher) {
+	ret = newLazyMatcher(patterns, excludes, excludeSystemFiles)
+	ret.subroot = subroot
+	if 0 < len(never) {
+		ret.never = newLazyLoadingMatcher(never)
+	}
+	return
+}
+
+// MatchesPath 判断路径是否为懒加载文件，路径不带前导 '/'。
+func (m *lazyMatcher) MatchesPath(p string) bool {
+	if nil != m.never && m.never.MatchesPath(p) {
+		return false
+	}
+	if "" != m.subroot {
+		if !strings.HasPrefix(p, m.subroot+"/") {
+			return false
+		}
+		p = p[len(m.subroot)+1:]
+	}
+	return m.patterns.MatchesPath(p) && !m.excludes.MatchesPath(p)
+}
+
+// SetPatterns 更新懒加载模式，并移除不再匹配的懒加载文件记录
+func (m *LazyIndexManager) SetPatterns(patterns []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.patterns = append([]string{}, patterns...)
+	m.rematch()
+}
+
+// SetExcludes 更新懒加载排除模式以及是否排除系统生成的隐藏文件，并移除不再匹配的懒加载文件记录
+func (m *LazyIndexManager) SetExcludes(excludeSystemFiles bool, excludes []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.excludes = append([]string{}, excludes...)
+	m.keepSystem = !excludeSystemFiles
+	m.rematch()
+}
+
+// SetSubroot 设置懒加载根目录，只有根目录下的文件可能是懒加载文件，并移除根目录外的懒加载文件记录。
+func (m *LazyIndexManager) SetSubroot(subroot string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.subroot = subroot
+	m.rematch()
+}
+
+// SetNeverLazy 设置永不懒加载模式，匹配的文件总是正常同步，并移除这些文件的懒加载记录。
+func (m *LazyIndexManager) SetNeverLazy(patterns []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.neverLazy = append([]string{}, patterns...)
+	m.rematch()
+}
+
+// rematch 重新编译匹配器并移除不再匹配的懒加载文件记录，调用方需要持有写锁。
+// 已驱逐并且本地没有副本的文件只能通过记录出现在之后的索引中，移除记录会导致下次同步删除该文件，
+// 所以保留这些记录（见 DemotedLazyFiles），由调用方下载到本地后再移除。
+func (m *LazyIndexManager) rematch() {
+	m.matcher = compileLazyMatcher(m.patterns, m.excludes, !m.keepSystem, m.subroot, m.neverLazy)
+
+	removed, kept := 0, 0
+	for path := range m.lazyFiles {
+		if m.isLazyLoadingFile(path) {
+			continue
+		}
+		if m.evicted[path] && !gulu.File.IsExist(filepath.Join(m.dataPath, path)) {
+			kept++
+			continue
+		}
+		delete(m.lazyFiles, path)
+		delete(m.evicted, path)
+		removed++
+	}
+	if 0 < removed {
+		m.scheduleSave()
+	}
+
+	logging.LogInfof("[Lazy Index] patterns updated: %v, excludes: %v, removed %d files no longer matched, kept %d evicted files until downloaded", m.patterns, m.excludes, removed, kept)
+}
+
+// DemotedLazyFiles 返回不再匹配懒加载模式、但本地副本已被驱逐的文件记录。这些文件仍然通过记录出现在索引中，
+// 需要下载到本地后再调用 RemoveLazyFile 移除记录，之后作为普通文件同步。
+func (m *LazyIndexManager) DemotedLazyFiles() (ret []*entity.File) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for path, file := range m.lazyFiles {
+		if m.evicted[path] && !m.isLazyLoadingFile(path) {
+			ret = append(ret, file)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return
+}
+
+// Patterns 返回懒加载模式的副本，修改返回值不会影响匹配
+func (m *LazyIndexManager) Patterns() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return append([]string{}, m.patterns...)
+}
+
+// Path 返回懒加载索引文件的路径，只保存在内存中时返回空字符串。
+func (m *LazyIndexManager) Path() string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.inMemory {
+		return ""
+	}
+	return filepath.Join(m.repoPath, m.name)
+}
+
+// SetConflictHandler 设置记录冲突处理函数，为 nil 时使用默认规则。
+func (m *LazyIndexManager) SetConflictHandler(handler LazyConflictHandler) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.onConflict = handler
+}
+
+// SetCompact 设置懒加载索引写入磁盘时是否使用紧凑格式，默认带缩进以便阅读，文件很多时使用紧凑格式可以明显减小索引文件。
+// 设置后立即按新格式重写索引文件，加载时两种格式都支持。
+func (m *LazyIndexManager) SetCompact(compact bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.compact == compact {
+		return nil
+	}
+	m.compact = compact
+	return m.save()
+}
+
+// SetConflictMode 设置记录冲突判断规则，默认为 LazyConflictStrict。
+func (m *LazyIndexManager) SetConflictMode(mode LazyConflictMode) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.conflictMode = mode
+}
+
+// useIncoming 判断同一路径的新记录是否替换已有记录，useIncomingByDefault 是默认规则的结果。调用方需要持有锁。
+func (m *LazyIndexManager) useIncoming(existing, incoming *entity.File, useIncomingByDefault bool) bool {
+	if existing.ID != incoming.ID && LazyConflictContentOnly == m.conflictMode &&
+		existing.Size == incoming.Size && slices.Equal(existing.Chunks, incoming.Chunks) {
+		// 内容相同只有更新时间不同，不算冲突
+		return false
+	}
+	if existing.ID == incoming.ID || nil == m.onConflict {
+		return useIncomingByDefault
+	}
+
+	switch m.onConflict(existing, incoming) {
+	case LazyConflictKeepExisting:
+		return false
+	case LazyConflictUseIncoming:
+		return true
+	default:
+		return useIncomingByDefault
+	}
+}
 
 // GetLazyFiles 获取所有懒加载文件
 func (m *LazyIndexManager) GetLazyFiles() []*entity.File {
@@ -90,6 +388,46 @@ func (m *LazyIndexManager) GetLazyFiles() []*entity.File {
 	return files
 }
 
+// GetLazyFile 根据路径获取懒加载文件记录，不存在时返回 nil
+func (m *LazyIndexManager) GetLazyFile(path string) *entity.File {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.lazyFiles[path]
+}
+
+// GetLazyFilesByPaths 批量获取懒加载文件记录，只加锁一次，未记录的路径不会出现在返回结果中
+func (m *LazyIndexManager) GetLazyFilesByPaths(paths []string) map[string]*entity.File {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	ret := make(map[string]*entity.File, len(paths))
+	for _, path := range paths {
+		if file, exists := m.lazyFiles[path]; exists {
+			ret[path] = file
+		}
+	}
+	return ret
+}
+
+// GetLazyFilesUnder 获取 prefix 文件夹下（包括子文件夹）的懒加载文件记录，按路径排序，只加锁一次。
+// prefix 会被规范为索引路径格式，"/" 或者空字符串表示全部记录。
+func (m *LazyIndexManager) GetLazyFilesUnder(prefix string) (ret []*entity.File) {
+	prefix = lazyIndexPath(prefix)
+	dirPrefix := strings.TrimSuffix(prefix, "/") + "/"
+
+	m.mutex.RLock()
+	for path, file := range m.lazyFiles {
+		if path == prefix || strings.HasPrefix(path, dirPrefix) {
+			ret = append(ret, file)
+		}
+	}
+	m.mutex.RUnlock()
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return
+}
+
 // UpdateFromCloudIndex 从云端索引更新懒加载文件信息
 func (m *LazyIndexManager) UpdateFromCloudIndex(cloudIndex *entity.Index, cloudFiles []*entity.File) error {
 	if cloudIndex.ID == m.lastCloudID {
@@ -108,7 +446,7 @@ func (m *LazyIndexManager) UpdateFromCloudIndex(cloudIndex *entity.Index, cloudF
 	for _, file := range cloudFiles {
 		if m.isLazyLoadingFile(file.Path) {
 			if oldFile, exists := m.lazyFiles[file.Path]; exists {
-				if oldFile.Updated != file.Updated {
+				if m.useIncoming(oldFile, file, oldFile.Updated != file.Updated) {
 					updated++
 					m.lazyFiles[file.Path] = file
 				}
@@ -119,6 +457,7 @@ func (m *LazyIndexManager) UpdateFromCloudIndex(cloudIndex *entity.Index, cloudF
 		}
 	}
 
+	m.recordOrigins(cloudIndex.ID, cloudFiles)
 	m.lastCloudID = cloudIndex.ID
 
 	// 保存到磁盘
@@ -130,6 +469,113 @@ func (m *LazyIndexManager) UpdateFromCloudIndex(cloudIndex *entity.Index, cloudF
 	return nil
 }
 
+// lazyOrigin 记录了最先产生某个分块列表的索引，用于排查懒加载记录的来源。
+type lazyOrigin struct {
+	IndexID string `json:"indexID"` // 索引 ID
+	Chunks  string `json:"chunks"`  // 分块列表的摘要，与当前记录的分块列表不一致时来源无效
+}
+
+// lazyChunksDigest 计算分块列表的摘要。
+func lazyChunksDigest(chunks []string) string {
+	return util.Hash([]byte(strings.Join(chunks, ",")))
+}
+
+// RecordOrigins 记录索引 indexID 中懒加载文件分块列表的来源，只有分块列表与已记录的来源不同时才记录，
+// 因此来源总是最先产生当前分块列表的索引。文件还没有加入懒加载索引时也会记录，加入后即可查询。
+func (m *LazyIndexManager) RecordOrigins(indexID string, files []*entity.File) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.recordOrigins(indexID, files)
+}
+
+func (m *LazyIndexManager) recordOrigins(indexID string, files []*entity.File) {
+	if nil == m.origins {
+		m.origins = make(map[string]*lazyOrigin)
+	}
+
+	recorded := 0
+	for _, file := range files {
+		if 1 > len(file.Chunks) || !m.isLazyLoadingFile(file.Path) {
+			continue
+		}
+		digest := lazyChunksDigest(file.Chunks)
+		if origin := m.origins[file.Path]; nil != origin && origin.Chunks == digest {
+			continue
+		}
+		m.origins[file.Path] = &lazyOrigin{IndexID: indexID, Chunks: digest}
+		recorded++
+	}
+	if 0 < recorded {
+		m.scheduleSave()
+		logging.LogInfof("[Lazy Index] recorded origin index [%s] of %d files", indexID, recorded)
+	}
+}
+
+// lazyMtime 记录了下载懒加载文件后本地副本的更新时间，没有恢复记录中的更新时间（见 Repo.LazyPreserveMtime）时用于判断本地副本是否被修改过。
+type lazyMtime struct {
+	FileID  string `json:"fileID"`  // 下载的文件 ID，与当前记录的文件 ID 不一致时无效
+	Updated int64  `json:"updated"` // 本地副本的更新时间，Unix 毫秒
+}
+
+// SetLocalMtime 记录下载文件 file 后本地副本的更新时间 updated，与记录中的更新时间一致时清除已有的记录。
+func (m *LazyIndexManager) SetLocalMtime(file *entity.File, updated int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if updated == file.Updated {
+		if _, exists := m.localMtimes[file.Path]; exists {
+			delete(m.localMtimes, file.Path)
+			m.scheduleSave()
+		}
+		return
+	}
+
+	if nil == m.localMtimes {
+		m.localMtimes = make(map[string]*lazyMtime)
+	}
+	m.localMtimes[file.Path] = &lazyMtime{FileID: file.ID, Updated: updated}
+	m.scheduleSave()
+}
+
+// clearLocalMtime 清除路径 path 下载后记录的本地更新时间。
+func (m *LazyIndexManager) clearLocalMtime(path string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.localMtimes[path]; exists {
+		delete(m.localMtimes, path)
+		m.scheduleSave()
+	}
+}
+
+// LocalMtime 返回文件 file 的本地副本没有被修改过时应有的更新时间：下载时记录了本地更新时间并且文件 ID 一致时使用该时间，否则使用记录中的更新时间。
+func (m *LazyIndexManager) LocalMtime(file *entity.File) int64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if mtime := m.localMtimes[file.Path]; nil != mtime && mtime.FileID == file.ID {
+		return mtime.Updated
+	}
+	return file.Updated
+}
+
+// GetOriginIndexID 返回懒加载文件 path 当前分块列表的来源索引 ID，没有记录或者记录已经过时时返回空字符串。
+func (m *LazyIndexManager) GetOriginIndexID(path string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.originIndexID(path)
+}
+
+func (m *LazyIndexManager) originIndexID(path string) string {
+	file, origin := m.lazyFiles[path], m.origins[path]
+	if nil == file || nil == origin || origin.Chunks != lazyChunksDigest(file.Chunks) {
+		return ""
+	}
+	return origin.IndexID
+}
+
 // AddLazyFilesFromIndex 从索引中添加懒加载文件（不删除现有记录）
 func (m *LazyIndexManager) AddLazyFilesFromIndex(files []*entity.File) {
 	m.mutex.Lock()
@@ -148,7 +594,7 @@ func (m *LazyIndexManager) AddLazyFilesFromIndex(files []*entity.File) {
 			
 			if existingFile, exists := m.lazyFiles[file.Path]; exists {
 				// 只更新更新时间更新的文件
-				if file.Updated > existingFile.Updated {
+				if m.useIncoming(existingFile, file, file.Updated > existingFile.Updated) {
 					m.lazyFiles[file.Path] = file
 					updated++
 				}
@@ -160,7 +606,7 @@ func (m *LazyIndexManager) AddLazyFilesFromIndex(files []*entity.File) {
 	}
 
 	if added > 0 || updated > 0 {
-		m.save() // 保存更改
+		m.scheduleSave()
 		logging.LogInfof("[Lazy Index] added %d new files, updated %d files from index", added, updated)
 	}
 }
@@ -175,11 +621,48 @@ func (m *LazyIndexManager) AddLazyFile(file *entity.File) {
 	defer m.mutex.Unlock()
 
 	m.lazyFiles[file.Path] = file
-	m.save() // 异步保存，忽略错误
+	m.scheduleSave()
 
 	logging.LogInfof("[Lazy Index] added file: %s", file.Path)
 }
 
+// Merge 将另一份懒加载索引合并到当前索引中，按路径取并集。
+// 同一路径以更新时间较新的记录为准，更新时间相同时取 ID 较大的记录，保证不同设备合并后结果一致。
+// 返回新增和更新的记录数。
+func (m *LazyIndexManager) Merge(other *LazyIndexManager) (added, updated int) {
+	if nil == other || m == other {
+		return
+	}
+
+	otherFiles := other.GetLazyFiles()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, file := range otherFiles {
+		if !m.isLazyLoadingFile(file.Path) || 1 > len(file.Chunks) {
+			continue
+		}
+
+		existingFile, exists := m.lazyFiles[file.Path]
+		if !exists {
+			m.lazyFiles[file.Path] = file
+			added++
+			continue
+		}
+		if m.useIncoming(existingFile, file, file.Updated > existingFile.Updated || (file.Updated == existingFile.Updated && file.ID > existingFile.ID)) {
+			m.lazyFiles[file.Path] = file
+			updated++
+		}
+	}
+
+	if added > 0 || updated > 0 {
+		m.scheduleSave()
+		logging.LogInfof("[Lazy Index] merged %d new files, updated %d files", added, updated)
+	}
+	return
+}
+
 // RemoveLazyFile 从索引中移除懒加载文件
 func (m *LazyIndexManager) RemoveLazyFile(path string) {
 	m.mutex.Lock()
@@ -187,20 +670,354 @@ func (m *LazyIndexManager) RemoveLazyFile(path string) {
 
 	if _, exists := m.lazyFiles[path]; exists {
 		delete(m.lazyFiles, path)
-		m.save() // 异步保存，忽略错误
+		delete(m.evicted, path)
+		delete(m.localMtimes, path)
+		m.scheduleSave()
 		logging.LogInfof("[Lazy Index] removed file: %s", path)
 	}
 }
 
-// MergeWithLocalFiles 将懒加载文件与本地文件合并，返回完整的文件列表
-func (m *LazyIndexManager) MergeWithLocalFiles(localFiles []*entity.File) []*entity.File {
+// RenameLazyFile 将懒加载文件记录从 oldPath 移动到 newPath，保留分块列表以免重新下载
+func (m *LazyIndexManager) RenameLazyFile(oldPath, newPath string) (ret *entity.File, err error) {
+	if !m.isLazyLoadingFile(newPath) {
+		err = fmt.Errorf("file [%s] is not a lazy loading file", newPath)
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	oldFile, exists := m.lazyFiles[oldPath]
+	if !exists {
+		err = fmt.Errorf("lazy file [%s] not found", oldPath)
+		return
+	}
+	if _, exists = m.lazyFiles[newPath]; exists {
+		err = fmt.Errorf("lazy file [%s] already exists", newPath)
+		return
+	}
+
+	ret = entity.NewFile(newPath, oldFile.Size, oldFile.Updated)
+	ret.Chunks = append([]string{}, oldFile.Chunks...)
+	ret.Mode = oldFile.Mode
+	delete(m.lazyFiles, oldPath)
+	m.lazyFiles[newPath] = ret
+	if m.evicted[oldPath] {
+		delete(m.evicted, oldPath)
+		m.evicted[newPath] = true
+	}
+	if mtime := m.localMtimes[oldPath]; nil != mtime {
+		// 文件 ID 由路径计算，重命名后本地更新时间记录到新的文件 ID 下
+		delete(m.localMtimes, oldPath)
+		if mtime.FileID == oldFile.ID {
+			m.localMtimes[newPath] = &lazyMtime{FileID: ret.ID, Updated: mtime.Updated}
+		}
+	}
+	if origin := m.origins[oldPath]; nil != origin {
+		delete(m.origins, oldPath)
+		m.origins[newPath] = origin
+	}
+	if err = m.save(); nil != err {
+		return
+	}
+
+	logging.LogInfof("[Lazy Index] renamed file: %s -> %s", oldPath, newPath)
+	return
+}
+
+// MarkEvicted 将懒加载文件标记为已驱逐，调用方需要保证文件已经安全上传到云端并删除了本地副本。
+// 已驱逐的文件在本地不存在时仍然保留在之后的索引中，重新加载到本地后标记自动清除。
+func (m *LazyIndexManager) MarkEvicted(path string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.lazyFiles[path]; !exists {
+		return
+	}
+	m.evicted[path] = true
+	m.scheduleSave()
+}
+
+// IsEvicted 判断懒加载文件是否已被驱逐。
+func (m *LazyIndexManager) IsEvicted(path string) bool {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
+	return m.evicted[path]
+}
+
+// ClearEvicted 清除 paths 中懒加载文件的已驱逐标记，返回标记被清除的路径，有修改时只保存一次。
+func (m *LazyIndexManager) ClearEvicted(paths []string) (cleared []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, path := range paths {
+		if m.evicted[path] {
+			delete(m.evicted, path)
+			cleared = append(cleared, path)
+		}
+	}
+	if 0 < len(cleared) {
+		m.scheduleSave()
+	}
+	return
+}
+
+// PruneEvicted 清除不在 files 中的懒加载文件的已驱逐标记，files 为最新索引中的文件。路径离开最新索引（比如在云端被删除或者重命名）后，
+// 保留标记会导致之后的索引通过记录重新加入该文件。返回标记被清除的路径，有修改时只保存一次。
+func (m *LazyIndexManager) PruneEvicted(files []*entity.File) (cleared []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if 1 > len(m.evicted) {
+		return
+	}
+
+	paths := make(map[string]bool, len(files))
+	for _, file := range files {
+		paths[file.Path] = true
+	}
+	for path := range m.evicted {
+		if !paths[path] {
+			delete(m.evicted, path)
+			cleared = append(cleared, path)
+		}
+	}
+	if 0 < len(cleared) {
+		m.scheduleSave()
+		logging.LogInfof("[Lazy Index] cleared evicted marks of files not in latest index %v", cleared)
+	}
+	return
+}
+
+// RepairFileIDs 为懒加载索引中文件 ID 为空的记录（比如旧版本或者同步中断时写入的记录）补全文件 ID：
+// 在 files 中查找路径相同并且分块列表一致的文件，使用该文件替换记录，保留记录中的文件权限。返回补全的路径，有修改时只保存一次。
+func (m *LazyIndexManager) RepairFileIDs(files []*entity.File) (repaired []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	byPath := make(map[string]*entity.File, len(files))
+	for _, file := range files {
+		byPath[file.Path] = file
+	}
+	for path, lazyFile := range m.lazyFiles {
+		if "" != lazyFile.ID {
+			continue
+		}
+
+		file := byPath[path]
+		if nil == file || "" == file.ID || !slices.Equal(file.Chunks, lazyFile.Chunks) {
+			logging.LogWarnf("[Lazy Index] can not repair file ID of [%s], no matching file in index", path)
+			continue
+		}
+		repairedFile := *file
+		if 0 != lazyFile.Mode {
+			repairedFile.Mode = lazyFile.Mode
+		}
+		m.lazyFiles[path] = &repairedFile
+		repaired = append(repaired, path)
+	}
+	if 0 < len(repaired) {
+		sort.Strings(repaired)
+		m.scheduleSave()
+		logging.LogInfof("[Lazy Index] repaired file IDs of %v", repaired)
+	}
+	return
+}
+
+// RebuildPlan 描述了从仓库本地所有索引重建懒加载索引时将要做的修改，路径均已排序。
+type RebuildPlan struct {
+	Added   []string // 将要新增的懒加载文件路径
+	Updated []string // 将要更新记录的懒加载文件路径
+	Removed []string // 将要移除的懒加载文件路径
+
+	files    map[string]*entity.File // 重建后的懒加载文件记录 path -> file
+	latestID string                  // 计算时的最新索引 ID，没有最新索引时为空
+	indexes  []string                // 计算时扫描的本地索引 ID，已排序
+	current  map[string]string       // 计算时懒加载索引的记录 path -> file ID
+}
+
+// ErrRebuildPlanStale 表示计算重建计划之后最新索引、本地索引或者懒加载索引已经变化，计划不能再应用，需要重新计算。
+var ErrRebuildPlanStale = errors.New("lazy index rebuild plan is stale")
+
+// PlanRebuild 扫描仓库本地所有索引计算重建后的懒加载索引，返回将要做的修改，不会修改当前的懒加载索引，确认后通过 ApplyRebuild 应用。
+// 同一路径在多个索引中出现时使用和 Merge 相同的规则，即更新时间较新的记录优先，本地缺失的文件对象会被跳过。
+func (m *LazyIndexManager) PlanRebuild(repo *Repo) (ret *RebuildPlan, err error) {
+	dir := filepath.Join(repo.Path, "indexes")
+	entries, err := os.ReadDir(dir)
+	if nil != err {
+		if !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+
+	latestID, err := rebuildLatestID(repo)
+	if nil != err {
+		return
+	}
+
+	files := map[string]*entity.File{}
+	scanned := map[string]bool{}
+	var indexes []string
+	for _, entry := range entries {
+		if entry.IsDir() || 40 != len(entry.Name()) {
+			continue
+		}
+		indexes = append(indexes, entry.Name())
+
+		index, getErr := repo.store.GetIndex(entry.Name())
+		if nil != getErr {
+			logging.LogWarnf("[Lazy Index] skip index [%s] in rebuild plan: %s", entry.Name(), getErr)
+			continue
+		}
+		for _, fileID := range index.Files {
+			if scanned[fileID] {
+				continue
+			}
+			scanned[fileID] = true
+
+			file, getErr := repo.store.GetFile(fileID)
+			if nil != getErr {
+				logging.LogWarnf("[Lazy Index] skip file [%s] in rebuild plan: %s", fileID, getErr)
+				continue
+			}
+			if !m.isLazyLoadingFile(file.Path) || 1 > len(file.Chunks) {
+				continue
+			}
+			if existing := files[file.Path]; nil == existing || file.Updated > existing.Updated || (file.Updated == existing.Updated && file.ID > existing.ID) {
+				files[file.Path] = file
+			}
+		}
+	}
+
+	ret = &RebuildPlan{files: files, latestID: latestID, indexes: indexes, current: map[string]string{}}
+	m.mutex.RLock()
+	for path, file := range m.lazyFiles {
+		ret.current[path] = file.ID
+	}
+	for path, file := range files {
+		if existing, exists := m.lazyFiles[path]; !exists {
+			ret.Added = append(ret.Added, path)
+		} else if existing.ID != file.ID {
+			ret.Updated = append(ret.Updated, path)
+		}
+	}
+	for path := range m.lazyFiles {
+		if _, exists := files[path]; !exists {
+			ret.Removed = append(ret.Removed, path)
+		}
+	}
+	m.mutex.RUnlock()
+	sort.Strings(ret.Added)
+	sort.Strings(ret.Updated)
+	sort.Strings(ret.Removed)
+	return
+}
+
+// RebuildFromAllIndexes 从仓库本地所有索引重建懒加载索引，用于懒加载索引丢失或者损坏后恢复，返回实际做的修改。
+func (m *LazyIndexManager) RebuildFromAllIndexes(repo *Repo) (ret *RebuildPlan, err error) {
+	if ret, err = m.PlanRebuild(repo); nil != err {
+		return
+	}
+	err = m.ApplyRebuild(repo, ret)
+	return
+}
+
+// ApplyRebuild 应用 PlanRebuild 返回的重建计划 plan。计算计划之后最新索引、本地索引或者懒加载索引有变化时不做任何修改，
+// 返回 ErrRebuildPlanStale，调用方需要重新计算计划并确认。
+func (m *LazyIndexManager) ApplyRebuild(repo *Repo, plan *RebuildPlan) (err error) {
+	latestID, err := rebuildLatestID(repo)
+	if nil != err {
+		return
+	}
+	entries, err := os.ReadDir(filepath.Join(repo.Path, "indexes"))
+	if nil != err {
+		if !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+	var indexes []string
+	for _, entry := range entries {
+		if !entry.IsDir() && 40 == len(entry.Name()) {
+			indexes = append(indexes, entry.Name())
+		}
+	}
+	if latestID != plan.latestID || !slices.Equal(indexes, plan.indexes) {
+		return fmt.Errorf("%w: indexes changed since planning", ErrRebuildPlanStale)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.lazyFiles) != len(plan.current) {
+		return fmt.Errorf("%w: lazy index changed since planning", ErrRebuildPlanStale)
+	}
+	for path, file := range m.lazyFiles {
+		if id, ok := plan.current[path]; !ok || id != file.ID {
+			return fmt.Errorf("%w: lazy file [%s] changed since planning", ErrRebuildPlanStale, path)
+		}
+	}
+
+	m.lazyFiles = maps.Clone(plan.files)
+	for path := range m.evicted {
+		if _, exists := m.lazyFiles[path]; !exists {
+			delete(m.evicted, path)
+		}
+	}
+	if err = m.save(); nil != err {
+		return
+	}
+	logging.LogInfof("[Lazy Index] rebuilt from all indexes, added [%d], updated [%d], removed [%d]", len(plan.Added), len(plan.Updated), len(plan.Removed))
+	return
+}
+
+// rebuildLatestID 返回仓库最新索引的 ID，没有最新索引时返回空。
+func rebuildLatestID(repo *Repo) (ret string, err error) {
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			err = nil
+		}
+		return
+	}
+	return latest.ID, nil
+}
+
+// MergeWithLocalFiles 将懒加载文件与本地文件合并，返回完整的文件列表
+//
+// 合并优先级：
+//  1. localFiles 中的文件总是原样使用，其分块在索引时根据磁盘内容计算
+//  2. 不在 localFiles 中但磁盘上存在的懒加载文件，如果大小和更新时间与懒加载索引记录一致则使用记录（包括分块），
+//     否则说明记录已经过时，使用磁盘上的文件重新生成记录，由索引重新计算分块
+//  3. 磁盘上不存在的已驱逐文件使用记录加入合并结果，因为驱逐只删除了本地副本，文件本身仍然存在
+//  4. 磁盘上不存在的其他懒加载文件不加入合并结果，但保留在懒加载索引中
+//
+// 磁盘上存在的文件会清除已驱逐标记。
+func (m *LazyIndexManager) MergeWithLocalFiles(localFiles []*entity.File) []*entity.File {
+	return m.mergeWithLocalFiles(localFiles, true)
+}
+
+// mergeWithLocalFiles 实现 MergeWithLocalFiles，update 为 false 时只计算合并结果，不清除已驱逐标记。
+func (m *LazyIndexManager) mergeWithLocalFiles(localFiles []*entity.File, update bool) []*entity.File {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	// 创建本地文件路径映射
 	localFileMap := make(map[string]*entity.File)
+	evictedChanged := false
 	for _, file := range localFiles {
 		localFileMap[file.Path] = file
+		if update && m.evicted[file.Path] {
+			delete(m.evicted, file.Path)
+			evictedChanged = true
+		}
+		if _, recorded := m.lazyFiles[file.Path]; update && recorded && !m.isLazyLoadingFile(file.Path) {
+			// 不再匹配懒加载模式的文件已经回到本地，之后作为普通文件同步
+			delete(m.lazyFiles, file.Path)
+			evictedChanged = true
+		}
 	}
 
 	// 合并文件列表
@@ -214,7 +1031,18 @@ func (m *LazyIndexManager) MergeWithLocalFiles(localFiles []*entity.File) []*ent
 		if _, existsLocally := localFileMap[path]; !existsLocally {
 			// 检查文件在本地文件系统中是否实际存在
 			// 这防止了已删除的懒加载文件被重新加入索引
-			if fsPath := filepath.Join(m.dataPath, path); gulu.File.IsExist(fsPath) {
+			if info, statErr := os.Stat(filepath.Join(m.dataPath, path)); nil == statErr && !info.IsDir() {
+				if info.Size() != lazyFile.Size || info.ModTime().UnixMilli() != lazyFile.Updated {
+					logging.LogInfof("[Lazy Index] lazy file [%s] changed on disk, recompute chunks", path)
+					lazyFile = entity.NewFile(path, info.Size(), info.ModTime().UnixMilli())
+				}
+				mergedFiles = append(mergedFiles, lazyFile)
+				addedLazy++
+				if update && m.evicted[path] {
+					delete(m.evicted, path)
+					evictedChanged = true
+				}
+			} else if m.evicted[path] {
 				mergedFiles = append(mergedFiles, lazyFile)
 				addedLazy++
 			} else {
@@ -231,10 +1059,66 @@ func (m *LazyIndexManager) MergeWithLocalFiles(localFiles []*entity.File) []*ent
 	if skippedLazy > 0 {
 		logging.LogInfof("[Lazy Index] skipped %d deleted lazy files from index merge", skippedLazy)
 	}
+	if evictedChanged {
+		m.scheduleSave()
+	}
 
 	return mergedFiles
 }
 
+// Close 将懒加载索引写入磁盘
+func (m *LazyIndexManager) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.closed = true
+	if nil != m.saveTimer {
+		m.saveTimer.Stop()
+		m.saveTimer = nil
+	}
+	return m.save()
+}
+
+// Flush 立即将尚未写入磁盘的修改写入磁盘，没有修改时不做任何事。
+// 添加、移除等修改默认延迟 lazyIndexSaveDelay 合并写入，需要确保修改已经持久化时（比如退出前）调用该方法。
+func (m *LazyIndexManager) Flush() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.dirty {
+		return nil
+	}
+	return m.save()
+}
+
+// scheduleSave 标记懒加载索引有修改，并在 lazyIndexSaveDelay 后写入磁盘，期间的其他修改合并到同一次写入，关闭后立即写入。调用方需要持有写锁。
+func (m *LazyIndexManager) scheduleSave() {
+	m.dirty = true
+	if m.closed {
+		if err := m.save(); nil != err {
+			logging.LogWarnf("[Lazy Index] save failed, keep changes in memory only: %s", err)
+		}
+		return
+	}
+	if nil == m.saveTimer {
+		m.saveTimer = time.AfterFunc(lazyIndexSaveDelay, m.delayedSave)
+	}
+}
+
+// delayedSave 由合并写入的定时器调用
+func (m *LazyIndexManager) delayedSave() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.saveTimer = nil
+	if !m.dirty {
+		return
+	}
+	if err := m.save(); nil != err {
+		logging.LogWarnf("[Lazy Index] save failed, keep changes in memory only: %s", err)
+	}
+}
+
 // isLazyLoadingFile 检查文件是否为懒加载文件，使用与repo.go完全相同的逻辑
 func (m *LazyIndexManager) isLazyLoadingFile(filePath string) bool {
 	if len(m.patterns) == 0 {
@@ -250,26 +1134,49 @@ func (m *LazyIndexManager) isLazyLoadingFile(filePath string) bool {
 
 // save 保存懒加载索引到磁盘
 func (m *LazyIndexManager) save() error {
+	if m.inMemory {
+		m.dirty = false
+		return nil
+	}
+
 	data := struct {
 		LastCloudID string                  `json:"lastCloudID"`
 		LazyFiles   map[string]*entity.File `json:"lazyFiles"`
+		Evicted     map[string]bool         `json:"evicted,omitempty"`
+		Origins     map[string]*lazyOrigin  `json:"origins,omitempty"`
+		LocalMtimes map[string]*lazyMtime   `json:"localMtimes,omitempty"`
 	}{
 		LastCloudID: m.lastCloudID,
 		LazyFiles:   m.lazyFiles,
+		Evicted:     m.evicted,
+		Origins:     m.origins,
+		LocalMtimes: m.localMtimes,
 	}
 
-	bytes, err := json.MarshalIndent(data, "", "  ")
+	var bytes []byte
+	var err error
+	if m.compact {
+		bytes, err = json.Marshal(data)
+	} else {
+		bytes, err = json.MarshalIndent(data, "", "  ")
+	}
 	if err != nil {
 		return err
 	}
 
-	lazyIndexPath := filepath.Join(m.repoPath, "lazy-index.json")
-	return gulu.File.WriteFileSafer(lazyIndexPath, bytes, 0644)
+	// 先写入临时文件再重命名，读取方不会看到写了一半的文件
+	lazyIndexPath := filepath.Join(m.repoPath, m.name)
+	if err = gulu.File.WriteFileSafer(lazyIndexPath, bytes, 0644); nil != err {
+		return fmt.Errorf("%w: %s", ErrLazyIndexNotWritable, err)
+	}
+	m.dirty = false
+	m.writes++
+	return nil
 }
 
 // load 从磁盘加载懒加载索引
 func (m *LazyIndexManager) load() error {
-	lazyIndexPath := filepath.Join(m.repoPath, "lazy-index.json")
+	lazyIndexPath := filepath.Join(m.repoPath, m.name)
 
 	if !gulu.File.IsExist(lazyIndexPath) {
 		return nil // 文件不存在是正常的
@@ -283,6 +1190,9 @@ func (m *LazyIndexManager) load() error {
 	var data struct {
 		LastCloudID string                  `json:"lastCloudID"`
 		LazyFiles   map[string]*entity.File `json:"lazyFiles"`
+		Evicted     map[string]bool         `json:"evicted"`
+		Origins     map[string]*lazyOrigin  `json:"origins"`
+		LocalMtimes map[string]*lazyMtime   `json:"localMtimes"`
 	}
 
 	if err := json.Unmarshal(bytes, &data); err != nil {
@@ -293,6 +1203,15 @@ func (m *LazyIndexManager) load() error {
 	if data.LazyFiles != nil {
 		m.lazyFiles = data.LazyFiles
 	}
+	if data.Evicted != nil {
+		m.evicted = data.Evicted
+	}
+	if data.Origins != nil {
+		m.origins = data.Origins
+	}
+	if data.LocalMtimes != nil {
+		m.localMtimes = data.LocalMtimes
+	}
 
 	logging.LogInfof("[Lazy Index] loaded %d lazy files (last cloud ID: %s)", len(m.lazyFiles), m.lastCloudID)
 	return nil
@@ -0,0 +1,199 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/siyuan-note/logging"
+)
+
+// lazyLoadJob 描述了一个懒加载下载任务。
+type lazyLoadJob struct {
+	absPath     string                 // 数据文件夹下的绝对路径
+	relPath     string                 // 与索引一致的相对路径
+	context     map[string]interface{} // 发布事件时传递的调用上下文
+	interactive bool                   // 是否为交互式加载
+	paused      bool                   // 后台预取是否因为超出缓存上限而暂停过
+	stats       LazyChunkStats         // 任务加载的分块来源统计
+	done        chan struct{}          // 任务完成后关闭
+	err         error                  // 任务执行结果
+}
+
+// lazyLoadQueue 是懒加载下载队列。
+// 交互式加载（LazyLoadFile）优先于后台预取（PrefetchLazyFiles），同一路径的任务会被复用而不会重复下载。
+// 由于懒加载需要持有仓库锁，这里只使用一个工作协程，队列为空时工作协程退出。
+// 超出缓存上限的后台预取任务被暂停，不占用工作协程，直到 resume 将其重新排队。
+type lazyLoadQueue struct {
+	mutex       sync.Mutex
+	interactive []*lazyLoadJob          // 交互式加载队列
+	background  []*lazyLoadJob          // 后台预取队列
+	paused      []*lazyLoadJob          // 因为超出缓存上限暂停的后台预取任务
+	jobs        map[string]*lazyLoadJob // 排队中、暂停或者正在执行的任务 relPath -> job
+	running     bool                    // 工作协程是否在运行
+	resumes     int                     // resume 的调用次数，用于发现检查缓存上限期间发生的恢复
+}
+
+// load 加载懒加载文件并等待完成。
+func (q *lazyLoadQueue) load(repo *Repo, absPath, relPath string, context map[string]interface{}, interactive bool) error {
+	job := q.enqueue(repo, absPath, relPath, context, interactive)
+	<-job.done
+	return job.err
+}
+
+// enqueue 将任务加入队列，如果同一路径的任务已经在队列中或正在执行，则复用该任务。
+// 任务按 resolveLazyFilePath 规范化后的 relPath 去重，同一文件的绝对路径、相对路径以及带或不带前导 '/' 的写法共用一个任务。
+func (q *lazyLoadQueue) enqueue(repo *Repo, absPath, relPath string, context map[string]interface{}, interactive bool) (ret *lazyLoadJob) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if nil == q.jobs {
+		q.jobs = map[string]*lazyLoadJob{}
+	}
+
+	if ret = q.jobs[relPath]; nil != ret {
+		if interactive && !ret.interactive {
+			// 后台预取中排队或者暂停的任务提升为交互式加载
+			for _, queue := range []*[]*lazyLoadJob{&q.background, &q.paused} {
+				if i := slices.Index(*queue, ret); -1 < i {
+					*queue = slices.Delete(*queue, i, i+1)
+					q.interactive = append(q.interactive, ret)
+					ret.interactive = true
+					break
+				}
+			}
+			q.start(repo)
+		}
+		return
+	}
+
+	ret = &lazyLoadJob{absPath: absPath, relPath: relPath, context: context, interactive: interactive, done: make(chan struct{})}
+	q.jobs[relPath] = ret
+	if interactive {
+		q.interactive = append(q.interactive, ret)
+	} else {
+		q.background = append(q.background, ret)
+	}
+	q.start(repo)
+	return
+}
+
+// start 在工作协程没有运行时启动工作协程。调用方需要持有 q.mutex。
+func (q *lazyLoadQueue) start(repo *Repo) {
+	if !q.running {
+		q.running = true
+		go q.work(repo)
+	}
+}
+
+// next 取出下一个待执行的任务，交互式加载优先。队列为空时返回 nil 并标记工作协程退出。
+// 任务的 interactive 会被 enqueue 在持有锁时修改，这里在锁内复制一份给工作协程使用。
+func (q *lazyLoadQueue) next() (ret *lazyLoadJob, interactive bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if 0 < len(q.interactive) {
+		ret, q.interactive = q.interactive[0], q.interactive[1:]
+		return ret, ret.interactive
+	}
+	if 0 < len(q.background) {
+		ret, q.background = q.background[0], q.background[1:]
+		return ret, ret.interactive
+	}
+	q.running = false
+	return
+}
+
+// resumeCount 返回 resume 的调用次数，检查缓存上限前读取，暂停任务时传给 pause。
+func (q *lazyLoadQueue) resumeCount() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.resumes
+}
+
+// pause 暂停超出缓存上限的后台预取任务，工作协程继续执行后面的任务。
+// 如果检查缓存上限后（resumes 之后）已经有过恢复，检查结果可能已经过时，任务放回后台队列队首重新检查。
+func (q *lazyLoadQueue) pause(job *lazyLoadJob, resumes int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if resumes != q.resumes {
+		q.background = append([]*lazyLoadJob{job}, q.background...)
+		return
+	}
+	q.paused = append(q.paused, job)
+}
+
+// resume 将暂停的后台预取任务放回后台队列队首重新检查缓存上限，在本地懒加载文件被驱逐、缓存上限调整以及关闭仓库时调用。
+func (q *lazyLoadQueue) resume(repo *Repo) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.resumes++
+	if 1 > len(q.paused) {
+		return
+	}
+	q.background = append(q.paused, q.background...)
+	q.paused = nil
+	q.start(repo)
+}
+
+// pending 返回排队中或者正在执行的任务数。
+func (q *lazyLoadQueue) pending() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.jobs)
+}
+
+// finish 标记任务完成。
+func (q *lazyLoadQueue) finish(job *lazyLoadJob) {
+	q.mutex.Lock()
+	delete(q.jobs, job.relPath)
+	q.mutex.Unlock()
+	close(job.done)
+}
+
+func (q *lazyLoadQueue) work(repo *Repo) {
+	for job, interactive := q.next(); nil != job; job, interactive = q.next() {
+		resumes := q.resumeCount()
+		if !interactive && !repo.lazyClosed.Load() && !repo.lazyPrefetchAllowed(job) {
+			// 超出缓存上限时暂停该后台预取任务，其他任务继续执行，本地懒加载文件被驱逐或者调整上限后恢复
+			if !job.paused {
+				job.paused = true
+				logging.LogInfof("[Lazy Load] prefetch paused at file [%s], local lazy files reach the limit", job.relPath)
+			}
+			q.pause(job, resumes)
+			continue
+		}
+
+		job.err = repo.lazyLoadFile(job.absPath, job.relPath, &job.stats, job.context)
+		if nil == job.err {
+			now := repo.now().UnixMilli()
+			repo.lazyLastLoaded.Store(now)
+			repo.lazyAccessed.Store(job.relPath, now)
+			repo.lazyLocalChunkHits.Add(int64(job.stats.LocalChunkHits))
+			repo.lazyCloudChunkFetches.Add(int64(job.stats.CloudChunkFetches))
+		}
+		if nil != job.err && !interactive {
+			logging.LogWarnf("[Lazy Load] prefetch file [%s] failed: %s", job.relPath, job.err)
+		}
+		q.finish(job)
+		repo.logLazyAccess(job)
+		repo.prefetchAfterAccess(job, interactive)
+	}
+}
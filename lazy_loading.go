@@ -0,0 +1,3116 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/restic/chunker"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/filelock"
+	"github.com/siyuan-note/logging"
+)
+
+// ErrLazyLoadingDisabled 表示仓库没有配置懒加载模式，懒加载相关的操作都不可用。
+var ErrLazyLoadingDisabled = errors.New("lazy loading is not enabled")
+
+// ErrLazyLoadingClosed 表示仓库已经关闭，不再接受新的懒加载请求。
+var ErrLazyLoadingClosed = errors.New("lazy loading is closed")
+
+// 懒加载失败的原因分类，加载返回的错误可以通过 errors.Is 判断，原始错误仍然保留在错误链中。
+var (
+	ErrLazyCloudUnreachable = errors.New("lazy loading cloud unreachable") // ErrLazyCloudUnreachable 描述了云端存储服务不可用或者网络不通，可以稍后重试
+	ErrLazyChunkMissing     = errors.New("lazy loading chunk missing")     // ErrLazyChunkMissing 描述了云端缺少懒加载文件的对象
+	ErrLazyDiskFull         = errors.New("lazy loading disk full")         // ErrLazyDiskFull 描述了本地磁盘空间不足
+	ErrLazyHashMismatch     = errors.New("lazy loading hash mismatch")     // ErrLazyHashMismatch 描述了下载的分块内容与分块 ID 不一致
+)
+
+// ErrLazyFileUnresolvable 表示懒加载文件记录在索引中，但是本地存储、分块提供者、云端和所有镜像都没有它的有效数据，重试也无法加载。
+// 返回的错误中包含文件路径和原始错误，原始错误可以继续通过 errors.Is 判断，比如 ErrLazyChunkMissing。
+var ErrLazyFileUnresolvable = errors.New("lazy file is unresolvable")
+
+// classifyLazyLoadError 按原因对懒加载错误分类，返回同时包含分类错误和原始错误的错误，无法分类时原样返回。
+func classifyLazyLoadError(err error) error {
+	var netErr net.Error
+	switch {
+	case nil == err,
+		errors.Is(err, ErrLazyCloudUnreachable), errors.Is(err, ErrLazyChunkMissing),
+		errors.Is(err, ErrLazyDiskFull), errors.Is(err, ErrLazyHashMismatch):
+		return err
+	case errors.Is(err, syscall.ENOSPC):
+		return fmt.Errorf("%w: %w", ErrLazyDiskFull, err)
+	case errors.Is(err, cloud.ErrCloudObjectNotFound):
+		return fmt.Errorf("%w: %w", ErrLazyChunkMissing, err)
+	case errors.Is(err, cloud.ErrCloudServiceUnavailable), errors.Is(err, cloud.ErrCloudTooManyRequests), errors.As(err, &netErr):
+		return fmt.Errorf("%w: %w", ErrLazyCloudUnreachable, err)
+	}
+	return err
+}
+
+// BatchLazyResult 是批量懒加载的结果。
+type BatchLazyResult struct {
+	Loaded []string         // 加载成功的路径
+	Errors map[string]error // 加载失败的路径和原因，可以通过 errors.Is 判断 ErrLazyCloudUnreachable 等分类
+}
+
+// Failed 返回加载失败原因为 cause 的路径，比如只重试 ErrLazyCloudUnreachable 的路径。
+func (result *BatchLazyResult) Failed(cause error) (ret []string) {
+	for p, err := range result.Errors {
+		if errors.Is(err, cause) {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return
+}
+
+// LazyLoadFilesBatch 批量加载懒加载文件，单个文件加载失败不会中断其他文件的加载，失败的原因按路径记录在结果中。
+func (repo *Repo) LazyLoadFilesBatch(filePaths []string, context map[string]interface{}) (ret *BatchLazyResult, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+
+	ret = &BatchLazyResult{Errors: map[string]error{}}
+	for i, filePath := range filePaths {
+		if loadErr := repo.LazyLoadFile(filePath, context); nil != loadErr {
+			loadErr = classifyLazyLoadError(loadErr)
+			logging.LogWarnf("[Lazy Load] lazy load file [%s] failed: %s", filePath, loadErr)
+			ret.Errors[filePath] = loadErr
+		} else {
+			ret.Loaded = append(ret.Loaded, filePath)
+		}
+
+		if nil != context {
+			eventbus.Publish(eventbus.EvtCheckoutUpsertFile, context, i+1, len(filePaths))
+		}
+	}
+	return
+}
+
+// LazyAccessEvent 描述了一次懒加载访问，用于审计。
+type LazyAccessEvent struct {
+	Path              string // 与索引一致的相对路径，如：/assets/foo.png
+	Size              int64  // 加载成功时为文件大小，失败时为 0
+	Time              int64  // 加载完成时间，Unix 毫秒
+	Success           bool   // 是否加载成功
+	Err               error  // 加载失败时的错误
+	LocalChunkHits    int    // 本地已有的分块数
+	CloudChunkFetches int    // 从云端下载的分块数
+}
+
+// LazyAccessLogger 接收懒加载访问事件，集成方可以将事件写入自己的审计存储。
+// 事件在懒加载完成并释放仓库锁之后由懒加载队列的工作协程同步调用，实现不应长时间阻塞。
+type LazyAccessLogger interface {
+	LogLazyAccess(event *LazyAccessEvent)
+}
+
+// logLazyAccess 将懒加载访问事件发送给 repo.LazyAccessLogger，未设置时不做任何事。
+func (repo *Repo) logLazyAccess(job *lazyLoadJob) {
+	logger := repo.LazyAccessLogger
+	if nil == logger {
+		return
+	}
+
+	event := &LazyAccessEvent{Path: job.relPath, Time: repo.now().UnixMilli(), Success: nil == job.err, Err: job.err,
+		LocalChunkHits: job.stats.LocalChunkHits, CloudChunkFetches: job.stats.CloudChunkFetches}
+	if event.Success {
+		if info, statErr := os.Stat(job.absPath); nil == statErr {
+			event.Size = info.Size()
+		}
+	}
+	logger.LogLazyAccess(event)
+}
+
+// MetricsObserver 接收懒加载的指标观测，集成方可以将其适配到 Prometheus 等监控系统。
+// 方法在懒加载路径上同步调用（可能持有仓库锁），实现应只做计数之类的轻量操作。
+type MetricsObserver interface {
+
+	// ObserveDownload 在每次按需加载文件成功后调用，bytes 为文件大小，dur 为加载耗时，fromCache 表示所有分块都来自本地存储，没有从云端下载。
+	ObserveDownload(bytes int64, dur time.Duration, fromCache bool)
+
+	// ObserveEviction 在每次驱逐一个本地懒加载文件后调用，bytes 为释放的文件大小。
+	ObserveEviction(bytes int64)
+}
+
+// NopMetricsObserver 是不做任何事的 MetricsObserver，Repo.MetricsObserver 为空时使用。
+type NopMetricsObserver struct{}
+
+func (NopMetricsObserver) ObserveDownload(bytes int64, dur time.Duration, fromCache bool) {}
+
+func (NopMetricsObserver) ObserveEviction(bytes int64) {}
+
+// metrics 返回 repo.MetricsObserver，未设置时返回 NopMetricsObserver。
+func (repo *Repo) metrics() MetricsObserver {
+	if nil == repo.MetricsObserver {
+		return NopMetricsObserver{}
+	}
+	return repo.MetricsObserver
+}
+
+// PrefetchStrategy 根据懒加载访问决定接下来需要预取的文件，集成方可以实现该接口学习访问模式做预测缓存。
+type PrefetchStrategy interface {
+
+	// OnAccess 在文件 relPath 按需加载成功后调用，返回需要在后台预取的文件路径（与索引一致的相对路径）。
+	// 该方法由懒加载队列的工作协程同步调用，实现不应长时间阻塞。
+	OnAccess(repo *Repo, relPath string) []string
+}
+
+// SameDirPrefetchStrategy 是一个简单的预取策略：访问一个文件后预取同一文件夹下（不包括子文件夹）尚未加载的其他懒加载文件。
+type SameDirPrefetchStrategy struct {
+	MaxFiles int // 每次最多预取的文件数，为 0 时不限制
+}
+
+func (s *SameDirPrefetchStrategy) OnAccess(repo *Repo, relPath string) (ret []string) {
+	if nil == repo.lazyIndexMgr {
+		return
+	}
+
+	dir := path.Dir(relPath)
+	for _, file := range repo.lazyIndexMgr.GetLazyFilesUnder(dir) {
+		if file.Path == relPath || path.Dir(file.Path) != dir || gulu.File.IsExist(repo.absPath(file.Path)) {
+			continue
+		}
+		ret = append(ret, file.Path)
+		if 0 < s.MaxFiles && len(ret) >= s.MaxFiles {
+			break
+		}
+	}
+	return
+}
+
+// prefetchAfterAccess 将交互式加载成功的文件通知给 repo.LazyPrefetchStrategy，并将策略返回的文件加入后台预取队列。
+func (repo *Repo) prefetchAfterAccess(job *lazyLoadJob, interactive bool) {
+	strategy := repo.LazyPrefetchStrategy
+	if nil == strategy || nil != job.err || !interactive {
+		return
+	}
+
+	paths := strategy.OnAccess(repo, job.relPath)
+	if 1 > len(paths) {
+		return
+	}
+	if repo.lazyClosed.Load() {
+		return
+	}
+
+	// 策略返回的是索引路径，不能按调用方传入的路径解析，否则设置了懒加载根目录时会重复拼接根目录
+	var absPaths, relPaths []string
+	for _, p := range paths {
+		absPath, relPath := repo.resolveLazyIndexPath(p)
+		absPaths = append(absPaths, absPath)
+		relPaths = append(relPaths, relPath)
+	}
+	repo.enqueueLazyPrefetch(absPaths, relPaths, job.context)
+}
+
+// lazyCloseTimeout 是关闭仓库时等待正在进行的懒加载完成的最长时间。
+const lazyCloseTimeout = 30 * time.Second
+
+// Close 关闭仓库的懒加载功能：不再接受新的懒加载请求，等待正在进行的懒加载完成后将懒加载索引写入磁盘。
+// 如果等待超时则返回错误，懒加载索引会在正在进行的懒加载完成后再写入。
+func (repo *Repo) Close() (err error) {
+	if repo.lazyClosed.Swap(true) {
+		return
+	}
+	// 暂停的后台预取任务重新排队，以 ErrLazyLoadingClosed 结束
+	repo.lazyQueue.resume(repo)
+	// 空闲或者等待重试的后台上传协程退出
+	repo.lazyUploads.close()
+
+	done := make(chan error, 1)
+	go func() {
+		// 懒加载持有仓库锁，拿到锁说明正在进行的懒加载已经完成
+		lock.Lock()
+		defer lock.Unlock()
+
+		if nil == repo.lazyIndexMgr {
+			done <- nil
+			return
+		}
+		done <- repo.lazyIndexMgr.Close()
+	}()
+
+	select {
+	case err = <-done:
+		if nil != err {
+			logging.LogErrorf("[Lazy Load] close lazy index failed: %s", err)
+		}
+	case <-time.After(lazyCloseTimeout):
+		err = fmt.Errorf("wait for in-flight lazy loads timeout after %s", lazyCloseTimeout)
+		logging.LogWarnf("[Lazy Load] %s", err)
+	}
+	return
+}
+
+// lazyLoadingEnabled 判断仓库是否启用了懒加载。
+func (repo *Repo) lazyLoadingEnabled() bool {
+	return 0 < len(repo.lazySnapshot().patterns)
+}
+
+// lazySettings 是懒加载设置的不可变快照。设置方法在仓库锁下复制当前快照，修改后整体替换，
+// 读取方通过 lazySnapshot 获取快照，不需要加仓库锁，匹配器也只在设置变化时编译一次。快照中的切片不会被修改。
+type lazySettings struct {
+	patterns        []string     // 懒加载模式
+	excludes        []string     // 懒加载排除模式，在懒加载模式之后评估
+	keepSystemFiles bool         // 是否不排除系统生成的隐藏文件（如 .DS_Store），默认排除
+	subroot         string       // 懒加载根目录，相对于数据文件夹，为空时为整个数据文件夹
+	never           []string     // 永不懒加载模式，优先级最高
+	indexName       string       // 懒加载索引文件名，为空时为 DefaultLazyIndexName
+	indexInMemory   bool         // 懒加载索引是否只保存在内存中
+	indexCompact    bool         // 懒加载索引文件是否使用紧凑格式
+	matcher         *lazyMatcher // 由以上模式编译的匹配器
+}
+
+// emptyLazySettings 是没有设置过懒加载时使用的快照。
+var emptyLazySettings = &lazySettings{matcher: compileLazyMatcher(nil, nil, true, "", nil)}
+
+// lazySnapshot 返回当前的懒加载设置快照。
+func (repo *Repo) lazySnapshot() *lazySettings {
+	if ret := repo.lazyConf.Load(); nil != ret {
+		return ret
+	}
+	return emptyLazySettings
+}
+
+// updateLazySettings 复制当前的懒加载设置快照，由 update 修改后重新编译匹配器并替换快照。调用方需要持有仓库锁，避免并发修改互相覆盖。
+func (repo *Repo) updateLazySettings(update func(s *lazySettings)) *lazySettings {
+	s := *repo.lazySnapshot()
+	update(&s)
+	s.matcher = compileLazyMatcher(s.patterns, s.excludes, !s.keepSystemFiles, s.subroot, s.never)
+	repo.lazyConf.Store(&s)
+	return &s
+}
+
+// ensureLazyIndexMigrated 在第一次用到懒加载索引（索引、查找孤儿文件）时执行打开仓库时推迟的迁移，只执行一次，迁移失败不影响调用方。
+// 调用方需要持有 lock。
+func (repo *Repo) ensureLazyIndexMigrated() {
+	if !repo.lazyMigratePending.CompareAndSwap(true, false) {
+		return
+	}
+	if _, err := repo.migrateLazyIndex(); nil != err {
+		logging.LogWarnf("[Lazy Index] migrate existing files to lazy index failed: %s", err)
+	}
+}
+
+// migrateLazyIndex 在打开启用懒加载的仓库且懒加载索引为空时由 ensureLazyIndexMigrated 调用，用于兼容启用懒加载之前的仓库。
+// 以前完整同步的文件现在匹配懒加载模式时，本地文件和分块都在但懒加载索引中没有记录，会被当作孤儿文件。
+// 这里将最新索引中匹配懒加载模式、本地存在且没有修改过的文件连同已有的分块登记到懒加载索引，不重新分块也不重新上传。
+func (repo *Repo) migrateLazyIndex() (migrated int, err error) {
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			err = nil
+		}
+		return
+	}
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+
+	var lazyFiles []*entity.File
+	for _, file := range files {
+		if !repo.isLazyLoadingFile(file.Path) {
+			continue
+		}
+		if _, ok := repo.lazyUnchangedFileInfo(file); !ok {
+			continue
+		}
+		lazyFiles = append(lazyFiles, file)
+	}
+	if 1 > len(lazyFiles) {
+		return
+	}
+
+	repo.lazyIndexMgr.AddLazyFilesFromIndex(lazyFiles)
+	repo.lazyIndexMgr.RecordOrigins(latest.ID, lazyFiles)
+	if err = repo.lazyIndexMgr.Flush(); nil != err {
+		return
+	}
+	migrated = len(lazyFiles)
+	logging.LogInfof("[Lazy Index] migrated [%d] existing files of index [%s] to lazy index", migrated, latest.ID)
+	return
+}
+
+// ErrLazyIndexInvalid 表示校验模式下新建的索引中有不完整的懒加载文件记录。
+var ErrLazyIndexInvalid = errors.New("lazy file records in index are invalid")
+
+// validateLazyIndex 检查索引 index 中的懒加载文件 files 是否都有完整的记录：非空文件必须有分块，文件对象必须已经入库。
+// 懒加载文件的本地副本不一定存在，之后只能根据这些记录按需加载，记录不完整的文件将无法加载。
+func (repo *Repo) validateLazyIndex(index *entity.Index, files []*entity.File) (err error) {
+	var invalid []string
+	for _, file := range files {
+		if !repo.isLazyLoadingFile(file.Path) {
+			continue
+		}
+		if 0 < file.Size && 1 > len(file.Chunks) {
+			invalid = append(invalid, file.Path+" (no chunks)")
+			continue
+		}
+		if _, statErr := repo.store.Stat(file.ID); nil != statErr {
+			invalid = append(invalid, file.Path+" (file object missing)")
+		}
+	}
+	if 0 < len(invalid) {
+		err = fmt.Errorf("%w: index [%s], files %v", ErrLazyIndexInvalid, index.ID, invalid)
+		logging.LogErrorf("[Lazy Index] %s", err)
+	}
+	return
+}
+
+// DownloadLazyIndexOnly 从云端下载索引 indexID 中的文件元数据，只把其中的懒加载文件加入懒加载索引，不下载任何分块，也不在本地保存该索引，
+// 用于加快新设备的初始化：之后懒加载文件可以按需加载，普通文件仍然需要通过 DownloadIndex 和 Checkout 同步。
+// 文件路径保存在文件对象中，所以本地缺失的文件对象（包括普通文件的）都需要下载，这些对象很小，与分块相比可以忽略。
+func (repo *Repo) DownloadLazyIndexOnly(indexID string, context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+	if nil == repo.cloud {
+		return errors.New("downloading lazy index requires cloud storage")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	length, index, err := repo.downloadCloudIndex(indexID, context)
+	if nil != err {
+		logging.LogErrorf("download cloud index failed: %s", err)
+		return
+	}
+	downloadBytes := length
+	apiGet := 1
+
+	fetchFileIDs, err := repo.localNotFoundFiles(index.Files)
+	if nil != err {
+		return
+	}
+	length, _, err = repo.downloadCloudFilesPut(fetchFileIDs, context)
+	if nil != err {
+		logging.LogErrorf("download cloud files put failed: %s", err)
+		return
+	}
+	downloadBytes += length
+	apiGet += len(fetchFileIDs)
+	go repo.cloud.AddTraffic(&cloud.Traffic{DownloadBytes: downloadBytes, APIGet: apiGet})
+
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
+		return
+	}
+	var lazyFiles []*entity.File
+	for _, file := range files {
+		if repo.isLazyLoadingFile(file.Path) {
+			lazyFiles = append(lazyFiles, file)
+		}
+	}
+	repo.lazyIndexMgr.AddLazyFilesFromIndex(lazyFiles)
+	repo.lazyIndexMgr.RecordOrigins(index.ID, lazyFiles)
+	if err = repo.lazyIndexMgr.Flush(); nil != err {
+		return
+	}
+	logging.LogInfof("[Lazy Index] downloaded lazy index of [%s], [%d/%d] lazy files, [%d] file objects, [%d] bytes", index.ID, len(lazyFiles), len(files), len(fetchFileIDs), downloadBytes)
+	return
+}
+
+// SetLazyIndexName 切换仓库使用的懒加载索引文件名，当前索引会先写入磁盘，然后从新的索引文件加载。
+// 不同工作空间可以共用一个仓库文件夹，各自使用独立的懒加载索引和延迟上传队列。该方法应该在打开仓库后、开始懒加载之前调用。
+func (repo *Repo) SetLazyIndexName(name string) (err error) {
+	if "" == name || name != filepath.Base(name) || "." == name || ".." == name {
+		return fmt.Errorf("invalid lazy index name [%s]", name)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if nil != repo.lazyIndexMgr {
+		if err = repo.lazyIndexMgr.Close(); nil != err {
+			logging.LogWarnf("[Lazy Index] save before switching to [%s] failed: %s", name, err)
+			err = nil
+		}
+	}
+	settings := repo.updateLazySettings(func(s *lazySettings) { s.indexName = name })
+	repo.lazyIndexMgr = NewLazyIndexManagerWithName(repo.Path, repo.DataPath, name, settings.patterns)
+	repo.lazyIndexMgr.SetConflictHandler(repo.lazyConflictHandler)
+	repo.lazyIndexMgr.SetConflictMode(repo.lazyConflictMode)
+	repo.lazyIndexMgr.SetExcludes(!settings.keepSystemFiles, settings.excludes)
+	repo.lazyIndexMgr.SetSubroot(settings.subroot)
+	repo.lazyIndexMgr.SetNeverLazy(settings.never)
+	if settings.indexInMemory {
+		repo.lazyIndexMgr.SetInMemory()
+	} else {
+		repo.lazyUploads.open(filepath.Join(repo.Path, lazyUploadQueueName(name)))
+		if settings.indexCompact {
+			err = repo.lazyIndexMgr.SetCompact(true)
+		}
+	}
+	return
+}
+
+// UseInMemoryLazyIndex 将懒加载索引切换为只保存在内存中，已加载的记录保留，之后不再写入懒加载索引文件，仓库关闭后记录丢失。
+// 适用于测试、临时使用以及只读的仓库文件夹，懒加载的下载和状态查询不受影响。该方法应该在打开仓库后、开始懒加载之前调用。
+func (repo *Repo) UseInMemoryLazyIndex() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	repo.updateLazySettings(func(s *lazySettings) { s.indexInMemory = true })
+	if nil != repo.lazyIndexMgr {
+		repo.lazyIndexMgr.SetInMemory()
+	}
+	repo.lazyUploads.keepInMemory()
+}
+
+// SetLazyIndexCompact 设置懒加载索引文件是否使用紧凑格式（无缩进）写入磁盘，默认带缩进。
+func (repo *Repo) SetLazyIndexCompact(compact bool) (err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	repo.updateLazySettings(func(s *lazySettings) { s.indexCompact = compact })
+	if nil != repo.lazyIndexMgr {
+		err = repo.lazyIndexMgr.SetCompact(compact)
+	}
+	return
+}
+
+// SetLazyExcludes 设置懒加载排除规则：excludeSystemFiles 为 true（默认）时排除 .DS_Store、Thumbs.db 等系统生成的隐藏文件，
+// patterns 为额外的排除模式，使用 .gitignore 语法。排除规则在懒加载模式之后评估，被排除的文件不作为懒加载文件，
+// 已记录在懒加载索引中的被排除文件会被移除，其中已驱逐的文件先下载到本地（见 LoadDemotedLazyFiles），下载失败时返回错误但设置仍然生效。
+func (repo *Repo) SetLazyExcludes(excludeSystemFiles bool, patterns []string) (err error) {
+	for _, p := range patterns {
+		if "" == strings.TrimSpace(p) || strings.ContainsAny(p, "\r\n") {
+			return fmt.Errorf("invalid lazy exclude pattern [%s]", p)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	settings := repo.updateLazySettings(func(s *lazySettings) {
+		s.keepSystemFiles = !excludeSystemFiles
+		s.excludes = gulu.Str.RemoveDuplicatedElem(append([]string{}, patterns...))
+	})
+	if nil != repo.lazyIndexMgr {
+		repo.lazyIndexMgr.SetExcludes(excludeSystemFiles, settings.excludes)
+		err = repo.loadDemotedLazyFiles(nil)
+	}
+	return
+}
+
+// SetNeverLazyPatterns 设置永不懒加载模式，使用 .gitignore 语法，按相对于数据文件夹的路径匹配。
+// 永不懒加载模式的优先级最高，匹配的文件即使同时匹配懒加载模式也总是正常同步（比如懒加载 *.json 但始终同步 /conf/settings.json），
+// 比构造取反模式更清晰。已记录在懒加载索引中的匹配文件会被移除，其中已驱逐的文件先下载到本地（见 LoadDemotedLazyFiles），
+// 下载失败时返回错误但设置仍然生效。
+func (repo *Repo) SetNeverLazyPatterns(patterns []string) (err error) {
+	for _, p := range patterns {
+		if "" == strings.TrimSpace(p) || strings.ContainsAny(p, "\r\n") {
+			return fmt.Errorf("invalid never lazy pattern [%s]", p)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	settings := repo.updateLazySettings(func(s *lazySettings) {
+		s.never = gulu.Str.RemoveDuplicatedElem(append([]string{}, patterns...))
+	})
+	if nil != repo.lazyIndexMgr {
+		repo.lazyIndexMgr.SetNeverLazy(settings.never)
+		err = repo.loadDemotedLazyFiles(nil)
+	}
+	return
+}
+
+// SetLazySubroot 设置懒加载根目录 subroot（相对于数据文件夹，比如 media），用于只挂载仓库中一个子目录的集成方。
+// 设置后只有根目录下的文件可能是懒加载文件，懒加载模式和排除模式都按相对于根目录的路径匹配，
+// 懒加载方法传入的相对路径也相对于根目录，解析到根目录之外的路径会返回错误。subroot 为空时恢复为整个数据文件夹。
+// 懒加载索引记录仍然使用相对于数据文件夹的路径，与快照索引一致，根目录之外的记录会被移除，其中已驱逐的文件先下载到本地。
+func (repo *Repo) SetLazySubroot(subroot string) (err error) {
+	subroot = filepath.ToSlash(subroot)
+	if filepath.IsAbs(subroot) || strings.HasPrefix(subroot, "/") || slices.Contains(strings.Split(subroot, "/"), "..") {
+		return fmt.Errorf("invalid lazy subroot [%s]", subroot)
+	}
+	subroot = strings.TrimPrefix(path.Clean("/"+subroot), "/")
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	repo.updateLazySettings(func(s *lazySettings) { s.subroot = subroot })
+	if nil != repo.lazyIndexMgr {
+		repo.lazyIndexMgr.SetSubroot(subroot)
+		err = repo.loadDemotedLazyFiles(nil)
+	}
+	return
+}
+
+// SetLazyConflictMode 设置判断懒加载索引记录是否冲突的规则，默认为 LazyConflictStrict。
+// 在时间戳精度不可靠（比如会截断更新时间）的文件系统上可以使用 LazyConflictContentOnly，避免只有更新时间不同的记录被当作冲突处理。
+func (repo *Repo) SetLazyConflictMode(mode LazyConflictMode) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	repo.lazyConflictMode = mode
+	if nil != repo.lazyIndexMgr {
+		repo.lazyIndexMgr.SetConflictMode(mode)
+	}
+}
+
+// SetLazyConflictHandler 设置懒加载索引记录冲突时的处理函数，为 nil 时使用默认规则（更新时间较新的记录优先）。
+func (repo *Repo) SetLazyConflictHandler(handler LazyConflictHandler) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	repo.lazyConflictHandler = handler
+	if nil != repo.lazyIndexMgr {
+		repo.lazyIndexMgr.SetConflictHandler(handler)
+	}
+}
+
+// LoadDemotedLazyFiles 下载不再匹配懒加载模式（比如修改了懒加载模式或者永不懒加载模式后）但本地副本已被驱逐的文件，
+// 下载完成后移除其懒加载记录，之后作为普通文件同步。修改模式的方法会自动调用，该方法用于之前下载失败（比如离线）后重试。
+func (repo *Repo) LoadDemotedLazyFiles(context map[string]interface{}) (err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return repo.loadDemotedLazyFiles(context)
+}
+
+// loadDemotedLazyFiles 实现 LoadDemotedLazyFiles，调用方需要持有仓库锁。下载失败的文件保留记录，仍然出现在之后的索引中。
+func (repo *Repo) loadDemotedLazyFiles(context map[string]interface{}) (err error) {
+	if nil == repo.lazyIndexMgr {
+		return
+	}
+	demoted := repo.lazyIndexMgr.DemotedLazyFiles()
+	if 1 > len(demoted) {
+		return
+	}
+	if nil == context {
+		context = map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	}
+
+	var failed []string
+	for _, file := range demoted {
+		if loadErr := repo.checkoutDemotedLazyFile(file, context); nil != loadErr {
+			logging.LogWarnf("[Lazy Load] download file [%s] no longer lazy failed, keep its lazy record: %s", file.Path, loadErr)
+			failed = append(failed, file.Path)
+			if nil == err {
+				err = loadErr
+			}
+			continue
+		}
+		repo.lazyIndexMgr.RemoveLazyFile(file.Path)
+	}
+	if flushErr := repo.lazyIndexMgr.Flush(); nil != flushErr && nil == err {
+		err = flushErr
+	}
+	if 0 < len(failed) {
+		err = fmt.Errorf("download files no longer lazy %v failed: %w", failed, err)
+	}
+	return
+}
+
+// checkoutDemotedLazyFile 将不再匹配懒加载模式的已驱逐文件 file 下载到数据文件夹，并恢复更新时间，使之后的索引将其视为未修改。
+func (repo *Repo) checkoutDemotedLazyFile(file *entity.File, context map[string]interface{}) (err error) {
+	if gulu.File.IsExist(repo.absPath(file.Path)) {
+		return
+	}
+
+	target := file
+	if 0 == file.Size {
+		empty := *file
+		empty.Chunks = nil
+		target = &empty
+	} else {
+		if nil == repo.cloud {
+			return errors.New("lazy loading requires cloud storage")
+		}
+		if err = repo.lazyLoadFromCloud(file, lazyEventContext(context, file.Path)); nil != err {
+			return
+		}
+	}
+	return repo.checkoutFileWithMtime(target, repo.DataPath, repo.LazyLoadingTempDir, true, 1, 1, context)
+}
+
+// GetLazyLoadingPatterns 返回当前配置的懒加载模式的副本，修改返回值不会影响匹配。
+func (repo *Repo) GetLazyLoadingPatterns() []string {
+	return append([]string{}, repo.lazySnapshot().patterns...)
+}
+
+// SetLazyLoadingPatterns 在运行时更新懒加载模式，同时更新懒加载索引管理器的匹配器。
+// 更新后会重新评估已索引的文件：不再匹配的文件从懒加载索引中移除（已驱逐的文件先下载到本地），新匹配的文件从本地最新索引中加入懒加载索引。
+func (repo *Repo) SetLazyLoadingPatterns(patterns []string) (err error) {
+	var validated []string
+	for _, p := range patterns {
+		if "" == strings.TrimSpace(p) || strings.ContainsAny(p, "\r\n") {
+			return fmt.Errorf("invalid lazy loading pattern [%s]", p)
+		}
+		validated = append(validated, p)
+	}
+	validated = gulu.Str.RemoveDuplicatedElem(validated)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	repo.updateLazySettings(func(s *lazySettings) { s.patterns = validated })
+	repo.LazyLoadingPatterns = validated
+	if nil == repo.lazyIndexMgr {
+		return
+	}
+	repo.lazyIndexMgr.SetPatterns(validated)
+	if err = repo.loadDemotedLazyFiles(nil); nil != err {
+		return
+	}
+
+	latest, err := repo.Latest()
+	if nil != err {
+		if ErrNotFoundIndex == err {
+			err = nil
+		}
+		return
+	}
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+	repo.lazyIndexMgr.AddLazyFilesFromIndex(files)
+	repo.lazyIndexMgr.RecordOrigins(latest.ID, files)
+	return
+}
+
+// LazyHealth 描述了懒加载子系统的健康状况。
+type LazyHealth struct {
+	Enabled         bool  // 是否配置了懒加载模式
+	IndexLoaded     bool  // 懒加载索引是否已加载
+	LazyFileCount   int   // 懒加载索引中的文件数
+	CloudConfigured bool  // 是否配置了云端存储
+	PendingLoads    int   // 排队中或者正在执行的懒加载任务数
+	LastLoaded      int64 // 最后一次懒加载成功的时间，Unix 毫秒，没有成功过时为 0
+	Closed          bool  // 懒加载是否已关闭
+}
+
+// LazyLoadingEnabled 返回是否启用了懒加载，即是否配置了懒加载模式。
+func (repo *Repo) LazyLoadingEnabled() bool {
+	return repo.lazyLoadingEnabled()
+}
+
+// LazyLoadingConfig 是懒加载的生效配置，包括构造时的参数和之后通过各个 Set 方法修改的设置，用于设置界面和诊断。
+type LazyLoadingConfig struct {
+	Enabled                bool     // 是否启用了懒加载
+	Patterns               []string // 懒加载模式
+	ExcludePatterns        []string // 懒加载排除模式
+	ExcludeSystemFiles     bool     // 是否排除系统生成的隐藏文件（如 .DS_Store）
+	NeverPatterns          []string // 永不懒加载模式
+	Subroot                string   // 懒加载根目录，相对于数据文件夹，为空时为整个数据文件夹
+	PrefetchMaxBytes       int64    // 后台预取时本地懒加载文件的总大小上限，为 0 时不限制
+	MinFreeBytes           int64    // 懒加载下载后磁盘至少需要保留的可用空间，为 0 时不保留
+	DownloadConcurrency    int      // 从云端下载的并发数，没有配置云端存储时为 0
+	IndexUploadConcurrency int      // 重新索引懒加载文件时上传分块的并发数，没有配置云端存储时为 0
+	ChunkBatchSize         int      // 批量下载分块每次请求的分块数
+	IndexPath              string   // 懒加载索引文件的路径，只保存在内存中时为空
+	IndexInMemory          bool     // 懒加载索引是否只保存在内存中
+	IndexCompact           bool     // 懒加载索引文件是否使用紧凑格式
+	CloudConfigured        bool     // 是否配置了云端存储
+	ReadOnlyCloud          bool     // 云端存储是否只读
+}
+
+// LazyLoadingConfig 返回懒加载的生效配置，返回值中的切片都是副本，修改不会影响仓库。
+// 配置从懒加载设置快照中读取，不加仓库锁，同步或者加载进行中时也不会阻塞。
+func (repo *Repo) LazyLoadingConfig() (ret *LazyLoadingConfig) {
+	settings := repo.lazySnapshot()
+	ret = &LazyLoadingConfig{
+		Enabled:            0 < len(settings.patterns),
+		Patterns:           append([]string{}, settings.patterns...),
+		ExcludePatterns:    append([]string{}, settings.excludes...),
+		ExcludeSystemFiles: !settings.keepSystemFiles,
+		NeverPatterns:      append([]string{}, settings.never...),
+		Subroot:            settings.subroot,
+		PrefetchMaxBytes:   repo.LazyPrefetchMaxBytes,
+		MinFreeBytes:       repo.MinFreeBytes,
+		ChunkBatchSize:     repo.ChunkBatchSize,
+		IndexInMemory:      settings.indexInMemory,
+		IndexCompact:       settings.indexCompact,
+		CloudConfigured:    nil != repo.cloud,
+		ReadOnlyCloud:      repo.ReadOnlyCloud,
+	}
+	if 1 > ret.ChunkBatchSize {
+		ret.ChunkBatchSize = defaultChunkBatchSize
+	}
+	if nil != repo.cloud {
+		ret.DownloadConcurrency = repo.cloud.GetConcurrentReqs()
+		ret.IndexUploadConcurrency = repo.indexUploadConcurrency()
+	}
+	if !settings.indexInMemory {
+		name := settings.indexName
+		if "" == name {
+			name = DefaultLazyIndexName
+		}
+		ret.IndexPath = filepath.Join(repo.Path, name)
+	}
+	return
+}
+
+// LazyHealth 返回懒加载子系统的健康状况，只读取内存中的状态，不会访问网络。
+func (repo *Repo) LazyHealth() (ret LazyHealth) {
+	ret.Enabled = repo.lazyLoadingEnabled()
+	if nil != repo.lazyIndexMgr {
+		ret.IndexLoaded = true
+		ret.LazyFileCount, _ = repo.lazyIndexMgr.GetStats()
+	}
+	ret.CloudConfigured = nil != repo.cloud
+	ret.PendingLoads = repo.lazyQueue.pending()
+	ret.LastLoaded = repo.lazyLastLoaded.Load()
+	ret.Closed = repo.lazyClosed.Load()
+	return
+}
+
+// LazyDiagnosis 是懒加载状态的诊断结果。
+type LazyDiagnosis struct {
+	Health         LazyHealth // 懒加载子系统的健康状况
+	CaseCollisions [][]string // 只有大小写不同的懒加载文件路径，每组按路径排序，在大小写不敏感的文件系统（macOS、Windows）上会相互覆盖
+}
+
+// DiagnoseLazyState 诊断懒加载状态，除了 LazyHealth 外还会检查懒加载索引和最新索引中的懒加载文件，不会访问网络。
+func (repo *Repo) DiagnoseLazyState() (ret *LazyDiagnosis, err error) {
+	ret = &LazyDiagnosis{Health: repo.LazyHealth()}
+	if !ret.Health.Enabled {
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	files, err := repo.lazyTrackedFiles()
+	if nil != err {
+		return
+	}
+	ret.CaseCollisions = lazyCaseCollisions(files)
+	for _, paths := range ret.CaseCollisions {
+		logging.LogWarnf("[Lazy Load] lazy files %v collide on case-insensitive file systems", paths)
+	}
+	return
+}
+
+// LazyCaseCollisionPolicy 是加载只有大小写不同的懒加载文件时的处理策略。
+type LazyCaseCollisionPolicy int
+
+const (
+	LazyCaseCollisionIgnore       LazyCaseCollisionPolicy = iota // 不检查，按请求的路径加载，默认策略
+	LazyCaseCollisionError                                       // 返回 ErrLazyCaseCollision，不加载
+	LazyCaseCollisionCanonicalize                                // 统一使用更新时间最新的记录的内容
+)
+
+// ErrLazyCaseCollision 表示懒加载文件的路径与其他懒加载文件只有大小写不同。
+var ErrLazyCaseCollision = errors.New("lazy file path collides case-insensitively")
+
+// lazyCaseCollisions 返回 files 中只有大小写不同的路径分组，每组按路径排序，分组按第一个路径排序。
+func lazyCaseCollisions(files map[string]*entity.File) (ret [][]string) {
+	groups := map[string][]string{}
+	for _, file := range files {
+		key := strings.ToLower(file.Path)
+		if !slices.Contains(groups[key], file.Path) {
+			groups[key] = append(groups[key], file.Path)
+		}
+	}
+	for _, paths := range groups {
+		if 1 < len(paths) {
+			sort.Strings(paths)
+			ret = append(ret, paths)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i][0] < ret[j][0] })
+	return
+}
+
+// resolveLazyCaseCollision 按 repo.LazyCaseCollisionPolicy 处理加载的文件 target 与其他懒加载文件只有大小写不同的情况，返回实际加载的文件记录。调用方需要持有 lock。
+func (repo *Repo) resolveLazyCaseCollision(target *entity.File) (ret *entity.File, err error) {
+	ret = target
+	if LazyCaseCollisionIgnore == repo.LazyCaseCollisionPolicy {
+		return
+	}
+
+	folded := strings.ToLower(target.Path)
+	latestFolded, err := repo.lazyCaseFoldedLatest()
+	if nil != err {
+		return
+	}
+	files := map[string]*entity.File{} // 与 target 只有大小写不同的文件，以路径为键，优先使用最新索引中的记录
+	for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+		if file.Path != target.Path && folded == strings.ToLower(file.Path) {
+			files[file.Path] = file
+		}
+	}
+	for _, file := range latestFolded[folded] {
+		if file.Path != target.Path {
+			files[file.Path] = file
+		}
+	}
+	if 1 > len(files) {
+		return
+	}
+	var colliding []*entity.File
+	for _, file := range files {
+		colliding = append(colliding, file)
+	}
+	sort.Slice(colliding, func(i, j int) bool { return colliding[i].Path < colliding[j].Path })
+
+	if LazyCaseCollisionError == repo.LazyCaseCollisionPolicy {
+		return nil, fmt.Errorf("%w: [%s] and [%s]", ErrLazyCaseCollision, target.Path, colliding[0].Path)
+	}
+
+	newest := target
+	for _, file := range colliding {
+		if file.Updated > newest.Updated || (file.Updated == newest.Updated && file.Path < newest.Path) {
+			newest = file
+		}
+	}
+	if newest != target {
+		logging.LogWarnf("[Lazy Load] file [%s] collides case-insensitively, use content of [%s]", target.Path, newest.Path)
+		canonical := *newest
+		canonical.Path = target.Path
+		ret = &canonical
+	}
+	return
+}
+
+// lazyCaseFoldIndex 是最新索引中的懒加载文件按小写路径的分组，最新索引变化时重建。
+type lazyCaseFoldIndex struct {
+	indexID  string                    // 分组对应的最新索引 ID
+	settings *lazySettings             // 分组时的懒加载设置快照，懒加载模式变化时重建
+	files    map[string][]*entity.File // 小写路径 -> 懒加载文件
+}
+
+// lazyCaseFoldedLatest 返回最新索引中的懒加载文件按小写路径的分组，最新索引和懒加载设置不变时只读取一次文件记录。调用方需要持有 lock。
+func (repo *Repo) lazyCaseFoldedLatest() (ret map[string][]*entity.File, err error) {
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			err = nil
+		}
+		return
+	}
+	settings := repo.lazySnapshot()
+	if cached := repo.lazyCaseFold; nil != cached && latest.ID == cached.indexID && settings == cached.settings {
+		return cached.files, nil
+	}
+
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+	ret = map[string][]*entity.File{}
+	for _, file := range files {
+		if repo.isLazyLoadingFile(file.Path) {
+			folded := strings.ToLower(file.Path)
+			ret[folded] = append(ret[folded], file)
+		}
+	}
+	repo.lazyCaseFold = &lazyCaseFoldIndex{indexID: latest.ID, settings: settings, files: ret}
+	return
+}
+
+// CheckLazyCloudReady 通过读取云端 refs/latest 对云端存储做一次轻量探测，用于在提供懒加载功能前确认云端可达且鉴权有效。
+// 云端仓库还没有 refs/latest 时（对象不存在）也认为云端可用。
+func (repo *Repo) CheckLazyCloudReady(context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+	if nil == repo.cloud {
+		return errors.New("lazy loading requires cloud storage, but no cloud is configured")
+	}
+
+	_, err = repo.cloud.DownloadObject("refs/latest")
+	if nil == err || errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		return nil
+	}
+
+	switch {
+	case errors.Is(err, cloud.ErrCloudAuthFailed), errors.Is(err, cloud.ErrCloudForbidden):
+		err = fmt.Errorf("lazy loading cloud is misconfigured, auth failed: %w", err)
+	case errors.Is(err, cloud.ErrCloudServiceUnavailable), errors.Is(err, cloud.ErrCloudTooManyRequests):
+		err = fmt.Errorf("lazy loading cloud is unreachable: %w", err)
+	default:
+		err = fmt.Errorf("lazy loading cloud probe failed: %w", err)
+	}
+	logging.LogWarnf("check lazy cloud ready failed: %s", err)
+	return
+}
+
+// ChunkProvider 从外部存储（比如 CDN 或者应用自己的缓存）获取分块数据，data 是分块的原始内容。
+// 返回 ok 为 false 时表示外部存储中没有该分块，返回错误时记录日志并回退到云端下载。
+type ChunkProvider func(chunkID string) (data []byte, ok bool, err error)
+
+// provideLazyChunks 在从云端下载前先通过 ChunkProvider 获取本地缺失的分块并写入本地存储，返回仍然需要从云端下载的分块。
+// 内容和分块 ID 不一致的数据会被丢弃。
+func (repo *Repo) provideLazyChunks(chunkIDs []string) (remaining []string, err error) {
+	if nil == repo.ChunkProvider || 1 > len(chunkIDs) {
+		return chunkIDs, nil
+	}
+
+	for _, chunkID := range chunkIDs {
+		data, ok, provideErr := repo.ChunkProvider(chunkID)
+		if nil != provideErr {
+			logging.LogWarnf("[Lazy Load] chunk provider failed for chunk [%s], fallback to cloud: %s", chunkID, provideErr)
+			remaining = append(remaining, chunkID)
+			continue
+		}
+		if !ok {
+			remaining = append(remaining, chunkID)
+			continue
+		}
+		if hash := util.Hash(data); chunkID != hash {
+			logging.LogWarnf("[Lazy Load] chunk provider returned mismatched data for chunk [%s], got [%s], fallback to cloud", chunkID, hash)
+			remaining = append(remaining, chunkID)
+			continue
+		}
+		if err = repo.store.PutChunk(&entity.Chunk{ID: chunkID, Data: data}); nil != err {
+			return
+		}
+	}
+	if provided := len(chunkIDs) - len(remaining); 0 < provided {
+		logging.LogInfof("[Lazy Load] chunk provider supplied [%d/%d] chunks", provided, len(chunkIDs))
+	}
+	return
+}
+
+// LazyChunkStats 描述了懒加载时分块的来源，用于衡量本地分块复用的效果。
+type LazyChunkStats struct {
+	LocalChunkHits    int // 本地已有的分块数
+	CloudChunkFetches int // 从云端下载的分块数
+}
+
+// LazyChunkStats 返回仓库创建以来所有成功的懒加载累计的分块来源统计。
+func (repo *Repo) LazyChunkStats() LazyChunkStats {
+	return LazyChunkStats{
+		LocalChunkHits:    int(repo.lazyLocalChunkHits.Load()),
+		CloudChunkFetches: int(repo.lazyCloudChunkFetches.Load()),
+	}
+}
+
+// LazyCloudFootprint 统计懒加载文件在云端占用的去重分块数和这些分块对象的总字节数，用于估算存储成本。
+// 多个文件共享的分块只计算一次，所以结果通常小于文件大小之和。分块大小优先读取本地存储，本地没有的再列举云端对象获取。
+func (repo *Repo) LazyCloudFootprint() (uniqueChunks int, totalBytes int64, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return 0, 0, ErrLazyLoadingDisabled
+	}
+
+	files := repo.lazyIndexMgr.GetLazyFiles()
+	latest, err := repo.Latest()
+	if nil != err {
+		if ErrNotFoundIndex != err {
+			return
+		}
+		err = nil
+	} else {
+		var indexFiles []*entity.File
+		if indexFiles, err = repo.getFiles(latest.Files); nil != err {
+			return
+		}
+		files = append(files, indexFiles...)
+	}
+
+	chunkIDs := map[string]bool{}
+	for _, file := range files {
+		if !repo.isLazyLoadingFile(file.Path) {
+			continue
+		}
+		for _, chunkID := range file.Chunks {
+			chunkIDs[chunkID] = true
+		}
+	}
+	uniqueChunks = len(chunkIDs)
+
+	remoteChunks := map[string][]string{} // 本地没有的分块，按云端对象目录分组
+	remoteCount := 0
+	for chunkID := range chunkIDs {
+		if stat, statErr := repo.store.Stat(chunkID); nil == statErr {
+			totalBytes += stat.Size()
+			continue
+		}
+		dir, name := path.Split(cloudObjectKey(chunkID))
+		remoteChunks[dir] = append(remoteChunks[dir], name)
+		remoteCount++
+	}
+	if 1 > remoteCount {
+		return
+	}
+	if nil == repo.cloud {
+		return 0, 0, fmt.Errorf("[%d] lazy chunks are not in local store and no cloud storage configured", remoteCount)
+	}
+
+	unknown := 0
+	for dir, names := range remoteChunks {
+		objInfos, listErr := repo.cloud.ListObjects(dir)
+		if nil != listErr {
+			return 0, 0, fmt.Errorf("list cloud objects [%s] failed: %s", dir, listErr)
+		}
+		for _, name := range names {
+			if objInfo := objInfos[name]; nil != objInfo {
+				totalBytes += objInfo.Size
+				continue
+			}
+			unknown++
+		}
+	}
+	if 0 < unknown {
+		logging.LogWarnf("[Lazy Load] [%d] lazy chunks are missing in both local store and cloud", unknown)
+	}
+	return
+}
+
+// LazyPatternCoverage 统计最新索引中每个懒加载模式各自匹配的文件数，返回结果以模式为键。
+// 匹配数为 0 的模式通常是拼写错误，调用方可以据此提示用户。取反模式（! 开头）统计的是其排除的文件数。
+func (repo *Repo) LazyPatternCoverage() (ret map[string]int, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+
+	patterns := repo.lazySnapshot().patterns
+	ret = make(map[string]int, len(patterns))
+	for _, pattern := range patterns {
+		ret[pattern] = 0
+	}
+
+	latest, err := repo.Latest()
+	if nil != err {
+		if ErrNotFoundIndex == err {
+			err = nil
+		}
+		return
+	}
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+
+	for _, pattern := range patterns {
+		trimmed := strings.TrimPrefix(pattern, "!")
+		if "" == strings.TrimSpace(trimmed) || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		matcher := newLazyLoadingMatcher([]string{trimmed})
+		for _, file := range files {
+			if matcher.MatchesPath(strings.TrimPrefix(file.Path, "/")) {
+				ret[pattern]++
+			}
+		}
+		if 0 == ret[pattern] {
+			logging.LogWarnf("[Lazy Load] pattern [%s] matched 0 files", pattern)
+		}
+	}
+	return
+}
+
+// LazyStatus 描述了一个文件的懒加载状态。
+type LazyStatus struct {
+	Lazy          bool   // 是否匹配懒加载模式
+	Recorded      bool   // 是否已记录在懒加载索引中
+	Cached        bool   // 是否已下载到数据文件夹中
+	Size          int64  // 懒加载索引中记录的文件大小
+	Evicted       bool   // 是否在懒加载索引中标记为已驱逐
+	OriginIndexID string // 最先产生懒加载索引中记录的分块列表的索引 ID，未知时为空
+}
+
+// LazyStatusBatch 批量查询文件的懒加载状态，返回结果以传入的路径为键，设置了懒加载根目录时路径相对于根目录。
+// 和逐个查询相比，这里只编译一次匹配器并只对懒加载索引加锁一次，适合一次性渲染大量文件的场景。
+func (repo *Repo) LazyStatusBatch(paths []string) (ret map[string]LazyStatus, err error) {
+	ret = make(map[string]LazyStatus, len(paths))
+	if !repo.lazyLoadingEnabled() {
+		// 未启用懒加载时所有文件都不是懒加载文件
+		for _, p := range paths {
+			ret[p] = LazyStatus{}
+		}
+		return
+	}
+
+	matcher := repo.lazyLoadingMatcher()
+	relPaths := make([]string, len(paths))
+	lazy := make([]bool, len(paths))
+	var lazyRelPaths []string
+	for i, p := range paths {
+		relPaths[i] = repo.lazyStatusRelPath(p)
+		if lazy[i] = matcher.MatchesPath(relPaths[i][1:]); lazy[i] {
+			lazyRelPaths = append(lazyRelPaths, relPaths[i])
+		}
+	}
+
+	var recorded map[string]*entity.File
+	if nil != repo.lazyIndexMgr {
+		recorded = repo.lazyIndexMgr.GetLazyFilesByPaths(lazyRelPaths)
+	}
+
+	for i, p := range paths {
+		relPath := relPaths[i]
+		status := LazyStatus{Lazy: lazy[i]}
+		if status.Lazy {
+			if file := recorded[relPath]; nil != file {
+				status.Recorded = true
+				status.Size = file.Size
+				status.OriginIndexID = repo.lazyIndexMgr.GetOriginIndexID(relPath)
+				status.Evicted = repo.lazyIndexMgr.IsEvicted(relPath)
+			}
+			status.Cached = gulu.File.IsExist(repo.absPath(relPath))
+		}
+		ret[p] = status
+	}
+	return
+}
+
+// lazyStatusRelPath 返回 LazyStatusBatch 中相对于懒加载根目录的路径 p 对应的懒加载索引路径。
+func (repo *Repo) lazyStatusRelPath(p string) string {
+	return lazyIndexPath(path.Join(repo.lazySnapshot().subroot, filepath.ToSlash(p)))
+}
+
+// RefreshLazyStatuses 与 LazyStatusBatch 一样返回 paths 中文件的懒加载状态，同时修正懒加载索引中已经过时的状态：
+// 本地已经存在的文件清除已驱逐标记（比如用户手动恢复了被驱逐的文件）。整个过程只加锁一次，有修正时只写入一次懒加载索引。
+// 本地不存在且没有已驱逐标记的文件无法区分是尚未下载还是已被删除，不做修正。
+func (repo *Repo) RefreshLazyStatuses(paths []string) (ret map[string]LazyStatus, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if ret, err = repo.LazyStatusBatch(paths); nil != err || nil == repo.lazyIndexMgr {
+		return
+	}
+
+	var stale []string
+	for p, status := range ret {
+		if status.Cached && status.Evicted {
+			stale = append(stale, repo.lazyStatusRelPath(p))
+		}
+	}
+	if 1 > len(stale) {
+		return
+	}
+
+	cleared := repo.lazyIndexMgr.ClearEvicted(stale)
+	if err = repo.lazyIndexMgr.Flush(); nil != err {
+		return
+	}
+	for p, status := range ret {
+		if status.Cached && status.Evicted {
+			status.Evicted = false
+			ret[p] = status
+		}
+	}
+	logging.LogInfof("[Lazy Index] cleared stale evicted marks %v", cleared)
+	return
+}
+
+// ClassifiedFile 是带有懒加载分类的索引文件。
+type ClassifiedFile struct {
+	*entity.File
+	IsLazy bool // 是否匹配懒加载模式
+	Cached bool // 懒加载文件是否已下载到数据文件夹中，非懒加载文件总为 false
+}
+
+// GetFilesClassified 获取索引 index 中的文件并标记每个文件是否为懒加载文件以及是否已下载，
+// 匹配器只编译一次，调用方不需要再逐个调用 isLazyLoadingFile。
+func (repo *Repo) GetFilesClassified(index *entity.Index) (ret []*ClassifiedFile, err error) {
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
+		return
+	}
+
+	ret = make([]*ClassifiedFile, 0, len(files))
+	if !repo.lazyLoadingEnabled() {
+		for _, file := range files {
+			ret = append(ret, &ClassifiedFile{File: file})
+		}
+		return
+	}
+
+	matcher := repo.lazyLoadingMatcher()
+	for _, file := range files {
+		classified := &ClassifiedFile{File: file, IsLazy: matcher.MatchesPath(strings.TrimPrefix(file.Path, "/"))}
+		if classified.IsLazy {
+			classified.Cached = gulu.File.IsExist(repo.absPath(file.Path))
+		}
+		ret = append(ret, classified)
+	}
+	return
+}
+
+// PrefetchLazyFiles 在后台预取多个懒加载文件，调用后立即返回。
+// 预取的优先级低于 LazyLoadFile，已经在排队或正在下载的文件不会重复下载。
+func (repo *Repo) PrefetchLazyFiles(filePaths []string, context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+	if repo.lazyClosed.Load() {
+		return ErrLazyLoadingClosed
+	}
+
+	var absPaths, relPaths []string
+	for _, filePath := range filePaths {
+		absPath, relPath, resolveErr := repo.resolveLazyFilePath(filePath)
+		if nil != resolveErr {
+			return resolveErr
+		}
+		absPaths = append(absPaths, absPath)
+		relPaths = append(relPaths, relPath)
+	}
+	repo.enqueueLazyPrefetch(absPaths, relPaths, context)
+	return
+}
+
+// enqueueLazyPrefetch 将已经解析好的文件加入后台预取队列。
+func (repo *Repo) enqueueLazyPrefetch(absPaths, relPaths []string, context map[string]interface{}) {
+	for i := range relPaths {
+		repo.lazyQueue.enqueue(repo, absPaths[i], relPaths[i], context, false)
+	}
+	logging.LogInfof("[Lazy Load] queued [%d] files for prefetch", len(relPaths))
+}
+
+// SetLazyPrefetchMaxBytes 设置后台预取时本地懒加载文件的总大小上限，为 0 时不限制。因为超出上限暂停的后台预取任务会重新检查。
+func (repo *Repo) SetLazyPrefetchMaxBytes(maxBytes int64) {
+	lock.Lock()
+	repo.LazyPrefetchMaxBytes = maxBytes
+	lock.Unlock()
+
+	repo.lazyQueue.resume(repo)
+}
+
+// lazyPrefetchAllowed 判断后台预取任务是否可以执行：本地懒加载文件的总大小加上该文件的大小不能超过 repo.LazyPrefetchMaxBytes。
+// 持有仓库锁检查，避免与驱逐和 SetLazyPrefetchMaxBytes 并发。
+func (repo *Repo) lazyPrefetchAllowed(job *lazyLoadJob) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if 1 > repo.LazyPrefetchMaxBytes || gulu.File.IsExist(job.absPath) {
+		return true
+	}
+
+	file, err := repo.getLazyFile(job.relPath)
+	if nil != err {
+		return true // 交给懒加载返回错误
+	}
+	return repo.localLazyFilesSize()+file.Size <= repo.LazyPrefetchMaxBytes
+}
+
+// localLazyFilesSize 返回懒加载索引中已经下载到本地的文件的总大小。
+func (repo *Repo) localLazyFilesSize() (ret int64) {
+	if nil == repo.lazyIndexMgr {
+		return
+	}
+
+	for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+		if info, statErr := os.Stat(filepath.Join(repo.DataPath, filepath.FromSlash(file.Path))); nil == statErr {
+			ret += info.Size()
+		}
+	}
+	return
+}
+
+// RenameLazyFile 将懒加载文件从 oldPath 重命名为 newPath。
+// 懒加载索引中的记录会被移动到新路径并保留分块列表，如果本地已缓存该文件，则一并移动，无需重新下载。
+// newPath 必须仍然匹配懒加载模式。
+func (repo *Repo) RenameLazyFile(oldPath, newPath string) (err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+	if nil == repo.lazyIndexMgr {
+		return fmt.Errorf("lazy index manager is not initialized")
+	}
+
+	oldPath, newPath = lazyIndexPath(oldPath), lazyIndexPath(newPath)
+	if oldPath == newPath {
+		return
+	}
+
+	newAbsPath := repo.absPath(newPath)
+	if gulu.File.IsExist(newAbsPath) {
+		return fmt.Errorf("file [%s] already exists", newPath)
+	}
+
+	renamed, err := repo.lazyIndexMgr.RenameLazyFile(oldPath, newPath)
+	if nil != err {
+		if !errors.Is(err, ErrLazyIndexNotWritable) {
+			return
+		}
+		logging.LogWarnf("[Lazy Load] %s", err)
+		err = nil
+	}
+
+	oldAbsPath := repo.absPath(oldPath)
+	if gulu.File.IsExist(oldAbsPath) {
+		if err = os.MkdirAll(filepath.Dir(newAbsPath), 0755); nil == err {
+			err = filelock.Rename(oldAbsPath, newAbsPath)
+		}
+		if nil != err {
+			logging.LogErrorf("[Lazy Load] rename cached file [%s] to [%s] failed: %s", oldAbsPath, newAbsPath, err)
+			if _, rollbackErr := repo.lazyIndexMgr.RenameLazyFile(newPath, oldPath); nil != rollbackErr {
+				logging.LogErrorf("[Lazy Load] rollback lazy file [%s] failed: %s", newPath, rollbackErr)
+			}
+			return
+		}
+	}
+
+	if err = repo.store.PutFile(renamed); nil != err {
+		logging.LogErrorf("[Lazy Load] put renamed file [%s] failed: %s", newPath, err)
+		return
+	}
+
+	logging.LogInfof("[Lazy Load] renamed file [%s] to [%s]", oldPath, newPath)
+	return
+}
+
+// VerifyLazyCache 校验数据文件夹中所有已下载的懒加载文件，重新计算分块并与懒加载索引记录比较，返回内容不一致的文件路径。
+// 每校验完一个文件调用一次 progress（为空时不调用），ctx 取消时停止校验并返回已发现的不一致文件和 ctx.Err()。
+// 校验大量文件耗时较长，所以只在读取懒加载索引记录时短暂持有仓库锁，文件内容的校验不持有锁。
+func (repo *Repo) VerifyLazyCache(ctx context.Context, progress func(checked, total int)) (mismatched []string, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+
+	lock.Lock()
+	var paths []string
+	for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+		paths = append(paths, file.Path)
+	}
+	lock.Unlock()
+	sort.Strings(paths)
+
+	total := len(paths)
+	for i, relPath := range paths {
+		if err = ctx.Err(); nil != err {
+			logging.LogInfof("[Lazy Load] verify cache canceled after [%d/%d] files", i, total)
+			return
+		}
+
+		lock.Lock()
+		file := repo.lazyIndexMgr.GetLazyFile(relPath)
+		lock.Unlock()
+
+		if nil != file && !repo.verifyLazyCachedFile(file) {
+			mismatched = append(mismatched, relPath)
+		}
+		if nil != progress {
+			progress(i+1, total)
+		}
+	}
+	if 0 < len(mismatched) {
+		logging.LogWarnf("[Lazy Load] verify cache found [%d/%d] mismatched files: %v", len(mismatched), total, mismatched)
+	}
+	return
+}
+
+// verifyLazyCachedFile 校验懒加载文件的本地副本是否和记录一致，文件没有下载时视为一致。
+func (repo *Repo) verifyLazyCachedFile(file *entity.File) bool {
+	absPath := repo.absPath(file.Path)
+	info, err := os.Stat(absPath)
+	if nil != err || info.IsDir() {
+		return true
+	}
+	if info.Size() != file.Size {
+		return false
+	}
+
+	chunkIDs, err := lazyFileChunkIDs(absPath, repo.chunkPol)
+	if nil != err {
+		logging.LogWarnf("[Lazy Load] compute chunks of file [%s] failed: %s", file.Path, err)
+		return false
+	}
+	return slices.Equal(chunkIDs, file.Chunks)
+}
+
+// ErrLazyWriteVerifyFailed 表示懒加载文件写入后重新读取的内容与记录不一致，写入的文件已被删除。
+var ErrLazyWriteVerifyFailed = errors.New("lazy file write verification failed")
+
+// lazyReadBackChunkIDs 在写入后校验时重新读取文件并计算分块 ID。
+var lazyReadBackChunkIDs = lazyFileChunkIDs
+
+// verifyLazyWrittenFile 重新读取刚写入的懒加载文件，分块与记录 file 不一致时删除文件并返回 ErrLazyWriteVerifyFailed。
+func (repo *Repo) verifyLazyWrittenFile(absPath string, file *entity.File) (err error) {
+	chunkIDs, err := lazyReadBackChunkIDs(absPath, repo.chunkPol)
+	if nil == err && slices.Equal(chunkIDs, file.Chunks) {
+		return
+	}
+
+	if nil == err {
+		err = fmt.Errorf("%w: file [%s] content does not match its chunks", ErrLazyWriteVerifyFailed, file.Path)
+	} else {
+		err = fmt.Errorf("%w: read back file [%s] failed: %w", ErrLazyWriteVerifyFailed, file.Path, err)
+	}
+	logging.LogErrorf("[Lazy Load] %s", err)
+	if removeErr := os.Remove(absPath); nil != removeErr && !os.IsNotExist(removeErr) {
+		logging.LogErrorf("[Lazy Load] remove unverified file [%s] failed: %s", absPath, removeErr)
+	}
+	return
+}
+
+// lazyFileChunkIDs 按照索引时的分块规则计算文件的分块 ID，不写入存储。
+func lazyFileChunkIDs(absPath string, pol chunker.Pol) (ret []string, err error) {
+	err = chunkFile(absPath, pol, func(data []byte) error {
+		ret = append(ret, util.Hash(data))
+		return nil
+	})
+	if nil != err {
+		ret = nil
+	}
+	return
+}
+
+// DiskSpaceReporter 返回路径 p 所在磁盘的可用空间字节数。
+type DiskSpaceReporter func(p string) int64
+
+// CanLazyLoad 在加载大量懒加载文件之前检查磁盘空间是否足够。needBytes 为需要下载的文件大小之和（已下载且大小一致的文件不计入），
+// 加上下载后保留在本地存储中的分块大小：本地存储缺失的分块按所在文件的平均分块大小估算，多个文件共用的分块只计一次。
+// freeBytes 为数据文件夹所在磁盘的可用空间，下载后剩余空间不小于 repo.MinFreeBytes 时 ok 为 true。该方法不会触发下载。
+func (repo *Repo) CanLazyLoad(paths []string) (ok bool, needBytes, freeBytes int64, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return false, 0, 0, ErrLazyLoadingDisabled
+	}
+
+	seen := map[string]bool{}
+	chunkBytes := map[string]int64{} // 本地存储缺失的分块 -> 估算的大小
+	for _, p := range paths {
+		absPath, relPath, resolveErr := repo.resolveLazyFilePath(p)
+		if nil != resolveErr {
+			return false, 0, 0, resolveErr
+		}
+		if seen[relPath] {
+			continue
+		}
+		seen[relPath] = true
+
+		file, getErr := repo.getLazyFile(relPath)
+		if nil != getErr {
+			return false, 0, 0, getErr
+		}
+		if info, statErr := os.Stat(absPath); nil == statErr && info.Size() == file.Size {
+			continue
+		}
+		needBytes += file.Size
+
+		missing, missingErr := repo.localNotFoundChunks(file.Chunks)
+		if nil != missingErr {
+			return false, 0, 0, missingErr
+		}
+		for _, chunkID := range missing {
+			chunkBytes[chunkID] = file.Size / int64(len(file.Chunks))
+		}
+	}
+	for _, size := range chunkBytes {
+		needBytes += size
+	}
+
+	freeDiskSpace := repo.FreeDiskSpace
+	if nil == freeDiskSpace {
+		freeDiskSpace = util.GetFreeDiskSpace
+	}
+	freeBytes = freeDiskSpace(repo.DataPath)
+	ok = freeBytes-needBytes >= repo.MinFreeBytes
+	if !ok {
+		logging.LogWarnf("[Lazy Load] not enough disk space for [%d] files, need [%d] bytes, free [%d] bytes, min free [%d] bytes", len(seen), needBytes, freeBytes, repo.MinFreeBytes)
+	}
+	return
+}
+
+// LazyFileChunkStatus 返回懒加载文件 filePath 的分块在本地存储中的存在情况，不会触发下载。
+// present 为本地已存在的分块，missing 为需要从云端获取的分块，均按文件中的分块顺序排列。
+func (repo *Repo) LazyFileChunkStatus(filePath string) (present, missing []string, err error) {
+	if !repo.lazyLoadingEnabled() {
+		err = ErrLazyLoadingDisabled
+		return
+	}
+
+	relPath := lazyIndexPath(filePath)
+	if !repo.isLazyLoadingFile(relPath) {
+		err = fmt.Errorf("file [%s] is not a lazy loading file", relPath)
+		return
+	}
+
+	file, err := repo.getLazyFile(relPath)
+	if nil != err {
+		return
+	}
+
+	for _, chunkID := range file.Chunks {
+		if _, statErr := repo.store.Stat(chunkID); nil != statErr {
+			if isNoSuchFileOrDirErr(statErr) {
+				missing = append(missing, chunkID)
+				continue
+			}
+			err = statErr
+			return
+		}
+		present = append(present, chunkID)
+	}
+	return
+}
+
+// repairCorruptedChunks 校验文件 file 的分块 chunkIDs，分块 ID 是分块内容的哈希，不一致说明分块已损坏。
+// 这里只重新下载损坏的分块，其他分块继续复用，避免因为单个分块损坏而重新下载整个文件。
+func (repo *Repo) repairCorruptedChunks(file *entity.File, chunkIDs []string, context map[string]interface{}) (err error) {
+	corrupted := repo.corruptedChunks(chunkIDs)
+	if 1 > len(corrupted) {
+		return
+	}
+
+	logging.LogWarnf("[Lazy Load] found [%d] corrupted chunks for file [%s], downloading them again", len(corrupted), file.Path)
+	for _, chunkID := range corrupted {
+		if err = repo.store.Remove(chunkID); nil != err {
+			logging.LogErrorf("[Lazy Load] remove corrupted chunk [%s] failed: %s", chunkID, err)
+			return
+		}
+	}
+
+	if _, err = repo.downloadCloudChunksPut(corrupted, context); nil != err {
+		return fmt.Errorf("download corrupted chunks failed: %w", err)
+	}
+
+	if corrupted = repo.corruptedChunks(corrupted); 0 < len(corrupted) {
+		return fmt.Errorf("chunks %v of file [%s] are still corrupted after download: %w", corrupted, file.Path, ErrLazyHashMismatch)
+	}
+	return
+}
+
+// corruptedChunks 返回本地无法读取或者内容哈希与分块 ID 不一致的分块
+func (repo *Repo) corruptedChunks(chunkIDs []string) (ret []string) {
+	for _, chunkID := range chunkIDs {
+		chunk, getErr := repo.store.GetChunk(chunkID)
+		if nil != getErr {
+			logging.LogWarnf("[Lazy Load] get chunk [%s] failed: %s", chunkID, getErr)
+			ret = append(ret, chunkID)
+			continue
+		}
+		if chunkID != util.Hash(chunk.Data) {
+			logging.LogWarnf("[Lazy Load] chunk [%s] hash mismatch", chunkID)
+			ret = append(ret, chunkID)
+		}
+	}
+	ret = gulu.Str.RemoveDuplicatedElem(ret)
+	return
+}
+
+// getLazyFile 根据索引路径查找懒加载文件记录，优先使用懒加载索引，其次查找本地最新索引
+func (repo *Repo) getLazyFile(relPath string) (ret *entity.File, err error) {
+	if nil != repo.lazyIndexMgr {
+		if ret = repo.lazyIndexMgr.GetLazyFile(relPath); nil != ret {
+			return
+		}
+	}
+
+	latest, err := repo.Latest()
+	if nil != err {
+		if ErrNotFoundIndex == err {
+			err = fmt.Errorf("lazy file [%s] not found", relPath)
+		}
+		return
+	}
+
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+	for _, file := range files {
+		if file.Path == relPath {
+			ret = file
+			return
+		}
+	}
+	err = fmt.Errorf("lazy file [%s] not found", relPath)
+	return
+}
+
+// LazyLoadByFileID 按文件 ID 加载懒加载文件，文件 ID 即 entity.File.ID。
+func (repo *Repo) LazyLoadByFileID(fileID string, context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+
+	relPath, err := repo.getLazyFilePathByID(fileID)
+	if nil != err {
+		return
+	}
+	return repo.LazyLoadFile(filepath.Join(repo.DataPath, filepath.FromSlash(relPath)), context)
+}
+
+// LazyLoadFilesFromIndex 按指定的历史索引加载懒加载文件，文件内容以该索引中记录的版本为准，而不是最新索引中的版本。
+// paths 为数据文件夹下的文件路径，可以是绝对路径或相对于数据文件夹的路径，已存在的本地文件会被该索引中的版本覆盖。
+func (repo *Repo) LazyLoadFilesFromIndex(indexID string, paths []string, context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+
+	relPaths := map[string]string{}
+	for _, p := range paths {
+		absPath, relPath, resolveErr := repo.resolveLazyFilePath(p)
+		if nil != resolveErr {
+			return resolveErr
+		}
+		if !repo.isLazyLoadingFile(relPath) {
+			return fmt.Errorf("file [%s] is not a lazy loading file", relPath)
+		}
+		relPaths[relPath] = absPath
+	}
+	if 1 > len(relPaths) {
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if repo.lazyClosed.Load() {
+		return ErrLazyLoadingClosed
+	}
+
+	index, err := repo.store.GetIndex(indexID)
+	if nil != err {
+		if nil == repo.cloud {
+			return fmt.Errorf("get index [%s] failed: %s", indexID, err)
+		}
+		if _, index, err = repo.downloadCloudIndex(indexID, context); nil != err {
+			return fmt.Errorf("download cloud index [%s] failed: %s", indexID, err)
+		}
+	}
+
+	// 只解析到所有请求的文件都找到为止
+	targets := map[string]*entity.File{}
+	for _, fileID := range index.Files {
+		if len(targets) == len(relPaths) {
+			break
+		}
+
+		file, getErr := repo.store.GetFile(fileID)
+		if nil != getErr {
+			if nil == repo.cloud {
+				return fmt.Errorf("get file [%s] failed: %s", fileID, getErr)
+			}
+			if _, file, getErr = repo.downloadCloudFile(fileID, 1, 1, context); nil != getErr {
+				return fmt.Errorf("download cloud file [%s] failed: %s", fileID, getErr)
+			}
+			if getErr = repo.store.PutFile(file); nil != getErr {
+				return fmt.Errorf("put file [%s] failed: %s", fileID, getErr)
+			}
+		}
+		if _, ok := relPaths[file.Path]; ok {
+			targets[file.Path] = file
+		}
+	}
+
+	for relPath, absPath := range relPaths {
+		file := targets[relPath]
+		if nil == file {
+			return fmt.Errorf("file [%s] not found in index [%s]", relPath, indexID)
+		}
+
+		if 0 != file.Size {
+			if nil == repo.cloud {
+				return fmt.Errorf("lazy loading requires cloud storage")
+			}
+			if err = repo.ensureChunksAvailable(file, context); nil != err {
+				return fmt.Errorf("lazy load file [%s] from index [%s] failed: %s", relPath, indexID, err)
+			}
+		} else {
+			emptyFile := *file
+			emptyFile.Chunks = nil
+			file = &emptyFile
+		}
+
+		if err = repo.checkoutFileWithMtime(file, repo.DataPath, repo.LazyLoadingTempDir, false, 1, 1, context); nil != err {
+			return fmt.Errorf("checkout file [%s] failed: %s", relPath, err)
+		}
+		repo.restoreLazyMtime(absPath, file)
+		if 0 != file.Mode {
+			if err = os.Chmod(absPath, os.FileMode(file.Mode)); nil != err {
+				return fmt.Errorf("change file mode failed: %s", err)
+			}
+		}
+		logging.LogInfof("[Lazy Load] loaded file [%s] from index [%s], size [%d] bytes", relPath, indexID, file.Size)
+	}
+	return
+}
+
+// LazyLoadFileWithDeadline 在 deadline 时间内尽量下载懒加载文件的分块，所有分块都下载完成时写入文件并返回 complete 为 true，
+// 否则不写入文件，返回 complete 为 false 以及已经获得的文件内容字节数，调用方可以据此决定继续加载还是放弃。
+// 已下载的分块保留在本地存储中，再次调用该方法或者 LazyLoadFile 时不会重复下载。截止时间在分块之间检查，不会中断正在下载的分块。
+// 没有全部下载时 bytesGot 是估算值，本地已有的分块按存储中（压缩后）的大小计算。
+func (repo *Repo) LazyLoadFileWithDeadline(filePath string, deadline time.Duration, context map[string]interface{}) (complete bool, bytesGot int64, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return false, 0, ErrLazyLoadingDisabled
+	}
+	if repo.lazyClosed.Load() {
+		return false, 0, ErrLazyLoadingClosed
+	}
+
+	absPath, relPath, err := repo.resolveLazyFilePath(filePath)
+	if nil != err {
+		return
+	}
+
+	if complete, bytesGot, err = repo.fetchLazyChunksUntil(absPath, relPath, repo.now().Add(deadline), context); nil != err || !complete {
+		return
+	}
+
+	// 分块已经全部在本地，按正常流程写入文件
+	if err = repo.lazyQueue.load(repo, absPath, relPath, context, true); nil != err {
+		complete = false
+	}
+	return
+}
+
+// ErrFileTooLarge 表示懒加载文件超过了调用方允许读入内存的大小。
+var ErrFileTooLarge = errors.New("file too large")
+
+// LazyReadAll 读取懒加载文件 filePath 的内容到内存中，本地不存在时从云端下载分块后按索引记录拼接，不会写入数据文件夹。
+// 索引记录的文件大小超过 maxBytes 时在下载前返回 ErrFileTooLarge，避免误将超大文件读入内存。
+func (repo *Repo) LazyReadAll(filePath string, maxBytes int64, context map[string]interface{}) (ret []byte, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+	if repo.lazyClosed.Load() {
+		return nil, ErrLazyLoadingClosed
+	}
+
+	absPath, relPath, err := repo.resolveLazyFilePath(filePath)
+	if nil != err {
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !repo.isLazyLoadingFile(relPath) {
+		return nil, fmt.Errorf("file [%s] is not a lazy loading file", relPath)
+	}
+
+	file, err := repo.findLazyLoadTarget(relPath, context)
+	if nil != err {
+		return
+	}
+	if file.Size > maxBytes {
+		return nil, fmt.Errorf("file [%s] size [%d] exceeds [%d] bytes: %w", relPath, file.Size, maxBytes, ErrFileTooLarge)
+	}
+
+	if info, statErr := os.Stat(absPath); nil == statErr && !info.IsDir() {
+		if info.Size() > maxBytes {
+			return nil, fmt.Errorf("file [%s] size [%d] exceeds [%d] bytes: %w", relPath, info.Size(), maxBytes, ErrFileTooLarge)
+		}
+		return filelock.ReadFile(absPath)
+	}
+
+	if 0 < file.Size {
+		if nil == repo.cloud {
+			return nil, errors.New("lazy loading requires cloud storage")
+		}
+		if err = repo.lazyLoadFromCloud(file, lazyEventContext(context, relPath)); nil != err {
+			return nil, fmt.Errorf("lazy load from cloud failed: %w", err)
+		}
+	}
+
+	ret = make([]byte, 0, file.Size)
+	for _, chunkID := range file.Chunks {
+		chunk, getErr := repo.store.GetChunk(chunkID)
+		if nil != getErr {
+			return nil, fmt.Errorf("get chunk [%s] failed: %w", chunkID, getErr)
+		}
+		ret = append(ret, chunk.Data...)
+	}
+	return
+}
+
+// ThumbnailProvider 根据懒加载文件 file 开头的几个分块数据 firstChunks 生成缩略图或者预览。
+// 分块数可能少于请求的数量（文件较小时），调用方不应假定 firstChunks 拼接后是完整的文件。
+type ThumbnailProvider func(file *entity.File, firstChunks [][]byte) ([]byte, error)
+
+// ErrNoThumbnailProvider 表示没有设置 ThumbnailProvider。
+var ErrNoThumbnailProvider = errors.New("thumbnail provider is not set")
+
+const defaultLazyThumbnailChunks = 2
+
+// LazyThumbnail 只获取懒加载文件 filePath 开头的几个分块（数量由 LazyThumbnailChunks 决定），交给 ThumbnailProvider 生成缩略图。
+// 文件已经下载且未被修改时直接读取本地文件，否则只下载缺失的开头分块。下载的分块只保存在内存中，该方法不会写入数据文件夹，也不会改变本地存储。
+func (repo *Repo) LazyThumbnail(filePath string, context map[string]interface{}) (ret []byte, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+	if repo.lazyClosed.Load() {
+		return nil, ErrLazyLoadingClosed
+	}
+	provider := repo.ThumbnailProvider
+	if nil == provider {
+		return nil, ErrNoThumbnailProvider
+	}
+
+	_, relPath, err := repo.resolveLazyFilePath(filePath)
+	if nil != err {
+		return
+	}
+
+	file, firstChunks, err := repo.fetchLazyLeadingChunks(relPath, context)
+	if nil != err {
+		return
+	}
+	return provider(file, firstChunks)
+}
+
+// fetchLazyLeadingChunks 获取懒加载文件 relPath 开头的分块数据。本地文件未被修改时从文件读取，否则依次使用本地存储、ChunkProvider 和云端下载的分块。
+// ChunkProvider 写入存储的分块在读取后删除，下载的分块不写入存储。
+func (repo *Repo) fetchLazyLeadingChunks(relPath string, context map[string]interface{}) (file *entity.File, ret [][]byte, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !repo.isLazyLoadingFile(relPath) {
+		return nil, nil, fmt.Errorf("file [%s] is not a lazy loading file", relPath)
+	}
+
+	if file, err = repo.findLazyLoadTarget(relPath, context); nil != err {
+		return
+	}
+
+	count := repo.LazyThumbnailChunks
+	if 1 > count {
+		count = defaultLazyThumbnailChunks
+	}
+	chunkIDs := file.Chunks[:min(count, len(file.Chunks))]
+
+	if ret = repo.readLocalLeadingChunks(file, chunkIDs); nil != ret {
+		return
+	}
+
+	missing, err := repo.localNotFoundChunks(chunkIDs)
+	if nil != err {
+		return
+	}
+	defer func() {
+		for _, chunkID := range missing {
+			if removeErr := repo.store.Remove(chunkID); nil != removeErr {
+				logging.LogWarnf("[Lazy Load] remove provided chunk [%s] failed: %s", chunkID, removeErr)
+			}
+		}
+	}()
+	remaining, err := repo.provideLazyChunks(missing)
+	if nil != err {
+		return
+	}
+
+	downloaded := map[string][]byte{}
+	if 0 < len(remaining) {
+		if nil == repo.cloud {
+			return nil, nil, errors.New("lazy loading requires cloud storage")
+		}
+		context = lazyEventContext(context, relPath)
+		for i, chunkID := range remaining {
+			_, chunk, downloadErr := repo.downloadCloudChunk(chunkID, i+1, len(remaining), context)
+			if nil != downloadErr {
+				return nil, nil, downloadErr
+			}
+			if hash := util.Hash(chunk.Data); chunkID != hash {
+				return nil, nil, fmt.Errorf("chunk [%s] downloaded for file [%s] hashes to [%s]: %w", chunkID, relPath, hash, ErrLazyHashMismatch)
+			}
+			downloaded[chunkID] = chunk.Data
+		}
+	}
+
+	for _, chunkID := range chunkIDs {
+		if data, ok := downloaded[chunkID]; ok {
+			ret = append(ret, data)
+			continue
+		}
+		chunk, getErr := repo.store.GetChunk(chunkID)
+		if nil != getErr {
+			return nil, nil, fmt.Errorf("get chunk [%s] failed: %w", chunkID, getErr)
+		}
+		ret = append(ret, chunk.Data)
+	}
+	return
+}
+
+// readLocalLeadingChunks 从已下载且未被修改的本地文件读取开头的分块，分块与 chunkIDs 不一致或者文件不可用时返回 nil。
+func (repo *Repo) readLocalLeadingChunks(file *entity.File, chunkIDs []string) (ret [][]byte) {
+	if _, ok := repo.lazyUnchangedFileInfo(file); !ok {
+		return nil
+	}
+
+	absPath := filepath.Join(repo.DataPath, filepath.FromSlash(file.Path))
+	err := chunkFile(absPath, repo.chunkPol, func(data []byte) error {
+		if chunkIDs[len(ret)] != util.Hash(data) {
+			return ErrLazyHashMismatch
+		}
+		if ret = append(ret, data); len(chunkIDs) == len(ret) {
+			return io.EOF
+		}
+		return nil
+	})
+	if nil != err || len(chunkIDs) != len(ret) {
+		logging.LogDebugf("[Lazy Load] read leading chunks of local file [%s] failed, fallback to chunks: %v", file.Path, err)
+		return nil
+	}
+	return
+}
+
+// fetchLazyChunksUntil 逐个下载懒加载文件 relPath 缺失的分块直到全部下载完成或者超过截止时间 until，返回分块是否全部在本地以及已获得的文件内容字节数。
+// 分块全部在本地时 bytesGot 为文件大小，否则本地已有的分块按存储中的大小估算。只在检查分块和写入分块时持有仓库锁，下载分块时不持有锁。
+func (repo *Repo) fetchLazyChunksUntil(absPath, relPath string, until time.Time, context map[string]interface{}) (complete bool, bytesGot int64, err error) {
+	file, missing, bytesGot, err := repo.lazyMissingChunks(absPath, relPath, context)
+	if nil != err || 1 > len(missing) {
+		return nil == err, bytesGot, err
+	}
+
+	context = lazyEventContext(context, relPath)
+	var downloaded int64
+	for i, chunkID := range missing {
+		if repo.now().After(until) {
+			logging.LogInfof("[Lazy Load] deadline exceeded for file [%s], got [%d/%d] bytes, [%d] chunks missing", relPath, bytesGot, file.Size, len(missing)-i)
+			return false, bytesGot, nil
+		}
+
+		length, chunk, downloadErr := repo.downloadCloudChunk(chunkID, i+1, len(missing), context)
+		if nil != downloadErr {
+			return false, bytesGot, downloadErr
+		}
+		if hash := util.Hash(chunk.Data); chunkID != hash {
+			return false, bytesGot, fmt.Errorf("chunk [%s] downloaded for file [%s] hashes to [%s]: %w", chunkID, relPath, hash, ErrLazyHashMismatch)
+		}
+		if err = repo.putDownloadedLazyChunk(chunk); nil != err {
+			return false, bytesGot, err
+		}
+		bytesGot += int64(len(chunk.Data))
+		downloaded += length
+		publishLazyDownloadProgress(context, i+1, len(missing), downloaded)
+	}
+	return true, file.Size, nil
+}
+
+// lazyMissingChunks 持有仓库锁检查懒加载文件 relPath 在本地缺失的分块，ChunkProvider 能提供的分块会先写入存储。
+// 文件已经在本地时 missing 为空，bytesGot 为文件大小。
+func (repo *Repo) lazyMissingChunks(absPath, relPath string, context map[string]interface{}) (file *entity.File, missing []string, bytesGot int64, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if repo.lazyClosed.Load() {
+		return nil, nil, 0, ErrLazyLoadingClosed
+	}
+	if !repo.isLazyLoadingFile(relPath) {
+		return nil, nil, 0, fmt.Errorf("file [%s] is not a lazy loading file", relPath)
+	}
+
+	if file, err = repo.findLazyLoadTarget(relPath, context); nil != err {
+		return
+	}
+	if info, statErr := os.Stat(absPath); nil == statErr && !info.IsDir() {
+		return file, nil, info.Size(), nil
+	}
+
+	if missing, err = repo.localNotFoundChunks(file.Chunks); nil != err {
+		return
+	}
+	if missing, err = repo.provideLazyChunks(missing); nil != err {
+		return
+	}
+	if 1 > len(missing) {
+		return file, nil, file.Size, nil
+	}
+	for _, chunkID := range file.Chunks {
+		if slices.Contains(missing, chunkID) {
+			continue
+		}
+		if stat, statErr := repo.store.Stat(chunkID); nil == statErr {
+			bytesGot += stat.Size()
+		}
+	}
+	if nil == repo.cloud {
+		return file, nil, bytesGot, errors.New("lazy loading requires cloud storage")
+	}
+	return
+}
+
+// putDownloadedLazyChunk 持有仓库锁将下载的分块写入存储，懒加载已经关闭时返回 ErrLazyLoadingClosed。
+func (repo *Repo) putDownloadedLazyChunk(chunk *entity.Chunk) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if repo.lazyClosed.Load() {
+		return ErrLazyLoadingClosed
+	}
+	return repo.store.PutChunk(chunk)
+}
+
+// LazyLoadTransaction 以全部成功或者全部失败的方式加载多个懒加载文件：先将所有文件下载到临时文件夹中，
+// 全部下载成功后再移动到数据文件夹下。任意一个文件加载失败时清理已下载的临时文件并返回错误，数据文件夹保持不变。
+// 本地已经存在的文件会被跳过。
+func (repo *Repo) LazyLoadTransaction(paths []string, context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+
+	var absPaths, relPaths []string
+	for _, p := range paths {
+		absPath, relPath, resolveErr := repo.resolveLazyFilePath(p)
+		if nil != resolveErr {
+			return resolveErr
+		}
+		if !repo.isLazyLoadingFile(relPath) {
+			return fmt.Errorf("file [%s] is not a lazy loading file", relPath)
+		}
+		if slices.Contains(relPaths, relPath) {
+			continue
+		}
+		absPaths = append(absPaths, absPath)
+		relPaths = append(relPaths, relPath)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if repo.lazyClosed.Load() {
+		return ErrLazyLoadingClosed
+	}
+
+	stagingDir := filepath.Join(repo.TempPath, "lazy-transaction-"+gulu.Rand.String(7))
+	defer os.RemoveAll(stagingDir)
+
+	// 先将所有文件下载到临时文件夹中
+	var targets []*entity.File
+	var targetAbsPaths []string
+	for i, relPath := range relPaths {
+		if gulu.File.IsExist(absPaths[i]) {
+			continue
+		}
+
+		file, findErr := repo.findLazyLoadTarget(relPath, context)
+		if nil != findErr {
+			return fmt.Errorf("lazy load transaction aborted, %s", findErr)
+		}
+		if 0 == file.Size {
+			emptyFile := *file
+			emptyFile.Chunks = nil
+			file = &emptyFile
+		} else if nil == repo.cloud {
+			return fmt.Errorf("lazy loading requires cloud storage")
+		} else if err = repo.lazyLoadFromCloud(file, context); nil != err {
+			return fmt.Errorf("lazy load transaction aborted, load file [%s] failed: %s", relPath, err)
+		}
+		if err = repo.checkoutFileWithMtime(file, stagingDir, "", false, i+1, len(relPaths), context); nil != err {
+			return fmt.Errorf("lazy load transaction aborted, stage file [%s] failed: %s", relPath, err)
+		}
+		targets = append(targets, file)
+		targetAbsPaths = append(targetAbsPaths, absPaths[i])
+	}
+
+	// 全部下载成功后再移动到数据文件夹下，移动失败时删除已经移动的文件
+	var committed []string
+	for i, file := range targets {
+		if err = repo.commitStagedLazyFile(file, filepath.Join(stagingDir, file.Path), targetAbsPaths[i]); nil != err {
+			for _, committedPath := range committed {
+				if removeErr := os.Remove(committedPath); nil != removeErr {
+					logging.LogErrorf("roll back lazy file [%s] failed: %s", committedPath, removeErr)
+				}
+			}
+			return fmt.Errorf("lazy load transaction aborted, commit file [%s] failed: %s", file.Path, err)
+		}
+		committed = append(committed, targetAbsPaths[i])
+		repo.lazyAccessed.Store(file.Path, repo.now().UnixMilli())
+	}
+	if 0 < len(committed) {
+		repo.lazyLastLoaded.Store(repo.now().UnixMilli())
+	}
+	logging.LogInfof("[Lazy Load] loaded [%d] files in transaction", len(committed))
+	return
+}
+
+// commitStagedLazyFile 将临时文件夹中已下载的懒加载文件移动到数据文件夹下，并恢复更新时间和权限。
+func (repo *Repo) commitStagedLazyFile(file *entity.File, stagedPath, absPath string) (err error) {
+	dirMode := repo.LazyDirMode
+	if 0 == dirMode {
+		dirMode = 0755
+	}
+	if err = os.MkdirAll(filepath.Dir(absPath), dirMode); nil != err {
+		return
+	}
+	if _, err = moveToDir(stagedPath, filepath.Dir(absPath)); nil != err {
+		return
+	}
+
+	repo.restoreLazyMtime(absPath, file)
+	mode := repo.LazyFileMode
+	if 0 == mode {
+		mode = os.FileMode(file.Mode)
+	}
+	if 0 != mode {
+		err = os.Chmod(absPath, mode)
+	}
+	return
+}
+
+// EvictSyncedLazyFiles 删除已经安全上传到云端的懒加载文件的本地副本以释放空间，被驱逐的文件之后访问时重新按需加载。
+// 只驱逐磁盘上的大小和更新时间与懒加载索引记录一致，并且文件对象和所有分块都已经存在于云端的文件，本地有未上传修改的文件不会被驱逐。
+func (repo *Repo) EvictSyncedLazyFiles(context map[string]interface{}) (evicted int, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return 0, ErrLazyLoadingDisabled
+	}
+	if nil == repo.cloud {
+		return 0, errors.New("evicting lazy files requires cloud storage")
+	}
+
+	var evictedFiles []*entity.File
+	var evictedPaths []string
+	var freed int64
+	defer func() { repo.notifyLazyEviction(evictedPaths, freed) }()
+	lock.Lock()
+	defer lock.Unlock()
+
+	if repo.lazyClosed.Load() {
+		return 0, ErrLazyLoadingClosed
+	}
+
+	for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+		if _, ok := repo.lazyUnchangedFileInfo(file); !ok {
+			continue
+		}
+
+		var ok bool
+		if ok, err = repo.evictSyncedLazyFile(file); nil != err {
+			break
+		}
+		if ok {
+			evicted++
+			evictedFiles = append(evictedFiles, file)
+			evictedPaths = append(evictedPaths, file.Path)
+			freed += file.Size
+		}
+	}
+	// 所有驱逐标记都已经写入磁盘，最后统一清理分块，避免每个文件都读取一次最新索引
+	repo.cleanupLazyFilesChunks(evictedFiles)
+	if nil != err {
+		return
+	}
+	if err = repo.lazyIndexMgr.Flush(); nil != err {
+		return
+	}
+	logging.LogInfof("[Lazy Load] evicted [%d] synced lazy files", evicted)
+	return
+}
+
+// EvictLazyFilesToSize 按最近最少使用的顺序驱逐本地懒加载文件，直到本地懒加载文件的总大小不超过 targetBytes，返回释放的字节数。
+// 最近使用时间取本次运行中最后一次成功访问的时间，没有访问过的文件使用磁盘上的更新时间。
+// 和 EvictSyncedLazyFiles 一样只驱逐确认已经上传到云端的文件，repo.LazyPinPredicate 固定的文件和有未上传修改的文件不会被驱逐，
+// 所以驱逐后总大小仍然可能超过目标。
+func (repo *Repo) EvictLazyFilesToSize(targetBytes int64) (freed int64, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return 0, ErrLazyLoadingDisabled
+	}
+	if nil == repo.cloud {
+		return 0, errors.New("evicting lazy files requires cloud storage")
+	}
+
+	var evictedFiles []*entity.File
+	var evictedPaths []string
+	defer func() { repo.notifyLazyEviction(evictedPaths, freed) }()
+	lock.Lock()
+	defer lock.Unlock()
+
+	if repo.lazyClosed.Load() {
+		return 0, ErrLazyLoadingClosed
+	}
+
+	total := repo.localLazyFilesSize()
+	if total <= targetBytes {
+		return
+	}
+
+	type candidate struct {
+		file     *entity.File
+		size     int64
+		lastUsed int64
+	}
+	var candidates []*candidate
+	for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+		info, ok := repo.lazyUnchangedFileInfo(file)
+		if !ok {
+			continue
+		}
+		if nil != repo.LazyPinPredicate && repo.LazyPinPredicate(file) {
+			continue
+		}
+
+		lastUsed := info.ModTime().UnixMilli()
+		if accessed, loaded := repo.lazyAccessed.Load(file.Path); loaded {
+			lastUsed = accessed.(int64)
+		}
+		candidates = append(candidates, &candidate{file: file, size: info.Size(), lastUsed: lastUsed})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed < candidates[j].lastUsed
+	})
+
+	for _, c := range candidates {
+		if total <= targetBytes {
+			break
+		}
+
+		var ok bool
+		if ok, err = repo.evictSyncedLazyFile(c.file); nil != err {
+			break
+		}
+		if ok {
+			evictedFiles = append(evictedFiles, c.file)
+			evictedPaths = append(evictedPaths, c.file.Path)
+			freed += c.size
+			total -= c.size
+		}
+	}
+	repo.cleanupLazyFilesChunks(evictedFiles)
+	if nil != err {
+		return
+	}
+	if err = repo.lazyIndexMgr.Flush(); nil != err {
+		return
+	}
+	if total > targetBytes {
+		logging.LogWarnf("[Lazy Load] evicted [%d] bytes, local lazy files [%d] bytes still exceed the target [%d]", freed, total, targetBytes)
+	} else {
+		logging.LogInfof("[Lazy Load] evicted [%d] bytes, local lazy files [%d] bytes", freed, total)
+	}
+	return
+}
+
+// LazyEvictionHandler 在一轮驱逐本地懒加载文件结束后调用，evicted 为被驱逐的文件路径，freedBytes 为释放的字节数。
+// 和 MetricsObserver 逐个文件观测不同，它面向用户提示，比如"为腾出空间释放了 500 MB"。
+type LazyEvictionHandler func(evicted []string, freedBytes int64)
+
+// notifyLazyEviction 在一轮驱逐结束、释放仓库锁之后恢复因为超出缓存上限暂停的后台预取，并调用 repo.OnLazyEviction，没有驱逐任何文件时不做任何事。
+func (repo *Repo) notifyLazyEviction(evicted []string, freedBytes int64) {
+	if 1 > len(evicted) {
+		return
+	}
+	repo.lazyQueue.resume(repo)
+	if nil == repo.OnLazyEviction {
+		return
+	}
+	repo.OnLazyEviction(evicted, freedBytes)
+}
+
+// lazyUnchangedFileInfo 返回本地懒加载文件的信息，文件不存在或者在索引后被修改过（修改后的内容还没有上传）时返回 false。
+func (repo *Repo) lazyUnchangedFileInfo(file *entity.File) (info os.FileInfo, ok bool) {
+	info, statErr := os.Stat(filepath.Join(repo.DataPath, filepath.FromSlash(file.Path)))
+	if nil != statErr || info.IsDir() {
+		return nil, false
+	}
+	if info.Size() != file.Size || info.ModTime().UnixMilli() != repo.lazyIndexMgr.LocalMtime(file) || 1 > len(file.Chunks) {
+		logging.LogDebugf("[Lazy Load] skip evicting changed file [%s]", file.Path)
+		return nil, false
+	}
+	return info, true
+}
+
+// evictSyncedLazyFile 在确认文件对象和所有分块都已经存在于云端后删除本地懒加载文件并标记为已驱逐，没有全部上传时返回 false。
+// 驱逐标记先写入磁盘再删除文件，否则崩溃后文件既不在本地也不会出现在之后的索引中。
+// 本地分块由调用方在一轮驱逐结束后通过 cleanupLazyFilesChunks 统一清理。调用方需要持有 lock。
+func (repo *Repo) evictSyncedLazyFile(file *entity.File) (ok bool, err error) {
+	notFound, err := repo.cloud.GetChunks(append([]string{file.ID}, file.Chunks...))
+	if nil != err {
+		return false, fmt.Errorf("check cloud objects of file [%s] failed: %s", file.Path, err)
+	}
+	if 0 < len(notFound) {
+		logging.LogInfof("[Lazy Load] skip evicting file [%s], [%d] objects are not in cloud", file.Path, len(notFound))
+		return false, nil
+	}
+
+	repo.lazyIndexMgr.MarkEvicted(file.Path)
+	if err = repo.lazyIndexMgr.Flush(); nil != err {
+		repo.lazyIndexMgr.ClearEvicted([]string{file.Path})
+		return false, fmt.Errorf("persist evicted mark of file [%s] failed: %w", file.Path, err)
+	}
+	if err = os.Remove(filepath.Join(repo.DataPath, filepath.FromSlash(file.Path))); nil != err {
+		repo.lazyIndexMgr.ClearEvicted([]string{file.Path})
+		return false, fmt.Errorf("remove file [%s] failed: %s", file.Path, err)
+	}
+	repo.lazyAccessed.Delete(file.Path)
+	repo.metrics().ObserveEviction(file.Size)
+	return true, nil
+}
+
+// GetAllLazyFileVersions 扫描仓库本地所有索引，返回出现过的每个懒加载文件的每个版本，按路径和更新时间排序。
+// 文件 ID 由路径和更新时间计算，所以按文件 ID 去重后每条记录就是一个版本。
+// 与 GetLazyLoadingFiles 只返回最新索引中的记录不同，该方法用于浏览或者恢复懒加载文件的历史版本。读取失败的索引和本地缺失的文件对象会被跳过。
+func (repo *Repo) GetAllLazyFileVersions() (ret []*entity.File, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	indexIDs, err := repo.store.indexIDs()
+	if nil != err {
+		return
+	}
+
+	scanned := map[string]bool{}
+	for indexID := range indexIDs {
+		index, getErr := repo.store.GetIndex(indexID)
+		if nil != getErr {
+			logging.LogWarnf("[Lazy Load] skip index [%s] when listing lazy file versions: %s", indexID, getErr)
+			continue
+		}
+		for _, fileID := range index.Files {
+			if scanned[fileID] {
+				continue
+			}
+			scanned[fileID] = true
+
+			file, getErr := repo.store.GetFile(fileID)
+			if nil != getErr {
+				logging.LogWarnf("[Lazy Load] skip file [%s] when listing lazy file versions: %s", fileID, getErr)
+				continue
+			}
+			if repo.isLazyLoadingFile(file.Path) {
+				ret = append(ret, file)
+			}
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Path != ret[j].Path {
+			return ret[i].Path < ret[j].Path
+		}
+		if ret[i].Updated != ret[j].Updated {
+			return ret[i].Updated < ret[j].Updated
+		}
+		return ret[i].ID < ret[j].ID
+	})
+	return
+}
+
+// VerifyChunkAvailability 检查最新索引和懒加载索引中的懒加载文件，返回每个无法加载的文件路径及其在本地存储、云端和镜像中都缺失的分块 ID。
+// 返回结果中的文件已经无法恢复（数据丢失），需要尽快从仍有完整文件的设备重新上传。
+func (repo *Repo) VerifyChunkAvailability() (ret map[string][]string, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	files, err := repo.lazyTrackedFiles()
+	if nil != err {
+		return
+	}
+
+	var chunkIDs []string
+	for _, file := range files {
+		chunkIDs = append(chunkIDs, file.Chunks...)
+	}
+	missing, err := repo.localNotFoundChunks(gulu.Str.RemoveDuplicatedElem(chunkIDs))
+	if nil != err {
+		return
+	}
+	if 0 < len(missing) && nil != repo.cloud {
+		if missing, err = repo.cloud.GetChunks(missing); nil != err {
+			return nil, fmt.Errorf("check cloud chunks failed: %w", err)
+		}
+		for i, mirror := range repo.MirrorClouds {
+			if 1 > len(missing) {
+				break
+			}
+			if missing, err = mirror.GetChunks(missing); nil != err {
+				return nil, fmt.Errorf("check mirror [%d] chunks failed: %w", i, err)
+			}
+		}
+	}
+
+	ret = map[string][]string{}
+	if 1 > len(missing) {
+		return
+	}
+	lost := map[string]bool{}
+	for _, chunkID := range missing {
+		lost[chunkID] = true
+	}
+	for _, file := range files {
+		for _, chunkID := range file.Chunks {
+			if lost[chunkID] && !slices.Contains(ret[file.Path], chunkID) {
+				ret[file.Path] = append(ret[file.Path], chunkID)
+			}
+		}
+	}
+	for p, chunks := range ret {
+		logging.LogErrorf("[Lazy Load] file [%s] can not be loaded, chunks %v are missing from local store and cloud", p, chunks)
+	}
+	return
+}
+
+// ListUnuploadedLazyFiles 返回本地存在但文件对象或者分块没有全部上传到云端的懒加载文件，按路径排序。
+// 索引时上传失败只记录日志，这些文件在重新上传前只有本地一份，可以用来提示用户尚未备份的文件。
+func (repo *Repo) ListUnuploadedLazyFiles(context map[string]interface{}) (ret []*entity.File, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+	if nil == repo.cloud {
+		return nil, errors.New("lazy loading requires cloud storage")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	files, err := repo.lazyTrackedFiles()
+	if nil != err {
+		return
+	}
+
+	var local []*entity.File
+	var objectIDs []string
+	for _, file := range files {
+		if !gulu.File.IsExist(filepath.Join(repo.DataPath, filepath.FromSlash(file.Path))) {
+			continue
+		}
+		local = append(local, file)
+		objectIDs = append(objectIDs, file.ID)
+		objectIDs = append(objectIDs, file.Chunks...)
+	}
+	if 1 > len(local) {
+		return
+	}
+
+	notFound, err := repo.cloud.GetChunks(gulu.Str.RemoveDuplicatedElem(objectIDs))
+	if nil != err {
+		return nil, fmt.Errorf("check cloud objects failed: %w", err)
+	}
+	missing := map[string]bool{}
+	for _, id := range notFound {
+		missing[id] = true
+	}
+	for _, file := range local {
+		if missing[file.ID] || slices.ContainsFunc(file.Chunks, func(chunkID string) bool { return missing[chunkID] }) {
+			ret = append(ret, file)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	if 0 < len(ret) {
+		logging.LogWarnf("[Lazy Load] [%d] lazy files are not uploaded to cloud", len(ret))
+	}
+	return
+}
+
+// lazyTrackedFiles 返回懒加载索引和最新索引中的懒加载文件，以路径为键，同一路径在两边都有记录时使用最新索引中的记录。调用方需要持有 lock。
+func (repo *Repo) lazyTrackedFiles() (ret map[string]*entity.File, err error) {
+	ret = map[string]*entity.File{}
+	for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+		ret[file.Path] = file
+	}
+
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			err = nil
+		}
+		return
+	}
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+	for _, file := range files {
+		if repo.isLazyLoadingFile(file.Path) {
+			ret[file.Path] = file
+		}
+	}
+	return
+}
+
+// GCLazyChunks 回收不再被引用的数据对象，返回本地存储和云端删除的对象数。
+// 所有索引（不只是 refs 引用的索引）以及懒加载索引都作为根：先扫描这些根引用的文件和分块，再删除没有被引用的数据对象，不删除任何索引。
+// 有索引无法读取时中止回收，避免误删该索引引用的对象。
+// 云端存储只读（repo.ReadOnlyCloud）时跳过云端回收，只回收本地存储。镜像云端存储不做回收。
+func (repo *Repo) GCLazyChunks(context map[string]interface{}) (removedLocal, removedCloud int, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return 0, 0, ErrLazyLoadingDisabled
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if repo.lazyClosed.Load() {
+		return 0, 0, ErrLazyLoadingClosed
+	}
+
+	indexIDs, err := repo.store.indexIDs()
+	if nil != err {
+		return
+	}
+	var retentionIndexIDs []string
+	for indexID := range indexIDs {
+		if _, err = repo.store.GetIndex(indexID); nil != err {
+			logging.LogErrorf("[Lazy GC] get index [%s] failed, abort collecting: %s", indexID, err)
+			return
+		}
+		retentionIndexIDs = append(retentionIndexIDs, indexID)
+	}
+
+	stat, err := repo.purge(retentionIndexIDs...)
+	if nil != err {
+		return
+	}
+	if nil != stat {
+		removedLocal = stat.Objects
+	}
+
+	if nil == repo.cloud || repo.ReadOnlyCloud {
+		logging.LogInfof("[Lazy GC] skip collecting cloud objects, removed [%d] local objects", removedLocal)
+		return
+	}
+	if stat, err = repo.purgeCloud(context, true); nil != err {
+		return
+	}
+	if nil != stat {
+		removedCloud = stat.Objects
+	}
+	logging.LogInfof("[Lazy GC] removed [%d] local objects, [%d] cloud objects", removedLocal, removedCloud)
+	return
+}
+
+// lazyReferencedObjects 返回懒加载索引中的文件和分块 ID，清理未引用数据时这些对象算作被引用，未启用懒加载时返回空。
+func (repo *Repo) lazyReferencedObjects() (ret map[string]bool) {
+	ret = map[string]bool{}
+	if nil == repo.lazyIndexMgr {
+		return
+	}
+
+	for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+		if "" != file.ID {
+			ret[file.ID] = true
+		}
+		for _, chunkID := range file.Chunks {
+			ret[chunkID] = true
+		}
+	}
+	return
+}
+
+// RepairLazyFileIDs 根据最新索引补全懒加载索引中缺失的文件 ID，返回补全的路径。缺少文件 ID 的记录无法通过 LazyLoadByFileID 加载，
+// 也无法追溯来源。最新索引中没有路径相同并且分块一致的文件时记录保持不变。
+func (repo *Repo) RepairLazyFileIDs() (repaired []string, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			err = nil
+		}
+		return
+	}
+	files, err := repo.GetFiles(latest)
+	if nil != err {
+		return
+	}
+	if repaired = repo.lazyIndexMgr.RepairFileIDs(files); 0 < len(repaired) {
+		err = repo.lazyIndexMgr.Flush()
+	}
+	return
+}
+
+// getLazyFilePathByID 根据文件 ID 查找懒加载文件的索引路径，先查找懒加载索引，再查找本地存储的文件对象。
+// 文件 ID 由路径和更新时间计算得到，正常情况下只对应一个路径，如果对应多个路径则返回错误。
+func (repo *Repo) getLazyFilePathByID(fileID string) (ret string, err error) {
+	if 2 >= len(fileID) {
+		return "", fmt.Errorf("lazy file [%s] not found", fileID)
+	}
+
+	paths := map[string]bool{}
+	if nil != repo.lazyIndexMgr {
+		for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+			if file.ID == fileID {
+				paths[file.Path] = true
+			}
+		}
+	}
+	if file, getErr := repo.store.GetFile(fileID); nil == getErr && repo.isLazyLoadingFile(file.Path) {
+		paths[file.Path] = true
+	}
+
+	switch len(paths) {
+	case 0:
+		err = fmt.Errorf("lazy file [%s] not found", fileID)
+	case 1:
+		for p := range paths {
+			ret = p
+		}
+	default:
+		var found []string
+		for p := range paths {
+			found = append(found, p)
+		}
+		sort.Strings(found)
+		err = fmt.Errorf("lazy file [%s] matches multiple paths %v", fileID, found)
+	}
+	return
+}
+
+// ReindexLazyFile 只为一个懒加载文件重新生成分块并创建新的索引，不遍历整个数据文件夹。
+// 新索引基于最新索引，只替换该文件的记录。如果文件没有变化则不做任何事。配置了云端存储时会上传新的分块和文件，云端只读时只在本地记录。
+func (repo *Repo) ReindexLazyFile(filePath string, context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+
+	absPath, relPath, err := repo.resolveLazyFilePath(filePath)
+	if nil != err {
+		return
+	}
+	if !repo.isLazyLoadingFile(relPath) {
+		return fmt.Errorf("file [%s] is not a lazy loading file", relPath)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	info, err := os.Stat(absPath)
+	if nil != err {
+		return
+	}
+	_, err = repo.reindexLazyFiles(map[string]os.FileInfo{relPath: info}, context)
+	return
+}
+
+// SyncLocalLazyEdits 检查已下载的懒加载文件，将本地修改过（内容与懒加载索引记录不一致）的文件重新分块，
+// 在一个新的索引中更新这些文件的记录并上传新的分块，即把本地修改提升为新的版本，之后索引时不再视为冲突。
+// 只有更新时间变化而内容没有变化的文件不会产生新的记录。上传规则与 ReindexLazyFile 一致。
+func (repo *Repo) SyncLocalLazyEdits(context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if repo.lazyClosed.Load() {
+		return ErrLazyLoadingClosed
+	}
+
+	edited := map[string]os.FileInfo{}
+	for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+		info, statErr := os.Stat(repo.absPath(file.Path))
+		if nil != statErr || info.IsDir() {
+			continue
+		}
+		if info.Size() != file.Size || info.ModTime().UnixMilli() != repo.lazyIndexMgr.LocalMtime(file) {
+			edited[file.Path] = info
+		}
+	}
+	if 1 > len(edited) {
+		return
+	}
+
+	reindexed, err := repo.reindexLazyFiles(edited, context)
+	if nil != err {
+		return
+	}
+	logging.LogInfof("[Lazy Index] synced [%d/%d] locally edited lazy files", len(reindexed), len(edited))
+	return
+}
+
+// reindexLazyFiles 为懒加载文件 infos（与索引一致的相对路径 -> 本地文件信息）重新生成分块，基于最新索引创建一个替换这些文件记录的新索引，
+// 然后按配置上传新的分块和文件，返回内容有变化、重新索引了的文件路径。调用方需要持有仓库锁。
+func (repo *Repo) reindexLazyFiles(infos map[string]os.FileInfo, context map[string]interface{}) (reindexed []string, err error) {
+	latest, err := repo.Latest()
+	if nil != err {
+		return
+	}
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+
+	olds := map[string]*entity.File{}
+	for _, f := range files {
+		if _, ok := infos[f.Path]; ok {
+			olds[f.Path] = f
+		}
+	}
+
+	var relPaths []string
+	for relPath := range infos {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	changed := map[string]*entity.File{}
+	for _, relPath := range relPaths {
+		info := infos[relPath]
+		old := olds[relPath]
+		file := entity.NewFile(relPath, info.Size(), info.ModTime().UnixMilli())
+		file.Mode = uint32(info.Mode().Perm())
+		if nil != old && old.ID == file.ID && old.Size == file.Size {
+			logging.LogInfof("[Lazy Index] file [%s] not changed, skip reindex", relPath)
+			continue
+		}
+
+		if err = repo.putFileChunks(file, context, 1, 1); nil != err {
+			return
+		}
+		if nil != old && old.Size == file.Size && slices.Equal(old.Chunks, file.Chunks) {
+			logging.LogInfof("[Lazy Index] content of file [%s] not changed, skip reindex", relPath)
+			continue
+		}
+		changed[relPath] = file
+		reindexed = append(reindexed, relPath)
+	}
+	if 1 > len(reindexed) {
+		return
+	}
+
+	memo := fmt.Sprintf("[Lazy] Reindex [%s]", reindexed[0])
+	if 1 < len(reindexed) {
+		memo = fmt.Sprintf("[Lazy] Reindex [%d] files", len(reindexed))
+	}
+	index := &entity.Index{
+		ID:         util.RandHash(),
+		Memo:       memo,
+		Created:    repo.now().UnixMilli(),
+		SystemID:   repo.DeviceID,
+		SystemName: repo.DeviceName,
+		SystemOS:   repo.DeviceOS,
+	}
+	for _, f := range files {
+		if file := changed[f.Path]; nil != file {
+			f = file
+		}
+		index.Files = append(index.Files, f.ID)
+		index.Size += f.Size
+	}
+	for _, relPath := range reindexed {
+		if file := changed[relPath]; nil == olds[relPath] {
+			index.Files = append(index.Files, file.ID)
+			index.Size += file.Size
+		}
+	}
+	index.Count = len(index.Files)
+
+	if err = repo.store.PutIndex(index); nil != err {
+		return
+	}
+	if err = repo.UpdateLatest(index); nil != err {
+		return
+	}
+	for _, relPath := range reindexed {
+		file := changed[relPath]
+		if nil != repo.lazyIndexMgr {
+			repo.lazyIndexMgr.AddLazyFile(file)
+		}
+		logging.LogInfof("[Lazy Index] reindexed file [%s] with [%d] chunks, new index [%s]", relPath, len(file.Chunks), index.ID)
+	}
+
+	if nil == repo.cloud {
+		return
+	}
+	for _, relPath := range reindexed {
+		file, old := changed[relPath], olds[relPath]
+		if repo.ReadOnlyCloud {
+			// 分块保留在本地，之后切换到可写的云端后再通过同步上传
+			logging.LogInfof("[Lazy Index] cloud is read-only, uploads are disabled, keep file [%s] locally", relPath)
+			continue
+		}
+		if repo.DeferLazyUploads {
+			// 分块保留在本地，由后台上传协程限速上传
+			repo.lazyUploads.add(file)
+			logging.LogInfof("[Lazy Index] defer uploading file [%s]", relPath)
+			continue
+		}
+
+		// 只上传新增的分块，上传失败时保留本地分块，下次同步时再上传
+		var upsertChunkIDs []string
+		for _, chunkID := range file.Chunks {
+			if nil == old || !slices.Contains(old.Chunks, chunkID) {
+				upsertChunkIDs = append(upsertChunkIDs, chunkID)
+			}
+		}
+		if _, err = repo.uploadChunksWithConcurrency(upsertChunkIDs, repo.indexUploadConcurrency(), context); nil != err {
+			return reindexed, fmt.Errorf("upload chunks of file [%s] failed: %s", relPath, err)
+		}
+		if _, err = repo.uploadFiles([]*entity.File{file}, context); nil != err {
+			return reindexed, fmt.Errorf("upload file [%s] failed: %s", relPath, err)
+		}
+		repo.cleanupLazyFileChunks(file)
+	}
+	return
+}
+
+// FindLazyOrphans 遍历数据文件夹，返回匹配懒加载模式但既不在懒加载索引也不在最新索引中的文件（孤儿文件）的相对路径，按路径排序。
+// 孤儿文件通常是异常操作后遗留的，不参与懒加载缓存统计和驱逐，可以通过 ResolveLazyOrphans 收编或者删除。
+func (repo *Repo) FindLazyOrphans() (ret []string, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if repo.lazyClosed.Load() {
+		return nil, ErrLazyLoadingClosed
+	}
+
+	known, err := repo.lazyKnownPaths()
+	if nil != err {
+		return
+	}
+
+	ignoreMatcher := repo.ignoreMatcher()
+	err = filelock.Walk(repo.DataPath, func(path string, d fs.DirEntry, err error) error {
+		if nil != err {
+			return err
+		}
+
+		info, err := d.Info()
+		if nil != err {
+			return err
+		}
+		if ignored, ignoreResult := repo.builtInIgnore(info, path); ignored || nil != ignoreResult {
+			return ignoreResult
+		}
+
+		p := repo.relPath(path)
+		if ignoreMatcher.MatchesPath(p) || !repo.isLazyLoadingFile(p) {
+			return nil
+		}
+		if !known[p] {
+			ret = append(ret, p)
+		}
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+	sort.Strings(ret)
+	return
+}
+
+// lazyKnownPaths 返回懒加载索引和最新索引中记录的所有文件路径，不在其中的懒加载文件即为孤儿文件。调用方需要持有 lock。
+func (repo *Repo) lazyKnownPaths() (ret map[string]bool, err error) {
+	repo.ensureLazyIndexMigrated()
+	ret = map[string]bool{}
+	for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+		ret[file.Path] = true
+	}
+
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			err = nil
+		}
+		return
+	}
+	files, err := repo.getFiles(latest.Files)
+	if nil != err {
+		return
+	}
+	for _, file := range files {
+		ret[file.Path] = true
+	}
+	return
+}
+
+// ResolveLazyOrphans 处理 FindLazyOrphans 找到的孤儿文件。adopt 为 true 时通过 ReindexLazyFile 索引并注册到懒加载索引，
+// 否则从数据文件夹删除。paths 是 FindLazyOrphans 返回的索引路径，不受懒加载根目录影响。已经被索引记录的文件不是孤儿文件，会返回错误，不会被删除。
+func (repo *Repo) ResolveLazyOrphans(paths []string, adopt bool, context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+
+	lock.Lock()
+	known, err := repo.lazyKnownPaths()
+	lock.Unlock()
+	if nil != err {
+		return
+	}
+
+	for _, p := range paths {
+		absPath, relPath := repo.resolveLazyIndexPath(p)
+		if !repo.isLazyLoadingFile(relPath) {
+			return fmt.Errorf("file [%s] is not a lazy loading file", relPath)
+		}
+		if known[relPath] {
+			return fmt.Errorf("file [%s] is not an orphan", relPath)
+		}
+
+		if adopt {
+			if err = repo.ReindexLazyFile(absPath, context); nil != err {
+				return fmt.Errorf("adopt orphan [%s] failed: %s", relPath, err)
+			}
+			logging.LogInfof("[Lazy Load] adopted orphan [%s]", relPath)
+			continue
+		}
+
+		if rmErr := os.Remove(absPath); nil != rmErr && !os.IsNotExist(rmErr) {
+			return fmt.Errorf("remove orphan [%s] failed: %s", relPath, rmErr)
+		}
+		logging.LogInfof("[Lazy Load] removed orphan [%s]", relPath)
+	}
+	return
+}
+
+// indexUploadConcurrency 返回重新索引懒加载文件时上传分块的并发数：repo.MaxIndexUploadConcurrency 大于 0 时不超过它，否则使用云端存储的并发数。
+// 云端存储的并发数是上限，MaxIndexUploadConcurrency 更大时不会提高并发；SyncUpload 始终使用云端存储的并发数。
+func (repo *Repo) indexUploadConcurrency() int {
+	ret := repo.cloud.GetConcurrentReqs()
+	if 0 < repo.MaxIndexUploadConcurrency {
+		ret = min(ret, repo.MaxIndexUploadConcurrency)
+	}
+	return max(ret, 1)
+}
+
+// lazyClock 提供懒加载使用的当前时间（访问时间、截止时间、下载后的文件更新时间等），测试时可以替换为可控的时钟。
+type lazyClock interface {
+	Now() time.Time
+}
+
+// now 返回懒加载使用的当前时间，没有设置时钟时使用系统时间。
+func (repo *Repo) now() time.Time {
+	if nil == repo.clock {
+		return time.Now()
+	}
+	return repo.clock.Now()
+}
+
+// lazySelfTestDir 是懒加载自检使用的保留文件夹，位于仓库临时文件夹下，不会写入数据文件夹。
+const lazySelfTestDir = ".lazy-self-test"
+
+// LazySelfTest 使用一个随机内容的临时文件端到端地检查懒加载流程：分块、上传、清理本地分块、按照按需加载的流程从云端下载并迁出，校验内容后清理本地和云端的临时数据。
+// 该方法不会生成索引，也不会修改数据文件夹。返回的错误中包含失败的阶段。
+func (repo *Repo) LazySelfTest(context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+	if nil == repo.cloud {
+		return errors.New("lazy self test requires cloud storage")
+	}
+	if repo.ReadOnlyCloud {
+		return errors.New("lazy self test requires writable cloud storage, but the cloud is read-only")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	stage := "write"
+	defer func() {
+		if nil != err {
+			err = fmt.Errorf("lazy self test [%s] failed: %s", stage, err)
+			logging.LogErrorf("%s", err)
+		}
+	}()
+
+	testDir := filepath.Join(repo.TempPath, lazySelfTestDir)
+	defer os.RemoveAll(testDir)
+
+	data := make([]byte, 4096)
+	if _, err = rand.Read(data); nil != err {
+		return
+	}
+	relPath := "/" + util.RandHash() + ".dat"
+	absPath := filepath.Join(testDir, "source", filepath.FromSlash(relPath))
+	if err = os.MkdirAll(filepath.Dir(absPath), 0755); nil != err {
+		return
+	}
+	if err = gulu.File.WriteFileSafer(absPath, data, 0644); nil != err {
+		return
+	}
+
+	stage = "chunk"
+	file := entity.NewFile(relPath, int64(len(data)), repo.now().UnixMilli())
+	if err = repo.createLazyFileChunks(file, absPath); nil != err {
+		return
+	}
+	if err = repo.store.PutFile(file); nil != err {
+		return
+	}
+	defer repo.removeLazySelfTestObjects(file)
+
+	stage = "upload"
+	if _, err = repo.uploadChunks(file.Chunks, context); nil != err {
+		return
+	}
+	if _, err = repo.uploadFiles([]*entity.File{file}, context); nil != err {
+		return
+	}
+
+	stage = "evict"
+	for _, chunkID := range file.Chunks {
+		if err = repo.store.Remove(chunkID); nil != err {
+			return
+		}
+	}
+
+	// 与按需加载使用同样的流程下载、迁出并写入文件，只是迁出到临时文件夹
+	stage = "load"
+	checkoutDir := filepath.Join(testDir, "checkout")
+	checkoutPath := filepath.Join(checkoutDir, filepath.FromSlash(relPath))
+	if nil != repo.lazyIndexMgr {
+		defer repo.lazyIndexMgr.clearLocalMtime(relPath)
+	}
+	if err = repo.loadLazyTarget(file, checkoutPath, checkoutDir, context); nil != err {
+		return
+	}
+
+	stage = "verify"
+	checkedOut, err := os.ReadFile(checkoutPath)
+	if nil != err {
+		return
+	}
+	if !bytes.Equal(data, checkedOut) {
+		return errors.New("content mismatch")
+	}
+
+	logging.LogInfof("[Lazy Load] self test passed")
+	return
+}
+
+// removeLazySelfTestObjects 删除懒加载自检在本地存储和云端留下的数据对象。
+// 自检文件内容随机，其分块不会和其他文件共用，因此可以安全删除。
+func (repo *Repo) removeLazySelfTestObjects(file *entity.File) {
+	ids := append([]string{file.ID}, file.Chunks...)
+	for _, id := range ids {
+		if err := repo.store.Remove(id); nil != err {
+			logging.LogWarnf("[Lazy Load] remove self test object [%s] failed: %s", id, err)
+		}
+		for _, c := range append([]cloud.Cloud{repo.cloud}, repo.MirrorClouds...) {
+			if err := c.RemoveObject(cloudObjectKey(id)); nil != err {
+				logging.LogWarnf("[Lazy Load] remove self test cloud object [%s] failed: %s", id, err)
+			}
+		}
+	}
+}
+
+// lazyIndexPath 将数据文件夹下的相对路径转换为与索引一致的格式（以 "/" 开头，正斜杠）
+func lazyIndexPath(p string) string {
+	return path.Clean("/" + filepath.ToSlash(p))
+}
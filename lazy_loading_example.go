@@ -218,14 +218,14 @@ func demonstrateIndexAndUpload(repo *Repo) {
 	fmt.Printf("  总大小: %d 字节\n", index.Size)
 
 	// 分析文件类型
-	files, err := repo.GetFiles(index)
+	files, err := repo.GetFilesClassified(index)
 	if err != nil {
 		log.Fatalf("获取文件列表失败: %v", err)
 	}
 
 	var normalFiles, lazyFiles []string
 	for _, file := range files {
-		if repo.isLazyLoadingFile(file.Path) {
+		if file.IsLazy {
 			lazyFiles = append(lazyFiles, file.Path)
 		} else {
 			normalFiles = append(normalFiles, file.Path)
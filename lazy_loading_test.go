@@ -17,15 +17,32 @@
 package dejavu
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/88250/gulu"
+	"github.com/restic/chunker"
 	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/dejavu/util"
 	"github.com/siyuan-note/encryption"
 	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
 )
 
 const (
@@ -72,6 +89,8 @@ func setupLazyLoadingTest(t *testing.T) (repo *Repo, localCloud *cloud.Local) {
 	if nil != err {
 		t.Fatalf("create repo failed: %s", err)
 	}
+	// 取消等待中的懒加载索引合并写入，避免写入之后的测试数据
+	t.Cleanup(func() { repo.lazyIndexMgr.Close() })
 
 	return repo, localCloud
 }
@@ -311,6 +330,7 @@ func TestLazyLoadFile(t *testing.T) {
 	if nil != err {
 		t.Fatalf("create repo2 failed: %s", err)
 	}
+	t.Cleanup(func() { repo2.lazyIndexMgr.Close() })
 
 	// 从云端下载索引
 	_, _, _, err = repo2.DownloadIndex(index.ID, context)
@@ -416,6 +436,7 @@ func TestLazyLoadFiles(t *testing.T) {
 	if nil != err {
 		t.Fatalf("create repo2 failed: %s", err)
 	}
+	t.Cleanup(func() { repo2.lazyIndexMgr.Close() })
 
 	_, _, _, err = repo2.DownloadIndex(index.ID, context)
 	if nil != err {
@@ -546,3 +567,5337 @@ func TestLazyLoadingWithSync(t *testing.T) {
 
 	t.Logf("Sync test completed successfully")
 }
+
+func TestRenameLazyFile(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+
+	// 可执行文件重命名后重新加载仍然保留权限
+	if err := os.Chmod(filepath.Join(testLazyDataPath, "large-files/big1.dat"), 0755); nil != err {
+		t.Fatalf("chmod failed: %s", err)
+	}
+	index, err := repo.Index("Test rename lazy file", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	_, err = repo.SyncUpload(context)
+	if nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	oldFile := repo.lazyIndexMgr.GetLazyFile("/large-files/big1.dat")
+	if nil == oldFile {
+		t.Fatalf("lazy file [/large-files/big1.dat] should be recorded in lazy index")
+	}
+	if 0755 != os.FileMode(oldFile.Mode).Perm() {
+		t.Fatalf("file mode should be recorded, got [%o]", oldFile.Mode)
+	}
+	repo.lazyIndexMgr.SetLocalMtime(oldFile, oldFile.Updated+1000)
+
+	// 重命名后的路径不匹配懒加载模式
+	if err = repo.RenameLazyFile("large-files/big1.dat", "docs/big1.dat"); nil == err {
+		t.Errorf("should fail when new path is not a lazy loading file")
+	}
+
+	err = repo.RenameLazyFile("large-files/big1.dat", "large-files/renamed.dat")
+	if nil != err {
+		t.Fatalf("rename lazy file failed: %s", err)
+	}
+
+	if gulu.File.IsExist(filepath.Join(testLazyDataPath, "large-files/big1.dat")) {
+		t.Errorf("cached file should not exist under the old name")
+	}
+	content, err := os.ReadFile(filepath.Join(testLazyDataPath, "large-files/renamed.dat"))
+	if nil != err {
+		t.Fatalf("read renamed file failed: %s", err)
+	}
+	if strings.Repeat("A", 1000) != string(content) {
+		t.Errorf("renamed file content mismatch")
+	}
+
+	if nil != repo.lazyIndexMgr.GetLazyFile("/large-files/big1.dat") {
+		t.Errorf("old lazy file record should be removed")
+	}
+	newFile := repo.lazyIndexMgr.GetLazyFile("/large-files/renamed.dat")
+	if nil == newFile {
+		t.Fatalf("new lazy file record should exist")
+	}
+	if strings.Join(oldFile.Chunks, ",") != strings.Join(newFile.Chunks, ",") {
+		t.Errorf("renamed lazy file should preserve chunks")
+	}
+	if oldFile.Mode != newFile.Mode {
+		t.Errorf("renamed lazy file should preserve mode [%o], got [%o]", oldFile.Mode, newFile.Mode)
+	}
+	if mtime := repo.lazyIndexMgr.LocalMtime(newFile); oldFile.Updated+1000 != mtime {
+		t.Errorf("local mtime should move to the new path, got [%d]", mtime)
+	}
+	if originID := repo.lazyIndexMgr.GetOriginIndexID("/large-files/renamed.dat"); index.ID != originID {
+		t.Errorf("origin should move to the new path, expected [%s], got [%s]", index.ID, originID)
+	}
+	if "" != repo.lazyIndexMgr.GetOriginIndexID("/large-files/big1.dat") {
+		t.Errorf("origin of the old path should be removed")
+	}
+
+	// 驱逐后重新加载
+	renamedPath := filepath.Join(testLazyDataPath, "large-files/renamed.dat")
+	if err = os.Remove(renamedPath); nil != err {
+		t.Fatalf("remove renamed file failed: %s", err)
+	}
+	if err = repo.LazyLoadFile(renamedPath, context); nil != err {
+		t.Fatalf("lazy load renamed file failed: %s", err)
+	}
+	info, err := os.Stat(renamedPath)
+	if nil != err {
+		t.Fatalf("stat renamed file failed: %s", err)
+	}
+	if 0755 != info.Mode().Perm() {
+		t.Errorf("reloaded renamed file should keep mode 0755, got [%o]", info.Mode().Perm())
+	}
+}
+
+func TestLazyFileChunkStatus(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	chunks := []string{util.Hash([]byte("chunk0")), util.Hash([]byte("chunk1")), util.Hash([]byte("chunk2"))}
+	file := entity.NewFile("/large-files/partial.dat", 18, 1700000000000)
+	file.Chunks = chunks
+	repo.lazyIndexMgr.AddLazyFile(file)
+
+	// 预置第一个和最后一个分块
+	for _, i := range []int{0, 2} {
+		if err := repo.store.PutChunk(&entity.Chunk{ID: chunks[i], Data: []byte("chunk" + strconv.Itoa(i))}); nil != err {
+			t.Fatalf("put chunk failed: %s", err)
+		}
+	}
+
+	present, missing, err := repo.LazyFileChunkStatus("large-files/partial.dat")
+	if nil != err {
+		t.Fatalf("get lazy file chunk status failed: %s", err)
+	}
+	if 2 != len(present) || chunks[0] != present[0] || chunks[2] != present[1] {
+		t.Errorf("unexpected present chunks: %v", present)
+	}
+	if 1 != len(missing) || chunks[1] != missing[0] {
+		t.Errorf("unexpected missing chunks: %v", missing)
+	}
+
+	if _, _, err = repo.LazyFileChunkStatus("docs/readme.txt"); nil == err {
+		t.Errorf("should fail for a non-lazy file")
+	}
+}
+
+// setupLazyLoadingSecondDevice 在第一台设备上索引并上传，然后清空数据文件夹，模拟第二台设备下载索引并检出（跳过懒加载文件）
+func setupLazyLoadingSecondDevice(t *testing.T, repo *Repo, localCloud *cloud.Local) (repo2 *Repo) {
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+
+	index, err := repo.Index("Test second device", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	_, err = repo.SyncUpload(context)
+	if nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	os.RemoveAll(testLazyDataPath)
+	os.MkdirAll(testLazyDataPath, 0755)
+
+	aesKey, _ := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	repo2, err = NewRepoWithLazyLoading(testLazyDataPath, testLazyRepoPath, testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, []string{}, repo.LazyLoadingPatterns, localCloud)
+	if nil != err {
+		t.Fatalf("create repo2 failed: %s", err)
+	}
+	t.Cleanup(func() { repo2.lazyIndexMgr.Close() })
+
+	_, _, _, err = repo2.DownloadIndex(index.ID, context)
+	if nil != err {
+		t.Fatalf("download index failed: %s", err)
+	}
+
+	_, _, err = repo2.Checkout(index.ID, context)
+	if nil != err {
+		t.Fatalf("checkout failed: %s", err)
+	}
+	return
+}
+
+func TestLazyLoadFileWithTempDir(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	repo2.LazyLoadingTempDir = filepath.Join(testLazyTempPath, "lazy-download")
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	fullPath := filepath.Join(testLazyDataPath, "large-files/big2.dat")
+	if err := repo2.LazyLoadFile(fullPath, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+
+	content, err := os.ReadFile(fullPath)
+	if nil != err {
+		t.Fatalf("read lazy loaded file failed: %s", err)
+	}
+	if strings.Repeat("B", 2000) != string(content) {
+		t.Errorf("lazy loaded file content mismatch")
+	}
+
+	entries, err := os.ReadDir(repo2.LazyLoadingTempDir)
+	if nil != err {
+		t.Fatalf("read temp dir failed: %s", err)
+	}
+	if 0 != len(entries) {
+		t.Errorf("temp dir should be empty after download, got [%d] entries", len(entries))
+	}
+}
+
+func TestLazyStatusBatch(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo2.LazyLoadFile(filepath.Join(testLazyDataPath, "video.mp4"), context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+
+	paths := []string{
+		"/docs/readme.txt",
+		"video.mp4",
+		"/large-files/big1.dat",
+		"large-files/nonexistent.dat",
+		"/cache/subdir/cached_file.txt",
+	}
+	statuses, err := repo2.LazyStatusBatch(paths)
+	if nil != err {
+		t.Fatalf("lazy status batch failed: %s", err)
+	}
+	if len(paths) != len(statuses) {
+		t.Fatalf("expected %d statuses, got %d", len(paths), len(statuses))
+	}
+
+	for _, p := range paths {
+		relPath := lazyIndexPath(p)
+		status := statuses[p]
+		if repo2.isLazyLoadingFile(relPath) != status.Lazy {
+			t.Errorf("path [%s] lazy mismatch", p)
+		}
+		recorded := repo2.lazyIndexMgr.GetLazyFile(relPath)
+		if (nil != recorded) != status.Recorded {
+			t.Errorf("path [%s] recorded mismatch", p)
+		}
+		if status.Lazy && gulu.File.IsExist(repo2.absPath(relPath)) != status.Cached {
+			t.Errorf("path [%s] cached mismatch", p)
+		}
+	}
+
+	if !statuses["video.mp4"].Cached || statuses["/large-files/big1.dat"].Cached {
+		t.Errorf("only the loaded lazy file should be cached")
+	}
+	if statuses["/docs/readme.txt"].Lazy {
+		t.Errorf("normal file should not be lazy")
+	}
+}
+
+// writeHugeLazyFile 构造一个会被切分为多个分块的懒加载文件 /large-files/huge.dat
+func writeHugeLazyFile(t *testing.T) (data []byte) {
+	data = make([]byte, 3*1024*1024)
+	rand.New(rand.NewSource(379)).Read(data)
+	if err := gulu.File.WriteFileSafer(filepath.Join(testLazyDataPath, "large-files/huge.dat"), data, 0644); nil != err {
+		t.Fatalf("write huge file failed: %s", err)
+	}
+	return
+}
+
+func TestLazyFileChunksContentAddressed(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	data := writeHugeLazyFile(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test content addressed chunks", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+
+	var huge *entity.File
+	for _, file := range files {
+		if "/large-files/huge.dat" == file.Path {
+			huge = file
+		}
+	}
+	if nil == huge || 2 > len(huge.Chunks) {
+		t.Fatalf("huge lazy file should be split into multiple chunks")
+	}
+
+	// 迁出懒加载文件时直接拼接分块数据，这要求分块是内容寻址的：分块数据的哈希就是分块 ID
+	var assembled []byte
+	for _, chunkID := range huge.Chunks {
+		chunk, getErr := repo.store.GetChunk(chunkID)
+		if nil != getErr {
+			t.Fatalf("get chunk [%s] failed: %s", chunkID, getErr)
+		}
+		if chunkID != util.Hash(chunk.Data) {
+			t.Errorf("chunk [%s] is not content addressed", chunkID)
+		}
+		assembled = append(assembled, chunk.Data...)
+	}
+	if !bytes.Equal(data, assembled) {
+		t.Errorf("assembled chunks mismatch original content")
+	}
+}
+
+func TestLazyIndexOfflineThenUpload(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+
+	// 索引只在本地记录懒加载文件的元数据和分块，不访问云端，所以离线时也可以完成
+	repo.cloud = nil
+	index, err := repo.Index("Test offline index", false, context)
+	if nil != err {
+		t.Fatalf("create index offline failed: %s", err)
+	}
+
+	// 云端可用后再统一上传
+	repo.cloud = localCloud
+	_, err = repo.SyncUpload(context)
+	if nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+	for _, file := range files {
+		if !repo.isLazyLoadingFile(file.Path) {
+			continue
+		}
+		for _, chunkID := range file.Chunks {
+			if _, _, dlErr := repo.downloadCloudChunk(chunkID, 1, 1, context); nil != dlErr {
+				t.Errorf("lazy file [%s] chunk [%s] should be uploaded: %s", file.Path, chunkID, dlErr)
+			}
+		}
+	}
+}
+
+// failingUploadCloud 用于模拟上传分块失败的云端存储
+type failingUploadCloud struct {
+	*cloud.Local
+	failUploads atomic.Bool // 上传失败后仍在运行的上传协程会并发读取
+}
+
+func (c *failingUploadCloud) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	if c.failUploads.Load() && strings.HasPrefix(filePath, "objects/") {
+		return 0, errors.New("simulated upload failure")
+	}
+	return c.Local.UploadObject(filePath, overwrite)
+}
+
+func TestLazyChunksKeptUntilUploadSucceeds(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	failingCloud := &failingUploadCloud{Local: localCloud}
+	failingCloud.failUploads.Store(true)
+	repo.cloud = failingCloud
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test upload retry", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	if _, err := repo.SyncUpload(context); nil == err {
+		t.Fatalf("upload should fail")
+	}
+
+	// 上传失败时懒加载文件的本地分块不会被清理，下次上传时会重新计算待上传分块并重试
+	_, missing, err := repo.LazyFileChunkStatus("large-files/big1.dat")
+	if nil != err {
+		t.Fatalf("get lazy file chunk status failed: %s", err)
+	}
+	if 0 != len(missing) {
+		t.Fatalf("lazy chunks should be kept locally after upload failure, missing [%d]", len(missing))
+	}
+
+	failingCloud.failUploads.Store(false)
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("retry upload failed: %s", err)
+	}
+
+	file := repo.lazyIndexMgr.GetLazyFile("/large-files/big1.dat")
+	if nil == file {
+		t.Fatalf("lazy file should be recorded after upload")
+	}
+	for _, chunkID := range file.Chunks {
+		if _, _, dlErr := repo.downloadCloudChunk(chunkID, 1, 1, context); nil != dlErr {
+			t.Errorf("chunk [%s] should be uploaded after retry: %s", chunkID, dlErr)
+		}
+	}
+}
+
+func TestLazyIndexManagerNotWritable(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+
+	patterns := []string{"large-files/*"}
+	if err := os.MkdirAll(testLazyRepoPath, 0755); nil != err {
+		t.Fatalf("create repo dir failed: %s", err)
+	}
+	mgr := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, patterns)
+	file := entity.NewFile("/large-files/big1.dat", 1000, 1700000000000)
+	file.Chunks = []string{util.Hash([]byte("big1"))}
+	mgr.AddLazyFile(file)
+
+	// 仓库路径的上级是普通文件，无法创建目录或写入
+	blocker := filepath.Join(testLazyTempPath, "blocker")
+	if err := os.MkdirAll(testLazyTempPath, 0755); nil != err {
+		t.Fatalf("create temp dir failed: %s", err)
+	}
+	if err := gulu.File.WriteFileSafer(blocker, []byte("blocker"), 0644); nil != err {
+		t.Fatalf("write blocker file failed: %s", err)
+	}
+	readOnlyRepoPath := filepath.Join(blocker, "repo")
+
+	// 无法写入时以空索引初始化，只保存在内存中
+	emptyMgr := NewLazyIndexManager(readOnlyRepoPath, testLazyDataPath, patterns)
+	if count, _ := emptyMgr.GetStats(); 0 != count {
+		t.Errorf("expected empty lazy index, got [%d] files", count)
+	}
+	emptyMgr.AddLazyFile(file)
+	if nil == emptyMgr.GetLazyFile(file.Path) {
+		t.Errorf("lazy file should be kept in memory")
+	}
+
+	// 已加载的索引仍然可读，写入时返回明确的错误
+	mgr.repoPath = readOnlyRepoPath
+	if nil == mgr.GetLazyFile(file.Path) {
+		t.Errorf("lazy file should still be readable")
+	}
+	if err := mgr.save(); !errors.Is(err, ErrLazyIndexNotWritable) {
+		t.Errorf("expected ErrLazyIndexNotWritable, got %v", err)
+	}
+}
+
+// countingDownloadCloud 用于记录从云端下载的对象，懒加载并发下载分块，记录需要加锁
+type countingDownloadCloud struct {
+	*cloud.Local
+	mutex     sync.Mutex
+	downloads []string
+}
+
+func (c *countingDownloadCloud) DownloadObject(filePath string) (data []byte, err error) {
+	c.mutex.Lock()
+	c.downloads = append(c.downloads, filePath)
+	c.mutex.Unlock()
+	return c.Local.DownloadObject(filePath)
+}
+
+// downloaded 返回已经下载的对象
+func (c *countingDownloadCloud) downloaded() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return slices.Clone(c.downloads)
+}
+
+func TestLazyLoadFileRepairsCorruptedChunk(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	data := writeHugeLazyFile(t)
+	hugePath := filepath.Join(testLazyDataPath, "large-files/huge.dat")
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo2.LazyLoadFile(hugePath, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+
+	file, err := repo2.getLazyFile("/large-files/huge.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	if 2 > len(file.Chunks) {
+		t.Fatalf("huge lazy file should be split into multiple chunks")
+	}
+
+	// 损坏一个本地分块并删除已下载的文件
+	corrupted := file.Chunks[1]
+	if err = repo2.store.Remove(corrupted); nil != err {
+		t.Fatalf("remove chunk failed: %s", err)
+	}
+	if err = repo2.store.PutChunk(&entity.Chunk{ID: corrupted, Data: []byte("corrupted")}); nil != err {
+		t.Fatalf("put corrupted chunk failed: %s", err)
+	}
+	os.Remove(hugePath)
+
+	countingCloud := &countingDownloadCloud{Local: localCloud}
+	repo2.cloud = countingCloud
+	repo2.LazyVerifyChunks = true
+	if err = repo2.LazyLoadFile(hugePath, context); nil != err {
+		t.Fatalf("lazy load file again failed: %s", err)
+	}
+
+	expected := path.Join("objects", corrupted[:2], corrupted[2:])
+	if downloads := countingCloud.downloaded(); 1 != len(downloads) || expected != downloads[0] {
+		t.Errorf("only the corrupted chunk should be downloaded again, got %v", downloads)
+	}
+
+	content, err := os.ReadFile(hugePath)
+	if nil != err {
+		t.Fatalf("read lazy loaded file failed: %s", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("lazy loaded file content mismatch")
+	}
+}
+
+func TestGetLazyLoadingPatterns(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	expected := []string{"large-files/*", "*.mp4", "cache/**", "backup/*.backup"}
+	for _, patterns := range [][]string{repo.GetLazyLoadingPatterns(), repo.lazyIndexMgr.Patterns()} {
+		if strings.Join(expected, ",") != strings.Join(patterns, ",") {
+			t.Errorf("expected patterns %v, got %v", expected, patterns)
+		}
+
+		patterns[0] = "docs/*"
+		if repo.isLazyLoadingFile("/docs/readme.txt") || repo.lazyIndexMgr.isLazyLoadingFile("/docs/readme.txt") {
+			t.Errorf("mutating returned patterns should not affect matching")
+		}
+		if !repo.isLazyLoadingFile("/large-files/big1.dat") || !repo.lazyIndexMgr.isLazyLoadingFile("/large-files/big1.dat") {
+			t.Errorf("mutating returned patterns should not affect matching")
+		}
+	}
+}
+
+func TestSetLazyLoadingPatterns(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test set lazy loading patterns", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	if err := repo.SetLazyLoadingPatterns([]string{"docs/*", " "}); nil == err {
+		t.Errorf("should fail with an empty pattern")
+	}
+	if repo.isLazyLoadingFile("/docs/readme.txt") {
+		t.Errorf("invalid patterns should not be applied")
+	}
+
+	// 新增 docs/*，移除 *.mp4
+	if err := repo.SetLazyLoadingPatterns([]string{"large-files/*", "cache/**", "backup/*.backup", "docs/*"}); nil != err {
+		t.Fatalf("set lazy loading patterns failed: %s", err)
+	}
+
+	if !repo.isLazyLoadingFile("/docs/readme.txt") || !repo.lazyIndexMgr.isLazyLoadingFile("/docs/readme.txt") {
+		t.Errorf("previously normal file should be lazy now")
+	}
+	if nil == repo.lazyIndexMgr.GetLazyFile("/docs/readme.txt") {
+		t.Errorf("newly matched file should be added to lazy index")
+	}
+	if repo.isLazyLoadingFile("/video.mp4") || nil != repo.lazyIndexMgr.GetLazyFile("/video.mp4") {
+		t.Errorf("file no longer matched should not be lazy")
+	}
+}
+
+func TestLazyMethodsWithLazyLoadingDisabled(t *testing.T) {
+	clearLazyTestdata(t)
+	createLazyTestData(t)
+	defer clearLazyTestdata(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("init aes key failed: %s", err)
+	}
+	localCloud := cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{RepoPath: testLazyRepoPath, Local: &cloud.ConfLocal{Endpoint: testLazyCloudPath}}})
+	repo, err := NewRepo(testLazyDataPath, testLazyRepoPath, testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, nil, localCloud)
+	if nil != err {
+		t.Fatalf("create repo failed: %s", err)
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err = repo.Index("Test lazy loading disabled", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	lazyFilePath := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if err = repo.LazyLoadFile(lazyFilePath, context); !errors.Is(err, ErrLazyLoadingDisabled) {
+		t.Errorf("LazyLoadFile: expected ErrLazyLoadingDisabled, got %v", err)
+	}
+	if err = repo.LazyLoadFiles([]string{lazyFilePath}, context); !errors.Is(err, ErrLazyLoadingDisabled) {
+		t.Errorf("LazyLoadFiles: expected ErrLazyLoadingDisabled, got %v", err)
+	}
+	if _, err = repo.GetLazyLoadingFiles(); !errors.Is(err, ErrLazyLoadingDisabled) {
+		t.Errorf("GetLazyLoadingFiles: expected ErrLazyLoadingDisabled, got %v", err)
+	}
+	if err = repo.RenameLazyFile("large-files/big1.dat", "large-files/big9.dat"); !errors.Is(err, ErrLazyLoadingDisabled) {
+		t.Errorf("RenameLazyFile: expected ErrLazyLoadingDisabled, got %v", err)
+	}
+	if _, _, err = repo.LazyFileChunkStatus("large-files/big1.dat"); !errors.Is(err, ErrLazyLoadingDisabled) {
+		t.Errorf("LazyFileChunkStatus: expected ErrLazyLoadingDisabled, got %v", err)
+	}
+
+	statuses, err := repo.LazyStatusBatch([]string{"large-files/big1.dat"})
+	if nil != err || statuses["large-files/big1.dat"].Lazy {
+		t.Errorf("LazyStatusBatch: no file should be lazy when lazy loading is disabled")
+	}
+	if 0 != len(repo.GetLazyLoadingPatterns()) {
+		t.Errorf("GetLazyLoadingPatterns: expected no patterns")
+	}
+	if !gulu.File.IsExist(lazyFilePath) {
+		t.Errorf("file should not be touched when lazy loading is disabled")
+	}
+}
+
+func TestRepoCloseLazyLoading(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+
+	running := atomic.Int32{}
+	var loadErr error
+	loadDone := make(chan struct{})
+	running.Add(1)
+	go func() {
+		defer close(loadDone)
+		defer running.Add(-1)
+		loadErr = repo2.LazyLoadFile(filepath.Join(testLazyDataPath, "large-files/big1.dat"), context)
+	}()
+
+	if err := repo2.Close(); nil != err {
+		t.Fatalf("close failed: %s", err)
+	}
+
+	select {
+	case <-loadDone:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("in-flight lazy load should finish after close")
+	}
+	if 0 != running.Load() {
+		t.Errorf("lazy load goroutine leaked")
+	}
+	if nil != loadErr && !errors.Is(loadErr, ErrLazyLoadingClosed) {
+		t.Errorf("unexpected lazy load error: %s", loadErr)
+	}
+
+	if err := repo2.LazyLoadFile(filepath.Join(testLazyDataPath, "video.mp4"), context); !errors.Is(err, ErrLazyLoadingClosed) {
+		t.Errorf("expected ErrLazyLoadingClosed after close, got %v", err)
+	}
+
+	// 懒加载索引已写入磁盘
+	reloaded := NewLazyIndexManager(repo2.Path, repo2.DataPath, repo2.LazyLoadingPatterns)
+	if nil == reloaded.GetLazyFile("/large-files/big1.dat") {
+		t.Errorf("lazy index should be flushed to disk on close")
+	}
+}
+
+func TestLazyLoadFilePreemptsPrefetch(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	logger := &recordingAccessLogger{events: make(chan *LazyAccessEvent, 8)}
+	repo2.LazyAccessLogger = logger
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	queue := &repo2.lazyQueue
+
+	// 持有仓库锁，排队中的任务都不会完成
+	lock.Lock()
+	prefetchPaths := []string{"large-files/big1.dat", "cache/cached_data.json", "large-files/big2.dat"}
+	if err := repo2.PrefetchLazyFiles(prefetchPaths, context); nil != err {
+		lock.Unlock()
+		t.Fatalf("prefetch failed: %s", err)
+	}
+
+	// 交互式加载排队中的后台任务，该任务被提升并复用
+	big2Path := filepath.Join(testLazyDataPath, "large-files/big2.dat")
+	job := queue.enqueue(repo2, big2Path, "/large-files/big2.dat", context, true)
+	queue.mutex.Lock()
+	reused := queue.jobs["/large-files/big2.dat"] == job && 3 == len(queue.jobs) && 1 == len(queue.interactive) && !slices.Contains(queue.background, job)
+	queue.mutex.Unlock()
+	lock.Unlock()
+	if !reused {
+		t.Fatalf("queued prefetch job should be promoted and reused")
+	}
+
+	<-job.done
+	if nil != job.err {
+		t.Fatalf("lazy load file failed: %s", job.err)
+	}
+
+	// 工作协程按执行顺序记录访问事件，交互式加载先于排在它前面的后台预取完成
+	var loaded []string
+	for range prefetchPaths {
+		select {
+		case event := <-logger.events:
+			loaded = append(loaded, event.Path)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("wait for prefetch timeout, loaded %v", loaded)
+		}
+	}
+	if slices.Index(loaded, "/large-files/big2.dat") > slices.Index(loaded, "/cache/cached_data.json") {
+		t.Errorf("interactive load should complete before queued prefetch, got %v", loaded)
+	}
+	for _, p := range prefetchPaths {
+		if !gulu.File.IsExist(filepath.Join(testLazyDataPath, p)) {
+			t.Errorf("prefetched file [%s] should exist", p)
+		}
+	}
+}
+
+func TestIndexLogIncludesLazyFiles(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test index log with lazy files", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	// 索引不区分懒加载文件，懒加载文件和普通文件一样记录在 index.Files 中，这样其他设备同步时仍然可以看到完整的文件列表
+	log, err := repo.getLog(index, true)
+	if nil != err {
+		t.Fatalf("get log failed: %s", err)
+	}
+	if index.Count != len(log.Files) {
+		t.Errorf("expected %d files in log, got %d", index.Count, len(log.Files))
+	}
+
+	lazyCount := 0
+	for _, file := range log.Files {
+		if repo.isLazyLoadingFile(file.Path) {
+			lazyCount++
+		}
+	}
+	if 6 != lazyCount {
+		t.Errorf("expected 6 lazy files in log, got %d", lazyCount)
+	}
+}
+
+type recordingAccessLogger struct {
+	events chan *LazyAccessEvent
+}
+
+func (l *recordingAccessLogger) LogLazyAccess(event *LazyAccessEvent) {
+	l.events <- event
+}
+
+func TestLazyAccessLogger(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	logger := &recordingAccessLogger{events: make(chan *LazyAccessEvent, 8)}
+	repo2.LazyAccessLogger = logger
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	for _, p := range []string{"large-files/big1.dat", "large-files/big2.dat"} {
+		if err := repo2.LazyLoadFile(filepath.Join(testLazyDataPath, p), context); nil != err {
+			t.Fatalf("lazy load file [%s] failed: %s", p, err)
+		}
+	}
+	if err := repo2.LazyLoadFile(filepath.Join(testLazyDataPath, "docs/readme.txt"), context); nil == err {
+		t.Fatalf("lazy load non-lazy file should fail")
+	}
+
+	var events []*LazyAccessEvent
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-logger.events:
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 3 access events, got %d", len(events))
+		}
+	}
+	select {
+	case event := <-logger.events:
+		t.Fatalf("unexpected access event for [%s]", event.Path)
+	default:
+	}
+
+	successes := map[string]*LazyAccessEvent{}
+	for _, event := range events {
+		if 0 == event.Time {
+			t.Errorf("access event [%s] missing time", event.Path)
+		}
+		if !event.Success {
+			if "/docs/readme.txt" != event.Path || nil == event.Err {
+				t.Errorf("unexpected failed access event [%s]: %v", event.Path, event.Err)
+			}
+			continue
+		}
+		successes[event.Path] = event
+	}
+	if 2 != len(successes) {
+		t.Fatalf("expected 2 successful access events, got %d", len(successes))
+	}
+	for p, size := range map[string]int64{"/large-files/big1.dat": 1000, "/large-files/big2.dat": 2000} {
+		if event := successes[p]; nil == event || size != event.Size {
+			t.Errorf("access event for [%s] mismatch: %+v", p, event)
+		}
+	}
+}
+
+func TestCloudObjectKeyRoundTrip(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	data := writeHugeLazyFile(t)
+	index, err := repo.Index("test", false, context)
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+	var file *entity.File
+	for _, f := range files {
+		if "/large-files/huge.dat" == f.Path {
+			file = f
+			break
+		}
+	}
+	if nil == file || 2 > len(file.Chunks) {
+		t.Fatalf("huge file should have multiple chunks")
+	}
+
+	if _, err = repo.uploadChunks(file.Chunks, context); nil != err {
+		t.Fatalf("upload chunks failed: %s", err)
+	}
+
+	var downloaded []byte
+	for i, chunkID := range file.Chunks {
+		_, chunk, dlErr := repo.downloadCloudChunk(strings.ToUpper(chunkID)+"/", i+1, len(file.Chunks), context)
+		if nil != dlErr {
+			t.Fatalf("download chunk [%s] failed: %s", chunkID, dlErr)
+		}
+		// 本地存储和云端使用同一个规则计算对象位置，上传时读取的本地文件就是存储写入的文件
+		if _, absPath := repo.store.AbsPath(strings.ToUpper(chunkID)); filepath.Join(repo.store.Path, filepath.FromSlash(cloudObjectKey(chunkID))) != absPath {
+			t.Fatalf("local path [%s] of chunk [%s] does not match its cloud key", absPath, chunkID)
+		}
+		local, getErr := repo.store.GetChunk(strings.ToUpper(chunkID))
+		if nil != getErr {
+			t.Fatalf("get local chunk [%s] failed: %s", chunkID, getErr)
+		}
+		if !bytes.Equal(local.Data, chunk.Data) {
+			t.Fatalf("chunk [%s] downloaded data mismatch", chunkID)
+		}
+		downloaded = append(downloaded, chunk.Data...)
+	}
+	if !bytes.Equal(data, downloaded) {
+		t.Errorf("downloaded chunks do not reassemble the uploaded file")
+	}
+}
+
+func TestLazyIndexManagerMerge(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+
+	for _, dir := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join(testLazyRepoPath, dir), 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+		}
+	}
+
+	patterns := []string{"large-files/*"}
+	mgrA := NewLazyIndexManager(filepath.Join(testLazyRepoPath, "a"), testLazyDataPath, patterns)
+	mgrB := NewLazyIndexManager(filepath.Join(testLazyRepoPath, "b"), testLazyDataPath, patterns)
+
+	onlyA := entity.NewFile("/large-files/a.dat", 1, 1000)
+	onlyA.Chunks = []string{"a"}
+	onlyB := entity.NewFile("/large-files/b.dat", 1, 1000)
+	onlyB.Chunks = []string{"b"}
+	sharedOld := entity.NewFile("/large-files/shared.dat", 1, 1000)
+	sharedOld.Chunks = []string{"old"}
+	sharedNew := entity.NewFile("/large-files/shared.dat", 2, 2000)
+	sharedNew.Chunks = []string{"new"}
+
+	mgrA.AddLazyFile(onlyA)
+	mgrA.AddLazyFile(sharedNew)
+	mgrB.AddLazyFile(onlyB)
+	mgrB.AddLazyFile(sharedOld)
+
+	added, updated := mgrB.Merge(mgrA)
+	if 1 != added || 1 != updated {
+		t.Fatalf("merge A into B expected +1 ~1, got +%d ~%d", added, updated)
+	}
+	added, updated = mgrA.Merge(mgrB)
+	if 1 != added || 0 != updated {
+		t.Fatalf("merge B into A expected +1 ~0, got +%d ~%d", added, updated)
+	}
+
+	for _, mgr := range []*LazyIndexManager{mgrA, mgrB} {
+		if 3 != len(mgr.GetLazyFiles()) {
+			t.Fatalf("merged index should contain 3 files, got %d", len(mgr.GetLazyFiles()))
+		}
+		if shared := mgr.GetLazyFile("/large-files/shared.dat"); nil == shared || sharedNew.ID != shared.ID {
+			t.Errorf("merged index should keep the newer shared file")
+		}
+	}
+
+	if err := mgrB.Flush(); nil != err {
+		t.Fatalf("flush failed: %s", err)
+	}
+	reloaded := NewLazyIndexManager(filepath.Join(testLazyRepoPath, "b"), testLazyDataPath, patterns)
+	if 3 != len(reloaded.GetLazyFiles()) {
+		t.Errorf("merged index should be persisted, got %d files", len(reloaded.GetLazyFiles()))
+	}
+}
+
+func TestMirrorCloudFailover(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	mirror := cloud.NewLocal(&cloud.BaseCloud{
+		Conf: &cloud.Conf{
+			RepoPath: testLazyRepoPath,
+			Local: &cloud.ConfLocal{
+				Endpoint: filepath.Join(testLazyCloudPath, "mirror"),
+			},
+		},
+	})
+	repo.MirrorClouds = []cloud.Cloud{mirror}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("test", false, context); nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	if _, err := repo.SyncUpload(context); nil != err {
+		t.Fatalf("sync upload failed: %s", err)
+	}
+
+	file, err := repo.getLazyFile("/large-files/big1.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	chunkID := file.Chunks[0]
+	key := cloudObjectKey(chunkID)
+	if _, err = mirror.DownloadObject(key); nil != err {
+		t.Fatalf("chunk should be uploaded to mirror: %s", err)
+	}
+
+	if err = localCloud.RemoveObject(key); nil != err {
+		t.Fatalf("remove chunk from primary failed: %s", err)
+	}
+	if _, err = localCloud.DownloadObject(key); nil == err {
+		t.Fatalf("chunk should be missing from primary")
+	}
+
+	_, chunk, err := repo.downloadCloudChunk(chunkID, 1, 1, context)
+	if nil != err {
+		t.Fatalf("download chunk should fail over to mirror: %s", err)
+	}
+	if strings.Repeat("A", 1000) != string(chunk.Data) {
+		t.Errorf("chunk downloaded from mirror mismatch")
+	}
+
+	repo.MirrorClouds = nil
+	if _, _, err = repo.downloadCloudChunk(chunkID, 1, 1, context); nil == err {
+		t.Errorf("download chunk without mirror should fail")
+	}
+}
+
+func TestLazyIndexManagerWithName(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+
+	if err := os.MkdirAll(testLazyRepoPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+	}
+
+	patterns := []string{"large-files/*"}
+	mgrA := NewLazyIndexManagerWithName(testLazyRepoPath, testLazyDataPath, "lazy-index-a.json", patterns)
+	mgrB := NewLazyIndexManagerWithName(testLazyRepoPath, testLazyDataPath, "lazy-index-b.json", patterns)
+
+	fileA := entity.NewFile("/large-files/a.dat", 1, 1000)
+	fileA.Chunks = []string{"a"}
+	fileB := entity.NewFile("/large-files/b.dat", 1, 1000)
+	fileB.Chunks = []string{"b"}
+	mgrA.AddLazyFile(fileA)
+	mgrB.AddLazyFile(fileB)
+	for _, mgr := range []*LazyIndexManager{mgrA, mgrB} {
+		if err := mgr.Flush(); nil != err {
+			t.Fatalf("flush failed: %s", err)
+		}
+	}
+
+	reloadedA := NewLazyIndexManagerWithName(testLazyRepoPath, testLazyDataPath, "lazy-index-a.json", patterns)
+	reloadedB := NewLazyIndexManagerWithName(testLazyRepoPath, testLazyDataPath, "lazy-index-b.json", patterns)
+	if files := reloadedA.GetLazyFiles(); 1 != len(files) || "/large-files/a.dat" != files[0].Path {
+		t.Errorf("lazy index a should only contain a.dat")
+	}
+	if files := reloadedB.GetLazyFiles(); 1 != len(files) || "/large-files/b.dat" != files[0].Path {
+		t.Errorf("lazy index b should only contain b.dat")
+	}
+	if gulu.File.IsExist(filepath.Join(testLazyRepoPath, DefaultLazyIndexName)) {
+		t.Errorf("default lazy index should not be written")
+	}
+
+	repo, _ := setupLazyLoadingTest(t)
+	if err := repo.SetLazyIndexName("../lazy-index.json"); nil == err {
+		t.Errorf("set lazy index name with path should fail")
+	}
+	if err := repo.SetLazyIndexName("lazy-index-a.json"); nil != err {
+		t.Fatalf("set lazy index name failed: %s", err)
+	}
+}
+
+func TestLazyIndexUpdateFromCloudIndexRetriable(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+
+	if err := os.MkdirAll(testLazyRepoPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+	}
+
+	mgr := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, []string{"large-files/*"})
+	cloudIndex := &entity.Index{ID: "cloud-index-1"}
+	file := entity.NewFile("/large-files/a.dat", 1, 1000)
+	file.Chunks = []string{"a"}
+
+	// 同步时获取云端文件失败不会调用 UpdateFromCloudIndex，因此 lastCloudID 不变，下次同步会再次更新
+	if err := mgr.UpdateFromCloudIndex(cloudIndex, []*entity.File{file}); nil != err {
+		t.Fatalf("update from cloud index failed: %s", err)
+	}
+	if nil == mgr.GetLazyFile("/large-files/a.dat") {
+		t.Fatalf("lazy file should be added from cloud index")
+	}
+
+	other := entity.NewFile("/large-files/b.dat", 1, 1000)
+	other.Chunks = []string{"b"}
+	if err := mgr.UpdateFromCloudIndex(cloudIndex, []*entity.File{other}); nil != err {
+		t.Fatalf("update from cloud index failed: %s", err)
+	}
+	if nil != mgr.GetLazyFile("/large-files/b.dat") {
+		t.Errorf("the same cloud index should only be applied once")
+	}
+}
+
+func TestLazyLoadByFileID(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	file, err := repo2.getLazyFile("/large-files/big2.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err = repo2.LazyLoadByFileID(file.ID, context); nil != err {
+		t.Fatalf("lazy load by file id failed: %s", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(testLazyDataPath, "large-files/big2.dat"))
+	if nil != err {
+		t.Fatalf("read lazy loaded file failed: %s", err)
+	}
+	if strings.Repeat("B", 2000) != string(content) {
+		t.Errorf("lazy loaded file content mismatch")
+	}
+	if gulu.File.IsExist(filepath.Join(testLazyDataPath, "large-files/big1.dat")) {
+		t.Errorf("only the requested file should be loaded")
+	}
+
+	if err = repo2.LazyLoadByFileID("x", context); nil == err || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("lazy load by unknown file id should return not found, got: %v", err)
+	}
+}
+
+func TestPrefetchLazyFilesBudget(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	repo2.LazyPrefetchMaxBytes = 2500
+	logger := &recordingAccessLogger{events: make(chan *LazyAccessEvent, 8)}
+	repo2.LazyAccessLogger = logger
+	defer repo2.Close()
+
+	waitLoaded := func(p string) {
+		select {
+		case event := <-logger.events:
+			if p != event.Path || !event.Success {
+				t.Fatalf("expected [%s] to be prefetched, got %+v", p, event)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("wait for prefetching [%s] timeout", p)
+		}
+	}
+	waitPaused := func(n int) {
+		queue := &repo2.lazyQueue
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			queue.mutex.Lock()
+			paused := len(queue.paused)
+			queue.mutex.Unlock()
+			if n == paused {
+				return
+			}
+		}
+		t.Fatalf("expected [%d] paused prefetch jobs", n)
+	}
+
+	// big2.dat 超出上限被暂停，后面的 video.mp4 不受影响
+	big2 := filepath.Join(testLazyDataPath, "large-files/big2.dat")
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo2.PrefetchLazyFiles([]string{"large-files/big1.dat", "large-files/big2.dat", "video.mp4"}, context); nil != err {
+		t.Fatalf("prefetch lazy files failed: %s", err)
+	}
+	waitLoaded("/large-files/big1.dat")
+	waitLoaded("/video.mp4")
+	waitPaused(1)
+	if gulu.File.IsExist(big2) {
+		t.Fatalf("big2.dat should not be prefetched beyond the budget")
+	}
+	if size := repo2.localLazyFilesSize(); size > repo2.LazyPrefetchMaxBytes {
+		t.Fatalf("local lazy files size [%d] exceeds the budget", size)
+	}
+
+	// 驱逐本地懒加载文件后预取自动恢复
+	if _, err := repo2.EvictLazyFilesToSize(0); nil != err {
+		t.Fatalf("evict to size failed: %s", err)
+	}
+	waitLoaded("/large-files/big2.dat")
+	waitPaused(0)
+
+	// 调整上限后预取自动恢复
+	repo2.SetLazyPrefetchMaxBytes(1)
+	if err := repo2.PrefetchLazyFiles([]string{"cache/cached_data.json"}, context); nil != err {
+		t.Fatalf("prefetch lazy files failed: %s", err)
+	}
+	waitPaused(1)
+	repo2.SetLazyPrefetchMaxBytes(0)
+	waitLoaded("/cache/cached_data.json")
+
+	// 关闭仓库时暂停的任务以 ErrLazyLoadingClosed 结束
+	repo2.SetLazyPrefetchMaxBytes(1)
+	if err := repo2.PrefetchLazyFiles([]string{"video.mp4"}, context); nil != err {
+		t.Fatalf("prefetch lazy files failed: %s", err)
+	}
+	waitPaused(1)
+	if err := repo2.Close(); nil != err {
+		t.Fatalf("close failed: %s", err)
+	}
+	select {
+	case event := <-logger.events:
+		if !errors.Is(event.Err, ErrLazyLoadingClosed) {
+			t.Errorf("paused prefetch should end with ErrLazyLoadingClosed, got %+v", event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("paused prefetch should be drained on close")
+	}
+	if pending := repo2.LazyHealth().PendingLoads; 0 != pending {
+		t.Errorf("expected no pending loads after close, got [%d]", pending)
+	}
+}
+
+func TestLazyLoadFileSummaryLog(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+
+	logPath := filepath.Join(testLazyTempPath, "lazy-load.log")
+	originalLogPath := logging.LogPath
+	logging.SetLogPath(logPath)
+	defer logging.SetLogPath(originalLogPath)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo2.LazyLoadFile(filepath.Join(testLazyDataPath, "large-files/big2.dat"), context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if nil != err {
+		t.Fatalf("read log failed: %s", err)
+	}
+
+	var summaries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "I ") {
+			continue
+		}
+		if strings.Contains(line, "[Lazy Load Debug]") {
+			t.Errorf("debug details should not be logged at info level: %s", line)
+		}
+		if strings.Contains(line, "[Lazy Load] loaded file") {
+			summaries = append(summaries, line)
+		}
+	}
+	if 1 != len(summaries) {
+		t.Fatalf("expected 1 summary line, got %d: %v", len(summaries), summaries)
+	}
+	for _, field := range []string{"[/large-files/big2.dat]", "size [2000] bytes", "chunks [1]", "downloaded [1]", "elapsed ["} {
+		if !strings.Contains(summaries[0], field) {
+			t.Errorf("summary line missing [%s]: %s", field, summaries[0])
+		}
+	}
+}
+
+func TestLazyCheckoutPredicate(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test checkout predicate", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	os.RemoveAll(testLazyDataPath)
+	os.MkdirAll(testLazyDataPath, 0755)
+
+	aesKey, _ := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	repo2, err := NewRepoWithLazyLoading(testLazyDataPath, testLazyRepoPath, testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, []string{}, repo.LazyLoadingPatterns, localCloud)
+	if nil != err {
+		t.Fatalf("create repo2 failed: %s", err)
+	}
+	t.Cleanup(func() { repo2.lazyIndexMgr.Close() })
+	repo2.LazyCheckoutPredicate = func(file *entity.File) bool { return 1500 > file.Size }
+
+	if _, _, _, err = repo2.DownloadIndex(index.ID, context); nil != err {
+		t.Fatalf("download index failed: %s", err)
+	}
+	if _, _, err = repo2.Checkout(index.ID, context); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+	}
+
+	for _, p := range []string{"large-files/big1.dat", "video.mp4", "backup/data.backup"} {
+		if !gulu.File.IsExist(filepath.Join(testLazyDataPath, p)) {
+			t.Errorf("small lazy file [%s] should be checked out", p)
+		}
+	}
+	if gulu.File.IsExist(filepath.Join(testLazyDataPath, "large-files/big2.dat")) {
+		t.Errorf("large lazy file big2.dat should be deferred")
+	}
+	content, err := os.ReadFile(filepath.Join(testLazyDataPath, "large-files/big1.dat"))
+	if nil != err || strings.Repeat("A", 1000) != string(content) {
+		t.Errorf("checked out lazy file content mismatch")
+	}
+}
+
+func TestCheckoutWithLazy(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test checkout with lazy", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	os.RemoveAll(testLazyDataPath)
+	os.MkdirAll(testLazyDataPath, 0755)
+
+	aesKey, _ := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	repo2, err := NewRepoWithLazyLoading(testLazyDataPath, testLazyRepoPath, testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, []string{}, repo.LazyLoadingPatterns, localCloud)
+	if nil != err {
+		t.Fatalf("create repo2 failed: %s", err)
+	}
+	t.Cleanup(func() { repo2.lazyIndexMgr.Close() })
+	if _, _, _, err = repo2.DownloadIndex(index.ID, context); nil != err {
+		t.Fatalf("download index failed: %s", err)
+	}
+
+	_, _, skippedLazy, err := repo2.CheckoutWithLazy(index.ID, context)
+	if nil != err {
+		t.Fatalf("checkout failed: %s", err)
+	}
+
+	expected := map[string]bool{
+		"/large-files/big1.dat":         true,
+		"/large-files/big2.dat":         true,
+		"/video.mp4":                    true,
+		"/cache/cached_data.json":       true,
+		"/cache/subdir/cached_file.txt": true,
+		"/backup/data.backup":           true,
+	}
+	if len(expected) != len(skippedLazy) {
+		t.Fatalf("expected %d skipped lazy files, got %d", len(expected), len(skippedLazy))
+	}
+	for _, file := range skippedLazy {
+		if !expected[file.Path] {
+			t.Errorf("unexpected skipped lazy file [%s]", file.Path)
+		}
+		if gulu.File.IsExist(filepath.Join(testLazyDataPath, file.Path)) {
+			t.Errorf("skipped lazy file [%s] should not be checked out", file.Path)
+		}
+	}
+}
+
+func TestLazySelfTest(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo.LazySelfTest(context); nil != err {
+		t.Fatalf("lazy self test failed: %s", err)
+	}
+
+	if gulu.File.IsExist(filepath.Join(testLazyTempPath, lazySelfTestDir)) {
+		t.Errorf("self test dir should be removed")
+	}
+	var objects int
+	filepath.Walk(testLazyCloudPath, func(p string, info os.FileInfo, err error) error {
+		if nil == err && !info.IsDir() && strings.Contains(filepath.ToSlash(p), "/objects/") {
+			objects++
+		}
+		return nil
+	})
+	if 0 != objects {
+		t.Errorf("self test should remove cloud objects, got %d", objects)
+	}
+	if 0 != len(repo.lazyIndexMgr.localMtimes) {
+		t.Errorf("self test should not leave local mtimes in lazy index, got %v", repo.lazyIndexMgr.localMtimes)
+	}
+
+	// 自检与按需加载使用同样的加载流程，按需加载的临时文件夹不可用时自检失败
+	blocker := filepath.Join(testLazyTempPath, "blocker")
+	if err := gulu.File.WriteFileSafer(blocker, []byte("blocker"), 0644); nil != err {
+		t.Fatalf("write blocker file failed: %s", err)
+	}
+	repo.LazyLoadingTempDir = filepath.Join(blocker, "lazy-download")
+	if err := repo.LazySelfTest(context); nil == err || !strings.Contains(err.Error(), "[load]") {
+		t.Errorf("expected lazy self test to fail at load stage, got %v", err)
+	}
+	repo.LazyLoadingTempDir = ""
+
+	repo.cloud = nil
+	if err := repo.LazySelfTest(context); nil == err {
+		t.Errorf("lazy self test without cloud should fail")
+	}
+}
+
+func TestMergeWithLocalFilesPrefersDisk(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+
+	for _, dir := range []string{testLazyRepoPath, filepath.Join(testLazyDataPath, "large-files")} {
+		if err := os.MkdirAll(dir, 0755); nil != err {
+			t.Fatalf("mkdir failed: %s", err)
+		}
+	}
+
+	mgr := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, []string{"large-files/*"})
+	stale := entity.NewFile("/large-files/stale.dat", 10, 1000)
+	stale.Chunks = []string{"stale"}
+	mgr.AddLazyFile(stale)
+	absent := entity.NewFile("/large-files/absent.dat", 10, 1000)
+	absent.Chunks = []string{"absent"}
+	mgr.AddLazyFile(absent)
+
+	content := strings.Repeat("S", 300)
+	if err := os.WriteFile(filepath.Join(testLazyDataPath, "large-files/stale.dat"), []byte(content), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+
+	merged := mgr.MergeWithLocalFiles(nil)
+	if 1 != len(merged) {
+		t.Fatalf("expected 1 merged file, got %d", len(merged))
+	}
+	if "/large-files/stale.dat" != merged[0].Path || int64(len(content)) != merged[0].Size || 0 != len(merged[0].Chunks) {
+		t.Errorf("merged entry should reflect the file on disk, got %+v", merged[0])
+	}
+
+	// 记录与磁盘一致时使用记录中的分块
+	info, _ := os.Stat(filepath.Join(testLazyDataPath, "large-files/stale.dat"))
+	fresh := entity.NewFile("/large-files/stale.dat", info.Size(), info.ModTime().UnixMilli())
+	fresh.Chunks = []string{"fresh"}
+	mgr.AddLazyFile(fresh)
+	merged = mgr.MergeWithLocalFiles(nil)
+	if 1 != len(merged) || fresh.ID != merged[0].ID || "fresh" != merged[0].Chunks[0] {
+		t.Errorf("merged entry should use the up to date lazy record")
+	}
+}
+
+func TestLazyHealth(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	health := repo2.LazyHealth()
+	if !health.Enabled || !health.IndexLoaded || !health.CloudConfigured || health.Closed {
+		t.Fatalf("unexpected health of fresh repo: %+v", health)
+	}
+	if 0 != health.LastLoaded || 0 != health.PendingLoads {
+		t.Fatalf("fresh repo should have no loads: %+v", health)
+	}
+	if 1 > health.LazyFileCount {
+		t.Fatalf("lazy index should record lazy files: %+v", health)
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	before := time.Now().UnixMilli()
+	if err := repo2.LazyLoadFile(filepath.Join(testLazyDataPath, "large-files/big1.dat"), context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	health = repo2.LazyHealth()
+	if before > health.LastLoaded {
+		t.Errorf("last loaded time should be updated: %+v", health)
+	}
+
+	if err := repo2.Close(); nil != err {
+		t.Fatalf("close repo failed: %s", err)
+	}
+	if !repo2.LazyHealth().Closed {
+		t.Errorf("health should report closed repo")
+	}
+}
+
+func TestLazyLoadFileMode(t *testing.T) {
+	if "windows" == runtime.GOOS {
+		t.Skip("file modes are not supported on windows")
+	}
+
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	repo2.LazyFileMode = 0640
+	repo2.LazyDirMode = 0700
+
+	dir := filepath.Join(testLazyDataPath, "large-files")
+	os.RemoveAll(dir)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	fullPath := filepath.Join(dir, "big1.dat")
+	if err := repo2.LazyLoadFile(fullPath, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+
+	info, err := os.Stat(fullPath)
+	if nil != err {
+		t.Fatalf("stat file failed: %s", err)
+	}
+	if 0640 != info.Mode().Perm() {
+		t.Errorf("expected file mode 0640, got %04o", info.Mode().Perm())
+	}
+	info, err = os.Stat(dir)
+	if nil != err {
+		t.Fatalf("stat dir failed: %s", err)
+	}
+	if 0700 != info.Mode().Perm() {
+		t.Errorf("expected dir mode 0700, got %04o", info.Mode().Perm())
+	}
+}
+
+func TestLazyLoadFileRestoresMode(t *testing.T) {
+	if "windows" == runtime.GOOS {
+		t.Skip("file modes are not supported on windows")
+	}
+
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	execPath := filepath.Join(testLazyDataPath, "large-files/tool.bin")
+	if err := os.WriteFile(execPath, []byte(strings.Repeat("X", 1000)), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	if err := os.Chmod(execPath, 0755); nil != err {
+		t.Fatalf("chmod failed: %s", err)
+	}
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	file, err := repo2.getLazyFile("/large-files/tool.bin")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	if 0755 != file.Mode {
+		t.Fatalf("expected recorded mode 0755, got %04o", file.Mode)
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err = repo2.LazyLoadFile(execPath, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	info, err := os.Stat(execPath)
+	if nil != err {
+		t.Fatalf("stat file failed: %s", err)
+	}
+	if 0755 != info.Mode().Perm() {
+		t.Errorf("expected restored mode 0755, got %04o", info.Mode().Perm())
+	}
+}
+
+func TestReindexLazyFile(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test reindex lazy file", false, context)
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+	oldFiles, err := repo.getFiles(index.Files)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+
+	bigPath := filepath.Join(testLazyDataPath, "large-files/big2.dat")
+	if err = repo.ReindexLazyFile(bigPath, context); nil != err {
+		t.Fatalf("reindex unchanged file failed: %s", err)
+	}
+	if latest, _ := repo.Latest(); index.ID != latest.ID {
+		t.Fatalf("reindex unchanged file should not create a new index")
+	}
+
+	content := strings.Repeat("C", 3000)
+	if err = os.WriteFile(bigPath, []byte(content), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(bigPath, future, future)
+
+	if err = repo.ReindexLazyFile(bigPath, context); nil != err {
+		t.Fatalf("reindex lazy file failed: %s", err)
+	}
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+	}
+	if index.ID == latest.ID || index.Count != latest.Count || index.Size+1000 != latest.Size {
+		t.Fatalf("unexpected reindexed index: %s", latest)
+	}
+	if err = repo.VerifyIndex(latest.ID); nil != err {
+		t.Fatalf("verify reindexed index failed: %s", err)
+	}
+
+	newFiles, err := repo.getFiles(latest.Files)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+	oldByPath := map[string]*entity.File{}
+	for _, f := range oldFiles {
+		oldByPath[f.Path] = f
+	}
+	for _, f := range newFiles {
+		old := oldByPath[f.Path]
+		if "/large-files/big2.dat" == f.Path {
+			if old.ID == f.ID || 1 != len(f.Chunks) || old.Chunks[0] == f.Chunks[0] {
+				t.Errorf("big2.dat should have new chunks")
+			}
+			if _, dlErr := localCloud.DownloadObject(cloudObjectKey(f.Chunks[0])); nil != dlErr {
+				t.Errorf("new chunk should be uploaded: %s", dlErr)
+			}
+			continue
+		}
+		if nil == old || old.ID != f.ID {
+			t.Errorf("file [%s] should not change", f.Path)
+		}
+	}
+}
+
+func TestLazyConflictHandler(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+
+	if err := os.MkdirAll(testLazyRepoPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+	}
+
+	mgr := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, []string{"large-files/*"})
+	existing := entity.NewFile("/large-files/a.dat", 1, 1000)
+	existing.Chunks = []string{"existing"}
+	mgr.AddLazyFile(existing)
+
+	incoming := entity.NewFile("/large-files/a.dat", 1, 2000)
+	incoming.Chunks = []string{"incoming"}
+
+	var calls int
+	mgr.SetConflictHandler(func(e, i *entity.File) LazyConflictDecision {
+		calls++
+		if existing.ID != e.ID || incoming.ID != i.ID {
+			t.Errorf("unexpected conflict records")
+		}
+		return LazyConflictKeepExisting
+	})
+	mgr.AddLazyFilesFromIndex([]*entity.File{incoming})
+	if 1 != calls {
+		t.Fatalf("conflict handler should be called once, got %d", calls)
+	}
+	if existing.ID != mgr.GetLazyFile("/large-files/a.dat").ID {
+		t.Fatalf("conflict handler should keep the existing record")
+	}
+
+	mgr.SetConflictHandler(nil)
+	mgr.AddLazyFilesFromIndex([]*entity.File{incoming})
+	if incoming.ID != mgr.GetLazyFile("/large-files/a.dat").ID {
+		t.Fatalf("default rule should use the newer record")
+	}
+}
+
+func TestLazyConflictContentOnly(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+
+	if err := os.MkdirAll(testLazyRepoPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+	}
+
+	mgr := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, []string{"large-files/*"})
+	defer mgr.Close()
+	existing := entity.NewFile("/large-files/a.dat", 1, 1000)
+	existing.Chunks = []string{"same"}
+	mgr.AddLazyFile(existing)
+
+	// 只有更新时间不同（比如文件系统截断了时间戳）
+	touched := entity.NewFile("/large-files/a.dat", 1, 2000)
+	touched.Chunks = []string{"same"}
+	var calls int
+	mgr.SetConflictHandler(func(e, i *entity.File) LazyConflictDecision {
+		calls++
+		return LazyConflictMerge
+	})
+	mgr.SetConflictMode(LazyConflictContentOnly)
+	mgr.AddLazyFilesFromIndex([]*entity.File{touched})
+	if 0 != calls || existing.ID != mgr.GetLazyFile("/large-files/a.dat").ID {
+		t.Fatalf("mtime only difference should not be a conflict in content only mode")
+	}
+
+	changed := entity.NewFile("/large-files/a.dat", 1, 3000)
+	changed.Chunks = []string{"changed"}
+	mgr.AddLazyFilesFromIndex([]*entity.File{changed})
+	if 1 != calls || changed.ID != mgr.GetLazyFile("/large-files/a.dat").ID {
+		t.Fatalf("content change should be a conflict in content only mode")
+	}
+
+	mgr.SetConflictMode(LazyConflictStrict)
+	touched = entity.NewFile("/large-files/a.dat", 1, 4000)
+	touched.Chunks = []string{"changed"}
+	mgr.AddLazyFilesFromIndex([]*entity.File{touched})
+	if 2 != calls || touched.ID != mgr.GetLazyFile("/large-files/a.dat").ID {
+		t.Fatalf("mtime only difference should be a conflict in strict mode")
+	}
+}
+
+func TestGetLazyFilesUnder(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+
+	if err := os.MkdirAll(testLazyRepoPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+	}
+
+	mgr := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, []string{"cache/**"})
+	for _, p := range []string{"/cache/a.dat", "/cache/sub/b.dat", "/cache/sub/deep/c.dat", "/cache/subdir/d.dat"} {
+		file := entity.NewFile(p, 1, 1000)
+		file.Chunks = []string{p}
+		mgr.AddLazyFile(file)
+	}
+
+	var got []string
+	for _, file := range mgr.GetLazyFilesUnder("cache/sub/") {
+		got = append(got, file.Path)
+	}
+	if "/cache/sub/b.dat,/cache/sub/deep/c.dat" != strings.Join(got, ",") {
+		t.Errorf("unexpected files under cache/sub: %v", got)
+	}
+	if 4 != len(mgr.GetLazyFilesUnder("/")) {
+		t.Errorf("root prefix should return all files")
+	}
+	if 1 != len(mgr.GetLazyFilesUnder("/cache/a.dat")) {
+		t.Errorf("file path prefix should return the file itself")
+	}
+	if 0 != len(mgr.GetLazyFilesUnder("/other")) {
+		t.Errorf("unknown prefix should return nothing")
+	}
+}
+
+func TestLazyLoadEmptyFile(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	emptyPath := filepath.Join(testLazyDataPath, "large-files/empty.dat")
+	if err := os.WriteFile(emptyPath, nil, 0644); nil != err {
+		t.Fatalf("write empty file failed: %s", err)
+	}
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	file, err := repo2.getLazyFile("/large-files/empty.dat")
+	if nil != err {
+		t.Fatalf("empty lazy file should be indexed: %s", err)
+	}
+	if 0 != file.Size {
+		t.Fatalf("unexpected empty file size [%d]", file.Size)
+	}
+
+	// 空文件加载时不访问云端
+	repo2.cloud = &countingDownloadCloud{Local: localCloud}
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err = repo2.LazyLoadFile(emptyPath, context); nil != err {
+		t.Fatalf("lazy load empty file failed: %s", err)
+	}
+	if downloads := repo2.cloud.(*countingDownloadCloud).downloaded(); 0 != len(downloads) {
+		t.Errorf("lazy load empty file should not download, got %v", downloads)
+	}
+
+	info, err := os.Stat(emptyPath)
+	if nil != err {
+		t.Fatalf("stat empty file failed: %s", err)
+	}
+	if 0 != info.Size() {
+		t.Errorf("loaded empty file should have zero size, got %d", info.Size())
+	}
+}
+
+type unreachableCloud struct {
+	*cloud.Local
+	err error
+}
+
+func (c *unreachableCloud) DownloadObject(filePath string) (data []byte, err error) {
+	return nil, c.err
+}
+
+func TestCheckLazyCloudReady(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	// 云端还没有 refs/latest 时也认为可用
+	if err := repo.CheckLazyCloudReady(nil); nil != err {
+		t.Fatalf("empty cloud should be ready: %s", err)
+	}
+
+	repo.cloud = &unreachableCloud{Local: localCloud, err: cloud.ErrCloudServiceUnavailable}
+	err := repo.CheckLazyCloudReady(nil)
+	if !errors.Is(err, cloud.ErrCloudServiceUnavailable) || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("unexpected unreachable error: %v", err)
+	}
+
+	repo.cloud = &unreachableCloud{Local: localCloud, err: cloud.ErrCloudAuthFailed}
+	err = repo.CheckLazyCloudReady(nil)
+	if !errors.Is(err, cloud.ErrCloudAuthFailed) || !strings.Contains(err.Error(), "misconfigured") {
+		t.Errorf("unexpected auth error: %v", err)
+	}
+
+	repo.cloud = nil
+	if err = repo.CheckLazyCloudReady(nil); nil == err {
+		t.Errorf("repo without cloud should not be ready")
+	}
+}
+
+func TestLazyLoadFilesFromIndex(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index1, err := repo.Index("Test old version", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	bigPath := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	newContent := bytes.Repeat([]byte("C"), 1500)
+	if err = os.WriteFile(bigPath, newContent, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(bigPath, future, future)
+	index2, err := repo.Index("Test new version", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	os.Remove(bigPath)
+	if err = repo.LazyLoadFilesFromIndex(index1.ID, []string{"/large-files/big1.dat"}, context); nil != err {
+		t.Fatalf("lazy load from old index failed: %s", err)
+	}
+	data, err := os.ReadFile(bigPath)
+	if nil != err {
+		t.Fatalf("read file failed: %s", err)
+	}
+	if !bytes.Equal(bytes.Repeat([]byte("A"), 1000), data) {
+		t.Errorf("old index should yield old content, got %d bytes", len(data))
+	}
+
+	if err = repo.LazyLoadFilesFromIndex(index2.ID, []string{bigPath}, context); nil != err {
+		t.Fatalf("lazy load from new index failed: %s", err)
+	}
+	if data, _ = os.ReadFile(bigPath); !bytes.Equal(newContent, data) {
+		t.Errorf("new index should yield new content, got %d bytes", len(data))
+	}
+
+	if err = repo.LazyLoadFilesFromIndex(index1.ID, []string{"/large-files/missing.dat"}, context); nil == err {
+		t.Errorf("loading a file missing from the index should fail")
+	}
+}
+
+func TestLazyChunkStats(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	// 内容相同的文件共用分块，先加载的文件下载的分块被后加载的文件复用
+	copyPath := filepath.Join(testLazyDataPath, "large-files/big1-copy.dat")
+	if err := os.WriteFile(copyPath, bytes.Repeat([]byte("A"), 1000), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	logger := &recordingAccessLogger{events: make(chan *LazyAccessEvent, 8)}
+	repo2.LazyAccessLogger = logger
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	expected := []LazyChunkStats{{LocalChunkHits: 0, CloudChunkFetches: 1}, {LocalChunkHits: 1, CloudChunkFetches: 0}}
+	for i, p := range []string{"large-files/big1.dat", "large-files/big1-copy.dat"} {
+		if err := repo2.LazyLoadFile(filepath.Join(testLazyDataPath, p), context); nil != err {
+			t.Fatalf("lazy load file [%s] failed: %s", p, err)
+		}
+		event := <-logger.events
+		if got := (LazyChunkStats{LocalChunkHits: event.LocalChunkHits, CloudChunkFetches: event.CloudChunkFetches}); expected[i] != got {
+			t.Errorf("file [%s] expected chunk stats %+v, got %+v", p, expected[i], got)
+		}
+	}
+
+	if stats := repo2.LazyChunkStats(); 1 != stats.LocalChunkHits || 1 != stats.CloudChunkFetches {
+		t.Errorf("unexpected total chunk stats %+v", stats)
+	}
+}
+
+func TestLazyCloudFootprint(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	// 内容相同的文件共用分块，去重后的分块数应该小于逐个文件累加的分块数
+	copyPath := filepath.Join(testLazyDataPath, "large-files/big1-copy.dat")
+	if err := os.WriteFile(copyPath, bytes.Repeat([]byte("A"), 1000), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	naive := 0
+	for _, file := range repo2.lazyIndexMgr.GetLazyFiles() {
+		naive += len(file.Chunks)
+	}
+
+	// 第二台设备本地没有懒加载分块，分块大小需要从云端获取
+	uniqueChunks, totalBytes, err := repo2.LazyCloudFootprint()
+	if nil != err {
+		t.Fatalf("get lazy cloud footprint failed: %s", err)
+	}
+	if 1 > uniqueChunks || uniqueChunks >= naive {
+		t.Errorf("expected deduped chunk count less than naive sum [%d], got [%d]", naive, uniqueChunks)
+	}
+	if 1 > totalBytes {
+		t.Errorf("expected positive total bytes, got [%d]", totalBytes)
+	}
+
+	// 第一台设备本地有所有分块，统计结果应该和从云端获取的一致
+	localChunks, localBytes, err := repo.LazyCloudFootprint()
+	if nil != err {
+		t.Fatalf("get lazy cloud footprint failed: %s", err)
+	}
+	if localChunks != uniqueChunks || localBytes != totalBytes {
+		t.Errorf("expected [%d] chunks [%d] bytes, got [%d] chunks [%d] bytes", uniqueChunks, totalBytes, localChunks, localBytes)
+	}
+
+	// 没有云端存储时错误信息中的数量是缺失的分块数，而不是分块所在的目录数
+	repo2.cloud = nil
+	expected := "[" + strconv.Itoa(uniqueChunks) + "] lazy chunks are not in local store"
+	if _, _, err = repo2.LazyCloudFootprint(); nil == err || !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected error containing [%s], got [%v]", expected, err)
+	}
+}
+
+type batchDownloadCloud struct {
+	*cloud.Local
+	batches int
+	singles atomic.Int32
+}
+
+func (c *batchDownloadCloud) DownloadObject(filePath string) (data []byte, err error) {
+	c.singles.Add(1)
+	return c.Local.DownloadObject(filePath)
+}
+
+func (c *batchDownloadCloud) DownloadObjects(filePaths []string) (ret map[string][]byte, err error) {
+	c.batches++
+	ret = map[string][]byte{}
+	for _, filePath := range filePaths {
+		if ret[filePath], err = c.Local.DownloadObject(filePath); nil != err {
+			return nil, err
+		}
+	}
+	return
+}
+
+func TestDownloadCloudChunksBatch(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	var chunkIDs []string
+	for _, file := range repo2.lazyIndexMgr.GetLazyFiles() {
+		chunkIDs = append(chunkIDs, file.Chunks...)
+	}
+	chunkIDs = gulu.Str.RemoveDuplicatedElem(chunkIDs)
+	chunkIDs, err := repo2.localNotFoundChunks(chunkIDs)
+	if nil != err {
+		t.Fatalf("check local chunks failed: %s", err)
+	}
+	if 3 > len(chunkIDs) {
+		t.Fatalf("expected at least 3 missing chunks, got %d", len(chunkIDs))
+	}
+
+	batchCloud := &batchDownloadCloud{Local: localCloud}
+	repo2.cloud = batchCloud
+	repo2.ChunkBatchSize = 2
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err = repo2.downloadCloudChunksPut(chunkIDs, context); nil != err {
+		t.Fatalf("download chunks failed: %s", err)
+	}
+
+	if expected := (len(chunkIDs) + 1) / 2; expected != batchCloud.batches || batchCloud.batches >= len(chunkIDs) {
+		t.Errorf("expected %d batch requests for %d chunks, got %d", expected, len(chunkIDs), batchCloud.batches)
+	}
+	if 0 != batchCloud.singles.Load() {
+		t.Errorf("expected no single downloads, got %d", batchCloud.singles.Load())
+	}
+	if missing, _ := repo2.localNotFoundChunks(chunkIDs); 0 != len(missing) {
+		t.Errorf("chunks should be stored locally, still missing %d", len(missing))
+	}
+}
+
+func TestLazyPatternCoverage(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	if err := repo.SetLazyLoadingPatterns([]string{"large-files/*", "larg-files/*"}); nil != err {
+		t.Fatalf("set patterns failed: %s", err)
+	}
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test pattern coverage", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	coverage, err := repo.LazyPatternCoverage()
+	if nil != err {
+		t.Fatalf("get pattern coverage failed: %s", err)
+	}
+	if 2 != coverage["large-files/*"] {
+		t.Errorf("expected pattern [large-files/*] to match 2 files, got %d", coverage["large-files/*"])
+	}
+	if count, ok := coverage["larg-files/*"]; !ok || 0 != count {
+		t.Errorf("expected pattern [larg-files/*] to match 0 files, got %d (reported %v)", count, ok)
+	}
+}
+
+func TestLazyLoadOverlappingFilesFetchSharedChunksOnce(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	// 增量备份文件和原文件只有末尾不同，大部分分块相同
+	data := writeHugeLazyFile(t)
+	backupData := append(append([]byte{}, data...), bytes.Repeat([]byte("D"), 4096)...)
+	backupPath := filepath.Join(testLazyDataPath, "large-files/huge-incremental.dat")
+	if err := gulu.File.WriteFileSafer(backupPath, backupData, 0644); nil != err {
+		t.Fatalf("write backup file failed: %s", err)
+	}
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	hugeFile, err := repo2.getLazyFile("/large-files/huge.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	backupFile, err := repo2.getLazyFile("/large-files/huge-incremental.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	shared := 0
+	for _, chunkID := range backupFile.Chunks {
+		if slices.Contains(hugeFile.Chunks, chunkID) {
+			shared++
+		}
+	}
+	if 1 > shared {
+		t.Fatalf("expected the files to share chunks")
+	}
+
+	countingCloud := &countingDownloadCloud{Local: localCloud}
+	repo2.cloud = countingCloud
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	for _, p := range []string{filepath.Join(testLazyDataPath, "large-files/huge.dat"), backupPath} {
+		if err = repo2.LazyLoadFile(p, context); nil != err {
+			t.Fatalf("lazy load file [%s] failed: %s", p, err)
+		}
+	}
+
+	fetched := map[string]int{}
+	for _, key := range countingCloud.downloaded() {
+		fetched[key]++
+	}
+	for _, chunkID := range backupFile.Chunks {
+		if key := cloudObjectKey(chunkID); 1 != fetched[key] {
+			t.Errorf("chunk [%s] should be fetched once, got %d", chunkID, fetched[key])
+		}
+	}
+	if got, _ := os.ReadFile(backupPath); !bytes.Equal(backupData, got) {
+		t.Errorf("incremental file content mismatch")
+	}
+}
+
+func TestNewRepoWithLazyLoadingOverlappingPaths(t *testing.T) {
+	defer clearLazyTestdata(t)
+
+	aesKey, _ := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	patterns := []string{"large-files/*"}
+	_, err := NewRepoWithLazyLoading(testLazyDataPath, filepath.Join(testLazyDataPath, "repo"), testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, []string{}, patterns, nil)
+	if !errors.Is(err, ErrLazyPathsOverlap) {
+		t.Errorf("repo path inside data path should fail, got %v", err)
+	}
+	_, err = NewRepoWithLazyLoading(testLazyDataPath, testLazyRepoPath, testLazyHistoryPath, filepath.Join(testLazyRepoPath, "temp"), deviceID, deviceName, deviceOS, aesKey, []string{}, patterns, nil)
+	if !errors.Is(err, ErrLazyPathsOverlap) {
+		t.Errorf("temp path inside repo path should fail, got %v", err)
+	}
+
+	// 路径前缀相同但互不包含的文件夹不算重叠
+	if _, err = NewRepoWithLazyLoading(testLazyDataPath, testLazyDataPath+"-repo", testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, []string{}, patterns, nil); nil != err {
+		t.Errorf("sibling paths should not overlap: %s", err)
+	}
+}
+
+func TestEvictSyncedLazyFiles(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test evict", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err := repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+	synced := len(repo.lazyIndexMgr.GetLazyFiles())
+
+	// 已索引但还没有上传的文件不能驱逐
+	newPath := filepath.Join(testLazyDataPath, "large-files/new.dat")
+	if err := os.WriteFile(newPath, bytes.Repeat([]byte("N"), 1000), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	if _, err := repo.Index("Test evict not uploaded", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	evicted, err := repo.EvictSyncedLazyFiles(context)
+	if nil != err {
+		t.Fatalf("evict synced lazy files failed: %s", err)
+	}
+	if synced != evicted {
+		t.Errorf("expected %d evicted files, got %d", synced, evicted)
+	}
+	if !gulu.File.IsExist(newPath) {
+		t.Errorf("file not uploaded yet should not be evicted")
+	}
+	bigPath := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	statuses, err := repo.LazyStatusBatch([]string{"/large-files/big1.dat"})
+	if nil != err {
+		t.Fatalf("get lazy status failed: %s", err)
+	}
+	if status := statuses["/large-files/big1.dat"]; status.Cached || !status.Recorded {
+		t.Errorf("evicted file should be recorded but not cached, got %+v", status)
+	}
+
+	// 驱逐只删除本地副本，之后的索引仍然包含被驱逐的文件
+	if _, err = repo.Index("Test after evict", false, context); nil != err && !errors.Is(err, ErrEmptyIndex) {
+		t.Fatalf("create index failed: %s", err)
+	}
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest index failed: %s", err)
+	}
+	latestFiles, err := repo.getFiles(latest.Files)
+	if nil != err {
+		t.Fatalf("get latest files failed: %s", err)
+	}
+	if !slices.ContainsFunc(latestFiles, func(file *entity.File) bool { return "/large-files/big1.dat" == file.Path }) {
+		t.Errorf("evicted file should stay in latest index")
+	}
+
+	if err = repo.LazyLoadFile(bigPath, context); nil != err {
+		t.Fatalf("lazy load evicted file failed: %s", err)
+	}
+	if data, _ := os.ReadFile(bigPath); !bytes.Equal(bytes.Repeat([]byte("A"), 1000), data) {
+		t.Errorf("re-downloaded file content mismatch")
+	}
+}
+
+func TestEvictSyncedLazyFilesFlushFailure(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test evict flush failure", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err := repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+	if err := repo.lazyIndexMgr.Flush(); nil != err {
+		t.Fatalf("flush lazy index failed: %s", err)
+	}
+
+	// 懒加载索引无法写入时不能删除本地文件，否则崩溃后文件既不在本地也没有驱逐标记
+	blocker := filepath.Join(testLazyTempPath, "blocker")
+	if err := os.MkdirAll(testLazyTempPath, 0755); nil != err {
+		t.Fatalf("create temp dir failed: %s", err)
+	}
+	if err := gulu.File.WriteFileSafer(blocker, []byte("blocker"), 0644); nil != err {
+		t.Fatalf("write blocker file failed: %s", err)
+	}
+	repoPath := repo.lazyIndexMgr.repoPath
+	repo.lazyIndexMgr.repoPath = filepath.Join(blocker, "repo")
+
+	bigPath := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if _, err := repo.EvictSyncedLazyFiles(context); !errors.Is(err, ErrLazyIndexNotWritable) {
+		t.Fatalf("expected ErrLazyIndexNotWritable, got %v", err)
+	}
+	if !gulu.File.IsExist(bigPath) {
+		t.Errorf("file should be kept when the evicted mark can not be persisted")
+	}
+	if repo.lazyIndexMgr.IsEvicted("/large-files/big1.dat") {
+		t.Errorf("evicted mark should be dropped when the file is kept")
+	}
+
+	repo.lazyIndexMgr.repoPath = repoPath
+	if _, err := repo.EvictSyncedLazyFiles(context); nil != err {
+		t.Fatalf("evict synced lazy files failed: %s", err)
+	}
+	if gulu.File.IsExist(bigPath) || !repo.lazyIndexMgr.IsEvicted("/large-files/big1.dat") {
+		t.Errorf("file should be evicted once the lazy index is writable")
+	}
+}
+
+func TestEvictedMarkDroppedWithPath(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test evicted mark", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err := repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+	if _, err := repo.EvictSyncedLazyFiles(context); nil != err {
+		t.Fatalf("evict synced lazy files failed: %s", err)
+	}
+	if !repo.lazyIndexMgr.IsEvicted("/large-files/big1.dat") || !repo.lazyIndexMgr.IsEvicted("/large-files/big2.dat") {
+		t.Fatalf("files should be evicted")
+	}
+
+	// 同步合并删除文件（比如在云端被删除）时清除标记，之后的索引不能通过记录重新加入该文件
+	big1 := repo.lazyIndexMgr.GetLazyFile("/large-files/big1.dat")
+	if err := repo.removeFiles([]*entity.File{big1}, context); nil != err {
+		t.Fatalf("remove files failed: %s", err)
+	}
+	if repo.lazyIndexMgr.IsEvicted("/large-files/big1.dat") {
+		t.Errorf("evicted mark should be dropped when the file is removed")
+	}
+	if _, err := repo.Index("Test after remove", false, context); nil != err && !errors.Is(err, ErrEmptyIndex) {
+		t.Fatalf("create index failed: %s", err)
+	}
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest index failed: %s", err)
+	}
+	latestFiles, err := repo.getFiles(latest.Files)
+	if nil != err {
+		t.Fatalf("get latest files failed: %s", err)
+	}
+	if slices.ContainsFunc(latestFiles, func(file *entity.File) bool { return "/large-files/big1.dat" == file.Path }) {
+		t.Errorf("removed evicted file should not be added back to latest index")
+	}
+
+	// 路径离开最新索引（比如直接使用云端索引作为最新索引）时清除标记
+	index := &entity.Index{ID: util.RandHash(), Memo: "Test without big2", Created: time.Now().UnixMilli()}
+	for _, file := range latestFiles {
+		if "/large-files/big2.dat" == file.Path {
+			continue
+		}
+		index.Files = append(index.Files, file.ID)
+		index.Size += file.Size
+	}
+	index.Count = len(index.Files)
+	if err = repo.store.PutIndex(index); nil != err {
+		t.Fatalf("put index failed: %s", err)
+	}
+	if err = repo.UpdateLatest(index); nil != err {
+		t.Fatalf("update latest failed: %s", err)
+	}
+	if repo.lazyIndexMgr.IsEvicted("/large-files/big2.dat") {
+		t.Errorf("evicted mark should be dropped when the file leaves latest index")
+	}
+	if nil == repo.lazyIndexMgr.GetLazyFile("/large-files/big2.dat") {
+		t.Errorf("lazy file record should be kept for history snapshots")
+	}
+}
+
+func TestLazyIndexPlanRebuild(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test rebuild old", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	oldBig1 := findLazyFile(t, repo, "/large-files/big1.dat")
+
+	bigPath := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if err := os.WriteFile(bigPath, bytes.Repeat([]byte("C"), 1500), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(bigPath, future, future)
+	if _, err := repo.Index("Test rebuild new", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	newBig1 := findLazyFile(t, repo, "/large-files/big1.dat")
+	lazyFiles, err := repo.GetLazyLoadingFiles()
+	if nil != err {
+		t.Fatalf("get lazy files failed: %s", err)
+	}
+	var expectedAdded []string
+	for _, file := range lazyFiles {
+		if file.Path != newBig1.Path {
+			expectedAdded = append(expectedAdded, file.Path)
+		}
+	}
+	sort.Strings(expectedAdded)
+
+	// 让懒加载索引和本地索引不一致：big1 记录过时，其他记录丢失，多出一个不存在的记录
+	mgr := repo.lazyIndexMgr
+	for _, file := range mgr.GetLazyFiles() {
+		mgr.RemoveLazyFile(file.Path)
+	}
+	mgr.AddLazyFile(oldBig1)
+	ghost := entity.NewFile("/large-files/ghost.dat", 1, time.Now().UnixMilli())
+	ghost.Chunks = []string{oldBig1.Chunks[0]}
+	mgr.AddLazyFile(ghost)
+	indexPath := filepath.Join(testLazyRepoPath, DefaultLazyIndexName)
+	before, _ := os.ReadFile(indexPath)
+
+	plan, err := mgr.PlanRebuild(repo)
+	if nil != err {
+		t.Fatalf("plan rebuild failed: %s", err)
+	}
+	if !slices.Equal(expectedAdded, plan.Added) || !slices.Equal([]string{"/large-files/big1.dat"}, plan.Updated) || !slices.Equal([]string{"/large-files/ghost.dat"}, plan.Removed) {
+		t.Errorf("unexpected plan added %v, updated %v, removed %v", plan.Added, plan.Updated, plan.Removed)
+	}
+	if after, _ := os.ReadFile(indexPath); !bytes.Equal(before, after) || nil == mgr.GetLazyFile("/large-files/ghost.dat") {
+		t.Errorf("planning should not change the lazy index")
+	}
+
+	// 计算计划之后懒加载索引有变化时拒绝应用
+	mgr.RemoveLazyFile("/large-files/ghost.dat")
+	if err = mgr.ApplyRebuild(repo, plan); !errors.Is(err, ErrRebuildPlanStale) {
+		t.Errorf("expected ErrRebuildPlanStale after the lazy index changed, got [%v]", err)
+	}
+	if nil == mgr.GetLazyFile("/large-files/big1.dat") || oldBig1.ID != mgr.GetLazyFile("/large-files/big1.dat").ID {
+		t.Errorf("stale plan should not change the lazy index")
+	}
+	mgr.AddLazyFile(ghost)
+
+	rebuilt, err := mgr.RebuildFromAllIndexes(repo)
+	if nil != err {
+		t.Fatalf("rebuild failed: %s", err)
+	}
+	if !slices.Equal(plan.Added, rebuilt.Added) || !slices.Equal(plan.Updated, rebuilt.Updated) || !slices.Equal(plan.Removed, rebuilt.Removed) {
+		t.Errorf("rebuild differs from plan: added %v, updated %v, removed %v", rebuilt.Added, rebuilt.Updated, rebuilt.Removed)
+	}
+	if file := mgr.GetLazyFile("/large-files/big1.dat"); nil == file || newBig1.ID != file.ID {
+		t.Errorf("rebuild should use the newest big1 record")
+	}
+	if len(lazyFiles) != len(mgr.GetLazyFiles()) || nil != mgr.GetLazyFile("/large-files/ghost.dat") {
+		t.Errorf("rebuild should add the missing records and remove ghost")
+	}
+	if plan, err = mgr.PlanRebuild(repo); nil != err || 0 != len(plan.Added)+len(plan.Updated)+len(plan.Removed) {
+		t.Errorf("plan after rebuild should be empty, got %+v, err %v", plan, err)
+	}
+}
+
+func findLazyFile(t *testing.T, repo *Repo, relPath string) *entity.File {
+	lazyFiles, err := repo.GetLazyLoadingFiles()
+	if nil != err {
+		t.Fatalf("get lazy files failed: %s", err)
+	}
+	for _, file := range lazyFiles {
+		if relPath == file.Path {
+			return file
+		}
+	}
+	t.Fatalf("lazy file [%s] not found in latest index", relPath)
+	return nil
+}
+
+func TestGetIndexLogsMissingLazyFile(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test missing lazy file", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	// 模拟懒加载文件的文件对象缺失
+	big1 := findLazyFile(t, repo, "/large-files/big1.dat")
+	if err = repo.store.Remove(big1.ID); nil != err {
+		t.Fatalf("remove file object failed: %s", err)
+	}
+	fileCache.Del(big1.ID)
+
+	logs, _, _, err := repo.GetIndexLogs(1, 10)
+	if nil != err {
+		t.Fatalf("get index logs failed: %s", err)
+	}
+	if 1 != len(logs) || index.ID != logs[0].ID {
+		t.Fatalf("unexpected logs %v", logs)
+	}
+	if 1 != logs[0].MissingFiles {
+		t.Errorf("expected 1 missing file, got %d", logs[0].MissingFiles)
+	}
+	if len(index.Files)-1 != len(logs[0].Files) {
+		t.Errorf("expected %d files, got %d", len(index.Files)-1, len(logs[0].Files))
+	}
+}
+
+func TestSameDirPrefetchStrategy(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	repo2.LazyPrefetchStrategy = &SameDirPrefetchStrategy{}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo2.LazyLoadFile(filepath.Join(testLazyDataPath, "large-files/big1.dat"), context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+
+	siblingPath := filepath.Join(testLazyDataPath, "large-files/big2.dat")
+	for deadline := time.Now().Add(5 * time.Second); !gulu.File.IsExist(siblingPath) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !gulu.File.IsExist(siblingPath) {
+		t.Fatalf("sibling file should be prefetched")
+	}
+	for deadline := time.Now().Add(5 * time.Second); 0 < repo2.LazyHealth().PendingLoads && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 其他文件夹下的懒加载文件不预取
+	for _, p := range []string{"video.mp4", "cache/cached_data.json"} {
+		if gulu.File.IsExist(filepath.Join(testLazyDataPath, p)) {
+			t.Errorf("file [%s] outside the accessed folder should not be prefetched", p)
+		}
+	}
+}
+
+func TestSameDirPrefetchStrategyWithSubroot(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	if err := repo2.SetLazySubroot("large-files"); nil != err {
+		t.Fatalf("set lazy subroot failed: %s", err)
+	}
+	if err := repo2.SetLazyLoadingPatterns([]string{"*.dat"}); nil != err {
+		t.Fatalf("set lazy loading patterns failed: %s", err)
+	}
+	repo2.LazyPrefetchStrategy = &SameDirPrefetchStrategy{}
+
+	// 策略返回的索引路径已经包含根目录，预取时不能再拼接根目录
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo2.LazyLoadFile("big1.dat", context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+
+	siblingPath := filepath.Join(testLazyDataPath, "large-files/big2.dat")
+	for deadline := time.Now().Add(5 * time.Second); !gulu.File.IsExist(siblingPath) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !gulu.File.IsExist(siblingPath) {
+		t.Fatalf("sibling file under subroot should be prefetched")
+	}
+	for deadline := time.Now().Add(5 * time.Second); 0 < repo2.LazyHealth().PendingLoads && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if gulu.File.IsExist(filepath.Join(testLazyDataPath, "large-files/large-files")) {
+		t.Errorf("prefetch should not resolve index paths against the subroot")
+	}
+}
+
+func TestLazyLoadTransaction(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+
+	// 最后一个文件无法加载，前面已经下载的文件也不能移动到数据文件夹下
+	err := repo2.LazyLoadTransaction([]string{"large-files/big1.dat", "large-files/big2.dat", "large-files/missing.dat"}, context)
+	if nil == err {
+		t.Fatalf("transaction with an unloadable file should fail")
+	}
+	for _, p := range []string{"large-files/big1.dat", "large-files/big2.dat"} {
+		if gulu.File.IsExist(filepath.Join(testLazyDataPath, p)) {
+			t.Errorf("file [%s] should not be committed", p)
+		}
+	}
+	if staged, _ := filepath.Glob(filepath.Join(testLazyTempPath, "lazy-transaction-*")); 0 < len(staged) {
+		t.Errorf("staging dirs should be removed, got %v", staged)
+	}
+
+	if err = repo2.LazyLoadTransaction([]string{"large-files/big1.dat", "video.mp4"}, context); nil != err {
+		t.Fatalf("transaction failed: %s", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(testLazyDataPath, "large-files/big1.dat")); !bytes.Equal(bytes.Repeat([]byte("A"), 1000), data) {
+		t.Errorf("big1 content mismatch")
+	}
+	if data, _ := os.ReadFile(filepath.Join(testLazyDataPath, "video.mp4")); !bytes.Equal(bytes.Repeat([]byte("V"), 500), data) {
+		t.Errorf("video content mismatch")
+	}
+}
+
+func TestLazyPreserveMtime(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, p := range []string{"large-files/big1.dat", "large-files/big2.dat"} {
+		if err := os.Chtimes(filepath.Join(testLazyDataPath, p), old, old); nil != err {
+			t.Fatalf("change file time failed: %s", err)
+		}
+	}
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	if !repo2.LazyPreserveMtime {
+		t.Fatalf("mtime should be preserved by default")
+	}
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+
+	big1Path := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if err := repo2.LazyLoadFile(big1Path, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	big1, _ := repo2.getLazyFile("/large-files/big1.dat")
+	info, err := os.Stat(big1Path)
+	if nil != err {
+		t.Fatalf("stat file failed: %s", err)
+	}
+	if big1.Updated != info.ModTime().UnixMilli() {
+		t.Errorf("mtime should be restored to [%d], got [%d]", big1.Updated, info.ModTime().UnixMilli())
+	}
+
+	repo2.LazyPreserveMtime = false
+	big2Path := filepath.Join(testLazyDataPath, "large-files/big2.dat")
+	if err = repo2.LazyLoadFile(big2Path, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	if info, err = os.Stat(big2Path); nil != err {
+		t.Fatalf("stat file failed: %s", err)
+	}
+	if time.Since(info.ModTime()) > time.Hour {
+		t.Errorf("mtime should be the download time, got %v", info.ModTime())
+	}
+}
+
+func TestLazyPreserveMtimeDisabledEvict(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	repo2.LazyPreserveMtime = false
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	big1Path := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if err := repo2.LazyLoadFile(big1Path, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	big1 := repo2.lazyIndexMgr.GetLazyFile("/large-files/big1.dat")
+	info, err := os.Stat(big1Path)
+	if nil != err {
+		t.Fatalf("stat file failed: %s", err)
+	}
+	if info.ModTime().UnixMilli() == big1.Updated {
+		t.Fatalf("mtime should be the download time")
+	}
+	if mtime := repo2.lazyIndexMgr.LocalMtime(big1); info.ModTime().UnixMilli() != mtime {
+		t.Errorf("local mtime [%d] should be recorded, got [%d]", info.ModTime().UnixMilli(), mtime)
+	}
+
+	// 本地更新时间记录随懒加载索引持久化
+	if err = repo2.lazyIndexMgr.Flush(); nil != err {
+		t.Fatalf("flush lazy index failed: %s", err)
+	}
+	reloaded := NewLazyIndexManager(repo2.Path, testLazyDataPath, repo2.GetLazyLoadingPatterns())
+	if mtime := reloaded.LocalMtime(big1); info.ModTime().UnixMilli() != mtime {
+		t.Errorf("local mtime should be loaded from disk, got [%d]", mtime)
+	}
+
+	// 下载后没有修改过的文件不是本地修改，可以驱逐
+	latest, err := repo2.Latest()
+	if nil != err {
+		t.Fatalf("get latest index failed: %s", err)
+	}
+	if err = repo2.SyncLocalLazyEdits(context); nil != err {
+		t.Fatalf("sync local lazy edits failed: %s", err)
+	}
+	if current, _ := repo2.Latest(); latest.ID != current.ID {
+		t.Errorf("unmodified file should not be reindexed")
+	}
+	if _, err = repo2.EvictSyncedLazyFiles(context); nil != err {
+		t.Fatalf("evict synced lazy files failed: %s", err)
+	}
+	if gulu.File.IsExist(big1Path) || !repo2.lazyIndexMgr.IsEvicted("/large-files/big1.dat") {
+		t.Errorf("file downloaded without restoring mtime should be evictable")
+	}
+}
+
+func TestLazyLoadKeyGuard(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+
+	errCrossTenant := errors.New("cross tenant key")
+	var guarded []string
+	repo2.KeyGuard = func(key string) (string, error) {
+		guarded = append(guarded, key)
+		if !strings.HasPrefix(key, "tenant-a/") {
+			return "", errCrossTenant
+		}
+		return key, nil
+	}
+	big1Path := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if err := repo2.LazyLoadFile(big1Path, context); nil == err || !strings.Contains(err.Error(), errCrossTenant.Error()) {
+		t.Fatalf("lazy load with rejected keys should fail, got %v", err)
+	}
+	if 1 > len(guarded) {
+		t.Errorf("key guard should be called")
+	}
+	if gulu.File.IsExist(big1Path) {
+		t.Errorf("file should not be loaded when keys are rejected")
+	}
+
+	// 只允许数据对象
+	guarded = nil
+	repo2.KeyGuard = func(key string) (string, error) {
+		guarded = append(guarded, key)
+		if !strings.HasPrefix(key, "objects/") {
+			return "", errCrossTenant
+		}
+		return key, nil
+	}
+	if err := repo2.LazyLoadFile(big1Path, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	if 1 > len(guarded) {
+		t.Errorf("key guard should be called")
+	}
+
+	// 改写后的键不再以 objects/ 开头，数据对象仍然可以从镜像下载
+	file, err := repo2.getLazyFile("/large-files/big2.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	chunkID := file.Chunks[0]
+	data, err := localCloud.DownloadObject(cloudObjectKey(chunkID))
+	if nil != err {
+		t.Fatalf("download chunk failed: %s", err)
+	}
+	mirror := cloud.NewLocal(&cloud.BaseCloud{
+		Conf: &cloud.Conf{
+			RepoPath: testLazyRepoPath,
+			Local: &cloud.ConfLocal{
+				Endpoint: filepath.Join(testLazyCloudPath, "mirror"),
+			},
+		},
+	})
+	if _, err = mirror.UploadBytes("tenant-a/"+cloudObjectKey(chunkID), data, true); nil != err {
+		t.Fatalf("upload chunk to mirror failed: %s", err)
+	}
+	repo2.MirrorClouds = []cloud.Cloud{mirror}
+	repo2.KeyGuard = func(key string) (string, error) {
+		return "tenant-a/" + key, nil
+	}
+	if _, _, err = repo2.downloadCloudChunk(chunkID, 1, 1, context); nil != err {
+		t.Errorf("download rewritten chunk key should fall back to mirror: %s", err)
+	}
+}
+
+func TestGetLazyLoadingFilesPaged(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	for i := 0; i < 5; i++ {
+		p := filepath.Join(testLazyDataPath, "large-files", "paged-"+strconv.Itoa(i)+".dat")
+		if err := os.WriteFile(p, []byte(strconv.Itoa(i)), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+		}
+	}
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test paged", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	all, err := repo.GetLazyLoadingFiles()
+	if nil != err {
+		t.Fatalf("get lazy files failed: %s", err)
+	}
+	pageSize := 4
+	var paged []string
+	for page := 1; ; page++ {
+		files, totalCount, pageCount, pageErr := repo.GetLazyLoadingFilesPaged(page, pageSize)
+		if nil != pageErr {
+			t.Fatalf("get page [%d] failed: %s", page, pageErr)
+		}
+		if len(all) != totalCount || (len(all)+pageSize-1)/pageSize != pageCount {
+			t.Fatalf("unexpected total count [%d] or page count [%d]", totalCount, pageCount)
+		}
+		if page > pageCount {
+			if 0 != len(files) {
+				t.Errorf("page after the last one should be empty")
+			}
+			break
+		}
+		if page < pageCount && pageSize != len(files) {
+			t.Errorf("page [%d] should be full, got %d files", page, len(files))
+		}
+		for _, file := range files {
+			paged = append(paged, file.Path)
+		}
+	}
+
+	if len(all) != len(paged) || !sort.StringsAreSorted(paged) || len(paged) != len(gulu.Str.RemoveDuplicatedElem(append([]string{}, paged...))) {
+		t.Errorf("pages should cover all lazy files once in path order, got %v", paged)
+	}
+}
+
+func TestLazyIndexManagerCompact(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+
+	if err := os.MkdirAll(testLazyRepoPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+	}
+
+	patterns := []string{"large-files/*"}
+	mgr := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, patterns)
+	for i := 0; i < 20; i++ {
+		file := entity.NewFile("/large-files/"+strconv.Itoa(i)+".dat", int64(i), 1000)
+		file.Chunks = []string{"chunk-" + strconv.Itoa(i)}
+		mgr.AddLazyFile(file)
+	}
+	if err := mgr.Flush(); nil != err {
+		t.Fatalf("flush failed: %s", err)
+	}
+	indexPath := filepath.Join(testLazyRepoPath, DefaultLazyIndexName)
+	indented, _ := os.ReadFile(indexPath)
+
+	if err := mgr.SetCompact(true); nil != err {
+		t.Fatalf("set compact failed: %s", err)
+	}
+	compact, _ := os.ReadFile(indexPath)
+	if len(compact) >= len(indented) {
+		t.Errorf("compact index [%d bytes] should be smaller than indented index [%d bytes]", len(compact), len(indented))
+	}
+
+	reloaded := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, patterns)
+	expected, _ := gulu.JSON.MarshalJSON(mgr.GetLazyFilesUnder("/"))
+	got, _ := gulu.JSON.MarshalJSON(reloaded.GetLazyFilesUnder("/"))
+	if !bytes.Equal(expected, got) {
+		t.Errorf("compact index should round trip")
+	}
+}
+
+func TestLazyExcludeSystemFiles(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	dsStore := "/cache/.DS_Store"
+	if repo.isLazyLoadingFile(dsStore) || repo.lazyIndexMgr.isLazyLoadingFile(dsStore) {
+		t.Errorf("system file [%s] should not be lazy by default", dsStore)
+	}
+	if !repo.isLazyLoadingFile("/cache/cached_data.json") {
+		t.Errorf("normal file under cache should still be lazy")
+	}
+
+	// 排除模式在懒加载模式（包括取反模式）之后评估，自定义排除模式可以取反重新包含系统文件
+	if err := repo.SetLazyLoadingPatterns([]string{"cache/**", "!cache/keep.json"}); nil != err {
+		t.Fatalf("set lazy loading patterns failed: %s", err)
+	}
+	if err := repo.SetLazyExcludes(true, []string{"*.tmp", "!cache/.DS_Store"}); nil != err {
+		t.Fatalf("set lazy excludes failed: %s", err)
+	}
+	testCases := []struct {
+		path   string
+		isLazy bool
+	}{
+		{"/cache/cached_data.json", true},
+		{"/cache/keep.json", false},
+		{"/cache/data.tmp", false},
+		{"/cache/.DS_Store", true},
+		{"/cache/sub/Thumbs.db", false},
+	}
+	for _, tc := range testCases {
+		if got := repo.isLazyLoadingFile(tc.path); got != tc.isLazy || repo.lazyIndexMgr.isLazyLoadingFile(tc.path) != tc.isLazy {
+			t.Errorf("path [%s] expected lazy %v, got %v", tc.path, tc.isLazy, got)
+		}
+	}
+
+	if err := repo.SetLazyExcludes(false, nil); nil != err {
+		t.Fatalf("set lazy excludes failed: %s", err)
+	}
+	if !repo.isLazyLoadingFile("/cache/sub/Thumbs.db") {
+		t.Errorf("system file should be lazy when system file exclusion is disabled")
+	}
+}
+
+func TestVerifyLazyCache(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	pushCtx := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test verify lazy cache", false, pushCtx); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err := repo.SyncUpload(pushCtx); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+	total := len(repo.lazyIndexMgr.GetLazyFiles())
+	if 2 > total {
+		t.Fatalf("expected at least 2 lazy files, got %d", total)
+	}
+
+	// 大小不变但内容被损坏的文件需要被发现
+	bigPath := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if err := os.WriteFile(bigPath, bytes.Repeat([]byte("Z"), 1000), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	checked := 0
+	mismatched, err := repo.VerifyLazyCache(context.Background(), func(c, tt int) {
+		checked = c
+		if total != tt {
+			t.Errorf("expected total %d, got %d", total, tt)
+		}
+	})
+	if nil != err {
+		t.Fatalf("verify lazy cache failed: %s", err)
+	}
+	if total != checked || !slices.Equal([]string{"/large-files/big1.dat"}, mismatched) {
+		t.Errorf("expected [%d] checked and only big1.dat mismatched, got [%d] %v", total, checked, mismatched)
+	}
+
+	// 校验中途取消
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	checked = 0
+	_, err = repo.VerifyLazyCache(ctx, func(c, tt int) {
+		checked = c
+		if 1 == c {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled error, got %v", err)
+	}
+	if 1 != checked {
+		t.Errorf("expected verification to stop after 1 file, checked %d", checked)
+	}
+}
+
+func TestCanLazyLoad(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	var reportedPath string
+	repo2.FreeDiskSpace = func(p string) int64 {
+		reportedPath = p
+		return 10000
+	}
+
+	// 第二台设备本地存储没有分块，文件和下载后保留的分块都需要空间
+	paths := []string{"large-files/big1.dat", "/large-files/big2.dat", "large-files/big1.dat"}
+	repo2.MinFreeBytes = 3000
+	ok, needBytes, freeBytes, err := repo2.CanLazyLoad(paths)
+	if nil != err {
+		t.Fatalf("check lazy load failed: %s", err)
+	}
+	if !ok || 6000 != needBytes || 10000 != freeBytes || repo2.DataPath != reportedPath {
+		t.Errorf("expected fit with 6000 needed and 10000 free, got ok [%v] need [%d] free [%d]", ok, needBytes, freeBytes)
+	}
+
+	repo2.MinFreeBytes = 5000
+	if ok, _, _, err = repo2.CanLazyLoad(paths); nil != err || ok {
+		t.Errorf("expected no fit when reserving 5000 bytes, got ok [%v] err [%v]", ok, err)
+	}
+
+	// 已下载的文件不需要空间
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err = repo2.LazyLoadFile(filepath.Join(testLazyDataPath, "large-files/big2.dat"), context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	if ok, needBytes, _, err = repo2.CanLazyLoad(paths); nil != err || !ok || 2000 != needBytes {
+		t.Errorf("expected fit with 2000 needed for big1.dat and its chunks after loading big2.dat, got ok [%v] need [%d] err [%v]", ok, needBytes, err)
+	}
+}
+
+func TestLazyIndexManagerCoalescesSaves(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+
+	if err := os.MkdirAll(testLazyRepoPath, 0755); nil != err {
+		t.Fatalf("mkdir failed: %s", err)
+	}
+
+	patterns := []string{"large-files/*"}
+	mgr := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, patterns)
+	defer mgr.Close()
+	for i := 0; i < 100; i++ {
+		file := entity.NewFile("/large-files/"+strconv.Itoa(i)+".dat", int64(i), 1000)
+		file.Chunks = []string{"chunk-" + strconv.Itoa(i)}
+		mgr.AddLazyFile(file)
+	}
+	mgr.RemoveLazyFile("/large-files/0.dat")
+
+	// 连续的修改合并为一次延迟写入
+	time.Sleep(2 * lazyIndexSaveDelay)
+	mgr.mutex.RLock()
+	writes := mgr.writes
+	mgr.mutex.RUnlock()
+	if 1 != writes {
+		t.Errorf("expected 101 rapid changes to be coalesced into 1 write, got %d writes", writes)
+	}
+	if err := mgr.Flush(); nil != err {
+		t.Fatalf("flush failed: %s", err)
+	}
+	if 1 != mgr.writes {
+		t.Errorf("flush without pending changes should not write, got %d writes", mgr.writes)
+	}
+
+	reloaded := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, patterns)
+	if 99 != len(reloaded.GetLazyFiles()) || nil != reloaded.GetLazyFile("/large-files/0.dat") {
+		t.Errorf("expected 99 files in the final lazy index, got %d", len(reloaded.GetLazyFiles()))
+	}
+
+	// 显式 Flush 立即写入
+	file := entity.NewFile("/large-files/new.dat", 1, 1000)
+	file.Chunks = []string{"chunk-new"}
+	mgr.AddLazyFile(file)
+	if err := mgr.Flush(); nil != err {
+		t.Fatalf("flush failed: %s", err)
+	}
+	if reloaded = NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, patterns); nil == reloaded.GetLazyFile("/large-files/new.dat") {
+		t.Errorf("flushed change should be on disk")
+	}
+}
+
+// slowCloud 下载数据对象时等待 delay，用于模拟慢速云端
+type slowCloud struct {
+	*cloud.Local
+	delay     time.Duration
+	downloads atomic.Int32
+}
+
+func (c *slowCloud) DownloadObject(filePath string) (data []byte, err error) {
+	if strings.HasPrefix(filePath, "objects/") {
+		c.downloads.Add(1)
+		time.Sleep(c.delay)
+	}
+	return c.Local.DownloadObject(filePath)
+}
+
+func TestLazyLoadFileWithDeadline(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	data := writeHugeLazyFile(t)
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	hugeFile := findLazyFile(t, repo2, "/large-files/huge.dat")
+	if 2 > len(hugeFile.Chunks) {
+		t.Fatalf("huge file should have multiple chunks, got %d", len(hugeFile.Chunks))
+	}
+	slow := &slowCloud{Local: localCloud, delay: 300 * time.Millisecond}
+	repo2.cloud = slow
+
+	// 截止时间内只能下载部分分块，文件不写入
+	hugePath := filepath.Join(testLazyDataPath, "large-files/huge.dat")
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	type deadlineResult struct {
+		complete bool
+		bytesGot int64
+		err      error
+	}
+	results := make(chan deadlineResult, 1)
+	go func() {
+		complete, bytesGot, err := repo2.LazyLoadFileWithDeadline(hugePath, 100*time.Millisecond, context)
+		results <- deadlineResult{complete, bytesGot, err}
+	}()
+
+	// 下载分块时不持有仓库锁
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	lock.Lock()
+	lock.Unlock()
+	if waited := time.Since(start); 150*time.Millisecond < waited {
+		t.Errorf("repo lock should not be held while downloading, waited [%s]", waited)
+	}
+
+	result := <-results
+	complete, bytesGot, err := result.complete, result.bytesGot, result.err
+	if nil != err {
+		t.Fatalf("lazy load file with deadline failed: %s", err)
+	}
+	if complete || 1 > bytesGot || int64(len(data)) <= bytesGot {
+		t.Errorf("expected partial progress, got complete [%v] bytes [%d/%d]", complete, bytesGot, len(data))
+	}
+	if gulu.File.IsExist(hugePath) {
+		t.Errorf("incomplete file should not be written")
+	}
+	partialDownloads := slow.downloads.Load()
+
+	// 继续加载时只下载剩余的分块
+	complete, bytesGot, err = repo2.LazyLoadFileWithDeadline(hugePath, time.Minute, context)
+	if nil != err {
+		t.Fatalf("lazy load file with deadline failed: %s", err)
+	}
+	if !complete || int64(len(data)) != bytesGot {
+		t.Errorf("expected complete load of [%d] bytes, got complete [%v] bytes [%d]", len(data), complete, bytesGot)
+	}
+	if got, _ := os.ReadFile(hugePath); !bytes.Equal(data, got) {
+		t.Errorf("loaded file content mismatch")
+	}
+	if total := slow.downloads.Load(); int(total) > len(hugeFile.Chunks)+1 {
+		t.Errorf("expected chunks downloaded once, got [%d] downloads ([%d] in the first call) for [%d] chunks", total, partialDownloads, len(hugeFile.Chunks))
+	}
+}
+
+func TestLazyLoadFileDedupesPathSpellings(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	repo2.cloud = &slowCloud{Local: localCloud, delay: 300 * time.Millisecond}
+	logger := &recordingAccessLogger{events: make(chan *LazyAccessEvent, 8)}
+	repo2.LazyAccessLogger = logger
+
+	absPath, _ := filepath.Abs(filepath.Join(testLazyDataPath, "large-files/big1.dat"))
+	spellings := []string{absPath, "large-files/big1.dat", "/large-files/big1.dat"}
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	errs := make(chan error, len(spellings))
+	for _, p := range spellings {
+		go func() { errs <- repo2.LazyLoadFile(p, context) }()
+	}
+	for range spellings {
+		if err := <-errs; nil != err {
+			t.Fatalf("lazy load file failed: %s", err)
+		}
+	}
+
+	// 每个执行的任务记录一次访问，三种写法共用一个任务
+	if event := <-logger.events; "/large-files/big1.dat" != event.Path || !event.Success {
+		t.Errorf("unexpected access event %+v", event)
+	}
+	select {
+	case event := <-logger.events:
+		t.Errorf("expected a single download, got another access event %+v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestLazyEvents(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+
+	// eventbus 不支持取消订阅，处理函数不能阻塞后续测试
+	events := make(chan interface{}, 1024)
+	record := func(event interface{}) {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+	eventbus.Subscribe(EvtLazyFileMiss, func(context map[string]interface{}, event *LazyFileMissEvent) { record(event) })
+	eventbus.Subscribe(EvtLazyDownloadStart, func(context map[string]interface{}, event *LazyDownloadStartEvent) { record(event) })
+	eventbus.Subscribe(EvtLazyDownloadProgress, func(context map[string]interface{}, event *LazyDownloadProgressEvent) { record(event) })
+	eventbus.Subscribe(EvtLazyDownloadEnd, func(context map[string]interface{}, event *LazyDownloadEndEvent) { record(event) })
+	eventbus.Subscribe(EvtLazyAssetError, func(context map[string]interface{}, event *LazyAssetErrorEvent) { record(event) })
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo2.LazyLoadFile("large-files/big1.dat", context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	if _, ok := context[ctxLazyPath]; ok {
+		t.Errorf("caller context should not be modified")
+	}
+
+	var miss *LazyFileMissEvent
+	var start *LazyDownloadStartEvent
+	var progress []*LazyDownloadProgressEvent
+	var end *LazyDownloadEndEvent
+	for nil == end {
+		select {
+		case event := <-events:
+			switch e := event.(type) {
+			case *LazyFileMissEvent:
+				miss = e
+			case *LazyDownloadStartEvent:
+				start = e
+			case *LazyDownloadProgressEvent:
+				progress = append(progress, e)
+			case *LazyDownloadEndEvent:
+				end = e
+			case *LazyAssetErrorEvent:
+				t.Fatalf("unexpected asset error event %+v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lazy download end event")
+		}
+	}
+	const relPath = "/large-files/big1.dat"
+	if nil == miss || relPath != miss.Path {
+		t.Errorf("unexpected miss event %+v", miss)
+	}
+	if nil == start || relPath != start.Path || 1 > start.Chunks || 0 != start.CachedChunks {
+		t.Fatalf("unexpected start event %+v", start)
+	}
+	if len(progress) != start.Chunks {
+		t.Errorf("expected %d progress events, got %d", start.Chunks, len(progress))
+	}
+	for _, p := range progress {
+		if relPath != p.Path || p.Total != start.Chunks || 0 >= p.Length {
+			t.Errorf("unexpected progress event %+v", p)
+		}
+	}
+	if !end.Success || nil != end.Err || relPath != end.Path {
+		t.Errorf("unexpected end event %+v", end)
+	}
+
+	if err := repo2.LazyLoadFile("large-files/not-exist.dat", context); nil == err {
+		t.Fatalf("expected lazy load of unknown file to fail")
+	}
+	for assetErr := (*LazyAssetErrorEvent)(nil); nil == assetErr; {
+		select {
+		case event := <-events:
+			if e, ok := event.(*LazyAssetErrorEvent); ok {
+				assetErr = e
+				if "/large-files/not-exist.dat" != e.Path || nil == e.Err {
+					t.Errorf("unexpected asset error event %+v", e)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lazy asset error event")
+		}
+	}
+}
+
+type readOnlyCloud struct {
+	*cloud.Local
+	uploads atomic.Int32
+}
+
+func (c *readOnlyCloud) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	c.uploads.Add(1)
+	return 0, cloud.ErrCloudForbidden
+}
+
+func TestLazyReadOnlyCloud(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	roCloud := &readOnlyCloud{Local: localCloud}
+	repo2.cloud = roCloud
+	repo2.ReadOnlyCloud = true
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo2.LazyLoadFile("large-files/big2.dat", context); nil != err {
+		t.Fatalf("lazy load over read-only cloud failed: %s", err)
+	}
+
+	bigPath := filepath.Join(repo2.DataPath, "large-files/big2.dat")
+	if err := os.WriteFile(bigPath, []byte(strings.Repeat("R", 3000)), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(bigPath, future, future)
+	if err := repo2.ReindexLazyFile(bigPath, context); nil != err {
+		t.Fatalf("reindex over read-only cloud failed: %s", err)
+	}
+	if 0 != roCloud.uploads.Load() {
+		t.Errorf("expected no upload attempts, got %d", roCloud.uploads.Load())
+	}
+
+	lazyFile := repo2.lazyIndexMgr.GetLazyFile("/large-files/big2.dat")
+	if nil == lazyFile || 3000 != lazyFile.Size {
+		t.Fatalf("expected reindexed lazy file to be recorded locally, got %+v", lazyFile)
+	}
+	for _, chunkID := range lazyFile.Chunks {
+		if _, err := repo2.store.Stat(chunkID); nil != err {
+			t.Errorf("chunk [%s] should be kept locally: %s", chunkID, err)
+		}
+	}
+	if err := repo2.LazySelfTest(context); nil == err {
+		t.Errorf("expected lazy self test to be rejected over read-only cloud")
+	}
+}
+
+func TestLazyOrphans(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test lazy orphans", false, context); nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	orphans, err := repo.FindLazyOrphans()
+	if nil != err {
+		t.Fatalf("find orphans failed: %s", err)
+	}
+	if 0 != len(orphans) {
+		t.Fatalf("expected no orphans after index, got %v", orphans)
+	}
+
+	for _, name := range []string{"orphan1.dat", "orphan2.dat"} {
+		if err = os.WriteFile(filepath.Join(testLazyDataPath, "large-files", name), []byte(strings.Repeat("O", 2000)), 0644); nil != err {
+			t.Fatalf("write orphan failed: %s", err)
+		}
+	}
+	// 不匹配懒加载模式的文件不是孤儿文件
+	if err = os.WriteFile(filepath.Join(testLazyDataPath, "docs", "not-lazy.txt"), []byte("doc"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+
+	orphans, err = repo.FindLazyOrphans()
+	if nil != err {
+		t.Fatalf("find orphans failed: %s", err)
+	}
+	if !slices.Equal([]string{"/large-files/orphan1.dat", "/large-files/orphan2.dat"}, orphans) {
+		t.Fatalf("unexpected orphans %v", orphans)
+	}
+
+	if err = repo.ResolveLazyOrphans(orphans[:1], true, context); nil != err {
+		t.Fatalf("adopt orphan failed: %s", err)
+	}
+	if nil == repo.lazyIndexMgr.GetLazyFile("/large-files/orphan1.dat") {
+		t.Errorf("adopted orphan should be registered in the lazy index")
+	}
+	if err = repo.ResolveLazyOrphans(orphans[:1], false, context); nil == err {
+		t.Errorf("expected removing a registered file to be rejected")
+	}
+	if err = repo.ResolveLazyOrphans(orphans[1:], false, context); nil != err {
+		t.Fatalf("remove orphan failed: %s", err)
+	}
+	if gulu.File.IsExist(filepath.Join(testLazyDataPath, "large-files", "orphan2.dat")) {
+		t.Errorf("removed orphan should be deleted from disk")
+	}
+
+	if orphans, err = repo.FindLazyOrphans(); nil != err || 0 != len(orphans) {
+		t.Errorf("expected no orphans left, got %v (%v)", orphans, err)
+	}
+}
+
+func TestLazyOrphansWithSubroot(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	if err := repo.SetLazySubroot("large-files"); nil != err {
+		t.Fatalf("set lazy subroot failed: %s", err)
+	}
+	if err := repo.SetLazyLoadingPatterns([]string{"*.dat"}); nil != err {
+		t.Fatalf("set lazy loading patterns failed: %s", err)
+	}
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test lazy orphans with subroot", false, context); nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+
+	orphanPath := filepath.Join(testLazyDataPath, "large-files", "orphan.dat")
+	if err := os.WriteFile(orphanPath, []byte(strings.Repeat("O", 2000)), 0644); nil != err {
+		t.Fatalf("write orphan failed: %s", err)
+	}
+	orphans, err := repo.FindLazyOrphans()
+	if nil != err {
+		t.Fatalf("find orphans failed: %s", err)
+	}
+	if !slices.Equal([]string{"/large-files/orphan.dat"}, orphans) {
+		t.Fatalf("unexpected orphans %v", orphans)
+	}
+
+	// FindLazyOrphans 返回的索引路径已经包含根目录，删除时不能再拼接根目录
+	if err = repo.ResolveLazyOrphans(orphans, false, context); nil != err {
+		t.Fatalf("remove orphan failed: %s", err)
+	}
+	if gulu.File.IsExist(orphanPath) {
+		t.Errorf("removed orphan should be deleted from disk")
+	}
+	if orphans, err = repo.FindLazyOrphans(); nil != err || 0 != len(orphans) {
+		t.Errorf("expected no orphans left, got %v (%v)", orphans, err)
+	}
+}
+
+func TestLazyChunkProvider(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	data := writeHugeLazyFile(t)
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+
+	// 外部存储直接使用第一台设备从云端取到的分块
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	var provided atomic.Int32
+	repo2.ChunkProvider = func(chunkID string) ([]byte, bool, error) {
+		_, chunk, err := repo.downloadCloudChunk(chunkID, 0, 0, context)
+		if nil != err {
+			return nil, false, err
+		}
+		provided.Add(1)
+		return chunk.Data, true, nil
+	}
+	countingCloud := &countingDownloadCloud{Local: localCloud}
+	repo2.cloud = countingCloud
+
+	hugePath := filepath.Join(repo2.DataPath, "large-files/huge.dat")
+	if err := repo2.LazyLoadFile(hugePath, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	got, err := os.ReadFile(hugePath)
+	if nil != err || !bytes.Equal(data, got) {
+		t.Fatalf("lazy loaded content mismatch: %v", err)
+	}
+	if 2 > provided.Load() {
+		t.Errorf("expected all chunks to be supplied by the provider, got %d", provided.Load())
+	}
+	if 0 != len(countingCloud.downloaded()) {
+		t.Errorf("cloud should not be called, got downloads %v", countingCloud.downloaded())
+	}
+}
+
+func TestEvictLazyFilesCleanupChunks(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	writeHugeLazyFile(t)
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	paths := []string{"large-files/huge.dat", "large-files/big1.dat", "large-files/big2.dat"}
+	var chunkIDs []string
+	for _, p := range paths {
+		if err := repo2.LazyLoadFile(p, context); nil != err {
+			t.Fatalf("lazy load file [%s] failed: %s", p, err)
+		}
+		chunkIDs = append(chunkIDs, repo2.lazyIndexMgr.GetLazyFile(lazyIndexPath(p)).Chunks...)
+	}
+	for _, chunkID := range chunkIDs {
+		if _, err := repo2.store.Stat(chunkID); nil != err {
+			t.Fatalf("chunk [%s] of loaded file should be stored locally: %s", chunkID, err)
+		}
+	}
+
+	// 一轮驱逐结束后统一清理所有被驱逐文件的分块
+	if _, err := repo2.EvictLazyFilesToSize(0); nil != err {
+		t.Fatalf("evict to size failed: %s", err)
+	}
+	for _, p := range paths {
+		if !repo2.lazyIndexMgr.IsEvicted(lazyIndexPath(p)) {
+			t.Errorf("file [%s] should be evicted", p)
+		}
+	}
+	for _, chunkID := range chunkIDs {
+		if _, err := repo2.store.Stat(chunkID); nil == err {
+			t.Errorf("chunk [%s] of evicted file should be removed", chunkID)
+		}
+	}
+}
+
+func TestEvictLazyFilesToSize(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	writeHugeLazyFile(t)
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+
+	// 按访问顺序加载，huge.dat 最久没有使用
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	paths := []string{"large-files/huge.dat", "large-files/big1.dat", "large-files/big2.dat"}
+	for _, p := range paths {
+		if err := repo2.LazyLoadFile(p, context); nil != err {
+			t.Fatalf("lazy load file [%s] failed: %s", p, err)
+		}
+	}
+	sizes := map[string]int64{}
+	for _, p := range paths {
+		info, err := os.Stat(filepath.Join(repo2.DataPath, p))
+		if nil != err {
+			t.Fatalf("stat file failed: %s", err)
+		}
+		sizes[p] = info.Size()
+	}
+	total := repo2.localLazyFilesSize()
+
+	freed, err := repo2.EvictLazyFilesToSize(total - 1)
+	if nil != err {
+		t.Fatalf("evict to size failed: %s", err)
+	}
+	if sizes["large-files/huge.dat"] != freed {
+		t.Errorf("expected to free the least recently used file [%d], freed [%d]", sizes["large-files/huge.dat"], freed)
+	}
+	if size := repo2.localLazyFilesSize(); total-1 < size || total-freed != size {
+		t.Errorf("unexpected local lazy size [%d] after eviction", size)
+	}
+	if gulu.File.IsExist(filepath.Join(repo2.DataPath, "large-files/huge.dat")) || !repo2.lazyIndexMgr.IsEvicted("/large-files/huge.dat") {
+		t.Errorf("huge.dat should be evicted")
+	}
+
+	// 固定的文件不会被驱逐
+	repo2.LazyPinPredicate = func(file *entity.File) bool { return "/large-files/big1.dat" == file.Path }
+	if freed, err = repo2.EvictLazyFilesToSize(0); nil != err {
+		t.Fatalf("evict to size failed: %s", err)
+	}
+	if sizes["large-files/big2.dat"] != freed {
+		t.Errorf("expected to free big2.dat [%d], freed [%d]", sizes["large-files/big2.dat"], freed)
+	}
+	if size := repo2.localLazyFilesSize(); sizes["large-files/big1.dat"] != size {
+		t.Errorf("only the pinned file should be left, local lazy size [%d]", size)
+	}
+}
+
+func TestLazyCleanupKeepsSharedChunks(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	// 普通文件和懒加载文件内容相同，共享同一个分块
+	content := []byte(strings.Repeat("S", 1500))
+	if err := os.WriteFile(filepath.Join(testLazyDataPath, "docs", "shared.txt"), content, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(testLazyDataPath, "large-files", "shared.dat"), content, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test shared chunks", false, context)
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	sharedChunk := util.Hash(content)
+	if _, err = repo.store.Stat(sharedChunk); nil != err {
+		t.Fatalf("chunk shared with a non lazy file should survive lazy cleanup: %s", err)
+	}
+
+	// 删除懒加载文件后共享的分块仍然可以用于迁出普通文件
+	if err = os.Remove(filepath.Join(testLazyDataPath, "large-files", "shared.dat")); nil != err {
+		t.Fatalf("remove file failed: %s", err)
+	}
+	if _, err = repo.EvictSyncedLazyFiles(context); nil != err {
+		t.Fatalf("evict synced lazy files failed: %s", err)
+	}
+	if _, err = repo.store.Stat(sharedChunk); nil != err {
+		t.Fatalf("shared chunk should survive removing one of the files: %s", err)
+	}
+	os.Remove(filepath.Join(testLazyDataPath, "docs", "shared.txt"))
+	if _, _, err = repo.Checkout(index.ID, context); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+	}
+	if got, readErr := os.ReadFile(filepath.Join(testLazyDataPath, "docs", "shared.txt")); nil != readErr || !bytes.Equal(content, got) {
+		t.Errorf("checkout of the non lazy file failed: %v", readErr)
+	}
+}
+
+func TestGCLazyChunks(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	uniquePath := filepath.Join(testLazyDataPath, "docs", "gc-unique.txt")
+	uniqueContent := []byte(strings.Repeat("G", 1500))
+	if err := os.WriteFile(uniquePath, uniqueContent, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	oldIndex, err := repo.Index("Test gc old", false, context)
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	// 所有索引都还在时不回收任何对象
+	if removedLocal, removedCloud, gcErr := repo.GCLazyChunks(context); nil != gcErr || 0 != removedLocal || 0 != removedCloud {
+		t.Fatalf("expected nothing to collect, removed [%d] local, [%d] cloud: %v", removedLocal, removedCloud, gcErr)
+	}
+
+	if err = os.Remove(uniquePath); nil != err {
+		t.Fatalf("remove file failed: %s", err)
+	}
+	time.Sleep(time.Second)
+	if _, err = repo.Index("Test gc new", false, context); nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	// 删除旧快照后，只被旧快照引用的文件和分块可以回收
+	uniqueChunk := util.Hash(uniqueContent)
+	var sharedChunk string
+	for _, file := range repo.lazyIndexMgr.GetLazyFiles() {
+		sharedChunk = file.Chunks[0]
+		break
+	}
+	os.Remove(filepath.Join(repo.Path, "indexes", oldIndex.ID))
+	if err = localCloud.RemoveObject("indexes/" + oldIndex.ID); nil != err {
+		t.Fatalf("remove cloud index failed: %s", err)
+	}
+
+	// 只读云端只回收本地存储
+	repo.ReadOnlyCloud = true
+	removedLocal, removedCloud, err := repo.GCLazyChunks(context)
+	if nil != err {
+		t.Fatalf("gc lazy chunks failed: %s", err)
+	}
+	if 1 > removedLocal || 0 != removedCloud {
+		t.Errorf("expected only local objects to be collected over read-only cloud, removed [%d] local, [%d] cloud", removedLocal, removedCloud)
+	}
+	if _, statErr := repo.store.Stat(uniqueChunk); nil == statErr {
+		t.Errorf("unreferenced local chunk should be removed")
+	}
+	if _, dlErr := localCloud.DownloadObject(cloudObjectKey(uniqueChunk)); nil != dlErr {
+		t.Errorf("cloud chunk should not be removed over read-only cloud: %s", dlErr)
+	}
+	if _, err = repo.PurgeCloud(); nil == err {
+		t.Errorf("expected purging read-only cloud to be rejected")
+	}
+
+	repo.ReadOnlyCloud = false
+	if _, removedCloud, err = repo.GCLazyChunks(context); nil != err {
+		t.Fatalf("gc lazy chunks failed: %s", err)
+	}
+	if 1 > removedCloud {
+		t.Errorf("expected unreferenced cloud objects to be collected, removed [%d]", removedCloud)
+	}
+	if _, dlErr := localCloud.DownloadObject(cloudObjectKey(uniqueChunk)); nil == dlErr {
+		t.Errorf("unreferenced cloud chunk should be removed")
+	}
+	if _, dlErr := localCloud.DownloadObject(cloudObjectKey(sharedChunk)); nil != dlErr {
+		t.Errorf("referenced lazy chunk should survive: %s", dlErr)
+	}
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+	}
+	if err = repo.VerifyIndex(latest.ID); nil != err {
+		t.Errorf("latest index should stay intact after gc: %s", err)
+	}
+
+	if removedLocal, removedCloud, err = repo.GCLazyChunks(context); nil != err || 0 != removedLocal || 0 != removedCloud {
+		t.Errorf("second gc should remove nothing, removed [%d] local, [%d] cloud: %v", removedLocal, removedCloud, err)
+	}
+}
+
+func TestGCLazyChunksKeepsUntaggedIndexes(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	uniquePath := filepath.Join(testLazyDataPath, "docs", "gc-unique.txt")
+	uniqueContent := []byte(strings.Repeat("H", 1500))
+	if err := os.WriteFile(uniquePath, uniqueContent, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	oldIndex, err := repo.Index("Test gc keep old", false, context)
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	if err = os.Remove(uniquePath); nil != err {
+		t.Fatalf("remove file failed: %s", err)
+	}
+	time.Sleep(time.Second)
+	if _, err = repo.Index("Test gc keep new", false, context); nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	// 旧快照没有被 refs 引用，但仍然是快照历史的一部分，回收时不能删除旧快照以及它引用的文件和分块
+	removedLocal, removedCloud, err := repo.GCLazyChunks(context)
+	if nil != err {
+		t.Fatalf("gc lazy chunks failed: %s", err)
+	}
+	if 0 != removedLocal || 0 != removedCloud {
+		t.Errorf("expected nothing to collect, removed [%d] local, [%d] cloud", removedLocal, removedCloud)
+	}
+	if _, err = repo.store.GetIndex(oldIndex.ID); nil != err {
+		t.Errorf("untagged index should survive gc: %s", err)
+	}
+	if _, err = localCloud.DownloadObject("indexes/" + oldIndex.ID); nil != err {
+		t.Errorf("untagged cloud index should survive gc: %s", err)
+	}
+	uniqueChunk := util.Hash(uniqueContent)
+	if _, err = repo.store.Stat(uniqueChunk); nil != err {
+		t.Errorf("chunk referenced by untagged index should survive gc: %s", err)
+	}
+	if _, err = localCloud.DownloadObject(cloudObjectKey(uniqueChunk)); nil != err {
+		t.Errorf("cloud chunk referenced by untagged index should survive gc: %s", err)
+	}
+	if err = repo.VerifyIndex(oldIndex.ID); nil != err {
+		t.Errorf("untagged index should stay intact after gc: %s", err)
+	}
+}
+
+func TestGetAllLazyFileVersions(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test lazy versions 1", false, context); nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+
+	bigPath := filepath.Join(testLazyDataPath, "large-files/big2.dat")
+	if err := os.WriteFile(bigPath, []byte(strings.Repeat("V", 2500)), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(bigPath, future, future)
+	if _, err := repo.Index("Test lazy versions 2", false, context); nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+
+	versions, err := repo.GetAllLazyFileVersions()
+	if nil != err {
+		t.Fatalf("get all lazy file versions failed: %s", err)
+	}
+	var big1, big2 []*entity.File
+	for _, file := range versions {
+		if !repo.isLazyLoadingFile(file.Path) {
+			t.Errorf("unexpected non lazy file [%s]", file.Path)
+		}
+		switch file.Path {
+		case "/large-files/big1.dat":
+			big1 = append(big1, file)
+		case "/large-files/big2.dat":
+			big2 = append(big2, file)
+		}
+	}
+	if 1 != len(big1) {
+		t.Errorf("unchanged file should have one version, got %d", len(big1))
+	}
+	if 2 != len(big2) {
+		t.Fatalf("changed file should have two versions, got %d", len(big2))
+	}
+	if big2[0].ID == big2[1].ID || big2[0].Updated >= big2[1].Updated || 2500 != big2[1].Size {
+		t.Errorf("unexpected versions %+v, %+v", big2[0], big2[1])
+	}
+}
+
+type concurrencyTrackingCloud struct {
+	*cloud.Local
+	active  atomic.Int32
+	peak    atomic.Int32
+	uploads atomic.Int32
+}
+
+func (c *concurrencyTrackingCloud) UploadObject(filePath string, overwrite bool) (length int64, err error) {
+	if strings.HasPrefix(filePath, "objects/") {
+		active := c.active.Add(1)
+		defer c.active.Add(-1)
+		for {
+			peak := c.peak.Load()
+			if active <= peak || c.peak.CompareAndSwap(peak, active) {
+				break
+			}
+		}
+		c.uploads.Add(1)
+		time.Sleep(30 * time.Millisecond)
+	}
+	return c.Local.UploadObject(filePath, overwrite)
+}
+
+func (c *concurrencyTrackingCloud) GetConcurrentReqs() int {
+	return 8
+}
+
+func TestMaxIndexUploadConcurrency(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test index upload concurrency", false, context); nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	if _, err := repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	trackingCloud := &concurrencyTrackingCloud{Local: localCloud}
+	repo.cloud = trackingCloud
+	repo.MaxIndexUploadConcurrency = 2
+
+	// 新的大文件有多个分块，重新索引时并发上传
+	writeHugeLazyFile(t)
+	hugePath := filepath.Join(testLazyDataPath, "large-files/huge.dat")
+	if err := repo.ReindexLazyFile(hugePath, context); nil != err {
+		t.Fatalf("reindex lazy file failed: %s", err)
+	}
+	if 3 > trackingCloud.uploads.Load() {
+		t.Fatalf("expected several chunk uploads, got %d", trackingCloud.uploads.Load())
+	}
+	if peak := trackingCloud.peak.Load(); 2 != peak {
+		t.Errorf("expected concurrent uploads bounded by 2, peak %d", peak)
+	}
+}
+
+func TestIndexPreview(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	trackingCloud := &concurrencyTrackingCloud{Local: localCloud}
+	repo.cloud = trackingCloud
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	preview, err := repo.IndexPreview("Test index preview", context)
+	if nil != err {
+		t.Fatalf("index preview failed: %s", err)
+	}
+	if "" != preview.Index.ID || 1 > preview.LazyCount || preview.Index.Count != len(preview.Upserts) || 0 != len(preview.Removes) {
+		t.Fatalf("unexpected preview of the first index: %+v", preview)
+	}
+	if _, latestErr := repo.Latest(); !errors.Is(latestErr, ErrNotFoundIndex) {
+		t.Fatalf("preview should not create an index")
+	}
+	if 0 != trackingCloud.uploads.Load() {
+		t.Fatalf("preview should not upload, got %d uploads", trackingCloud.uploads.Load())
+	}
+
+	index, err := repo.Index("Test index preview", false, context)
+	if nil != err {
+		t.Fatalf("index failed: %s", err)
+	}
+	if index.Count != preview.Index.Count || index.Size != preview.Index.Size || !slices.Equal(index.Files, preview.Index.Files) {
+		t.Errorf("preview [count=%d, size=%d] does not match index [count=%d, size=%d]", preview.Index.Count, preview.Index.Size, index.Count, index.Size)
+	}
+
+	if err = os.WriteFile(filepath.Join(testLazyDataPath, "large-files", "preview.dat"), []byte("preview"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	if preview, err = repo.IndexPreview("Test index preview", context); nil != err {
+		t.Fatalf("index preview failed: %s", err)
+	}
+	if 1 != len(preview.Upserts) || "/large-files/preview.dat" != preview.Upserts[0].Path || index.Count+1 != preview.Index.Count {
+		t.Errorf("unexpected preview after adding a lazy file: %+v", preview)
+	}
+	if latest, _ := repo.Latest(); index.ID != latest.ID {
+		t.Errorf("preview should not change the latest index")
+	}
+	if 0 != trackingCloud.uploads.Load() {
+		t.Errorf("preview should not upload, got %d uploads", trackingCloud.uploads.Load())
+	}
+}
+
+func TestLazyLoadFilesBatchErrors(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+
+	// big1.dat 的分块在云端丢失，big2.dat 的分块在云端被篡改
+	missing, err := repo2.getLazyFile("/large-files/big1.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	if err = localCloud.RemoveObject(cloudObjectKey(missing.Chunks[0])); nil != err {
+		t.Fatalf("remove chunk from cloud failed: %s", err)
+	}
+	corrupted, err := repo2.getLazyFile("/large-files/big2.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	data, err := repo2.store.encodeData([]byte("corrupted"))
+	if nil != err {
+		t.Fatalf("encode data failed: %s", err)
+	}
+	if _, err = localCloud.UploadBytes(cloudObjectKey(corrupted.Chunks[0]), data, true); nil != err {
+		t.Fatalf("overwrite chunk in cloud failed: %s", err)
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	result, err := repo2.LazyLoadFilesBatch([]string{"large-files/big1.dat", "large-files/big2.dat", "video.mp4"}, context)
+	if nil != err {
+		t.Fatalf("lazy load files batch failed: %s", err)
+	}
+	if !slices.Equal([]string{"video.mp4"}, result.Loaded) {
+		t.Errorf("expected only video.mp4 to be loaded, got %v", result.Loaded)
+	}
+	if err = result.Errors["large-files/big1.dat"]; !errors.Is(err, ErrLazyChunkMissing) || !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Errorf("expected chunk missing for big1.dat, got %v", err)
+	}
+	if err = result.Errors["large-files/big2.dat"]; !errors.Is(err, ErrLazyHashMismatch) {
+		t.Errorf("expected hash mismatch for big2.dat, got %v", err)
+	}
+	if failed := result.Failed(ErrLazyCloudUnreachable); 0 != len(failed) {
+		t.Errorf("unexpected cloud unreachable paths %v", failed)
+	}
+	if failed := result.Failed(ErrLazyHashMismatch); !slices.Equal([]string{"large-files/big2.dat"}, failed) {
+		t.Errorf("unexpected hash mismatch paths %v", failed)
+	}
+}
+
+func TestChunkBundleRoundTrip(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	data := writeHugeLazyFile(t)
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	hugePath := filepath.Join(repo2.DataPath, "large-files/huge.dat")
+	if err := repo2.LazyLoadFile(hugePath, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	file, err := repo2.getLazyFile("/large-files/huge.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+
+	bundle := &bytes.Buffer{}
+	if err = repo2.ExportChunkBundle(file.Chunks, bundle); nil != err {
+		t.Fatalf("export chunk bundle failed: %s", err)
+	}
+
+	// 模拟新设备：本地没有分块，也无法访问云端
+	for _, chunkID := range file.Chunks {
+		if err = repo2.store.Remove(chunkID); nil != err {
+			t.Fatalf("remove chunk failed: %s", err)
+		}
+	}
+	if err = os.Remove(hugePath); nil != err {
+		t.Fatalf("remove file failed: %s", err)
+	}
+	repo2.cloud = &unreachableCloud{Local: localCloud, err: cloud.ErrCloudServiceUnavailable}
+
+	imported, err := repo2.ImportChunkBundle(bundle)
+	if nil != err {
+		t.Fatalf("import chunk bundle failed: %s", err)
+	}
+	if len(gulu.Str.RemoveDuplicatedElem(file.Chunks)) != imported {
+		t.Errorf("expected [%d] imported chunks, got [%d]", len(file.Chunks), imported)
+	}
+
+	if err = repo2.LazyLoadFile(hugePath, context); nil != err {
+		t.Fatalf("lazy load file offline failed: %s", err)
+	}
+	got, err := os.ReadFile(hugePath)
+	if nil != err || !bytes.Equal(data, got) {
+		t.Fatalf("lazy loaded content mismatch: %v", err)
+	}
+
+	// 超过分块最大大小的条目在读取内容前被拒绝
+	oversized := &bytes.Buffer{}
+	tw := tar.NewWriter(oversized)
+	if err = tw.WriteHeader(&tar.Header{Name: file.Chunks[0], Mode: 0644, Size: maxChunkBundleEntrySize + 1}); nil != err {
+		t.Fatalf("write tar header failed: %s", err)
+	}
+	if _, err = repo2.ImportChunkBundle(oversized); !errors.Is(err, ErrChunkBundleEntryTooLarge) {
+		t.Errorf("expected ErrChunkBundleEntryTooLarge, got [%v]", err)
+	}
+}
+
+func TestLazyTrackedFilesPreferLatest(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	// 懒加载索引中残留同一路径的旧记录，分块已经不存在
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	file, err := repo2.getLazyFile("/large-files/big1.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	stale := *file
+	stale.ID = util.Hash([]byte("stale big1.dat"))
+	stale.Chunks = []string{util.Hash([]byte("stale chunk"))}
+	repo2.lazyIndexMgr.AddLazyFile(&stale)
+
+	lock.Lock()
+	files, err := repo2.lazyTrackedFiles()
+	lock.Unlock()
+	if nil != err {
+		t.Fatalf("get tracked lazy files failed: %s", err)
+	}
+	if tracked := files["/large-files/big1.dat"]; nil == tracked || file.ID != tracked.ID {
+		t.Errorf("expected the latest index entry of big1.dat, got %+v", tracked)
+	}
+
+	lost, err := repo2.VerifyChunkAvailability()
+	if nil != err {
+		t.Fatalf("verify chunk availability failed: %s", err)
+	}
+	if 0 != len(lost) {
+		t.Errorf("stale lazy index entries should not be reported, got %v", lost)
+	}
+}
+
+func TestVerifyChunkAvailability(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	lost, err := repo2.VerifyChunkAvailability()
+	if nil != err {
+		t.Fatalf("verify chunk availability failed: %s", err)
+	}
+	if 0 != len(lost) {
+		t.Fatalf("expected all chunks to be available, got %v", lost)
+	}
+
+	// big1.dat 的分块在本地存储和云端都丢失
+	file, err := repo2.getLazyFile("/large-files/big1.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	chunkID := file.Chunks[0]
+	if err = repo2.store.Remove(chunkID); nil != err {
+		t.Fatalf("remove local chunk failed: %s", err)
+	}
+	if err = localCloud.RemoveObject(cloudObjectKey(chunkID)); nil != err {
+		t.Fatalf("remove cloud chunk failed: %s", err)
+	}
+
+	if lost, err = repo2.VerifyChunkAvailability(); nil != err {
+		t.Fatalf("verify chunk availability failed: %s", err)
+	}
+	if 1 != len(lost) || !slices.Equal([]string{chunkID}, lost["/large-files/big1.dat"]) {
+		t.Errorf("expected big1.dat to be reported with chunk [%s], got %v", chunkID, lost)
+	}
+}
+
+func TestLazyReadAll(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	data := writeHugeLazyFile(t)
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	countingCloud := &countingDownloadCloud{Local: localCloud}
+	repo2.cloud = countingCloud
+
+	// 超过上限时在下载前返回错误
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo2.LazyReadAll("large-files/huge.dat", int64(len(data))-1, context); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected file too large error, got %v", err)
+	}
+	if 0 != len(countingCloud.downloaded()) {
+		t.Fatalf("file over the cap should not be downloaded, got downloads %v", countingCloud.downloaded())
+	}
+
+	got, err := repo2.LazyReadAll("large-files/huge.dat", int64(len(data)), context)
+	if nil != err {
+		t.Fatalf("lazy read all failed: %s", err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatalf("lazy read content mismatch")
+	}
+	if 1 > len(countingCloud.downloaded()) {
+		t.Errorf("expected chunks to be downloaded")
+	}
+	if gulu.File.IsExist(filepath.Join(repo2.DataPath, "large-files/huge.dat")) {
+		t.Errorf("lazy read all should not write the file to the data folder")
+	}
+}
+
+func TestListUnuploadedLazyFiles(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test unuploaded", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err := repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+	files, err := repo.ListUnuploadedLazyFiles(context)
+	if nil != err {
+		t.Fatalf("list unuploaded lazy files failed: %s", err)
+	}
+	if 0 != len(files) {
+		t.Fatalf("expected all lazy files to be uploaded, got %+v", files)
+	}
+
+	// 重新索引时跳过上传，新文件只在本地
+	if err = os.WriteFile(filepath.Join(testLazyDataPath, "large-files", "local-only.dat"), []byte("local only"), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	repo.ReadOnlyCloud = true
+	if err = repo.ReindexLazyFile("large-files/local-only.dat", context); nil != err {
+		t.Fatalf("reindex lazy file failed: %s", err)
+	}
+	if files, err = repo.ListUnuploadedLazyFiles(context); nil != err {
+		t.Fatalf("list unuploaded lazy files failed: %s", err)
+	}
+	if 1 != len(files) || "/large-files/local-only.dat" != files[0].Path {
+		t.Errorf("expected only local-only.dat to be unuploaded, got %+v", files)
+	}
+}
+
+// recordingMetricsObserver 用于记录收到的指标观测
+type recordingMetricsObserver struct {
+	mutex     sync.Mutex
+	downloads []int64
+	fromCache []bool
+	evictions []int64
+}
+
+func (o *recordingMetricsObserver) ObserveDownload(bytes int64, dur time.Duration, fromCache bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.downloads = append(o.downloads, bytes)
+	o.fromCache = append(o.fromCache, fromCache)
+}
+
+func (o *recordingMetricsObserver) ObserveEviction(bytes int64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.evictions = append(o.evictions, bytes)
+}
+
+func TestMetricsObserver(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	observer := &recordingMetricsObserver{}
+	repo2.MetricsObserver = observer
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	paths := []string{"large-files/big1.dat", "large-files/big2.dat", "large-files/big1.dat"}
+	for _, p := range paths {
+		if err := repo2.LazyLoadFile(p, context); nil != err {
+			t.Fatalf("lazy load file [%s] failed: %s", p, err)
+		}
+	}
+
+	// 已经在本地的文件不再下载，不产生观测
+	big1, err := repo2.getLazyFile("/large-files/big1.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	if 2 != len(observer.downloads) || big1.Size != observer.downloads[0] || observer.fromCache[0] || observer.fromCache[1] {
+		t.Fatalf("expected one observation per download from cloud, got %v %v", observer.downloads, observer.fromCache)
+	}
+
+	evicted, err := repo2.EvictSyncedLazyFiles(context)
+	if nil != err {
+		t.Fatalf("evict synced lazy files failed: %s", err)
+	}
+	if evicted != len(observer.evictions) || 2 != evicted {
+		t.Errorf("expected one observation per eviction, evicted [%d], got %v", evicted, observer.evictions)
+	}
+}
+
+func TestMigratePreLazyRepo(t *testing.T) {
+	clearLazyTestdata(t)
+	defer clearLazyTestdata(t)
+	createLazyTestData(t)
+
+	aesKey, err := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	if nil != err {
+		t.Fatalf("init aes key failed: %s", err)
+	}
+
+	// 启用懒加载之前的普通仓库，所有文件完整索引
+	repo, err := NewRepo(testLazyDataPath, testLazyRepoPath, testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, nil, nil)
+	if nil != err {
+		t.Fatalf("create repo failed: %s", err)
+	}
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test pre-lazy repo", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+	repo.lazyIndexMgr.Close()
+
+	lazyRepo, err := NewRepoWithLazyLoading(testLazyDataPath, testLazyRepoPath, testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, nil, []string{"large-files/*"}, nil)
+	if nil != err {
+		t.Fatalf("create lazy repo failed: %s", err)
+	}
+	defer lazyRepo.lazyIndexMgr.Close()
+
+	// 打开仓库时不读取最新索引，迁移推迟到第一次用到懒加载索引时
+	if count, _ := lazyRepo.lazyIndexMgr.GetStats(); 0 != count {
+		t.Fatalf("migration should be deferred until the lazy index is used, got [%d] lazy files", count)
+	}
+	orphans, err := lazyRepo.FindLazyOrphans()
+	if nil != err {
+		t.Fatalf("find lazy orphans failed: %s", err)
+	}
+	if 0 != len(orphans) {
+		t.Errorf("migrated files should not be orphans, got %v", orphans)
+	}
+
+	var matched int
+	for _, file := range files {
+		if !lazyRepo.isLazyLoadingFile(file.Path) {
+			if nil != lazyRepo.lazyIndexMgr.GetLazyFile(file.Path) {
+				t.Errorf("file [%s] should not be a lazy entry", file.Path)
+			}
+			continue
+		}
+		matched++
+		lazyFile := lazyRepo.lazyIndexMgr.GetLazyFile(file.Path)
+		if nil == lazyFile || lazyFile.ID != file.ID || !slices.Equal(file.Chunks, lazyFile.Chunks) {
+			t.Errorf("file [%s] should be migrated with its existing chunks, got %+v", file.Path, lazyFile)
+		}
+	}
+	if 1 > matched {
+		t.Fatalf("expected files matching the lazy patterns")
+	}
+	if !gulu.File.IsExist(filepath.Join(testLazyRepoPath, DefaultLazyIndexName)) {
+		t.Errorf("lazy index should be written after migration")
+	}
+}
+
+func TestGetFilesClassified(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo2.LazyLoadFile("large-files/big1.dat", context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+
+	latest, err := repo2.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+	}
+	files, err := repo2.GetFilesClassified(latest)
+	if nil != err {
+		t.Fatalf("get classified files failed: %s", err)
+	}
+	if latest.Count != len(files) {
+		t.Fatalf("expected [%d] files, got [%d]", latest.Count, len(files))
+	}
+
+	var lazy, cached int
+	for _, file := range files {
+		if repo2.isLazyLoadingFile(file.Path) != file.IsLazy {
+			t.Errorf("file [%s] lazy classification mismatch", file.Path)
+		}
+		if expected := file.IsLazy && gulu.File.IsExist(filepath.Join(repo2.DataPath, file.Path)); expected != file.Cached {
+			t.Errorf("file [%s] cached classification mismatch", file.Path)
+		}
+		if file.IsLazy {
+			lazy++
+		}
+		if file.Cached {
+			cached++
+		}
+	}
+	if 2 > lazy || 1 != cached {
+		t.Errorf("unexpected classification, lazy [%d], cached [%d]", lazy, cached)
+	}
+}
+
+func TestLazyFileAppendReusesChunks(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	data := writeHugeLazyFile(t)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test append reuses chunks", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	var old *entity.File
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+	for _, file := range files {
+		if "/large-files/huge.dat" == file.Path {
+			old = file
+		}
+	}
+	if nil == old || 2 > len(old.Chunks) {
+		t.Fatalf("expected huge.dat to have several chunks, got %+v", old)
+	}
+
+	// 分块边界由内容决定，追加数据只影响最后的分块
+	appended := make([]byte, 64*1024)
+	rand.New(rand.NewSource(461)).Read(appended)
+	hugePath := filepath.Join(testLazyDataPath, "large-files/huge.dat")
+	if err = gulu.File.WriteFileSafer(hugePath, append(data, appended...), 0644); nil != err {
+		t.Fatalf("append huge file failed: %s", err)
+	}
+	// 文件 ID 由路径和更新时间计算，避免文件系统时间精度导致追加前后的更新时间相同
+	mtime := time.UnixMilli(old.Updated).Add(time.Second)
+	if err = os.Chtimes(hugePath, mtime, mtime); nil != err {
+		t.Fatalf("change file time failed: %s", err)
+	}
+	if err = repo.ReindexLazyFile(hugePath, context); nil != err {
+		t.Fatalf("reindex lazy file failed: %s", err)
+	}
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+	}
+	if files, err = repo.GetFiles(latest); nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+	var reindexed *entity.File
+	for _, file := range files {
+		if "/large-files/huge.dat" == file.Path {
+			reindexed = file
+		}
+	}
+	if nil == reindexed || old.ID == reindexed.ID {
+		t.Fatalf("huge.dat should be reindexed, got %+v", reindexed)
+	}
+
+	var shared int
+	for _, chunkID := range reindexed.Chunks {
+		if slices.Contains(old.Chunks, chunkID) {
+			shared++
+		}
+	}
+	if len(old.Chunks)-1 > shared {
+		t.Errorf("expected at least [%d] of [%d] chunks to be reused after append, got [%d]", len(old.Chunks)-1, len(old.Chunks), shared)
+	}
+}
+
+func TestLazyUploadWorker(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test lazy upload worker", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err := repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	// 重新索引时只加入延迟上传队列
+	repo.DeferLazyUploads = true
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(462)).Read(data)
+	deferredPath := filepath.Join(testLazyDataPath, "large-files", "deferred.dat")
+	if err := gulu.File.WriteFileSafer(deferredPath, data, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	if err := repo.ReindexLazyFile(deferredPath, context); nil != err {
+		t.Fatalf("reindex lazy file failed: %s", err)
+	}
+	if pending := repo.PendingLazyUploads(); !slices.Equal([]string{"/large-files/deferred.dat"}, pending) {
+		t.Fatalf("expected deferred.dat to be pending, got %v", pending)
+	}
+	file := repo.lazyIndexMgr.GetLazyFile("/large-files/deferred.dat")
+	if nil == file {
+		t.Fatalf("lazy file should be recorded")
+	}
+	if notFound, err := localCloud.GetChunks(file.Chunks); nil != err || 0 == len(notFound) {
+		t.Fatalf("chunks should not be uploaded before the worker runs: %v", err)
+	}
+
+	// 队列保存在懒加载索引旁边，重新打开仓库后未上传的文件仍然在队列中
+	queuePath := filepath.Join(testLazyRepoPath, lazyUploadQueueName(DefaultLazyIndexName))
+	aesKey, _ := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	repo, err := NewRepoWithLazyLoading(testLazyDataPath, testLazyRepoPath, testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, []string{}, repo.LazyLoadingPatterns, localCloud)
+	if nil != err {
+		t.Fatalf("reopen repo failed: %s", err)
+	}
+	t.Cleanup(func() { repo.lazyIndexMgr.Close() })
+	if pending := repo.PendingLazyUploads(); !slices.Equal([]string{"/large-files/deferred.dat"}, pending) {
+		t.Fatalf("expected deferred.dat to be pending after reopening, got %v", pending)
+	}
+
+	if err = repo.StartLazyUploadWorker(ctx, 64*1024*1024); nil != err {
+		t.Fatalf("start lazy upload worker failed: %s", err)
+	}
+	if err = repo.StartLazyUploadWorker(ctx, 0); !errors.Is(err, ErrLazyUploadWorkerRunning) {
+		t.Errorf("expected ErrLazyUploadWorkerRunning, got [%v]", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for 0 < len(repo.PendingLazyUploads()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pending := repo.PendingLazyUploads(); 0 != len(pending) {
+		t.Fatalf("upload queue should be drained, got %v", pending)
+	}
+	if gulu.File.IsExist(queuePath) {
+		t.Errorf("upload queue file should be removed once drained")
+	}
+
+	for !time.Now().After(deadline) {
+		if notFound, err := localCloud.GetChunks(append([]string{file.ID}, file.Chunks...)); nil == err && 0 == len(notFound) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("cloud should receive the file and its chunks")
+}
+
+func TestLazyUploadWorkerStopsOnClose(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	if _, err := repo.Index("Test lazy upload worker close", false, map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+
+	// ctx 不取消，空闲的协程在仓库关闭后也要退出
+	if err := repo.StartLazyUploadWorker(context.Background(), 0); nil != err {
+		t.Fatalf("start lazy upload worker failed: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond) // 等待协程进入空闲等待
+	if err := repo.Close(); nil != err {
+		t.Fatalf("close repo failed: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !repo.lazyUploads.setRunning(true) {
+		if time.Now().After(deadline) {
+			t.Fatalf("lazy upload worker should stop after the repo is closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLazyCaseCollisions(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	// 在大小写敏感的文件系统上模拟只有大小写不同的两个文件，BIG1.dat 更新
+	upperPath := filepath.Join(testLazyDataPath, "large-files", "BIG1.dat")
+	upperData := []byte(strings.Repeat("U", 1000))
+	if err := os.WriteFile(upperPath, upperData, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(upperPath, mtime, mtime); nil != err {
+		t.Fatalf("change file time failed: %s", err)
+	}
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+
+	diagnosis, err := repo2.DiagnoseLazyState()
+	if nil != err {
+		t.Fatalf("diagnose lazy state failed: %s", err)
+	}
+	if 1 != len(diagnosis.CaseCollisions) || !slices.Equal([]string{"/large-files/BIG1.dat", "/large-files/big1.dat"}, diagnosis.CaseCollisions[0]) {
+		t.Fatalf("expected case collision to be reported, got %v", diagnosis.CaseCollisions)
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	repo2.LazyCaseCollisionPolicy = LazyCaseCollisionError
+	if err = repo2.LazyLoadFile("large-files/big1.dat", context); !errors.Is(err, ErrLazyCaseCollision) {
+		t.Fatalf("expected case collision error, got %v", err)
+	}
+
+	// 最新索引不变时复用按小写路径的分组，不再重新读取最新索引
+	folded := repo2.lazyCaseFold
+	if nil == folded {
+		t.Fatalf("case folded paths of the latest index should be cached")
+	}
+
+	repo2.LazyCaseCollisionPolicy = LazyCaseCollisionCanonicalize
+	if err = repo2.LazyLoadFile("large-files/big1.dat", context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	if folded != repo2.lazyCaseFold {
+		t.Errorf("case folded paths should be reused while the latest index is unchanged")
+	}
+	got, err := os.ReadFile(filepath.Join(repo2.DataPath, "large-files", "big1.dat"))
+	if nil != err || !bytes.Equal(upperData, got) {
+		t.Errorf("expected content of the newest colliding file: %v", err)
+	}
+}
+
+func TestInMemoryLazyIndex(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	indexFile := filepath.Join(testLazyRepoPath, DefaultLazyIndexName)
+	repo.UseInMemoryLazyIndex()
+	os.Remove(indexFile)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test in-memory lazy index", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err := repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+	if nil == repo.lazyIndexMgr.GetLazyFile("/large-files/big1.dat") {
+		t.Fatalf("lazy file should be recorded in memory")
+	}
+
+	os.Remove(filepath.Join(testLazyDataPath, "large-files/big1.dat"))
+	if err := repo.LazyLoadFile("large-files/big1.dat", context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	os.Remove(filepath.Join(testLazyDataPath, "large-files/big2.dat"))
+	statuses, err := repo.LazyStatusBatch([]string{"large-files/big1.dat", "large-files/big2.dat"})
+	if nil != err {
+		t.Fatalf("lazy status failed: %s", err)
+	}
+	if status := statuses["large-files/big1.dat"]; !status.Recorded || !status.Cached {
+		t.Errorf("unexpected status of loaded file: %+v", status)
+	}
+	if status := statuses["large-files/big2.dat"]; !status.Recorded || status.Cached {
+		t.Errorf("unexpected status of evicted file: %+v", status)
+	}
+
+	if err = repo.lazyIndexMgr.Close(); nil != err {
+		t.Fatalf("close lazy index failed: %s", err)
+	}
+	if gulu.File.IsExist(indexFile) {
+		t.Errorf("lazy index file [%s] should not be written", indexFile)
+	}
+}
+
+func TestLazyFileUnresolvable(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	repo2.MirrorClouds = []cloud.Cloud{cloud.NewLocal(&cloud.BaseCloud{
+		Conf: &cloud.Conf{
+			RepoPath: testLazyRepoPath,
+			Local: &cloud.ConfLocal{
+				Endpoint: filepath.Join(testLazyCloudPath, "mirror"),
+			},
+		},
+	})}
+
+	// 分块在本地存储、云端和镜像中都不存在
+	file, err := repo2.getLazyFile("/large-files/big1.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	chunkID := file.Chunks[0]
+	repo2.store.Remove(chunkID)
+	if err = localCloud.RemoveObject(cloudObjectKey(chunkID)); nil != err {
+		t.Fatalf("remove chunk from cloud failed: %s", err)
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	err = repo2.LazyLoadFile("large-files/big1.dat", context)
+	if !errors.Is(err, ErrLazyFileUnresolvable) || !errors.Is(err, cloud.ErrCloudObjectNotFound) {
+		t.Fatalf("expected unresolvable error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "/large-files/big1.dat") {
+		t.Errorf("error [%s] should name the file path", err)
+	}
+	if gulu.File.IsExist(filepath.Join(testLazyDataPath, "large-files/big1.dat")) {
+		t.Errorf("unresolvable file should not be checked out")
+	}
+
+	// 其他文件不受影响
+	if err = repo2.LazyLoadFile("large-files/big2.dat", context); nil != err {
+		t.Errorf("lazy load file failed: %s", err)
+	}
+}
+
+func TestLazyOriginIndexID(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index1, err := repo.Index("Test origin 1", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	big1 := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if err = os.WriteFile(big1, bytes.Repeat([]byte("changed"), 1024), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	os.Chtimes(big1, time.Now(), time.Now().Add(time.Minute))
+	index2, err := repo.Index("Test origin 2", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	statuses, err := repo.LazyStatusBatch([]string{"large-files/big1.dat", "large-files/big2.dat"})
+	if nil != err {
+		t.Fatalf("lazy status failed: %s", err)
+	}
+	if origin := statuses["large-files/big1.dat"].OriginIndexID; index2.ID != origin {
+		t.Errorf("expected origin of changed file to be [%s], got [%s]", index2.ID, origin)
+	}
+	if origin := statuses["large-files/big2.dat"].OriginIndexID; index1.ID != origin {
+		t.Errorf("expected origin of unchanged file to be [%s], got [%s]", index1.ID, origin)
+	}
+
+	// 来源随懒加载索引写入磁盘
+	if err = repo.lazyIndexMgr.Flush(); nil != err {
+		t.Fatalf("flush lazy index failed: %s", err)
+	}
+	reloaded := NewLazyIndexManager(testLazyRepoPath, testLazyDataPath, repo.LazyLoadingPatterns)
+	if origin := reloaded.GetOriginIndexID("/large-files/big2.dat"); index1.ID != origin {
+		t.Errorf("expected reloaded origin [%s], got [%s]", index1.ID, origin)
+	}
+}
+
+func TestLazyVerifyAfterWrite(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	repo2.LazyVerifyAfterWrite = true
+
+	// 模拟写入后读回的内容损坏
+	readBack := lazyReadBackChunkIDs
+	t.Cleanup(func() { lazyReadBackChunkIDs = readBack })
+	lazyReadBackChunkIDs = func(absPath string, pol chunker.Pol) ([]string, error) {
+		data, err := os.ReadFile(absPath)
+		if nil != err {
+			return nil, err
+		}
+		data[0] ^= 0xff
+		return []string{util.Hash(data)}, nil
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	big1 := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	err := repo2.LazyLoadFile(big1, context)
+	if !errors.Is(err, ErrLazyWriteVerifyFailed) {
+		t.Fatalf("expected write verification failure, got %v", err)
+	}
+	if gulu.File.IsExist(big1) {
+		t.Errorf("unverified file should be removed")
+	}
+
+	lazyReadBackChunkIDs = readBack
+	if err = repo2.LazyLoadFile(big1, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	if !gulu.File.IsExist(big1) {
+		t.Errorf("verified file should be kept")
+	}
+}
+
+func TestLazySubroot(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	if err := repo2.SetLazySubroot("../large-files"); nil == err {
+		t.Fatalf("subroot outside data directory should be rejected")
+	}
+	if err := repo2.SetLazySubroot("large-files"); nil != err {
+		t.Fatalf("set lazy subroot failed: %s", err)
+	}
+	// 模式相对于根目录
+	if err := repo2.SetLazyLoadingPatterns([]string{"*.dat"}); nil != err {
+		t.Fatalf("set lazy loading patterns failed: %s", err)
+	}
+
+	lazyFiles, err := repo2.GetLazyLoadingFiles()
+	if nil != err {
+		t.Fatalf("get lazy loading files failed: %s", err)
+	}
+	if 2 > len(lazyFiles) {
+		t.Fatalf("expected lazy files under subroot, got [%d]", len(lazyFiles))
+	}
+	for _, file := range lazyFiles {
+		if !strings.HasPrefix(file.Path, "/large-files/") {
+			t.Errorf("file [%s] outside subroot should not be lazy", file.Path)
+		}
+	}
+	for _, file := range repo2.lazyIndexMgr.GetLazyFiles() {
+		if !strings.HasPrefix(file.Path, "/large-files/") {
+			t.Errorf("record [%s] outside subroot should be removed", file.Path)
+		}
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err = repo2.LazyLoadFile("big1.dat", context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	if !gulu.File.IsExist(filepath.Join(testLazyDataPath, "large-files/big1.dat")) {
+		t.Errorf("file should be loaded relative to subroot")
+	}
+	statuses, err := repo2.LazyStatusBatch([]string{"big2.dat", "../video.mp4"})
+	if nil != err {
+		t.Fatalf("lazy status failed: %s", err)
+	}
+	if status := statuses["big2.dat"]; !status.Lazy || !status.Recorded || status.Cached {
+		t.Errorf("unexpected status of file under subroot: %+v", status)
+	}
+	if statuses["../video.mp4"].Lazy {
+		t.Errorf("file outside subroot should not be lazy")
+	}
+
+	// 路径不能越过根目录
+	if err = repo2.LazyLoadFile("../video.mp4", context); nil == err {
+		t.Errorf("loading a path outside subroot should fail")
+	}
+	videoPath, _ := filepath.Abs(filepath.Join(testLazyDataPath, "video.mp4"))
+	if err = repo2.LazyLoadFile(videoPath, context); nil == err || !strings.Contains(err.Error(), "outside lazy root") {
+		t.Errorf("loading an absolute path outside subroot should fail, got %v", err)
+	}
+}
+
+func TestSyncLocalLazyEdits(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test sync local lazy edits", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err := repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+	unchanged := repo.lazyIndexMgr.GetLazyFile("/large-files/big2.dat")
+
+	// 在本地修改已下载的懒加载文件
+	big1 := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	edited := []byte(strings.Repeat("edited", 500))
+	if err := os.WriteFile(big1, edited, 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	os.Chtimes(big1, time.Now(), time.Now().Add(time.Minute))
+
+	if err := repo.SyncLocalLazyEdits(context); nil != err {
+		t.Fatalf("sync local lazy edits failed: %s", err)
+	}
+	file := repo.lazyIndexMgr.GetLazyFile("/large-files/big1.dat")
+	if nil == file || int64(len(edited)) != file.Size {
+		t.Fatalf("lazy index should reflect the edited file, got %+v", file)
+	}
+	if !slices.Equal([]string{util.Hash(edited)}, file.Chunks) {
+		t.Errorf("unexpected chunks of edited file %v", file.Chunks)
+	}
+	if missing, err := localCloud.GetChunks(file.Chunks); nil != err || 0 < len(missing) {
+		t.Errorf("chunks of edited file should be uploaded, missing %v, err %v", missing, err)
+	}
+	if got := repo.lazyIndexMgr.GetLazyFile("/large-files/big2.dat"); got.ID != unchanged.ID {
+		t.Errorf("unedited file should keep its record")
+	}
+
+	latest, err := repo.Latest()
+	if nil != err {
+		t.Fatalf("get latest failed: %s", err)
+	}
+	if !slices.Contains(latest.Files, file.ID) {
+		t.Errorf("latest index should contain the edited file")
+	}
+
+	// 没有新的修改时不创建索引
+	if err = repo.SyncLocalLazyEdits(context); nil != err {
+		t.Fatalf("sync local lazy edits failed: %s", err)
+	}
+	if again, _ := repo.Latest(); again.ID != latest.ID {
+		t.Errorf("no new index expected without local edits")
+	}
+}
+
+func TestNeverLazyPatterns(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	// big1.dat 匹配懒加载模式 large-files/*，也匹配永不懒加载模式
+	neverLazy := []string{"/large-files/big1.dat"}
+	if err := repo.SetNeverLazyPatterns(neverLazy); nil != err {
+		t.Fatalf("set never lazy patterns failed: %s", err)
+	}
+	if repo.isLazyLoadingFile("/large-files/big1.dat") || !repo.isLazyLoadingFile("/large-files/big2.dat") {
+		t.Fatalf("never lazy pattern should take priority over lazy patterns")
+	}
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test never lazy", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+	if nil != repo.lazyIndexMgr.GetLazyFile("/large-files/big1.dat") {
+		t.Errorf("never lazy file should not be recorded in lazy index")
+	}
+
+	os.RemoveAll(testLazyDataPath)
+	os.MkdirAll(testLazyDataPath, 0755)
+	aesKey, _ := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	repo2, err := NewRepoWithLazyLoading(testLazyDataPath, testLazyRepoPath, testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, []string{}, repo.LazyLoadingPatterns, localCloud)
+	if nil != err {
+		t.Fatalf("create repo2 failed: %s", err)
+	}
+	defer repo2.lazyIndexMgr.Close()
+	if err = repo2.SetNeverLazyPatterns(neverLazy); nil != err {
+		t.Fatalf("set never lazy patterns failed: %s", err)
+	}
+	if _, _, _, err = repo2.DownloadIndex(index.ID, context); nil != err {
+		t.Fatalf("download index failed: %s", err)
+	}
+	if _, _, err = repo2.Checkout(index.ID, context); nil != err {
+		t.Fatalf("checkout failed: %s", err)
+	}
+
+	// 永不懒加载的文件随检出正常同步，其他懒加载文件仍然按需加载
+	data, err := os.ReadFile(filepath.Join(testLazyDataPath, "large-files/big1.dat"))
+	if nil != err || strings.Repeat("A", 1000) != string(data) {
+		t.Errorf("never lazy file should be checked out normally, err %v", err)
+	}
+	if gulu.File.IsExist(filepath.Join(testLazyDataPath, "large-files/big2.dat")) {
+		t.Errorf("lazy file should not be checked out")
+	}
+}
+
+func TestOnLazyEviction(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	paths := []string{"large-files/big1.dat", "large-files/big2.dat"}
+	for _, p := range paths {
+		if err := repo2.LazyLoadFile(p, context); nil != err {
+			t.Fatalf("lazy load file [%s] failed: %s", p, err)
+		}
+	}
+	total := repo2.localLazyFilesSize()
+
+	var calls int
+	var evicted []string
+	var freedBytes int64
+	repo2.OnLazyEviction = func(paths []string, freed int64) {
+		calls++
+		evicted, freedBytes = paths, freed
+		// 回调在仓库锁之外调用
+		if !lock.TryLock() {
+			t.Errorf("eviction callback should be called outside the lock")
+			return
+		}
+		lock.Unlock()
+	}
+
+	freed, err := repo2.EvictLazyFilesToSize(0)
+	if nil != err {
+		t.Fatalf("evict to size failed: %s", err)
+	}
+	if 1 != calls {
+		t.Fatalf("expected the callback to be called once, got [%d]", calls)
+	}
+	sort.Strings(evicted)
+	if !slices.Equal([]string{"/large-files/big1.dat", "/large-files/big2.dat"}, evicted) {
+		t.Errorf("unexpected evicted paths %v", evicted)
+	}
+	if total != freedBytes || freed != freedBytes {
+		t.Errorf("expected freed bytes [%d], callback got [%d], returned [%d]", total, freedBytes, freed)
+	}
+
+	// 没有可以驱逐的文件时不调用
+	if _, err = repo2.EvictLazyFilesToSize(0); nil != err {
+		t.Fatalf("evict to size failed: %s", err)
+	}
+	if _, err = repo2.EvictSyncedLazyFiles(context); nil != err {
+		t.Fatalf("evict synced files failed: %s", err)
+	}
+	if 1 != calls {
+		t.Errorf("callback should not be called without evictions, got [%d] calls", calls)
+	}
+}
+
+func TestDownloadLazyIndexOnly(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	index, err := repo.Index("Test lazy index only", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if _, err = repo.SyncUpload(context); nil != err {
+		t.Fatalf("upload failed: %s", err)
+	}
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+	chunkKeys := map[string]bool{}
+	for _, file := range files {
+		for _, chunkID := range file.Chunks {
+			chunkKeys[cloudObjectKey(chunkID)] = true
+		}
+	}
+
+	// 新设备使用独立的仓库文件夹
+	repo2Path := filepath.Join(filepath.Dir(filepath.Clean(testLazyRepoPath)), "lazy-repo2")
+	defer os.RemoveAll(repo2Path)
+	os.RemoveAll(testLazyDataPath)
+	os.MkdirAll(testLazyDataPath, 0755)
+	aesKey, _ := encryption.KDF(testRepoPassword, testRepoPasswordSalt)
+	counting := &countingDownloadCloud{Local: localCloud}
+	repo2, err := NewRepoWithLazyLoading(testLazyDataPath, repo2Path, testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, aesKey, []string{}, repo.LazyLoadingPatterns, counting)
+	if nil != err {
+		t.Fatalf("create repo2 failed: %s", err)
+	}
+	defer repo2.lazyIndexMgr.Close()
+
+	if err = repo2.DownloadLazyIndexOnly(index.ID, context); nil != err {
+		t.Fatalf("download lazy index only failed: %s", err)
+	}
+	file := repo2.lazyIndexMgr.GetLazyFile("/large-files/big1.dat")
+	if nil == file || 1 > len(file.Chunks) {
+		t.Fatalf("lazy metadata should be populated, got %+v", file)
+	}
+	if nil != repo2.lazyIndexMgr.GetLazyFile("/docs/readme.txt") {
+		t.Errorf("normal file should not be recorded in lazy index")
+	}
+	for _, key := range counting.downloaded() {
+		if chunkKeys[key] {
+			t.Errorf("chunk [%s] should not be downloaded", key)
+		}
+	}
+	if _, err = repo2.Latest(); !errors.Is(err, ErrNotFoundIndex) {
+		t.Errorf("index should not be saved locally, got %v", err)
+	}
+
+	// 之后可以按需加载懒加载文件
+	if err = repo2.LazyLoadFile("large-files/big1.dat", context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(testLazyDataPath, "large-files/big1.dat")); strings.Repeat("A", 1000) != string(data) {
+		t.Errorf("unexpected content of lazy loaded file")
+	}
+}
+
+func TestValidateLazyIndex(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo.ValidateLazyIndex = true
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := os.WriteFile(filepath.Join(testLazyDataPath, "large-files", "big1.dat"), []byte(strings.Repeat("B", 1000)), 0644); nil != err {
+		t.Fatalf("write file failed: %s", err)
+	}
+	index, err := repo.Index("Test validate lazy index", false, context)
+	if nil != err {
+		t.Fatalf("index with validation failed: %s", err)
+	}
+
+	var files []*entity.File
+	for _, id := range index.Files {
+		file, getErr := repo.store.GetFile(id)
+		if nil != getErr {
+			t.Fatalf("get file failed: %s", getErr)
+		}
+		files = append(files, file)
+	}
+	if err = repo.validateLazyIndex(index, files); nil != err {
+		t.Fatalf("valid index reported invalid: %s", err)
+	}
+
+	// 非空的懒加载文件没有分块、文件对象未入库都视为不完整
+	noChunks := entity.NewFile("/large-files/no-chunks.dat", 100, time.Now().UnixMilli())
+	missing := entity.NewFile("/video.mp4", 100, 1) // 固定的更新时间避免和已入库的文件对象 ID 相同
+	missing.Chunks = []string{"0000000000000000000000000000000000000000"}
+	normal := entity.NewFile("/docs/other.txt", 100, time.Now().UnixMilli())
+	err = repo.validateLazyIndex(index, append(files, noChunks, missing, normal))
+	if !errors.Is(err, ErrLazyIndexInvalid) {
+		t.Fatalf("expected ErrLazyIndexInvalid, got [%v]", err)
+	}
+	for _, p := range []string{noChunks.Path, missing.Path} {
+		if !strings.Contains(err.Error(), p) {
+			t.Errorf("expected [%s] to be reported, got [%s]", p, err)
+		}
+	}
+	if strings.Contains(err.Error(), normal.Path) {
+		t.Errorf("non-lazy file should not be checked, got [%s]", err)
+	}
+}
+
+func TestLazyThumbnail(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	data := writeHugeLazyFile(t)
+	hugePath := filepath.Join(testLazyDataPath, "large-files/huge.dat")
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo2.LazyThumbnail(hugePath, context); !errors.Is(err, ErrNoThumbnailProvider) {
+		t.Fatalf("expected ErrNoThumbnailProvider, got [%v]", err)
+	}
+
+	file, err := repo2.getLazyFile("/large-files/huge.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+	if 2 > len(file.Chunks) {
+		t.Fatalf("huge lazy file should be split into multiple chunks")
+	}
+	for _, chunkID := range file.Chunks {
+		repo2.store.Remove(chunkID)
+	}
+
+	const thumbnailSize = 64
+	var gotChunks int
+	repo2.LazyThumbnailChunks = 1
+	repo2.ThumbnailProvider = func(file *entity.File, firstChunks [][]byte) ([]byte, error) {
+		gotChunks = len(firstChunks)
+		return firstChunks[0][:thumbnailSize], nil
+	}
+	countingCloud := &countingDownloadCloud{Local: localCloud}
+	repo2.cloud = countingCloud
+
+	thumbnail, err := repo2.LazyThumbnail(hugePath, context)
+	if nil != err {
+		t.Fatalf("lazy thumbnail failed: %s", err)
+	}
+	if !bytes.Equal(data[:thumbnailSize], thumbnail) {
+		t.Errorf("thumbnail should be the first [%d] bytes of the file", thumbnailSize)
+	}
+	if 1 != gotChunks {
+		t.Errorf("expected [1] leading chunk, got [%d]", gotChunks)
+	}
+
+	// 只下载开头的分块，不写入数据文件夹
+	expected := path.Join("objects", file.Chunks[0][:2], file.Chunks[0][2:])
+	if downloads := countingCloud.downloaded(); 1 != len(downloads) || expected != downloads[0] {
+		t.Errorf("only the leading chunk should be downloaded, got %v", downloads)
+	}
+	if gulu.File.IsExist(hugePath) {
+		t.Errorf("lazy thumbnail should not write the file")
+	}
+	// 下载的分块只保存在内存中，不留在本地存储
+	for _, chunkID := range file.Chunks {
+		if _, statErr := repo2.store.Stat(chunkID); nil == statErr {
+			t.Errorf("lazy thumbnail should not leave chunk [%s] in the store", chunkID)
+		}
+	}
+
+	// 文件已经下载时直接读取本地文件，不再下载
+	if err = repo2.LazyLoadFile(hugePath, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	for _, chunkID := range file.Chunks {
+		repo2.store.Remove(chunkID)
+	}
+	countingCloud = &countingDownloadCloud{Local: localCloud}
+	repo2.cloud = countingCloud
+	if thumbnail, err = repo2.LazyThumbnail(hugePath, context); nil != err {
+		t.Fatalf("lazy thumbnail of cached file failed: %s", err)
+	}
+	if !bytes.Equal(data[:thumbnailSize], thumbnail) {
+		t.Errorf("thumbnail of cached file should be the first [%d] bytes of the file", thumbnailSize)
+	}
+	if downloads := countingCloud.downloaded(); 0 < len(downloads) {
+		t.Errorf("lazy thumbnail of cached file should not download, got %v", downloads)
+	}
+}
+
+func TestLazyIndexFileNotIndexed(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test lazy index location", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if err := repo.lazyIndexMgr.Flush(); nil != err {
+		t.Fatalf("flush lazy index failed: %s", err)
+	}
+
+	// 懒加载索引文件保存在仓库文件夹下，只属于当前设备，不会进入数据索引
+	if !gulu.File.IsExist(filepath.Join(repo.Path, DefaultLazyIndexName)) {
+		t.Fatalf("lazy index file should be saved under the repo path")
+	}
+	index, err := repo.Index("Test lazy index location again", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+	for _, file := range files {
+		if DefaultLazyIndexName == path.Base(file.Path) {
+			t.Errorf("lazy index file [%s] should not be indexed", file.Path)
+		}
+	}
+}
+
+func TestLazyLoadingConfig(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	if !repo.LazyLoadingEnabled() {
+		t.Fatalf("lazy loading should be enabled")
+	}
+	config := repo.LazyLoadingConfig()
+	if !config.Enabled || !slices.Equal(repo.LazyLoadingPatterns, config.Patterns) {
+		t.Errorf("unexpected patterns %v", config.Patterns)
+	}
+	if !config.ExcludeSystemFiles || "" != config.Subroot || 0 < len(config.NeverPatterns) {
+		t.Errorf("unexpected default config %+v", config)
+	}
+	if filepath.Join(repo.Path, DefaultLazyIndexName) != config.IndexPath || config.IndexInMemory {
+		t.Errorf("unexpected lazy index path [%s]", config.IndexPath)
+	}
+	if err := repo.SetLazyIndexName("workspace-a.json"); nil != err {
+		t.Fatalf("set lazy index name failed: %s", err)
+	}
+	if config = repo.LazyLoadingConfig(); repo.lazyIndexMgr.Path() != config.IndexPath || filepath.Join(repo.Path, "workspace-a.json") != config.IndexPath {
+		t.Errorf("unexpected lazy index path [%s]", config.IndexPath)
+	}
+	if !config.CloudConfigured || localCloud.GetConcurrentReqs() != config.DownloadConcurrency || defaultChunkBatchSize != config.ChunkBatchSize {
+		t.Errorf("unexpected cloud config %+v", config)
+	}
+
+	// 运行时修改的设置
+	repo.LazyPrefetchMaxBytes = 1024
+	repo.MaxIndexUploadConcurrency = 1
+	if err := repo.SetLazyExcludes(false, []string{"*.tmp"}); nil != err {
+		t.Fatalf("set excludes failed: %s", err)
+	}
+	if err := repo.SetNeverLazyPatterns([]string{"keep/**"}); nil != err {
+		t.Fatalf("set never lazy patterns failed: %s", err)
+	}
+	if err := repo.SetLazySubroot("assets"); nil != err {
+		t.Fatalf("set subroot failed: %s", err)
+	}
+	if err := repo.SetLazyLoadingPatterns([]string{"*.mp4"}); nil != err {
+		t.Fatalf("set patterns failed: %s", err)
+	}
+	repo.UseInMemoryLazyIndex()
+
+	config = repo.LazyLoadingConfig()
+	if !slices.Equal([]string{"*.mp4"}, config.Patterns) || !slices.Equal([]string{"*.tmp"}, config.ExcludePatterns) || config.ExcludeSystemFiles {
+		t.Errorf("unexpected patterns %+v", config)
+	}
+	if !slices.Equal([]string{"keep/**"}, config.NeverPatterns) || "assets" != config.Subroot {
+		t.Errorf("unexpected never patterns or subroot %+v", config)
+	}
+	if 1024 != config.PrefetchMaxBytes || 1 != config.IndexUploadConcurrency {
+		t.Errorf("unexpected limits %+v", config)
+	}
+	if "" != config.IndexPath || !config.IndexInMemory {
+		t.Errorf("in-memory lazy index should have no path, got [%s]", config.IndexPath)
+	}
+
+	// 返回值是副本
+	config.Patterns[0] = "changed"
+	if "*.mp4" != repo.LazyLoadingPatterns[0] {
+		t.Errorf("modifying the config should not affect the repo")
+	}
+
+	// 读取配置不等待仓库锁
+	lock.Lock()
+	done := make(chan *LazyLoadingConfig)
+	go func() { done <- repo.LazyLoadingConfig() }()
+	select {
+	case config = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lazy loading config should not wait for the repo lock")
+	}
+	lock.Unlock()
+	if !slices.Equal([]string{"*.mp4"}, config.Patterns) {
+		t.Errorf("unexpected patterns %v", config.Patterns)
+	}
+
+	if err := repo.SetLazyLoadingPatterns(nil); nil != err {
+		t.Fatalf("clear patterns failed: %s", err)
+	}
+	if repo.LazyLoadingEnabled() || repo.LazyLoadingConfig().Enabled {
+		t.Errorf("lazy loading should be disabled without patterns")
+	}
+}
+
+func TestRefreshLazyStatuses(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if err := repo2.LazyLoadFile("large-files/big1.dat", context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+
+	// big1.dat 在本地存在但被标记为已驱逐，big2.dat 确实已被驱逐
+	repo2.lazyIndexMgr.MarkEvicted("/large-files/big1.dat")
+	repo2.lazyIndexMgr.MarkEvicted("/large-files/big2.dat")
+
+	statuses, err := repo2.RefreshLazyStatuses([]string{"large-files/big1.dat", "large-files/big2.dat", "docs/readme.txt"})
+	if nil != err {
+		t.Fatalf("refresh lazy statuses failed: %s", err)
+	}
+	if status := statuses["large-files/big1.dat"]; !status.Cached || status.Evicted {
+		t.Errorf("big1.dat should be cached and not evicted, got %+v", status)
+	}
+	if status := statuses["large-files/big2.dat"]; status.Cached || !status.Evicted {
+		t.Errorf("big2.dat should stay evicted, got %+v", status)
+	}
+	if status := statuses["docs/readme.txt"]; status.Lazy || status.Evicted {
+		t.Errorf("readme.txt is not a lazy file, got %+v", status)
+	}
+
+	// 修正已经写入懒加载索引
+	manager := NewLazyIndexManager(repo2.Path, repo2.DataPath, repo2.LazyLoadingPatterns)
+	defer manager.Close()
+	if manager.IsEvicted("/large-files/big1.dat") {
+		t.Errorf("stale evicted mark of big1.dat should be cleared on disk")
+	}
+	if !manager.IsEvicted("/large-files/big2.dat") {
+		t.Errorf("evicted mark of big2.dat should be kept on disk")
+	}
+}
+
+// fakeLazyClock 是测试使用的可控时钟。
+type fakeLazyClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeLazyClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeLazyClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestLazyClockEviction(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	clock := &fakeLazyClock{now: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	repo2.clock = clock
+
+	// big2.dat 先加载，big1.dat 后加载，然后再次访问 big2.dat，big1.dat 成为最近最少使用的文件
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	for _, p := range []string{"large-files/big2.dat", "large-files/big1.dat", "large-files/big2.dat"} {
+		clock.Advance(time.Minute)
+		if err := repo2.LazyLoadFile(p, context); nil != err {
+			t.Fatalf("lazy load file [%s] failed: %s", p, err)
+		}
+	}
+	if last := repo2.LazyHealth().LastLoaded; clock.Now().UnixMilli() != last {
+		t.Errorf("last loaded should be the fake clock time [%d], got [%d]", clock.Now().UnixMilli(), last)
+	}
+
+	var evicted []string
+	repo2.OnLazyEviction = func(paths []string, freedBytes int64) { evicted = paths }
+	if _, err := repo2.EvictLazyFilesToSize(repo2.localLazyFilesSize() - 1); nil != err {
+		t.Fatalf("evict to size failed: %s", err)
+	}
+	if !slices.Equal([]string{"/large-files/big1.dat"}, evicted) {
+		t.Errorf("expected the least recently used big1.dat to be evicted, got %v", evicted)
+	}
+}
+
+func TestLazyClockConflict(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	index, err := repo.Index("Test lazy clock conflict", false, map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone})
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	indexFiles, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	repo2.LazyPreserveMtime = false
+	downloaded := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo2.clock = &fakeLazyClock{now: downloaded}
+
+	// 不恢复更新时间时不修改磁盘上的更新时间，也不使用时钟
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	fullPath := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if err = repo2.LazyLoadFile(fullPath, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	info, err := os.Stat(fullPath)
+	if nil != err {
+		t.Fatalf("stat lazy loaded file failed: %s", err)
+	}
+	if downloaded.Equal(info.ModTime()) {
+		t.Fatalf("lazy loaded file mtime should be left to the file system, got clock time [%s]", info.ModTime())
+	}
+
+	// 本地副本在时钟时间被修改后按照磁盘上的文件生成记录（与重新索引一致）
+	recorded := repo2.lazyIndexMgr.GetLazyFile("/large-files/big1.dat")
+	local := entity.NewFile(recorded.Path, info.Size(), downloaded.UnixMilli())
+	local.Chunks = recorded.Chunks
+	repo2.lazyIndexMgr.AddLazyFilesFromIndex([]*entity.File{local})
+	if file := repo2.lazyIndexMgr.GetLazyFile(local.Path); local.ID != file.ID {
+		t.Fatalf("record with the later clock time should replace the older one, got %+v", file)
+	}
+
+	// 较早的记录与之冲突时保留较新的记录
+	repo2.lazyIndexMgr.AddLazyFilesFromIndex(indexFiles)
+	if file := repo2.lazyIndexMgr.GetLazyFile(local.Path); local.ID != file.ID {
+		t.Errorf("newer record should be kept, got %+v", file)
+	}
+}
+
+func TestRepairLazyFileIDs(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	if _, err := repo.Index("Test repair lazy file IDs", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	recorded, err := repo.getLazyFile("/large-files/big1.dat")
+	if nil != err {
+		t.Fatalf("get lazy file failed: %s", err)
+	}
+
+	// 模拟旧版本写入的缺少文件 ID 的记录
+	seeded := *recorded
+	seeded.ID = ""
+	seeded.Mode = 0600
+	unmatched := &entity.File{Path: "/large-files/gone.dat", Size: 1, Updated: 1, Chunks: []string{"missing"}}
+	repo.lazyIndexMgr.mutex.Lock()
+	repo.lazyIndexMgr.lazyFiles[seeded.Path] = &seeded
+	repo.lazyIndexMgr.lazyFiles[unmatched.Path] = unmatched
+	repo.lazyIndexMgr.mutex.Unlock()
+
+	repaired, err := repo.RepairLazyFileIDs()
+	if nil != err {
+		t.Fatalf("repair lazy file IDs failed: %s", err)
+	}
+	if !slices.Equal([]string{seeded.Path}, repaired) {
+		t.Errorf("expected [%s] to be repaired, got %v", seeded.Path, repaired)
+	}
+	file := repo.lazyIndexMgr.GetLazyFile(seeded.Path)
+	if recorded.ID != file.ID || 0600 != file.Mode {
+		t.Errorf("expected file ID [%s] and the recorded mode, got %+v", recorded.ID, file)
+	}
+	if "" != repo.lazyIndexMgr.GetLazyFile(unmatched.Path).ID {
+		t.Errorf("record without a matching file in the index should be left unchanged")
+	}
+	if p, getErr := repo.getLazyFilePathByID(recorded.ID); nil != getErr || seeded.Path != p {
+		t.Errorf("repaired file should be found by ID, got [%s], err [%v]", p, getErr)
+	}
+
+	// 补全已经写入懒加载索引
+	manager := NewLazyIndexManager(repo.Path, repo.DataPath, repo.LazyLoadingPatterns)
+	defer manager.Close()
+	if file = manager.GetLazyFile(seeded.Path); nil == file || recorded.ID != file.ID {
+		t.Errorf("repaired file ID should be saved, got %+v", file)
+	}
+}
+
+func TestLazySettingsSnapshot(t *testing.T) {
+	repo, _ := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	// 匹配器只在设置变化时编译
+	matcher := repo.lazyLoadingMatcher()
+	if matcher != repo.lazyLoadingMatcher() {
+		t.Fatalf("matcher should be compiled once per settings change")
+	}
+
+	// 设置方法在仓库锁下替换快照，读取方不加锁也不会出现数据竞争
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				repo.isLazyLoadingFile("/large-files/big1.dat")
+				repo.LazyLoadingEnabled()
+				if _, err := repo.LazyStatusBatch([]string{"video.mp4"}); nil != err {
+					t.Errorf("lazy status batch failed: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := repo.SetNeverLazyPatterns([]string{"large-files/big" + strconv.Itoa(i%2+1) + ".dat"}); nil != err {
+			t.Errorf("set never lazy patterns failed: %s", err)
+		}
+		if err := repo.SetLazyExcludes(0 == i%2, nil); nil != err {
+			t.Errorf("set excludes failed: %s", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if matcher == repo.lazyLoadingMatcher() {
+		t.Errorf("setters should replace the matcher")
+	}
+	if !matcher.MatchesPath("large-files/big1.dat") {
+		t.Errorf("old snapshot should not be changed by setters")
+	}
+	if repo.isLazyLoadingFile("/large-files/big2.dat") || !repo.isLazyLoadingFile("/large-files/big1.dat") {
+		t.Errorf("latest never lazy pattern should be in effect")
+	}
+}
+
+func TestNeverLazyPatternsKeepEvictedFiles(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	bigPath := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if err := repo2.LazyLoadFile(bigPath, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	if evicted, err := repo2.EvictSyncedLazyFiles(context); nil != err || 1 != evicted {
+		t.Fatalf("evict synced files failed, evicted [%d]: %v", evicted, err)
+	}
+
+	// 离线时无法下载，已驱逐的文件保留记录并且仍然出现在索引中
+	offline := cloud.NewLocal(&cloud.BaseCloud{Conf: &cloud.Conf{RepoPath: testLazyRepoPath, Local: &cloud.ConfLocal{Endpoint: filepath.Join(testLazyTempPath, "offline-cloud")}}})
+	repo2.cloud = offline
+	if err := repo2.SetNeverLazyPatterns([]string{"/large-files/big1.dat"}); nil == err {
+		t.Fatalf("set never lazy patterns should report the failed download")
+	}
+	if repo2.isLazyLoadingFile("/large-files/big1.dat") {
+		t.Fatalf("never lazy pattern should take effect even if the download failed")
+	}
+	index, err := repo2.Index("Test never lazy evicted offline", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if !lazyTestIndexHasPath(t, repo2, index, "/large-files/big1.dat") {
+		t.Fatalf("evicted file no longer lazy should stay in the index until downloaded")
+	}
+
+	// 恢复连接后下载到本地，移除记录，之后作为普通文件同步
+	repo2.cloud = localCloud
+	if err = repo2.LoadDemotedLazyFiles(context); nil != err {
+		t.Fatalf("load demoted lazy files failed: %s", err)
+	}
+	data, err := os.ReadFile(bigPath)
+	if nil != err || strings.Repeat("A", 1000) != string(data) {
+		t.Fatalf("evicted file should be downloaded, err %v", err)
+	}
+	if nil != repo2.lazyIndexMgr.GetLazyFile("/large-files/big1.dat") || 0 < len(repo2.lazyIndexMgr.DemotedLazyFiles()) {
+		t.Errorf("lazy record should be removed after download")
+	}
+	if index, err = repo2.Index("Test never lazy evicted", false, context); nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if !lazyTestIndexHasPath(t, repo2, index, "/large-files/big1.dat") {
+		t.Errorf("downloaded file should be in the index")
+	}
+}
+
+func TestSetNeverLazyPatternsDownloadsEvictedFile(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	repo2 := setupLazyLoadingSecondDevice(t, repo, localCloud)
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	bigPath := filepath.Join(testLazyDataPath, "large-files/big1.dat")
+	if err := repo2.LazyLoadFile(bigPath, context); nil != err {
+		t.Fatalf("lazy load file failed: %s", err)
+	}
+	if _, err := repo2.EvictSyncedLazyFiles(context); nil != err {
+		t.Fatalf("evict synced files failed: %s", err)
+	}
+
+	if err := repo2.SetNeverLazyPatterns([]string{"/large-files/big1.dat"}); nil != err {
+		t.Fatalf("set never lazy patterns failed: %s", err)
+	}
+	if !gulu.File.IsExist(bigPath) {
+		t.Fatalf("evicted file should be downloaded before its lazy record is dropped")
+	}
+	index, err := repo2.Index("Test never lazy evicted", false, context)
+	if nil != err {
+		t.Fatalf("create index failed: %s", err)
+	}
+	if !lazyTestIndexHasPath(t, repo2, index, "/large-files/big1.dat") {
+		t.Errorf("file no longer lazy should not be dropped from the index")
+	}
+}
+
+// lazyTestIndexHasPath 判断索引 index 中是否有路径为 p 的文件。
+func lazyTestIndexHasPath(t *testing.T, repo *Repo, index *entity.Index, p string) bool {
+	files, err := repo.GetFiles(index)
+	if nil != err {
+		t.Fatalf("get files failed: %s", err)
+	}
+	for _, file := range files {
+		if p == file.Path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,408 @@
+// DejaVu - Data snapshot and sync.
+// Copyright (c) 2022-present, b3log.org
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dejavu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/eventbus"
+	"github.com/siyuan-note/logging"
+)
+
+// lazyUploadRetryDelay 是后台上传失败后第一次重试前等待的时间，之后每次失败等待时间翻倍，最长为 lazyUploadMaxRetryDelay。
+var lazyUploadRetryDelay = 5 * time.Second
+
+// lazyUploadMaxRetryDelay 是后台上传失败后重试前等待的最长时间。
+var lazyUploadMaxRetryDelay = 5 * time.Minute
+
+// ErrLazyUploadWorkerRunning 表示后台上传协程已经在运行，不能重复启动。
+var ErrLazyUploadWorkerRunning = errors.New("lazy upload worker is already running")
+
+// lazyUploadQueue 是延迟上传的懒加载文件队列，同一路径只保留最新重新索引的版本。
+// 队列保存在懒加载索引旁边的文件中，重新打开仓库后未上传的文件不会丢失。
+type lazyUploadQueue struct {
+	mutex   sync.Mutex
+	files   []*entity.File // 待上传的文件，按加入顺序排列，正在上传的文件上传成功后才移出队列
+	notify  chan struct{}  // 有新文件加入时通知工作协程
+	closed  chan struct{}  // 仓库关闭时关闭，通知工作协程退出
+	path    string         // 队列文件的路径，为空时只保存在内存中
+	running bool           // 后台上传协程是否正在运行
+}
+
+// lazyUploadQueueName 返回懒加载索引 indexName 对应的延迟上传队列文件名，如：lazy-index-uploads.json
+func lazyUploadQueueName(indexName string) string {
+	return strings.TrimSuffix(indexName, filepath.Ext(indexName)) + "-uploads.json"
+}
+
+// open 切换队列文件为 p 并加载其中的文件，p 为空时只保存在内存中。切换前队列中的文件属于之前的懒加载索引，会被丢弃。
+func (q *lazyUploadQueue) open(p string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.path, q.files = p, nil
+	if "" == p || !gulu.File.IsExist(p) {
+		return
+	}
+
+	data, err := os.ReadFile(p)
+	if nil == err {
+		err = gulu.JSON.UnmarshalJSON(data, &q.files)
+	}
+	if nil != err {
+		logging.LogWarnf("[Lazy Upload] load upload queue [%s] failed: %s", p, err)
+		q.files = nil
+		return
+	}
+	if 0 < len(q.files) {
+		logging.LogInfof("[Lazy Upload] loaded [%d] pending uploads", len(q.files))
+		q.signal()
+	}
+}
+
+// keepInMemory 之后只在内存中保存队列，不再写入队列文件，队列中已有的文件保留。
+func (q *lazyUploadQueue) keepInMemory() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.path = ""
+}
+
+// save 将队列写入队列文件，调用方需要持有 q.mutex。
+func (q *lazyUploadQueue) save() {
+	if "" == q.path {
+		return
+	}
+
+	var err error
+	if 1 > len(q.files) {
+		if err = os.Remove(q.path); nil != err && !os.IsNotExist(err) {
+			logging.LogWarnf("[Lazy Upload] remove upload queue [%s] failed: %s", q.path, err)
+		}
+		return
+	}
+	data, err := gulu.JSON.MarshalJSON(q.files)
+	if nil == err {
+		err = gulu.File.WriteFileSafer(q.path, data, 0644)
+	}
+	if nil != err {
+		logging.LogWarnf("[Lazy Upload] save upload queue [%s] failed: %s", q.path, err)
+	}
+}
+
+// add 将文件加入队列，队列中已有同一路径的文件时替换为 file。
+func (q *lazyUploadQueue) add(file *entity.File) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	defer q.save()
+	defer q.signal()
+	for i, f := range q.files {
+		if f.Path == file.Path {
+			q.files[i] = file
+			return
+		}
+	}
+	q.files = append(q.files, file)
+}
+
+// peek 返回队首的文件但不移出队列，队列为空时返回 nil。
+func (q *lazyUploadQueue) peek() *entity.File {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if 1 > len(q.files) {
+		return nil
+	}
+	return q.files[0]
+}
+
+// done 将上传完成或者放弃上传的文件移出队列，期间同一路径被重新索引（队列中已经是新的版本）时不做任何事。
+func (q *lazyUploadQueue) done(file *entity.File) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if i := slices.Index(q.files, file); -1 < i {
+		q.files = slices.Delete(q.files, i, i+1)
+		q.save()
+	}
+}
+
+// retry 将上传失败的文件移到队尾，期间同一路径被重新索引时不做任何事。
+func (q *lazyUploadQueue) retry(file *entity.File) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if i := slices.Index(q.files, file); -1 < i {
+		q.files = append(slices.Delete(q.files, i, i+1), file)
+		q.save()
+	}
+}
+
+// paths 返回队列中文件的路径，按路径排序。
+func (q *lazyUploadQueue) paths() (ret []string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, file := range q.files {
+		ret = append(ret, file.Path)
+	}
+	sort.Strings(ret)
+	return
+}
+
+// wait 返回有新文件加入时收到通知的通道。
+func (q *lazyUploadQueue) wait() <-chan struct{} {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.notifyChan()
+}
+
+// signal 通知工作协程有新文件加入，调用方需要持有 q.mutex。
+func (q *lazyUploadQueue) signal() {
+	select {
+	case q.notifyChan() <- struct{}{}:
+	default:
+	}
+}
+
+// close 通知工作协程仓库已经关闭，可以重复调用。
+func (q *lazyUploadQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	select {
+	case <-q.closedChan():
+	default:
+		close(q.closed)
+	}
+}
+
+// closing 返回仓库关闭时关闭的通道。
+func (q *lazyUploadQueue) closing() <-chan struct{} {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.closedChan()
+}
+
+// closedChan 返回仓库关闭时关闭的通道，调用方需要持有 q.mutex。
+func (q *lazyUploadQueue) closedChan() chan struct{} {
+	if nil == q.closed {
+		q.closed = make(chan struct{})
+	}
+	return q.closed
+}
+
+// notifyChan 返回通知通道，调用方需要持有 q.mutex。
+func (q *lazyUploadQueue) notifyChan() chan struct{} {
+	if nil == q.notify {
+		q.notify = make(chan struct{}, 1)
+	}
+	return q.notify
+}
+
+// setRunning 标记后台上传协程是否正在运行，已经在运行时再次标记返回 false。
+func (q *lazyUploadQueue) setRunning(running bool) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if running && q.running {
+		return false
+	}
+	q.running = running
+	return true
+}
+
+// PendingLazyUploads 返回设置 DeferLazyUploads 后重新索引、还没有上传到云端的懒加载文件路径，按路径排序。
+func (repo *Repo) PendingLazyUploads() []string {
+	return repo.lazyUploads.paths()
+}
+
+// StartLazyUploadWorker 启动后台上传协程，逐个上传延迟上传队列中的懒加载文件，ratePerSec 为每秒最多上传的字节数，为 0 时不限速。
+// 每上传一个分块发布一次 EvtLazyUploadProgress 事件。上传失败的文件移到队尾稍后重试，连续失败时重试间隔翻倍；
+// 云端鉴权失败或者禁止访问时重试没有意义，协程直接退出。ctx 取消或者仓库关闭后协程退出，未上传的文件保留在队列中。
+// 协程已经在运行时返回 ErrLazyUploadWorkerRunning。
+func (repo *Repo) StartLazyUploadWorker(ctx context.Context, ratePerSec int64) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+	if nil == repo.cloud {
+		return errors.New("lazy upload requires cloud storage")
+	}
+	if repo.ReadOnlyCloud {
+		return errors.New("lazy upload is not available for read-only cloud")
+	}
+	if !repo.lazyUploads.setRunning(true) {
+		return ErrLazyUploadWorkerRunning
+	}
+
+	go repo.runLazyUploadWorker(ctx, ratePerSec)
+	return
+}
+
+func (repo *Repo) runLazyUploadWorker(ctx context.Context, ratePerSec int64) {
+	logging.LogInfof("[Lazy Upload] worker started, rate [%d] bytes/s", ratePerSec)
+	defer logging.LogInfof("[Lazy Upload] worker stopped")
+	defer repo.lazyUploads.setRunning(false)
+
+	throttle := &lazyUploadThrottle{rate: ratePerSec}
+	retryDelay := lazyUploadRetryDelay
+	closing := repo.lazyUploads.closing()
+	for nil == ctx.Err() && !repo.lazyClosed.Load() {
+		file := repo.lazyUploads.peek()
+		if nil == file {
+			throttle.reset()
+			select {
+			case <-ctx.Done():
+				return
+			case <-closing:
+				return
+			case <-repo.lazyUploads.wait():
+			}
+			continue
+		}
+
+		err := repo.uploadDeferredLazyFile(ctx, file, throttle)
+		if nil == err {
+			repo.lazyUploads.done(file)
+			retryDelay = lazyUploadRetryDelay
+			continue
+		}
+		if nil != ctx.Err() {
+			return
+		}
+		if errors.Is(err, cloud.ErrCloudAuthFailed) || errors.Is(err, cloud.ErrCloudForbidden) {
+			logging.LogErrorf("[Lazy Upload] upload file [%s] failed, stop uploading until the worker is restarted: %s", file.Path, err)
+			return
+		}
+
+		repo.lazyUploads.retry(file)
+		logging.LogWarnf("[Lazy Upload] upload file [%s] failed, retry in [%s]: %s", file.Path, retryDelay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-closing:
+			return
+		case <-time.After(retryDelay):
+		}
+		retryDelay = min(2*retryDelay, lazyUploadMaxRetryDelay)
+	}
+}
+
+// uploadDeferredLazyFile 按 throttle 限速上传懒加载文件 file 尚未在云端的分块，然后上传文件并清理本地分块。
+// 每个分块上传时才持有仓库锁，等待限速时不持有，不阻塞懒加载。
+func (repo *Repo) uploadDeferredLazyFile(ctx context.Context, file *entity.File, throttle *lazyUploadThrottle) (err error) {
+	chunkIDs := gulu.Str.RemoveDuplicatedElem(file.Chunks)
+	lock.Lock()
+	upsertChunkIDs, err := repo.cloud.GetChunks(chunkIDs)
+	var localMissing []string
+	if nil == err {
+		localMissing, err = repo.localNotFoundChunks(upsertChunkIDs)
+	}
+	lock.Unlock()
+	if nil != err {
+		return
+	}
+	if 0 < len(localMissing) {
+		// 分块既不在云端也不在本地，无法上传，重试也没有意义
+		logging.LogErrorf("[Lazy Upload] drop file [%s], chunks %v are missing from local store and cloud", file.Path, localMissing)
+		return nil
+	}
+
+	context := lazyEventContext(nil, file.Path)
+	var uploaded int64
+	for i, chunkID := range upsertChunkIDs {
+		if err = ctx.Err(); nil != err {
+			return
+		}
+
+		throttle.begin()
+		lock.Lock()
+		length, uploadErr := repo.uploadCloudObject(cloudObjectKey(chunkID))
+		lock.Unlock()
+		if nil != uploadErr {
+			return fmt.Errorf("upload chunk [%s] failed: %w", chunkID, uploadErr)
+		}
+		uploaded += length
+		eventbus.Publish(EvtLazyUploadProgress, context, &LazyUploadProgressEvent{Path: file.Path, Done: i + 1, Total: len(upsertChunkIDs), Length: uploaded})
+
+		if err = throttle.wait(ctx, length); nil != err {
+			return
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if _, err = repo.uploadFiles([]*entity.File{file}, context); nil != err {
+		return fmt.Errorf("upload file failed: %w", err)
+	}
+	repo.cleanupLazyFileChunks(file)
+	logging.LogInfof("[Lazy Upload] uploaded file [%s], [%d] chunks, [%d] bytes", file.Path, len(upsertChunkIDs), uploaded)
+	return
+}
+
+// lazyUploadThrottle 限制后台上传的速率，累计上传的字节数超过速率允许的量时等待。
+type lazyUploadThrottle struct {
+	rate  int64     // 每秒最多上传的字节数，为 0 时不限速
+	start time.Time // 本轮上传开始的时间
+	bytes int64     // 本轮已上传的字节数
+}
+
+// reset 在队列空闲时开始新的一轮计算，空闲的时间不计入上传预算。
+func (t *lazyUploadThrottle) reset() {
+	t.start = time.Time{}
+	t.bytes = 0
+}
+
+// begin 在上传前调用，记录本轮上传开始的时间。
+func (t *lazyUploadThrottle) begin() {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+}
+
+// wait 记录上传了 n 个字节，按速率需要等待时阻塞，ctx 取消时返回错误。
+func (t *lazyUploadThrottle) wait(ctx context.Context, n int64) error {
+	if 1 > t.rate {
+		return nil
+	}
+	t.bytes += n
+
+	delay := time.Duration(float64(t.bytes)/float64(t.rate)*float64(time.Second)) - time.Since(t.start)
+	if 0 >= delay {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
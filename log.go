@@ -17,6 +17,7 @@
 package dejavu
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"sort"
@@ -24,24 +25,27 @@ import (
 
 	"github.com/88250/go-humanize"
 	"github.com/88250/gulu"
+	"github.com/siyuan-note/dejavu/cloud"
 	"github.com/siyuan-note/dejavu/entity"
 	"github.com/siyuan-note/filelock"
+	"github.com/siyuan-note/logging"
 )
 
 type Log struct {
-	ID          string         `json:"id"`          // 索引 ID
-	Memo        string         `json:"memo"`        // 索引备注
-	Created     int64          `json:"created"`     // 索引时间
-	HCreated    string         `json:"hCreated"`    // 索引时间 "2006-01-02 15:04:05"
-	Files       []*entity.File `json:"files"`       // 文件列表
-	Count       int            `json:"count"`       // 文件总数
-	Size        int64          `json:"size"`        // 文件总大小
-	HSize       string         `json:"hSize"`       // 格式化好的文件总大小 "10.00 MB"
-	SystemID    string         `json:"systemID"`    // 设备 ID
-	SystemName  string         `json:"systemName"`  // 设备名称
-	SystemOS    string         `json:"systemOS"`    // 设备操作系统
-	Tag         string         `json:"tag"`         // 索引标记名称
-	HTagUpdated string         `json:"hTagUpdated"` // 标记时间 "2006-01-02 15:04:05"
+	ID           string         `json:"id"`           // 索引 ID
+	Memo         string         `json:"memo"`         // 索引备注
+	Created      int64          `json:"created"`      // 索引时间
+	HCreated     string         `json:"hCreated"`     // 索引时间 "2006-01-02 15:04:05"
+	Files        []*entity.File `json:"files"`        // 文件列表
+	MissingFiles int            `json:"missingFiles"` // 获取失败的文件数，大于 0 时文件列表不完整
+	Count        int            `json:"count"`        // 文件总数
+	Size         int64          `json:"size"`         // 文件总大小
+	HSize        string         `json:"hSize"`        // 格式化好的文件总大小 "10.00 MB"
+	SystemID     string         `json:"systemID"`     // 设备 ID
+	SystemName   string         `json:"systemName"`   // 设备名称
+	SystemOS     string         `json:"systemOS"`     // 设备操作系统
+	Tag          string         `json:"tag"`          // 索引标记名称
+	HTagUpdated  string         `json:"hTagUpdated"`  // 标记时间 "2006-01-02 15:04:05"
 }
 
 func (log *Log) String() string {
@@ -69,18 +73,62 @@ func (repo *Repo) GetCloudRepoLogs(page int) (ret []*Log, pageCount, totalCount
 	return
 }
 
+// CtxDeadline 是调用上下文中截止时间的键，值为 time.Time。
+// 上下文中设置了截止时间时，GetCloudRepoTagLogs 等方法中的云端请求超过截止时间后不再等待，返回已经获取到的结果和 os.ErrDeadlineExceeded。
+const CtxDeadline = "deadline"
+
+// withCtxDeadline 执行云端请求 fn，上下文中设置了截止时间时最多等待到截止时间，超时后返回 os.ErrDeadlineExceeded。
+// 超时的请求会在后台继续执行直到结束，fn 不应该修改调用方在超时后还会读取的变量。
+func withCtxDeadline(context map[string]interface{}, fn func() error) error {
+	deadline, ok := context[CtxDeadline].(time.Time)
+	if !ok {
+		return fn()
+	}
+	remaining := time.Until(deadline)
+	if 0 >= remaining {
+		return os.ErrDeadlineExceeded
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// GetCloudRepoTagLogs 获取云端标记的索引日志，本地没有的索引从云端下载。
+// 上下文中设置了 CtxDeadline 时，超过截止时间后返回已经获取到的日志和 os.ErrDeadlineExceeded。
 func (repo *Repo) GetCloudRepoTagLogs(context map[string]interface{}) (ret []*Log, err error) {
-	cloudTags, err := repo.cloud.GetTags()
+	defer func() { sort.Slice(ret, func(i, j int) bool { return ret[i].Created > ret[j].Created }) }()
+
+	var cloudTags []*cloud.Ref
+	err = withCtxDeadline(context, func() (getErr error) {
+		cloudTags, getErr = repo.cloud.GetTags()
+		return
+	})
 	if nil != err {
 		return
 	}
 	for _, tag := range cloudTags {
 		index, _ := repo.store.GetIndex(tag.ID)
 		if nil == index {
-			_, index, err = repo.downloadCloudIndex(tag.ID, context)
+			var downloaded *entity.Index
+			err = withCtxDeadline(context, func() (dlErr error) {
+				_, downloaded, dlErr = repo.downloadCloudIndex(tag.ID, context)
+				return
+			})
 			if nil != err {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					logging.LogWarnf("get cloud tag logs timed out, got [%d/%d] logs", len(ret), len(cloudTags))
+				}
 				return
 			}
+			index = downloaded
 		}
 
 		var log *Log
@@ -92,7 +140,6 @@ func (repo *Repo) GetCloudRepoTagLogs(context map[string]interface{}) (ret []*Lo
 		log.HTagUpdated = tag.Updated
 		ret = append(ret, log)
 	}
-	sort.Slice(ret, func(i, j int) bool { return ret[i].Created > ret[j].Created })
 	return
 }
 
@@ -142,6 +189,16 @@ func (repo *Repo) GetTagLogs() (ret []*Log, err error) {
 }
 
 func (repo *Repo) GetIndexLogs(page, pageSize int) (ret []*Log, pageCount, totalCount int, err error) {
+	return repo.getIndexLogs(page, pageSize, true)
+}
+
+// GetIndexLogsSummary 和 GetIndexLogs 一样分页返回索引日志，但是不获取文件列表（Files 为 nil），只填充索引上已有的元数据。
+// 适用于只需要展示数量、大小和时间的列表视图。
+func (repo *Repo) GetIndexLogsSummary(page, pageSize int) (ret []*Log, pageCount, totalCount int, err error) {
+	return repo.getIndexLogs(page, pageSize, false)
+}
+
+func (repo *Repo) getIndexLogs(page, pageSize int, fetchFiles bool) (ret []*Log, pageCount, totalCount int, err error) {
 	indexes, totalCount, pageCount, err := repo.GetIndexes(page, pageSize)
 	if nil != err {
 		return
@@ -149,7 +206,7 @@ func (repo *Repo) GetIndexLogs(page, pageSize int) (ret []*Log, pageCount, total
 
 	for _, index := range indexes {
 		var log *Log
-		log, err = repo.getLog(index, true)
+		log, err = repo.getLog(index, fetchFiles)
 		if nil != err {
 			return
 		}
@@ -160,21 +217,34 @@ func (repo *Repo) GetIndexLogs(page, pageSize int) (ret []*Log, pageCount, total
 
 func (repo *Repo) getLog(index *entity.Index, fetchFiles bool) (ret *Log, err error) {
 	var files []*entity.File
+	missingFiles := 0
 	if fetchFiles {
-		files, _ = repo.getFiles(index.Files)
+		// 文件对象缺失时（比如懒加载文件的对象没有下载）跳过该文件，并记录缺失数，而不是截断文件列表
+		for _, fileID := range index.Files {
+			file, getErr := repo.store.GetFile(fileID)
+			if nil != getErr {
+				missingFiles++
+				continue
+			}
+			files = append(files, file)
+		}
+		if 0 < missingFiles {
+			logging.LogWarnf("get files of index [%s] failed, [%d] files are missing", index.ID, missingFiles)
+		}
 	}
 	ret = &Log{
-		ID:         index.ID,
-		Memo:       index.Memo,
-		Created:    index.Created,
-		HCreated:   time.UnixMilli(index.Created).Format("2006-01-02 15:04:05"),
-		Files:      files,
-		Count:      index.Count,
-		Size:       index.Size,
-		HSize:      humanize.BytesCustomCeil(uint64(index.Size), 2),
-		SystemID:   index.SystemID,
-		SystemName: index.SystemName,
-		SystemOS:   index.SystemOS,
+		ID:           index.ID,
+		Memo:         index.Memo,
+		Created:      index.Created,
+		HCreated:     time.UnixMilli(index.Created).Format("2006-01-02 15:04:05"),
+		Files:        files,
+		MissingFiles: missingFiles,
+		Count:        index.Count,
+		Size:         index.Size,
+		HSize:        humanize.BytesCustomCeil(uint64(index.Size), 2),
+		SystemID:     index.SystemID,
+		SystemName:   index.SystemName,
+		SystemOS:     index.SystemOS,
 	}
 	return
 }
@@ -17,7 +17,15 @@
 package dejavu
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/eventbus"
 )
 
 func TestGetIndexLogs(t *testing.T) {
@@ -71,3 +79,131 @@ func TestGetTagLogs(t *testing.T) {
 		t.Logf("%+v", log)
 	}
 }
+
+func TestGetIndexLogsSummary(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+
+	logs, _, _, err := repo.GetIndexLogs(1, 10)
+	if nil != err {
+		t.Fatalf("get index logs failed: %s", err)
+		return
+	}
+	if 1 > len(logs[0].Files) {
+		t.Fatalf("full log should fetch files")
+		return
+	}
+
+	// 删除所有文件对象，摘要仍然可以获取说明没有读取文件
+	for _, fileID := range index.Files {
+		if err = repo.store.Remove(fileID); nil != err {
+			t.Fatalf("remove file [%s] failed: %s", fileID, err)
+			return
+		}
+		fileCache.Del(fileID)
+	}
+
+	logs, _, _, err = repo.GetIndexLogsSummary(1, 10)
+	if nil != err {
+		t.Fatalf("get index logs summary failed: %s", err)
+		return
+	}
+	if 1 > len(logs) {
+		t.Fatalf("logs length not match: %d", len(logs))
+		return
+	}
+
+	for _, log := range logs {
+		if nil != log.Files || 0 < log.MissingFiles {
+			t.Fatalf("summary log [%s] should not fetch files", log.ID)
+			return
+		}
+		if log.ID == index.ID && (index.Count != log.Count || index.Size != log.Size) {
+			t.Fatalf("summary log [%s] metadata not match", log.ID)
+			return
+		}
+	}
+
+	logs, _, _, err = repo.GetIndexLogs(1, 10)
+	if nil != err {
+		t.Fatalf("get index logs failed: %s", err)
+		return
+	}
+	if 0 < len(logs[0].Files) || len(index.Files) != logs[0].MissingFiles {
+		t.Fatalf("files should be removed")
+		return
+	}
+}
+
+// slowIndexCloud 下载指定索引时延迟返回，模拟缓慢的云端存储服务。
+type slowIndexCloud struct {
+	*cloud.Local
+	slowID string
+	delay  time.Duration
+}
+
+func (c *slowIndexCloud) DownloadObject(filePath string) (data []byte, err error) {
+	if strings.HasSuffix(filePath, c.slowID) {
+		time.Sleep(c.delay)
+	}
+	return c.Local.DownloadObject(filePath)
+}
+
+func TestGetCloudRepoTagLogsDeadline(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	var ids []string
+	for i, tag := range []string{"v1.0.0", "v1.0.1"} {
+		if err := os.WriteFile(filepath.Join(testLazyDataPath, "docs/readme.txt"), []byte(tag), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+		}
+		os.Chtimes(filepath.Join(testLazyDataPath, "docs/readme.txt"), time.Now(), time.Now().Add(time.Duration(i)*time.Minute))
+		index, err := repo.Index(tag, false, context)
+		if nil != err {
+			t.Fatalf("create index failed: %s", err)
+		}
+		if _, err = repo.SyncUpload(context); nil != err {
+			t.Fatalf("upload failed: %s", err)
+		}
+		if err = repo.AddTag(index.ID, tag); nil != err {
+			t.Fatalf("add tag failed: %s", err)
+		}
+		if _, _, _, err = repo.UploadTagIndex(tag, index.ID, context); nil != err {
+			t.Fatalf("upload tag index failed: %s", err)
+		}
+		ids = append(ids, index.ID)
+	}
+
+	// 本地没有标记的索引，需要从云端下载，第二个索引下载缓慢
+	for _, id := range ids {
+		_, file := repo.store.IndexAbsPath(id)
+		os.Remove(file)
+	}
+	indexCache.Clear()
+	repo.cloud = &slowIndexCloud{Local: localCloud, slowID: ids[1], delay: 2 * time.Second}
+
+	context[CtxDeadline] = time.Now().Add(300 * time.Millisecond)
+	start := time.Now()
+	logs, err := repo.GetCloudRepoTagLogs(context)
+	if elapsed := time.Since(start); time.Second < elapsed {
+		t.Errorf("get cloud tag logs should return at the deadline, elapsed [%s]", elapsed)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if 1 != len(logs) || ids[0] != logs[0].ID || "v1.0.0" != logs[0].Tag {
+		t.Fatalf("expected partial logs of the first tag, got %v", logs)
+	}
+
+	// 没有截止时间时等待所有索引下载完成
+	delete(context, CtxDeadline)
+	if logs, err = repo.GetCloudRepoTagLogs(context); nil != err {
+		t.Fatalf("get cloud tag logs failed: %s", err)
+	}
+	if 2 != len(logs) {
+		t.Fatalf("expected 2 logs, got [%d]", len(logs))
+	}
+}
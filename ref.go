@@ -90,6 +90,10 @@ func (repo *Repo) UpdateLatest(index *entity.Index) (err error) {
 		return
 	}
 
+	if nil != repo.lazyIndexMgr {
+		repo.lazyIndexMgr.PruneEvicted(files)
+	}
+
 	logging.LogInfof("updated local latest to [%s], full latest [size=%s], cost [%s]", index.String(), humanize.Bytes(uint64(len(data))), time.Since(start))
 	return
 }
@@ -46,20 +46,60 @@ import (
 
 // Repo 描述了逮虾户数据仓库。
 type Repo struct {
-	DataPath            string   // 数据文件夹的绝对路径，如：F:\\SiYuan\\data\\
-	Path                string   // 仓库的绝对路径，如：F:\\SiYuan\\repo\\
-	HistoryPath         string   // 数据历史文件夹的绝对路径，如：F:\\SiYuan\\history\\
-	TempPath            string   // 临时文件夹的绝对路径，如：F:\\SiYuan\\temp\\
-	DeviceID            string   // 设备 ID
-	DeviceName          string   // 设备名称
-	DeviceOS            string   // 操作系统
-	IgnoreLines         []string // 忽略配置文件内容行，是用 .gitignore 语法
-	LazyLoadingPatterns []string // 懒加载文件夹模式匹配，使用 .gitignore 语法
-
-	store        *Store            // 仓库的存储
-	chunkPol     chunker.Pol       // 文件分块多项式值
-	cloud        cloud.Cloud       // 云端存储服务
-	lazyIndexMgr *LazyIndexManager // 懒加载索引管理器
+	DataPath                  string                       // 数据文件夹的绝对路径，如：F:\\SiYuan\\data\\
+	Path                      string                       // 仓库的绝对路径，如：F:\\SiYuan\\repo\\
+	HistoryPath               string                       // 数据历史文件夹的绝对路径，如：F:\\SiYuan\\history\\
+	TempPath                  string                       // 临时文件夹的绝对路径，如：F:\\SiYuan\\temp\\
+	DeviceID                  string                       // 设备 ID
+	DeviceName                string                       // 设备名称
+	DeviceOS                  string                       // 操作系统
+	IgnoreLines               []string                     // 忽略配置文件内容行，是用 .gitignore 语法
+	LazyLoadingPatterns       []string                     // 懒加载文件夹模式匹配，使用 .gitignore 语法，只读，运行时修改需要使用 SetLazyLoadingPatterns
+	LazyLoadingTempDir        string                       // 懒加载下载时写入临时文件的文件夹，为空时写在目标文件旁边
+	LazyAccessLogger          LazyAccessLogger             // 懒加载访问审计，为空时不记录
+	LazyPrefetchMaxBytes      int64                        // 后台预取时本地懒加载文件的总大小上限，超出时暂停预取，为 0 时不限制，打开仓库后通过 SetLazyPrefetchMaxBytes 修改
+	LazyCheckoutPredicate     func(file *entity.File) bool // 检出时对每个懒加载文件调用，返回 true 时立即检出，为空时全部延迟到按需加载
+	LazyFileMode              os.FileMode                  // 懒加载下载的文件权限，为 0 时使用默认权限
+	LazyDirMode               os.FileMode                  // 懒加载下载时创建的文件夹权限，为 0 时使用 0755
+	MirrorClouds              []cloud.Cloud                // 镜像云端存储，数据对象上传时同步上传到镜像，从主云端下载失败时按顺序从镜像下载
+	LazyPreserveMtime         bool                         // 懒加载下载后是否恢复文件的更新时间，默认为 true，为 false 时使用下载时间。不恢复时之后索引会把文件当作已修改
+	LazyPrefetchStrategy      PrefetchStrategy             // 按需加载成功后根据访问决定需要后台预取的文件，为空时不预取
+	KeyGuard                  CloudKeyGuard                // 下载云端对象前调用，用于校验或者改写对象键（比如强制租户前缀），返回错误时拒绝下载，为空时不做处理
+	ChunkBatchSize            int                          // 云端存储服务实现了 cloud.BatchDownloader 时批量下载分块每次请求的分块数，为 0 时使用默认值 64
+	MinFreeBytes              int64                        // 懒加载下载后数据文件夹所在磁盘至少需要保留的可用空间，CanLazyLoad 据此判断，为 0 时不保留
+	FreeDiskSpace             DiskSpaceReporter            // 获取磁盘可用空间，为空时使用 util.GetFreeDiskSpace
+	ReadOnlyCloud             bool                         // 云端存储是否只读（比如辅助设备只有下载权限），只读时懒加载文件重新索引只在本地记录，不上传分块和文件
+	ChunkProvider             ChunkProvider                // 懒加载时在从云端下载前先通过它获取本地缺失的分块，为空时直接从云端下载
+	LazyPinPredicate          func(file *entity.File) bool // 按大小驱逐时对每个懒加载文件调用，返回 true 时该文件固定在本地不会被驱逐，为空时都可以驱逐
+	MaxIndexUploadConcurrency int                          // 重新索引懒加载文件（ReindexLazyFile 等）时上传分块的最大并发数，与按需下载的并发数分开设置，为 0 时使用云端存储的并发数。只能调低不能超过云端存储的并发数，SyncUpload 上传分块不受影响
+	MetricsObserver           MetricsObserver              // 懒加载指标观测，可以适配到 Prometheus 等监控系统，为空时不观测
+	DeferLazyUploads          bool                         // 重新索引懒加载文件时不立即上传，而是加入延迟上传队列，由 StartLazyUploadWorker 在后台限速上传
+	LazyCaseCollisionPolicy   LazyCaseCollisionPolicy      // 加载只有大小写不同的懒加载文件时的处理策略，默认不检查
+	LazyVerifyAfterWrite      bool                         // 懒加载写入文件后是否重新读取并校验分块，不一致时删除文件并返回 ErrLazyWriteVerifyFailed，适用于不可靠的存储介质（比如廉价的闪存卡）
+	LazyVerifyChunks          bool                         // 懒加载时是否重新读取本地已有的分块并校验内容哈希，只重新下载损坏的分块，默认只校验刚下载的分块
+	OnLazyEviction            LazyEvictionHandler          // 每轮驱逐本地懒加载文件（比如超出缓存大小时）结束后在仓库锁之外调用，用于提示用户，没有驱逐文件时不调用，为空时不通知
+	ValidateLazyIndex         bool                         // 校验模式，创建索引时检查懒加载文件记录是否完整（有分块并且文件对象已入库），不完整时不保存索引并返回 ErrLazyIndexInvalid，用于尽早发现索引逻辑的问题
+	ThumbnailProvider         ThumbnailProvider            // 根据懒加载文件开头的几个分块生成缩略图或者预览，LazyThumbnail 使用，为空时不支持缩略图
+	LazyThumbnailChunks       int                          // LazyThumbnail 下载并传给 ThumbnailProvider 的开头分块数，为 0 时使用默认值 2
+
+	store                 *Store              // 仓库的存储
+	chunkPol              chunker.Pol         // 文件分块多项式值
+	cloud                 cloud.Cloud         // 云端存储服务
+	lazyIndexMgr          *LazyIndexManager   // 懒加载索引管理器
+	lazyClosed            atomic.Bool         // 懒加载是否已关闭
+	lazyMigratePending    atomic.Bool         // 打开仓库时懒加载索引为空，第一次用到懒加载索引时需要迁移启用懒加载之前的文件
+	lazyCaseFold          *lazyCaseFoldIndex  // 最新索引中懒加载文件按小写路径的分组，处理大小写冲突时使用，持有 lock 时读写
+	lazyQueue             lazyLoadQueue       // 懒加载下载队列
+	lazyUploads           lazyUploadQueue     // 懒加载延迟上传队列
+	lazyLastLoaded        atomic.Int64        // 最后一次懒加载成功的时间，Unix 毫秒
+	lazyAccessed          sync.Map            // 懒加载文件本次运行中最后一次成功访问的时间，路径 -> Unix 毫秒，用于按最近最少使用驱逐
+	lazyLocalChunkHits    atomic.Int64        // 懒加载累计的本地分块命中数
+	lazyCloudChunkFetches atomic.Int64        // 懒加载累计的云端分块下载数
+	lazyConflictHandler   LazyConflictHandler // 懒加载索引记录冲突处理函数
+	lazyConflictMode      LazyConflictMode    // 懒加载索引记录冲突判断规则
+	clock                 lazyClock           // 懒加载使用的时钟，为空时使用系统时间，测试时可以替换为可控的时钟
+
+	lazyConf atomic.Pointer[lazySettings] // 懒加载设置快照，设置方法在仓库锁下替换，读取时不需要加锁
 }
 
 // NewRepo 创建一个新的仓库。
@@ -69,6 +109,12 @@ func NewRepo(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, de
 
 // NewRepoWithLazyLoading 创建一个新的仓库，支持懒加载配置。
 func NewRepoWithLazyLoading(dataPath, repoPath, historyPath, tempPath, deviceID, deviceName, deviceOS string, aesKey []byte, ignoreLines []string, lazyLoadingPatterns []string, cloud cloud.Cloud) (ret *Repo, err error) {
+	if 0 < len(lazyLoadingPatterns) {
+		if err = checkLazyPathsOverlap(map[string]string{"data": dataPath, "repo": repoPath, "history": historyPath, "temp": tempPath}); nil != err {
+			return
+		}
+	}
+
 	if nil != cloud {
 		cloud.GetConf().RepoPath = repoPath
 	}
@@ -83,6 +129,7 @@ func NewRepoWithLazyLoading(dataPath, repoPath, historyPath, tempPath, deviceID,
 		cloud:               cloud,
 		chunkPol:            chunker.Pol(0x3DA3358B4DC173), // 固定分块多项式值
 		LazyLoadingPatterns: lazyLoadingPatterns,
+		LazyPreserveMtime:   true,
 	}
 	if !strings.HasSuffix(ret.DataPath, string(os.PathSeparator)) {
 		ret.DataPath += string(os.PathSeparator)
@@ -96,6 +143,7 @@ func NewRepoWithLazyLoading(dataPath, repoPath, historyPath, tempPath, deviceID,
 	ignoreLines = gulu.Str.RemoveDuplicatedElem(ignoreLines)
 	ret.IgnoreLines = ignoreLines
 	ret.LazyLoadingPatterns = gulu.Str.RemoveDuplicatedElem(ret.LazyLoadingPatterns)
+	ret.updateLazySettings(func(s *lazySettings) { s.patterns = ret.LazyLoadingPatterns })
 	ret.store, err = NewStore(ret.Path, aesKey)
 	if nil != err {
 		return
@@ -103,6 +151,11 @@ func NewRepoWithLazyLoading(dataPath, repoPath, historyPath, tempPath, deviceID,
 
 	// 初始化懒加载索引管理器
 	ret.lazyIndexMgr = NewLazyIndexManager(ret.Path, ret.DataPath, ret.LazyLoadingPatterns)
+	ret.lazyUploads.open(filepath.Join(ret.Path, lazyUploadQueueName(DefaultLazyIndexName)))
+	if count, _ := ret.lazyIndexMgr.GetStats(); 0 == count && ret.lazyLoadingEnabled() {
+		// 懒加载索引为空时兼容启用懒加载之前的仓库，迁移需要读取整个最新索引，推迟到第一次用到懒加载索引时进行
+		ret.lazyMigratePending.Store(true)
+	}
 	return
 }
 
@@ -114,6 +167,44 @@ var (
 	ErrIndexFileChanged = errors.New("file changed")
 )
 
+// ErrLazyPathsOverlap 表示启用懒加载时数据文件夹、仓库文件夹、历史文件夹和临时文件夹之间存在包含关系。
+// 这会导致懒加载索引和分块被当作数据文件索引，或者数据文件被当作仓库数据处理。
+var ErrLazyPathsOverlap = errors.New("lazy loading paths overlap")
+
+// checkLazyPathsOverlap 检查 paths 中的文件夹两两之间是否相同或者存在包含关系，paths 以文件夹用途为键，空路径不检查。
+func checkLazyPathsOverlap(paths map[string]string) (err error) {
+	names := make([]string, 0, len(paths))
+	absPaths := map[string]string{}
+	for name, p := range paths {
+		if "" == p {
+			continue
+		}
+		if absPaths[name], err = filepath.Abs(p); nil != err {
+			return
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			if isSubPath(absPaths[a], absPaths[b]) || isSubPath(absPaths[b], absPaths[a]) {
+				return fmt.Errorf("%w: %s path [%s] and %s path [%s]", ErrLazyPathsOverlap, a, paths[a], b, paths[b])
+			}
+		}
+	}
+	return
+}
+
+// isSubPath 判断 p 是否为 parent 或者位于 parent 下，两者都需要是绝对路径。
+func isSubPath(parent, p string) bool {
+	rel, err := filepath.Rel(parent, p)
+	if nil != err {
+		return false
+	}
+	return "." == rel || (".." != rel && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)))
+}
+
 var lock = sync.Mutex{} // 仓库锁，Checkout、Index 和 Sync 等不能同时执行
 
 func (repo *Repo) CountIndexes() (ret int, err error) {
@@ -152,17 +243,31 @@ func (repo *Repo) Reset() (err error) {
 }
 
 // Purge 清理所有未引用数据，retentionIndexIDs 为保留的索引 ID 列表，如果不传入的话则清理所有未引用数据。
+// 懒加载索引中的文件和分块算作被引用。
 func (repo *Repo) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, err error) {
 	lock.Lock()
 	defer lock.Unlock()
-	return repo.store.Purge(retentionIndexIDs...)
+	return repo.purge(retentionIndexIDs...)
+}
+
+func (repo *Repo) purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, err error) {
+	return repo.store.purge(repo.lazyReferencedObjects(), retentionIndexIDs...)
 }
 
-// PurgeCloud 清理云端所有未引用数据。
+// PurgeCloud 清理云端所有未引用数据，懒加载索引中的文件和分块算作被引用。云端存储只读时返回错误。
 // Support manual purge of unreferenced data snapshots in the S3/WebDAV cloud storage https://github.com/siyuan-note/siyuan/issues/10081
 func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 	lock.Lock()
 	defer lock.Unlock()
+	return repo.purgeCloud(map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBarAndProgress}, false)
+}
+
+// purgeCloud 清理云端未引用数据。keepIndexes 为 true 时云端所有索引都算作被引用，只清理没有被任何索引引用的数据对象，
+// 此时无法读取的索引会中止清理，避免误删该索引引用的对象。
+func (repo *Repo) purgeCloud(context map[string]interface{}, keepIndexes bool) (ret *entity.PurgeStat, err error) {
+	if repo.ReadOnlyCloud {
+		return nil, errors.New("purging cloud is not available for read-only cloud")
+	}
 
 	lockCtx := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
 	err = repo.tryLockCloud("purge", lockCtx)
@@ -172,9 +277,8 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 	defer repo.unlockCloud(lockCtx)
 
 	logging.LogInfof("purging cloud...")
-	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToStatusBarAndProgress}
 	eventbus.Publish(eventbus.EvtCloudPurgeListObjects, context)
-	objInfos, listErr := repo.cloud.ListObjects("objects/")
+	objInfos, listErr := repo.listCloudObjects()
 	if nil != listErr {
 		logging.LogErrorf("list objects failed: %s", listErr)
 		err = listErr
@@ -182,8 +286,7 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 	}
 
 	objIDs := map[string]bool{}
-	for objPath, _ := range objInfos {
-		objID := strings.ReplaceAll(objPath, "/", "")
+	for objID := range objInfos {
 		objIDs[objID] = true
 	}
 
@@ -220,6 +323,11 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 		refID := strings.TrimSpace(string(ref))
 		refIndexIDs[refID] = true
 	}
+	if keepIndexes {
+		for indexID := range indexIDs {
+			refIndexIDs[indexID] = true
+		}
+	}
 
 	unreferencedIndexIDs := map[string]bool{}
 	for indexID := range indexIDs {
@@ -234,6 +342,11 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 	for refID := range refIndexIDs {
 		index, getErr := repo.cloud.GetIndex(refID)
 		if nil != getErr {
+			if keepIndexes && indexIDs[refID] != nil {
+				logging.LogErrorf("get index [%s] failed: %s", refID, getErr)
+				err = getErr
+				return
+			}
 			logging.LogWarnf("get index [%s] failed: %s", refID, getErr)
 			continue
 		}
@@ -270,6 +383,9 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 			referencedObjIDs[chunkID] = true
 		}
 	}
+	for objID := range repo.lazyReferencedObjects() {
+		referencedObjIDs[objID] = true
+	}
 
 	unreferencedIDs := map[string]bool{}
 	for objID := range objIDs {
@@ -284,7 +400,7 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 	unreferencedPaths := []string{}
 	for unreferencedID := range unreferencedIDs {
 		unreferencedPath := path.Join(unreferencedID[:2], unreferencedID[2:])
-		objInfo := objInfos[unreferencedPath]
+		objInfo := objInfos[unreferencedID]
 		if nil == objInfo {
 			logging.LogWarnf("unreferenced object [%s] not found", unreferencedPath)
 			continue
@@ -351,6 +467,36 @@ func (repo *Repo) PurgeCloud() (ret *entity.PurgeStat, err error) {
 	return
 }
 
+// listCloudObjects 列举云端所有数据对象，返回对象 ID -> 对象信息。
+// 有的云端存储服务递归列举（返回 xx/yyy），有的只列举一层（返回 xx 文件夹），这里都做处理。
+func (repo *Repo) listCloudObjects() (ret map[string]*entity.ObjectInfo, err error) {
+	ret = map[string]*entity.ObjectInfo{}
+	objInfos, err := repo.cloud.ListObjects("objects/")
+	if nil != err {
+		return
+	}
+
+	for objPath, objInfo := range objInfos {
+		if 2 == len(objPath) {
+			subInfos, listErr := repo.cloud.ListObjects(cloudObjectDir(objPath))
+			if nil != listErr {
+				return nil, listErr
+			}
+			for name, subInfo := range subInfos {
+				if id := objPath + name; 40 == len(id) {
+					ret[id] = subInfo
+				}
+			}
+			continue
+		}
+
+		if id := strings.ReplaceAll(objPath, "/", ""); 40 == len(id) {
+			ret[id] = objInfo
+		}
+	}
+	return
+}
+
 func (repo *Repo) purgeIndexesV2(refIndexIDs map[string]bool) (err error) {
 	data, err := repo.cloud.DownloadObject("indexes-v2.json")
 	if nil != err {
@@ -402,6 +548,35 @@ func (repo *Repo) GetIndex(id string) (index *entity.Index, err error) {
 	return repo.store.GetIndex(id)
 }
 
+// VerifyIndex 校验索引 id 记录的文件总数和文件总大小是否与其文件列表一致。
+// 懒加载文件和普通文件一样记录在索引的文件列表中，因此也会参与计算。
+func (repo *Repo) VerifyIndex(id string) (err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	index, err := repo.store.GetIndex(id)
+	if nil != err {
+		return
+	}
+
+	files, err := repo.getFiles(index.Files)
+	if nil != err {
+		return fmt.Errorf("get index [%s] files failed: %s", id, err)
+	}
+
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+	if index.Count != len(files) {
+		return fmt.Errorf("index [%s] count [%d] mismatch actual files [%d]", id, index.Count, len(files))
+	}
+	if index.Size != size {
+		return fmt.Errorf("index [%s] size [%d] mismatch actual size [%d]", id, index.Size, size)
+	}
+	return
+}
+
 // PutIndex 将索引 index 写入仓库。
 func (repo *Repo) PutIndex(index *entity.Index) (err error) {
 	lock.Lock()
@@ -414,6 +589,12 @@ var removeEmptyDirExcludes = append(workspaceDataDirs, ".git")
 
 // Checkout 将仓库中的数据迁出到 repo 数据文件夹下。context 参数用于发布事件时传递调用上下文。
 func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts, removes []*entity.File, err error) {
+	upserts, removes, _, err = repo.CheckoutWithLazy(id, context)
+	return
+}
+
+// CheckoutWithLazy 和 Checkout 一样迁出数据，同时返回本次迁出中因为懒加载而跳过的文件 skippedLazy，这些文件可以之后按需加载。
+func (repo *Repo) CheckoutWithLazy(id string, context map[string]interface{}) (upserts, removes, skippedLazy []*entity.File, err error) {
 	lock.Lock()
 	defer lock.Unlock()
 
@@ -468,7 +649,7 @@ func (repo *Repo) Checkout(id string, context map[string]interface{}) (upserts,
 		return
 	}
 
-	err = repo.checkoutFiles(upserts, context)
+	skippedLazy, err = repo.checkoutFiles(upserts, context)
 	if nil != err {
 		return
 	}
@@ -494,6 +675,69 @@ func (repo *Repo) Index(memo string, checkChunks bool, context map[string]interf
 	return
 }
 
+// IndexPreviewResult 描述了索引预览的结果。
+type IndexPreviewResult struct {
+	Index     *entity.Index  // 将要生成的索引，没有写入仓库，ID 为空；没有文件变化时为最新索引
+	Upserts   []*entity.File // 将要新增或者更新的文件，没有计算分块
+	Removes   []*entity.File // 将要删除的文件
+	LazyCount int            // 索引中的懒加载文件数
+	LazySize  int64          // 索引中的懒加载文件总大小
+}
+
+// IndexPreview 计算 Index 将要生成的索引和文件变化，用于在索引和上传前预览。
+// 预览只遍历数据文件夹并和最新索引比较，不计算分块，也不会写入仓库、懒加载索引或者云端。
+func (repo *Repo) IndexPreview(memo string, context map[string]interface{}) (ret *IndexPreviewResult, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	files, err := repo.walkIndexFiles(context)
+	if nil != err {
+		return
+	}
+	repo.ensureLazyIndexMigrated()
+	if repo.lazyLoadingEnabled() && nil != repo.lazyIndexMgr {
+		files = repo.lazyIndexMgr.mergeWithLocalFiles(files, false)
+	}
+
+	var latestFiles []*entity.File
+	latest, err := repo.Latest()
+	if nil != err {
+		if ErrNotFoundIndex != err {
+			return
+		}
+		latest, err = nil, nil
+	} else if latestFiles, err = repo.getFiles(latest.Files); nil != err {
+		return
+	}
+
+	ret = &IndexPreviewResult{}
+	ret.Upserts, ret.Removes = repo.diffUpsertRemove(files, latestFiles, false)
+	if nil != latest && 1 > len(ret.Upserts) && 1 > len(ret.Removes) {
+		ret.Index = latest
+	} else {
+		ret.Index = &entity.Index{
+			Memo:       memo,
+			Created:    time.Now().UnixMilli(),
+			SystemID:   repo.DeviceID,
+			SystemName: repo.DeviceName,
+			SystemOS:   repo.DeviceOS,
+		}
+		for _, file := range files {
+			ret.Index.Files = append(ret.Index.Files, file.ID)
+			ret.Index.Size += file.Size
+		}
+		ret.Index.Count = len(ret.Index.Files)
+	}
+
+	for _, file := range files {
+		if repo.isLazyLoadingFile(file.Path) {
+			ret.LazyCount++
+			ret.LazySize += file.Size
+		}
+	}
+	return
+}
+
 // GetFiles 返回快照索引 index 中的文件列表。
 func (repo *Repo) GetFiles(index *entity.Index) (ret []*entity.File, err error) {
 	ret, err = repo.getFiles(index.Files)
@@ -613,6 +857,7 @@ func (repo *Repo) removeCloudObjects(objects []string) (err error) {
 }
 
 func (repo *Repo) index(memo string, checkChunks bool, context map[string]interface{}) (ret *entity.Index, err error) {
+	repo.ensureLazyIndexMigrated()
 	for i := 0; i < 7; i++ {
 		ret, err = repo.index0(memo, checkChunks, context)
 		if nil == err {
@@ -630,8 +875,8 @@ func (repo *Repo) index(memo string, checkChunks bool, context map[string]interf
 	return
 }
 
-func (repo *Repo) index0(memo string, checkChunks bool, context map[string]interface{}) (ret *entity.Index, err error) {
-	var files []*entity.File
+// walkIndexFiles 遍历数据文件夹，返回需要索引的文件（不包含分块信息）。
+func (repo *Repo) walkIndexFiles(context map[string]interface{}) (files []*entity.File, err error) {
 	ignoreMatcher := repo.ignoreMatcher()
 	eventbus.Publish(eventbus.EvtIndexBeforeWalkData, context, repo.DataPath)
 	start := time.Now()
@@ -660,7 +905,12 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 			return nil
 		}
 
-		files = append(files, entity.NewFile(p, info.Size(), info.ModTime().UnixMilli()))
+		file := entity.NewFile(p, info.Size(), info.ModTime().UnixMilli())
+		if repo.isLazyLoadingFile(p) {
+			// 记录懒加载文件的权限，按需加载时恢复
+			file.Mode = uint32(info.Mode().Perm())
+		}
+		files = append(files, file)
 		eventbus.Publish(eventbus.EvtIndexWalkData, context, p)
 		return nil
 	})
@@ -679,6 +929,14 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 		logging.LogErrorf("empty index [%s]", repo.DataPath)
 		return
 	}
+	return
+}
+
+func (repo *Repo) index0(memo string, checkChunks bool, context map[string]interface{}) (ret *entity.Index, err error) {
+	files, err := repo.walkIndexFiles(context)
+	if nil != err {
+		return
+	}
 
 	latest, err := repo.Latest()
 	init := false
@@ -708,7 +966,7 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 		var workerErrs []error
 		workerErrLock := sync.Mutex{}
 		if !init {
-			start = time.Now()
+			start := time.Now()
 			count := atomic.Int32{}
 			total := len(files)
 			eventbus.Publish(eventbus.EvtIndexBeforeGetLatestFiles, context, total)
@@ -792,7 +1050,7 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 
 	// 优雅的懒加载文件处理：使用专门的懒加载索引管理器
 	// 这避免了在索引构建时进行复杂的云端查询和文件合并操作
-	if 0 < len(repo.LazyLoadingPatterns) && nil != repo.lazyIndexMgr {
+	if repo.lazyLoadingEnabled() && nil != repo.lazyIndexMgr {
 		// 关键修复：在构建索引时，将当前发现的懒加载文件添加到LazyIndexManager中
 		// 这确保了即使文件被删除，LazyIndexManager也保留了历史记录
 		repo.lazyIndexMgr.AddLazyFilesFromIndex(files)
@@ -877,11 +1135,20 @@ func (repo *Repo) index0(memo string, checkChunks bool, context map[string]inter
 	}
 	ret.Count = len(ret.Files)
 
+	if repo.ValidateLazyIndex {
+		if err = repo.validateLazyIndex(ret, files); nil != err {
+			return
+		}
+	}
+
 	err = repo.store.PutIndex(ret)
 	if nil != err {
 		logging.LogErrorf("put index failed: %s", err)
 		return
 	}
+	if nil != repo.lazyIndexMgr {
+		repo.lazyIndexMgr.RecordOrigins(ret.ID, files)
+	}
 
 	err = repo.UpdateLatest(ret)
 	if nil != err {
@@ -942,29 +1209,26 @@ func (repo *Repo) ignoreMatcher() *ignore.GitIgnore {
 	return ignore.CompileIgnoreLines(repo.IgnoreLines...)
 }
 
-// lazyLoadingMatcher 返回懒加载模式匹配器
-func (repo *Repo) lazyLoadingMatcher() *ignore.GitIgnore {
-	if len(repo.LazyLoadingPatterns) == 0 {
-		return ignore.CompileIgnoreLines() // 返回空匹配器
-	}
-	// 统一移除前导 '/'，以消除路径格式差异
-	var normalized []string
-	for _, p := range repo.LazyLoadingPatterns {
-		if strings.HasPrefix(p, "/") {
-			normalized = append(normalized, p[1:])
-		} else {
-			normalized = append(normalized, p)
-		}
+// lazyLoadingMatcher 返回当前设置快照中的懒加载模式匹配器，包括排除模式
+func (repo *Repo) lazyLoadingMatcher() *lazyMatcher {
+	return repo.lazySnapshot().matcher
+}
+
+// deferLazyFile 判断文件是否为检出时需要延迟到按需加载的懒加载文件。
+func (repo *Repo) deferLazyFile(file *entity.File) bool {
+	if !repo.isLazyLoadingFile(file.Path) {
+		return false
 	}
-	return ignore.CompileIgnoreLines(normalized...)
+	return nil == repo.LazyCheckoutPredicate || !repo.LazyCheckoutPredicate(file)
 }
 
 // isLazyLoadingFile 检查文件是否为懒加载文件
 func (repo *Repo) isLazyLoadingFile(filePath string) bool {
-	if len(repo.LazyLoadingPatterns) == 0 {
+	settings := repo.lazySnapshot()
+	if len(settings.patterns) == 0 {
 		return false
 	}
-	matcher := repo.lazyLoadingMatcher()
+	matcher := settings.matcher
 	// 去除被检测路径的前导 '/'
 	normalized := filePath
 	if strings.HasPrefix(normalized, "/") {
@@ -1142,6 +1406,49 @@ func (repo *Repo) putFileChunks(file *entity.File, context map[string]interface{
 	return
 }
 
+// chunkFile 按照索引时的分块规则切分文件 absPath，依次对每个分块的数据调用 fn，小于 chunker.MinSize 的文件整体作为一个分块。
+// fn 返回 io.EOF 时提前结束且不视为错误。每个分块使用独立的缓冲区，fn 可以持有 data。
+func chunkFile(absPath string, pol chunker.Pol, fn func(data []byte) error) (err error) {
+	reader, err := filelock.OpenFile(absPath, os.O_RDONLY, 0644)
+	if nil != err {
+		return
+	}
+	defer filelock.CloseFile(reader)
+
+	info, err := reader.Stat()
+	if nil != err {
+		return
+	}
+	if chunker.MinSize > info.Size() {
+		var data []byte
+		if data, err = io.ReadAll(reader); nil != err {
+			return
+		}
+		if err = fn(data); io.EOF == err {
+			err = nil
+		}
+		return
+	}
+
+	chnkr := chunker.NewWithBoundaries(reader, pol, chunker.MinSize, chunker.MaxSize)
+	for {
+		buf := make([]byte, chunker.MaxSize)
+		chnk, chnkErr := chnkr.Next(buf)
+		if io.EOF == chnkErr {
+			return
+		}
+		if nil != chnkErr {
+			return chnkErr
+		}
+		if err = fn(chnk.Data); nil != err {
+			if io.EOF == err {
+				err = nil
+			}
+			return
+		}
+	}
+}
+
 func (repo *Repo) getFiles(fileIDs []string) (ret []*entity.File, err error) {
 	for _, fileID := range fileIDs {
 		file, getErr := repo.store.GetFile(fileID)
@@ -1180,10 +1487,27 @@ func (repo *Repo) removeFiles(files []*entity.File, context map[string]interface
 		}
 		eventbus.Publish(eventbus.EvtCheckoutRemoveFile, context, i+1, total)
 	}
+	repo.clearRemovedEvicted(files)
 	return
 }
 
-func (repo *Repo) checkoutFiles(files []*entity.File, context map[string]interface{}) (err error) {
+// clearRemovedEvicted 清除已删除文件的已驱逐标记。已驱逐的文件本地没有副本，删除后如果保留标记，之后的索引会通过记录重新加入该文件。
+func (repo *Repo) clearRemovedEvicted(files []*entity.File) {
+	if nil == repo.lazyIndexMgr {
+		return
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	if cleared := repo.lazyIndexMgr.ClearEvicted(paths); 0 < len(cleared) {
+		logging.LogInfof("[Lazy Index] cleared evicted marks of removed files %v", cleared)
+	}
+}
+
+// checkoutFiles 迁出文件，返回跳过的懒加载文件 skippedLazyFiles。
+func (repo *Repo) checkoutFiles(files []*entity.File, context map[string]interface{}) (skippedLazyFiles []*entity.File, err error) {
 	if 1 > len(files) {
 		return
 	}
@@ -1192,13 +1516,20 @@ func (repo *Repo) checkoutFiles(files []*entity.File, context map[string]interfa
 
 	// 过滤掉懒加载文件
 	var filteredFiles []*entity.File
-	var skippedLazyFiles []*entity.File
 	for _, file := range files {
-		if repo.isLazyLoadingFile(file.Path) {
+		if repo.deferLazyFile(file) {
 			skippedLazyFiles = append(skippedLazyFiles, file)
-		} else {
-			filteredFiles = append(filteredFiles, file)
+			continue
+		}
+		if repo.isLazyLoadingFile(file.Path) {
+			// 由 LazyCheckoutPredicate 决定立即检出的懒加载文件，分块不全时仍然延迟到按需加载
+			if missing, checkErr := repo.localNotFoundChunks(file.Chunks); nil != checkErr || 0 < len(missing) {
+				logging.LogWarnf("[Lazy Load] chunks of file [%s] are not available, defer checkout", file.Path)
+				skippedLazyFiles = append(skippedLazyFiles, file)
+				continue
+			}
 		}
+		filteredFiles = append(filteredFiles, file)
 	}
 
 	if len(skippedLazyFiles) > 0 {
@@ -1290,6 +1621,16 @@ func (repo *Repo) checkoutFiles(files []*entity.File, context map[string]interfa
 }
 
 func (repo *Repo) checkoutFile(file *entity.File, checkoutDir string, count, total int, context map[string]interface{}) (err error) {
+	return repo.checkoutFileWithTemp(file, checkoutDir, "", count, total, context)
+}
+
+// checkoutFileWithTemp 迁出文件，tempDir 不为空时先在 tempDir 下写入临时文件，然后再移动到目标位置。
+func (repo *Repo) checkoutFileWithTemp(file *entity.File, checkoutDir, tempDir string, count, total int, context map[string]interface{}) (err error) {
+	return repo.checkoutFileWithMtime(file, checkoutDir, tempDir, true, count, total, context)
+}
+
+// checkoutFileWithMtime 和 checkoutFileWithTemp 一样迁出文件，preserveMtime 为 false 时不恢复文件的更新时间。
+func (repo *Repo) checkoutFileWithMtime(file *entity.File, checkoutDir, tempDir string, preserveMtime bool, count, total int, context map[string]interface{}) (err error) {
 	absPath := filepath.Join(checkoutDir, file.Path)
 	dir, name := filepath.Split(absPath)
 	if err = os.MkdirAll(dir, 0755); nil != err {
@@ -1297,13 +1638,19 @@ func (repo *Repo) checkoutFile(file *entity.File, checkoutDir string, count, tot
 	}
 
 	tmp := filepath.Join(dir, name+gulu.Rand.String(7)+".tmp")
+	if "" != tempDir {
+		if err = os.MkdirAll(tempDir, 0755); nil != err {
+			return
+		}
+		tmp = filepath.Join(tempDir, name+gulu.Rand.String(7)+".tmp")
+	}
 	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if nil != err {
 		return
 	}
 
 	totalWritten := int64(0)
-	logging.LogInfof("[Lazy Load Debug] checkoutFile [%s] with %d chunks, expected size: %d", file.Path, len(file.Chunks), file.Size)
+	logging.LogDebugf("[Lazy Load Debug] checkoutFile [%s] with %d chunks, expected size: %d", file.Path, len(file.Chunks), file.Size)
 	
 	for i, c := range file.Chunks {
 		var chunk *entity.Chunk
@@ -1329,10 +1676,10 @@ func (repo *Repo) checkoutFile(file *entity.File, checkoutDir string, count, tot
 		}
 		
 		totalWritten += int64(chunkSize)
-		logging.LogInfof("[Lazy Load Debug] wrote chunk %d/%d [%s] size: %d bytes for file [%s], total: %d", i+1, len(file.Chunks), c, chunkSize, file.Path, totalWritten)
+		logging.LogDebugf("[Lazy Load Debug] wrote chunk %d/%d [%s] size: %d bytes for file [%s], total: %d", i+1, len(file.Chunks), c, chunkSize, file.Path, totalWritten)
 	}
 	
-	logging.LogInfof("[Lazy Load Debug] checkout complete for [%s], total written: %d bytes (expected: %d)", file.Path, totalWritten, file.Size)
+	logging.LogDebugf("[Lazy Load Debug] checkout complete for [%s], total written: %d bytes (expected: %d)", file.Path, totalWritten, file.Size)
 
 	if err = f.Sync(); nil != err {
 		logging.LogErrorf("write file [%s] failed: %s", absPath, err)
@@ -1343,13 +1690,21 @@ func (repo *Repo) checkoutFile(file *entity.File, checkoutDir string, count, tot
 		return
 	}
 
+	if "" != tempDir {
+		// 临时文件夹可能和目标位置不在同一个卷上，跨卷重命名不是原子的，需要先复制到目标文件夹下再重命名
+		if tmp, err = moveToDir(tmp, dir); nil != err {
+			logging.LogErrorf("move temp file [%s] to [%s] failed: %s", f.Name(), dir, err)
+			return
+		}
+	}
+
 	filelock.Lock(absPath)
 	defer filelock.Unlock(absPath)
 
 	for i := 0; i < 3; i++ {
-		err = os.Rename(f.Name(), absPath) // Windows 上重命名是非原子的
+		err = os.Rename(tmp, absPath) // Windows 上重命名是非原子的
 		if nil == err {
-			os.Remove(f.Name())
+			os.Remove(tmp)
 			break
 		}
 
@@ -1363,12 +1718,60 @@ func (repo *Repo) checkoutFile(file *entity.File, checkoutDir string, count, tot
 		logging.LogFatalf(logging.ExitCodeFileSysErr, "write file [%s] failed: %s", absPath, err)
 	}
 
+	if preserveMtime {
+		updated := time.UnixMilli(file.Updated)
+		if err = os.Chtimes(absPath, updated, updated); nil != err {
+			logging.LogErrorf("change [%s] time [file.Updated=%d, updated=%v] failed: %s", absPath, file.Updated, updated, err)
+			return
+		}
+	}
+	eventbus.Publish(eventbus.EvtCheckoutUpsertFile, context, count, total)
+	return
+}
+
+// restoreLazyMtime 按照 repo.LazyPreserveMtime 尽力恢复懒加载文件的更新时间，失败时不返回错误。
+// 本地副本最终的更新时间与记录不一致时记录到懒加载索引中，驱逐和同步本地修改时据此判断本地副本是否被修改过。
+func (repo *Repo) restoreLazyMtime(absPath string, file *entity.File) {
+	if !repo.LazyPreserveMtime {
+		// 不恢复时不调用 Chtimes（在网络文件系统上较慢或者会失败），只记录磁盘上的更新时间
+		repo.recordLazyLocalMtime(absPath, file)
+		return
+	}
+
 	updated := time.UnixMilli(file.Updated)
-	if err = os.Chtimes(absPath, updated, updated); nil != err {
-		logging.LogErrorf("change [%s] time [file.Updated=%d, updated=%v] failed: %s", absPath, file.Updated, updated, err)
+	if err := os.Chtimes(absPath, updated, updated); nil != err {
+		logging.LogDebugf("[Lazy Load] change [%s] time failed: %s", absPath, err)
+	}
+	repo.recordLazyLocalMtime(absPath, file)
+}
+
+// recordLazyLocalMtime 将懒加载文件本地副本在磁盘上的更新时间记录到懒加载索引中。
+func (repo *Repo) recordLazyLocalMtime(absPath string, file *entity.File) {
+	if nil == repo.lazyIndexMgr {
 		return
 	}
-	eventbus.Publish(eventbus.EvtCheckoutUpsertFile, context, count, total)
+	info, err := os.Stat(absPath)
+	if nil != err {
+		return
+	}
+	repo.lazyIndexMgr.SetLocalMtime(file, info.ModTime().UnixMilli())
+}
+
+// moveToDir 将文件 src 移动到文件夹 dir 下，返回移动后的路径。如果无法直接重命名（比如跨卷），则复制后删除源文件。
+func moveToDir(src, dir string) (ret string, err error) {
+	ret = filepath.Join(dir, filepath.Base(src))
+	if err = os.Rename(src, ret); nil == err {
+		return
+	}
+
+	logging.LogInfof("rename [%s] to [%s] failed: %s, fallback to copy", src, ret, err)
+	if err = gulu.File.CopyFile(src, ret); nil != err {
+		os.Remove(ret)
+		return
+	}
+	if removeErr := os.Remove(src); nil != removeErr {
+		logging.LogWarnf("remove temp file [%s] failed: %s", src, removeErr)
+	}
 	return
 }
 
@@ -1420,14 +1823,38 @@ func (repo *Repo) isCloudSiYuan() bool {
 
 // LazyLoadFile 按需加载指定的懒加载文件
 func (repo *Repo) LazyLoadFile(filePath string, context map[string]interface{}) (err error) {
-	lock.Lock()
-	defer lock.Unlock()
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+	if repo.lazyClosed.Load() {
+		return ErrLazyLoadingClosed
+	}
 
+	absPath, relPath, err := repo.resolveLazyFilePath(filePath)
+	if nil != err {
+		return
+	}
+
+	// 交互式加载优先于后台预取
+	return repo.lazyQueue.load(repo, absPath, relPath, context, true)
+}
+
+// resolveLazyIndexPath 将索引路径（以 "/" 开头，相对于数据文件夹）解析为数据文件夹下的绝对路径和规范化的索引路径。
+// 索引路径已经包含懒加载根目录，不能再交给 resolveLazyFilePath 解析。
+func (repo *Repo) resolveLazyIndexPath(indexPath string) (absPath, relPath string) {
+	relPath = lazyIndexPath(indexPath)
+	absPath = repo.absPath(relPath)
+	return
+}
+
+// resolveLazyFilePath 将 filePath 解析为数据文件夹下的绝对路径和与索引一致的相对路径
+func (repo *Repo) resolveLazyFilePath(filePath string) (absPath, relPath string, err error) {
 	// 与索引路径格式保持一致：
 	// 1) 统一为绝对路径比较，确保路径在 DataPath 下
 	// 2) 再派生索引一致的相对路径（以 "/" 开头，正斜杠）
-	var absPath string
-	repoDataAbs, _ := filepath.Abs(filepath.Clean(repo.DataPath))
+	// 设置了懒加载根目录时相对路径基于根目录，并且路径不能在根目录之外
+	subroot := repo.lazySnapshot().subroot
+	repoDataAbs, _ := filepath.Abs(filepath.Clean(filepath.Join(repo.DataPath, subroot)))
 	if filepath.IsAbs(filePath) {
 		absPath = filepath.Clean(filePath)
 	} else {
@@ -1438,18 +1865,46 @@ func (repo *Repo) LazyLoadFile(filePath string, context map[string]interface{})
 	// 如果 absPath 不在 DataPath 下，尝试将其视为仓库内相对路径拼接到 DataPath
 	relToData, relErr := filepath.Rel(repoDataAbs, absPath)
 	if relErr != nil || strings.HasPrefix(relToData, "..") {
+		if "" != subroot {
+			dataAbs, _ := filepath.Abs(filepath.Clean(repo.DataPath))
+			if relToDataRoot, rootErr := filepath.Rel(dataAbs, absPath); nil == rootErr && !strings.HasPrefix(relToDataRoot, "..") {
+				err = fmt.Errorf("file path [%s] is outside lazy root [%s]", filePath, subroot)
+				return
+			}
+		}
+
 		joined := filepath.Clean(filepath.Join(repoDataAbs, filePath))
 		joinedAbs, _ := filepath.Abs(joined)
 		relToData2, relErr2 := filepath.Rel(repoDataAbs, joinedAbs)
 		if relErr2 != nil || strings.HasPrefix(relToData2, "..") {
-			return fmt.Errorf("file path [%s] is outside data directory", filePath)
+			err = fmt.Errorf("file path [%s] is outside data directory", filePath)
+			return
 		}
 		absPath = joinedAbs
 		relToData = relToData2
 	}
 
 	// 生成与索引一致的路径格式
-	relPath := "/" + filepath.ToSlash(filepath.Clean(relToData))
+	relPath = lazyIndexPath(path.Join(subroot, filepath.ToSlash(filepath.Clean(relToData))))
+	return
+}
+
+// lazyLoadFile 在仓库锁内加载懒加载文件，由懒加载队列调用，加载成功时将分块来源统计写入 stats
+func (repo *Repo) lazyLoadFile(absPath, relPath string, stats *LazyChunkStats, context map[string]interface{}) (err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	start := time.Now()
+	context = lazyEventContext(context, relPath)
+	defer func() {
+		if nil != err {
+			eventbus.Publish(EvtLazyAssetError, context, &LazyAssetErrorEvent{Path: relPath, Err: err})
+		}
+	}()
+
+	if repo.lazyClosed.Load() {
+		return ErrLazyLoadingClosed
+	}
 
 	// 检查是否为懒加载文件（使用与索引一致的路径格式）
 	if !repo.isLazyLoadingFile(relPath) {
@@ -1461,62 +1916,151 @@ func (repo *Repo) LazyLoadFile(filePath string, context map[string]interface{})
 		logging.LogInfof("[Lazy Load] file [%s] already exists locally", relPath)
 		return nil
 	}
+	eventbus.Publish(EvtLazyFileMiss, context, &LazyFileMissEvent{Path: relPath})
 
-	// 获取最新索引
-	latest, err := repo.Latest()
+	targetFile, err := repo.findLazyLoadTarget(relPath, context)
 	if nil != err {
-		return fmt.Errorf("get latest index failed: %s", err)
+		return
+	}
+	if targetFile, err = repo.resolveLazyCaseCollision(targetFile); nil != err {
+		return
 	}
 
-	// 从本地最新索引中查找文件
-	var targetFile *entity.File
-	latestFiles, err := repo.getFiles(latest.Files)
+	empty := 0 == targetFile.Size
+	if empty {
+		// 空文件不需要下载分块，直接在本地创建
+		emptyFile := *targetFile
+		emptyFile.Chunks = nil
+		targetFile = &emptyFile
+	}
+
+	// 记录下载前本地已有的分块数，用于输出加载摘要
+	var cachedChunks int
+	if missing, checkErr := repo.localNotFoundChunks(targetFile.Chunks); nil == checkErr {
+		cachedChunks = len(targetFile.Chunks) - len(missing)
+	}
+
+	eventbus.Publish(EvtLazyDownloadStart, context, &LazyDownloadStartEvent{Path: relPath, Size: targetFile.Size, Chunks: len(targetFile.Chunks), CachedChunks: cachedChunks})
+	defer func() {
+		eventbus.Publish(EvtLazyDownloadEnd, context, &LazyDownloadEndEvent{Path: relPath, Success: nil == err, Err: err})
+	}()
+
+	if err = repo.loadLazyTarget(targetFile, absPath, repo.DataPath, context); nil != err {
+		return
+	}
+
+	stats.LocalChunkHits = cachedChunks
+	stats.CloudChunkFetches = len(targetFile.Chunks) - cachedChunks
+	repo.metrics().ObserveDownload(targetFile.Size, time.Since(start), 0 == stats.CloudChunkFetches)
+	logging.LogInfof("[Lazy Load] loaded file [%s], size [%d] bytes, chunks [%d], cached [%d], downloaded [%d], elapsed [%s]",
+		relPath, targetFile.Size, len(targetFile.Chunks), stats.LocalChunkHits, stats.CloudChunkFetches, time.Since(start))
+	return nil
+}
+
+// loadLazyTarget 下载懒加载文件 targetFile 缺失的分块并迁出到 dataDir 下的 absPath，然后恢复更新时间、设置权限并按需校验写入的内容。
+// 调用方需要持有仓库锁，空文件需要先清空分块列表。
+func (repo *Repo) loadLazyTarget(targetFile *entity.File, absPath, dataDir string, context map[string]interface{}) (err error) {
+	empty := 0 == targetFile.Size
+
+	// 如果是云同步，从云端下载文件和chunks
+	if !empty {
+		if nil == repo.cloud {
+			return fmt.Errorf("lazy loading requires cloud storage")
+		}
+		err = repo.lazyLoadFromCloud(targetFile, context)
+		if nil != err {
+			return fmt.Errorf("lazy load from cloud failed: %w", err)
+		}
+	}
+
+	// 检出文件到本地
+	if 0 != repo.LazyDirMode {
+		if err = os.MkdirAll(filepath.Dir(absPath), repo.LazyDirMode); nil != err {
+			return fmt.Errorf("create dir failed: %s", err)
+		}
+	}
+	err = repo.checkoutFileWithMtime(targetFile, dataDir, repo.LazyLoadingTempDir, false, 1, 1, context)
 	if nil != err {
-		return fmt.Errorf("get latest files failed: %s", err)
+		return fmt.Errorf("checkout file failed: %w", err)
+	}
+	repo.restoreLazyMtime(absPath, targetFile)
+	// 优先使用配置的权限，其次使用索引时记录的权限，旧版本索引没有记录权限时使用默认权限
+	mode := repo.LazyFileMode
+	if 0 == mode {
+		mode = os.FileMode(targetFile.Mode)
+	}
+	if 0 != mode {
+		if err = os.Chmod(absPath, mode); nil != err {
+			return fmt.Errorf("change file mode failed: %s", err)
+		}
 	}
+	if repo.LazyVerifyAfterWrite && !empty {
+		if err = repo.verifyLazyWrittenFile(absPath, targetFile); nil != err {
+			return
+		}
+	}
+	return
+}
+
+// findLazyLoadTarget 查找懒加载文件 relPath 的文件记录，依次查找本地最新索引、云端最新索引和懒加载索引。
+func (repo *Repo) findLazyLoadTarget(relPath string, context map[string]interface{}) (targetFile *entity.File, err error) {
+	// 获取最新索引，新设备上只通过 DownloadLazyIndexOnly 获取了懒加载记录时本地还没有索引
+	latest, err := repo.Latest()
+	if nil != err && !errors.Is(err, ErrNotFoundIndex) {
+		return nil, fmt.Errorf("get latest index failed: %s", err)
+	}
+
+	// 从本地最新索引中查找文件
+	var latestFiles []*entity.File
+	if nil != latest {
+		if latestFiles, err = repo.getFiles(latest.Files); nil != err {
+			return nil, fmt.Errorf("get latest files failed: %s", err)
+		}
+	}
+	err = nil
 
 	for _, file := range latestFiles {
 		if file.Path == relPath {
 			targetFile = file
-			logging.LogInfof("[Lazy Load Debug] found file [%s] in local latest index", relPath)
+			logging.LogDebugf("[Lazy Load Debug] found file [%s] in local latest index", relPath)
 			break
 		}
 	}
 
 	if nil == targetFile {
-		logging.LogInfof("[Lazy Load Debug] file [%s] not found in local latest index, will try cloud latest", relPath)
+		logging.LogDebugf("[Lazy Load Debug] file [%s] not found in local latest index, will try cloud latest", relPath)
 	}
 
 	// 如果本地 latest 未包含该文件，则尝试从云端最新索引中查找（避免由于本地 latest 过旧导致失败）
 	var cloudFiles []*entity.File
 	if nil == targetFile {
 		if nil == repo.cloud {
-			return fmt.Errorf("file [%s] not found in latest index", relPath)
+			return nil, fmt.Errorf("file [%s] not found in latest index", relPath)
 		}
 
 		// 拉取云端最新索引并在其中查找目标文件
 		_, cloudLatest, dlErr := repo.downloadCloudLatest(context)
 		if nil != dlErr {
 			logging.LogErrorf("[Lazy Load Debug] get cloud latest failed: %s", dlErr)
-			return fmt.Errorf("file [%s] not found in latest index and get cloud latest failed: %s", relPath, dlErr)
+			return nil, fmt.Errorf("file [%s] not found in latest index and get cloud latest failed: %w", relPath, dlErr)
 		}
 		if nil != cloudLatest {
 			var gfErr error
 			cloudFiles, gfErr = repo.getFiles(cloudLatest.Files)
 			if nil != gfErr {
 				logging.LogErrorf("[Lazy Load Debug] get cloud latest files failed: %s", gfErr)
-				return fmt.Errorf("get cloud latest files failed: %s", gfErr)
+				return nil, fmt.Errorf("get cloud latest files failed: %s", gfErr)
 			}
-			logging.LogInfof("[Lazy Load Debug] checking %d files in cloud latest index", len(cloudFiles))
+			logging.LogDebugf("[Lazy Load Debug] checking %d files in cloud latest index", len(cloudFiles))
 			for _, f := range cloudFiles {
 				if f.Path == relPath {
 					targetFile = f
-					logging.LogInfof("[Lazy Load Debug] found file [%s] in cloud latest index", relPath)
+					logging.LogDebugf("[Lazy Load Debug] found file [%s] in cloud latest index", relPath)
 					break
 				}
 			}
 			if nil == targetFile {
-				logging.LogInfof("[Lazy Load Debug] file [%s] not found in cloud latest index, will try lazy index manager", relPath)
+				logging.LogDebugf("[Lazy Load Debug] file [%s] not found in cloud latest index, will try lazy index manager", relPath)
 			}
 		}
 
@@ -1524,11 +2068,11 @@ func (repo *Repo) LazyLoadFile(filePath string, context map[string]interface{})
 			// 尝试从懒加载索引管理器中查找历史文件记录
 			if nil != repo.lazyIndexMgr {
 				lazyFiles := repo.lazyIndexMgr.GetLazyFiles()
-				logging.LogInfof("[Lazy Load Debug] checking %d files in lazy index manager", len(lazyFiles))
+				logging.LogDebugf("[Lazy Load Debug] checking %d files in lazy index manager", len(lazyFiles))
 				for _, lazyFile := range lazyFiles {
 					if lazyFile.Path == relPath {
 						targetFile = lazyFile
-						logging.LogInfof("[Lazy Load Debug] found file [%s] in lazy index manager (from historical snapshot)", relPath)
+						logging.LogDebugf("[Lazy Load Debug] found file [%s] in lazy index manager (from historical snapshot)", relPath)
 						break
 					}
 				}
@@ -1544,49 +2088,39 @@ func (repo *Repo) LazyLoadFile(filePath string, context map[string]interface{})
 				if err := repo.saveCloudFilesForDebug(cloudFiles, relPath, context); err != nil {
 					logging.LogWarnf("failed to save cloud files for debug: %s", err)
 				}
-				return fmt.Errorf("file [%s] not found in any available index after comprehensive search", relPath)
+				return nil, fmt.Errorf("file [%s] not found in any available index after comprehensive search", relPath)
 			}
 		}
 	}
-
-	// 如果是云同步，从云端下载文件和chunks
-	if nil != repo.cloud {
-		err = repo.lazyLoadFromCloud(targetFile, context)
-		if nil != err {
-			return fmt.Errorf("lazy load from cloud failed: %s", err)
-		}
-	} else {
-		return fmt.Errorf("lazy loading requires cloud storage")
-	}
-
-	// 检出文件到本地
-	err = repo.checkoutFile(targetFile, repo.DataPath, 1, 1, context)
-	if nil != err {
-		return fmt.Errorf("checkout file failed: %s", err)
-	}
-
-	logging.LogInfof("[Lazy Load] file [%s] successfully loaded", relPath)
-	return nil
+	return
 }
 
 // lazyLoadFromCloud 从云端加载文件及其chunks
+// 云端和镜像都缺少文件的对象或者只有损坏的分块时返回 ErrLazyFileUnresolvable
 func (repo *Repo) lazyLoadFromCloud(file *entity.File, context map[string]interface{}) (err error) {
-	logging.LogInfof("[Lazy Load Debug] starting lazyLoadFromCloud for file [%s] with ID [%s]", file.Path, file.ID)
+	defer func() {
+		if errors.Is(err, cloud.ErrCloudObjectNotFound) || errors.Is(err, ErrLazyHashMismatch) {
+			logging.LogErrorf("[Lazy Load] file [%s] is unresolvable, all chunk sources are exhausted: %s", file.Path, err)
+			err = fmt.Errorf("%w [%s]: %w", ErrLazyFileUnresolvable, file.Path, err)
+		}
+	}()
+
+	logging.LogDebugf("[Lazy Load Debug] starting lazyLoadFromCloud for file [%s] with ID [%s]", file.Path, file.ID)
 	
 	// 检查文件是否已在本地存储
 	localFile, err := repo.store.GetFile(file.ID)
 	if nil == err && nil != localFile {
-		logging.LogInfof("[Lazy Load Debug] file [%s] already exists locally, checking chunks", file.Path)
+		logging.LogDebugf("[Lazy Load Debug] file [%s] already exists locally, checking chunks", file.Path)
 		// 文件已存在，检查chunks
 		return repo.ensureChunksAvailable(file, context)
 	}
 
-	logging.LogInfof("[Lazy Load Debug] file [%s] not found locally, downloading from cloud", file.Path)
+	logging.LogDebugf("[Lazy Load Debug] file [%s] not found locally, downloading from cloud", file.Path)
 	// 从云端下载文件元数据
 	length, cloudFile, err := repo.downloadCloudFile(file.ID, 1, 1, context)
 	if nil != err {
 		logging.LogErrorf("[Lazy Load Debug] download cloud file [%s] failed: %s", file.Path, err)
-		return fmt.Errorf("download cloud file failed: %s", err)
+		return fmt.Errorf("download cloud file failed: %w", err)
 	}
 
 	// 存储文件元数据
@@ -1595,15 +2129,16 @@ func (repo *Repo) lazyLoadFromCloud(file *entity.File, context map[string]interf
 		return fmt.Errorf("put file failed: %s", err)
 	}
 
-	logging.LogInfof("[Lazy Load] downloaded file metadata [%s], size: %d bytes", file.Path, length)
+	logging.LogDebugf("[Lazy Load] downloaded file metadata [%s], size: %d bytes", file.Path, length)
 
 	// 下载所有chunks
 	return repo.ensureChunksAvailable(cloudFile, context)
 }
 
 // ensureChunksAvailable 确保文件的所有chunks都可用
+// 分块按内容寻址，下载的分块写入本地存储后会保留，之后加载共享这些分块的文件时直接复用，不会重复下载
 func (repo *Repo) ensureChunksAvailable(file *entity.File, context map[string]interface{}) (err error) {
-	logging.LogInfof("[Lazy Load Debug] ensureChunksAvailable for file [%s], expected chunks: %d", file.Path, len(file.Chunks))
+	logging.LogDebugf("[Lazy Load Debug] ensureChunksAvailable for file [%s], expected chunks: %d", file.Path, len(file.Chunks))
 	
 	// 检查本地缺失的chunks
 	missingChunks, err := repo.localNotFoundChunks(file.Chunks)
@@ -1611,32 +2146,45 @@ func (repo *Repo) ensureChunksAvailable(file *entity.File, context map[string]in
 		return fmt.Errorf("check local chunks failed: %s", err)
 	}
 
-	logging.LogInfof("[Lazy Load Debug] missing chunks: %d/%d for file [%s]", len(missingChunks), len(file.Chunks), file.Path)
+	logging.LogDebugf("[Lazy Load Debug] missing chunks: %d/%d for file [%s]", len(missingChunks), len(file.Chunks), file.Path)
 
 	if len(missingChunks) == 0 {
-		logging.LogInfof("[Lazy Load Debug] all chunks for file [%s] are already available", file.Path)
+		logging.LogDebugf("[Lazy Load Debug] all chunks for file [%s] are already available", file.Path)
+		if repo.LazyVerifyChunks {
+			return repo.repairCorruptedChunks(file, file.Chunks, context)
+		}
 		return nil
 	}
 
+	missingChunks, err = repo.provideLazyChunks(missingChunks)
+	if nil != err {
+		return fmt.Errorf("put provided chunks failed: %s", err)
+	}
+
 	// 从云端下载缺失的chunks
-	logging.LogInfof("[Lazy Load Debug] downloading %d missing chunks for file [%s]", len(missingChunks), file.Path)
+	logging.LogDebugf("[Lazy Load Debug] downloading %d missing chunks for file [%s]", len(missingChunks), file.Path)
 	length, err := repo.downloadCloudChunksPut(missingChunks, context)
 	if nil != err {
 		logging.LogErrorf("[Lazy Load Debug] download cloud chunks failed for file [%s]: %s", file.Path, err)
-		return fmt.Errorf("download cloud chunks failed: %s", err)
+		return fmt.Errorf("download cloud chunks failed: %w", err)
 	}
 
-	logging.LogInfof("[Lazy Load] downloaded [%d] chunks for file [%s], total size: %d bytes", len(missingChunks), file.Path, length)
+	logging.LogDebugf("[Lazy Load] downloaded [%d] chunks for file [%s], total size: %d bytes", len(missingChunks), file.Path, length)
 	
 	// 验证下载后的chunks
 	stillMissing, checkErr := repo.localNotFoundChunks(file.Chunks)
 	if nil != checkErr {
 		logging.LogWarnf("[Lazy Load Debug] failed to verify chunks after download: %s", checkErr)
 	} else {
-		logging.LogInfof("[Lazy Load Debug] after download, still missing chunks: %d/%d for file [%s]", len(stillMissing), len(file.Chunks), file.Path)
+		logging.LogDebugf("[Lazy Load Debug] after download, still missing chunks: %d/%d for file [%s]", len(stillMissing), len(file.Chunks), file.Path)
 	}
 	
-	return nil
+	// 刚下载的分块总是校验，本地已有的分块只在开启 repo.LazyVerifyChunks 时校验
+	verifyChunks := missingChunks
+	if repo.LazyVerifyChunks {
+		verifyChunks = file.Chunks
+	}
+	return repo.repairCorruptedChunks(file, verifyChunks, context)
 }
 
 // createLazyFileChunks 为懒加载文件创建chunks，但不在本地存储chunks数据
@@ -1644,80 +2192,112 @@ func (repo *Repo) createLazyFileChunks(file *entity.File, absPath string) (err e
 	// 对于懒加载文件，我们需要创建chunks用于云端存储
 	// 但这些chunks不会在本地持久化，只用于上传
 
-	if chunker.MinSize > file.Size {
-		// 小文件直接作为一个chunk
-		var data []byte
-		data, err = filelock.ReadFile(absPath)
-		if nil != err {
-			logging.LogErrorf("read lazy file [%s] failed: %s", absPath, err)
-			return
-		}
-
+	err = chunkFile(absPath, repo.chunkPol, func(data []byte) error {
 		chunkHash := util.Hash(data)
 		file.Chunks = append(file.Chunks, chunkHash)
 
 		// 临时存储chunk用于上传
 		chunk := &entity.Chunk{ID: chunkHash, Data: data}
-		if err = repo.store.PutChunk(chunk); nil != err {
-			logging.LogErrorf("put lazy chunk [%s] failed: %s", chunkHash, err)
-			return
+		if putErr := repo.store.PutChunk(chunk); nil != putErr {
+			logging.LogErrorf("put lazy chunk [%s] failed: %s", chunkHash, putErr)
+			return putErr
 		}
+		return nil
+	})
+	if nil != err {
+		logging.LogErrorf("chunk lazy file [%s] failed: %s", absPath, err)
 		return
 	}
 
-	// 大文件分块处理
-	reader, err := filelock.OpenFile(absPath, os.O_RDONLY, 0644)
-	if nil != err {
-		logging.LogErrorf("open lazy file [%s] failed: %s", absPath, err)
+	logging.LogInfof("[Lazy Load] created [%d] chunks for file [%s]", len(file.Chunks), file.Path)
+	return
+}
+
+// cleanupLazyFileChunks 清理懒加载文件的本地chunks（上传后调用）
+func (repo *Repo) cleanupLazyFileChunks(file *entity.File) {
+	repo.cleanupLazyFilesChunks([]*entity.File{file})
+}
+
+// cleanupLazyFilesChunks 批量清理懒加载文件的本地chunks（上传后调用）。
+// 分块 ID 是内容哈希，内容相同的文件共享分块，所以最新索引中其他文件仍然引用的分块会保留，只删除没有其他引用的分块。
+func (repo *Repo) cleanupLazyFilesChunks(files []*entity.File) {
+	var lazyFiles []*entity.File
+	for _, file := range files {
+		if repo.isLazyLoadingFile(file.Path) {
+			lazyFiles = append(lazyFiles, file)
+		}
+	}
+	if 1 > len(lazyFiles) {
 		return
 	}
-	defer filelock.CloseFile(reader)
 
-	chnkr := chunker.NewWithBoundaries(reader, repo.chunkPol, chunker.MinSize, chunker.MaxSize)
-	for {
-		buf := make([]byte, chunker.MaxSize)
-		chnk, chnkErr := chnkr.Next(buf)
-		if io.EOF == chnkErr {
-			break
-		}
-		if nil != chnkErr {
-			err = chnkErr
-			logging.LogErrorf("chunk lazy file [%s] failed: %s", absPath, chnkErr)
+	// 删除分块前确保懒加载索引记录已经写入磁盘，否则崩溃后本地既没有分块也没有记录
+	if nil != repo.lazyIndexMgr {
+		if err := repo.lazyIndexMgr.Flush(); nil != err {
+			logging.LogWarnf("[Lazy Load] skip cleaning up lazy chunks, flush lazy index failed: %s", err)
 			return
 		}
+	}
 
-		chunkHash := util.Hash(chnk.Data)
-		file.Chunks = append(file.Chunks, chunkHash)
+	referenced, err := repo.chunksReferencedByOthers(lazyFiles)
+	if nil != err {
+		// 无法确认分块是否被其他文件引用时保留所有分块
+		logging.LogWarnf("[Lazy Load] skip cleaning up lazy chunks, get referenced chunks failed: %s", err)
+		return
+	}
 
-		// 临时存储chunk用于上传
-		chunk := &entity.Chunk{ID: chunkHash, Data: chnk.Data}
-		if err = repo.store.PutChunk(chunk); nil != err {
-			logging.LogErrorf("put lazy chunk [%s] failed: %s", chunkHash, err)
-			return
+	for _, file := range lazyFiles {
+		removed := 0
+		for _, chunkID := range file.Chunks {
+			if referenced[chunkID] {
+				continue
+			}
+			if err = repo.store.Remove(chunkID); nil != err {
+				logging.LogWarnf("remove lazy chunk [%s] failed: %s", chunkID, err)
+				continue
+			}
+			removed++
 		}
+		logging.LogInfof("[Lazy Load] cleaned up [%d/%d] chunks for file [%s]", removed, len(file.Chunks), file.Path)
 	}
-
-	logging.LogInfof("[Lazy Load] created [%d] chunks for file [%s]", len(file.Chunks), file.Path)
-	return
 }
 
-// cleanupLazyFileChunks 清理懒加载文件的本地chunks（上传后调用）
-func (repo *Repo) cleanupLazyFileChunks(file *entity.File) {
-	if !repo.isLazyLoadingFile(file.Path) {
+// chunksReferencedByOthers 返回最新索引中除 files 以外的文件引用的分块 ID，这些分块可能仍然需要在本地迁出或者上传。
+func (repo *Repo) chunksReferencedByOthers(files []*entity.File) (ret map[string]bool, err error) {
+	ret = map[string]bool{}
+	latest, err := repo.Latest()
+	if nil != err {
+		if errors.Is(err, ErrNotFoundIndex) {
+			err = nil
+		}
+		return
+	}
+	latestFiles, err := repo.getFiles(latest.Files)
+	if nil != err {
 		return
 	}
 
-	for _, chunkID := range file.Chunks {
-		err := repo.store.Remove(chunkID)
-		if nil != err {
-			logging.LogWarnf("remove lazy chunk [%s] failed: %s", chunkID, err)
+	excluded := map[string]bool{}
+	for _, file := range files {
+		excluded[file.ID] = true
+	}
+	for _, file := range latestFiles {
+		if excluded[file.ID] {
+			continue
+		}
+		for _, chunkID := range file.Chunks {
+			ret[chunkID] = true
 		}
 	}
-	logging.LogInfof("[Lazy Load] cleaned up [%d] chunks for file [%s]", len(file.Chunks), file.Path)
+	return
 }
 
 // LazyLoadFiles 批量按需加载多个懒加载文件
 func (repo *Repo) LazyLoadFiles(filePaths []string, context map[string]interface{}) (err error) {
+	if !repo.lazyLoadingEnabled() {
+		return ErrLazyLoadingDisabled
+	}
+
 	for i, filePath := range filePaths {
 		err = repo.LazyLoadFile(filePath, context)
 		if nil != err {
@@ -1733,6 +2313,10 @@ func (repo *Repo) LazyLoadFiles(filePaths []string, context map[string]interface
 
 // GetLazyLoadingFiles 获取当前索引中的所有懒加载文件列表
 func (repo *Repo) GetLazyLoadingFiles() (lazyFiles []*entity.File, err error) {
+	if !repo.lazyLoadingEnabled() {
+		return nil, ErrLazyLoadingDisabled
+	}
+
 	latest, err := repo.Latest()
 	if nil != err {
 		return nil, fmt.Errorf("get latest index failed: %s", err)
@@ -1752,9 +2336,38 @@ func (repo *Repo) GetLazyLoadingFiles() (lazyFiles []*entity.File, err error) {
 	return lazyFiles, nil
 }
 
+// GetLazyLoadingFilesPaged 分页获取当前索引中的懒加载文件列表，按路径排序，page 从 1 开始。
+func (repo *Repo) GetLazyLoadingFilesPaged(page, pageSize int) (files []*entity.File, totalCount, pageCount int, err error) {
+	if 1 > page || 1 > pageSize {
+		err = fmt.Errorf("invalid page [%d] or page size [%d]", page, pageSize)
+		return
+	}
+
+	lazyFiles, err := repo.GetLazyLoadingFiles()
+	if nil != err {
+		return
+	}
+	sort.Slice(lazyFiles, func(i, j int) bool { return lazyFiles[i].Path < lazyFiles[j].Path })
+
+	totalCount = len(lazyFiles)
+	pageCount = int(math.Ceil(float64(totalCount) / float64(pageSize)))
+
+	start := (page - 1) * pageSize
+	end := page * pageSize
+
+	if start > totalCount {
+		start = totalCount
+	}
+	if end > totalCount {
+		end = totalCount
+	}
+	files = lazyFiles[start:end]
+	return
+}
+
 // validateIndexCompleteness 验证索引的完整性（使用优雅的懒加载管理器）
 func (repo *Repo) validateIndexCompleteness(index *entity.Index, context map[string]interface{}) error {
-	if 0 == len(repo.LazyLoadingPatterns) || nil == repo.lazyIndexMgr {
+	if !repo.lazyLoadingEnabled() || nil == repo.lazyIndexMgr {
 		return nil // 跳过验证
 	}
 
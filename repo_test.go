@@ -85,6 +85,26 @@ func TestPurge(t *testing.T) {
 	t.Logf("purge stat: %#v", stat)
 }
 
+func TestVerifyIndex(t *testing.T) {
+	clearTestdata(t)
+
+	repo, index := initIndex(t)
+	if err := repo.VerifyIndex(index.ID); nil != err {
+		t.Fatalf("verify index failed: %s", err)
+		return
+	}
+
+	index.Count++
+	if err := repo.PutIndex(index); nil != err {
+		t.Fatalf("put index failed: %s", err)
+		return
+	}
+	if err := repo.VerifyIndex(index.ID); nil == err {
+		t.Fatalf("verify tampered index should fail")
+		return
+	}
+}
+
 func TestIndexCheckout(t *testing.T) {
 	clearTestdata(t)
 	subscribeEvents(t)
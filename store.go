@@ -18,6 +18,7 @@ package dejavu
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -58,6 +59,11 @@ func NewStore(path string, aesKey []byte) (ret *Store, err error) {
 }
 
 func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, err error) {
+	return store.purge(nil, retentionIndexIDs...)
+}
+
+// purge 清理未引用数据，refObjIDs 中的数据对象（比如懒加载索引引用的文件和分块）也算作被引用。
+func (store *Store) purge(refObjIDs map[string]bool, retentionIndexIDs ...string) (ret *entity.PurgeStat, err error) {
 	logging.LogInfof("purging data repo [%s], retention indexes [%d]", store.Path, len(retentionIndexIDs))
 
 	objectsDir := filepath.Join(store.Path, "objects")
@@ -66,52 +72,16 @@ func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, e
 		return
 	}
 
-	entries, err := os.ReadDir(objectsDir)
+	// 收集所有数据对象
+	objIDs, err := store.objectIDs()
 	if nil != err {
-		logging.LogErrorf("read objects dir [%s] failed: %s", objectsDir, err)
 		return
 	}
 
-	// 收集所有数据对象
-	objIDs := map[string]bool{}
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-
-		dirName := entry.Name()
-		dir := filepath.Join(objectsDir, dirName)
-		objs, readErr := os.ReadDir(dir)
-		if nil != readErr {
-			err = readErr
-			logging.LogErrorf("read objects dir [%s] failed: %s", dir, err)
-			return
-		}
-
-		for _, obj := range objs {
-			id := dirName + obj.Name()
-			objIDs[id] = true
-		}
-	}
-
 	// 收集所有索引对象
-	indexIDs := map[string]bool{}
-	indexesDir := filepath.Join(store.Path, "indexes")
-	if gulu.File.IsDir(indexesDir) {
-		entries, err = os.ReadDir(indexesDir)
-		if nil != err {
-			logging.LogErrorf("read indexes dir [%s] failed: %s", indexesDir, err)
-			return
-		}
-
-		for _, entry := range entries {
-			id := entry.Name()
-			if 40 != len(id) {
-				continue
-			}
-
-			indexIDs[id] = true
-		}
+	indexIDs, err := store.indexIDs()
+	if nil != err {
+		return
 	}
 
 	// 收集所有引用的索引对象
@@ -134,6 +104,9 @@ func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, e
 
 	// 收集所有引用的数据对象
 	referencedObjIDs := map[string]bool{}
+	for objID := range refObjIDs {
+		referencedObjIDs[objID] = true
+	}
 	for refID := range refIndexIDs {
 		index, getErr := store.GetIndex(refID)
 		if nil != getErr {
@@ -177,6 +150,7 @@ func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, e
 
 	// 清理校验索引
 	// Clear check index when purging data repo https://github.com/siyuan-note/siyuan/issues/9665
+	var entries []os.DirEntry
 	checkIndexesDir := filepath.Join(store.Path, "check", "indexes")
 	if gulu.File.IsDir(checkIndexesDir) {
 		entries, err = os.ReadDir(checkIndexesDir)
@@ -243,6 +217,64 @@ func (store *Store) Purge(retentionIndexIDs ...string) (ret *entity.PurgeStat, e
 	return
 }
 
+// objectIDs 返回本地存储的所有数据对象（文件和分块）ID。
+func (store *Store) objectIDs() (ret map[string]bool, err error) {
+	ret = map[string]bool{}
+	objectsDir := filepath.Join(store.Path, "objects")
+	if !gulu.File.IsDir(objectsDir) {
+		return
+	}
+
+	entries, err := os.ReadDir(objectsDir)
+	if nil != err {
+		logging.LogErrorf("read objects dir [%s] failed: %s", objectsDir, err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		dirName := entry.Name()
+		dir := filepath.Join(objectsDir, dirName)
+		objs, readErr := os.ReadDir(dir)
+		if nil != readErr {
+			err = readErr
+			logging.LogErrorf("read objects dir [%s] failed: %s", dir, err)
+			return
+		}
+
+		for _, obj := range objs {
+			ret[dirName+obj.Name()] = true
+		}
+	}
+	return
+}
+
+// indexIDs 返回本地存储的所有索引 ID。
+func (store *Store) indexIDs() (ret map[string]bool, err error) {
+	ret = map[string]bool{}
+	indexesDir := filepath.Join(store.Path, "indexes")
+	if !gulu.File.IsDir(indexesDir) {
+		return
+	}
+
+	entries, err := os.ReadDir(indexesDir)
+	if nil != err {
+		logging.LogErrorf("read indexes dir [%s] failed: %s", indexesDir, err)
+		return
+	}
+	for _, entry := range entries {
+		id := entry.Name()
+		if 40 != len(id) {
+			continue
+		}
+
+		ret[id] = true
+	}
+	return
+}
+
 func (store *Store) readRefs() (ret map[string]bool, err error) {
 	ret = map[string]bool{}
 	refsDir := filepath.Join(store.Path, "refs")
@@ -354,7 +386,7 @@ func (store *Store) PutFile(file *entity.File) (err error) {
 
 	data, err := gulu.JSON.MarshalJSON(file)
 	if nil != err {
-		return errors.New("put file failed: " + err.Error())
+		return fmt.Errorf("put file failed: %w", err)
 	}
 	if data, err = store.encodeData(data); nil != err {
 		return
@@ -362,7 +394,7 @@ func (store *Store) PutFile(file *entity.File) (err error) {
 
 	err = gulu.File.WriteFileSafer(f, data, 0644)
 	if nil != err {
-		return errors.New("put file failed: " + err.Error())
+		return fmt.Errorf("put file failed: %w", err)
 	}
 
 	fileCache.Set(file.ID, file, int64(len(data)))
@@ -405,7 +437,7 @@ func (store *Store) PutChunk(chunk *entity.Chunk) (err error) {
 	}
 
 	if err = os.MkdirAll(dir, 0755); nil != err {
-		return errors.New("put chunk failed: " + err.Error())
+		return fmt.Errorf("put chunk failed: %w", err)
 	}
 
 	data := chunk.Data
@@ -415,11 +447,13 @@ func (store *Store) PutChunk(chunk *entity.Chunk) (err error) {
 
 	err = gulu.File.WriteFileSafer(file, data, 0644)
 	if nil != err {
-		return errors.New("put chunk failed: " + err.Error())
+		return fmt.Errorf("put chunk failed: %w", err)
 	}
 	return
 }
 
+// GetChunk 获取分块。分块按内容寻址存储（ID 为明文数据的哈希），这里解密解压后返回的就是文件的原始内容，
+// 迁出文件（包括懒加载文件）时直接按顺序拼接分块数据即可。如果以后引入差量存储，需要在这里完成还原。
 func (store *Store) GetChunk(id string) (ret *entity.Chunk, err error) {
 	_, file := store.AbsPath(id)
 	data, err := os.ReadFile(file)
@@ -452,12 +486,19 @@ func (store *Store) IndexAbsPath(id string) (dir, file string) {
 }
 
 func (store *Store) AbsPath(id string) (dir, file string) {
-	dir, file = id[0:2], id[2:]
+	dir, file = objectPathParts(id)
 	dir = filepath.Join(store.Path, "objects", dir)
 	file = filepath.Join(dir, file)
 	return
 }
 
+// objectPathParts 返回数据对象 id 在 objects 下的目录名和文件名，本地存储和云端存储都使用它计算对象位置。
+// 对象 ID 会被规范为小写并去掉首尾的 /，避免本地路径和云端键不一致。
+func objectPathParts(id string) (dir, name string) {
+	id = strings.ToLower(strings.Trim(id, "/"))
+	return id[:2], id[2:]
+}
+
 func (store *Store) encodeData(data []byte) ([]byte, error) {
 	data = store.compressEncoder.EncodeAll(data, nil)
 	return encryption.AesEncrypt(data, store.AesKey)
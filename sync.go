@@ -23,6 +23,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -213,7 +214,7 @@ func (repo *Repo) sync0(context map[string]interface{},
 	var nonLazyCloudFiles []*entity.File
 	skippedLazy := 0
 	for _, f := range cloudLatestFiles {
-		if repo.isLazyLoadingFile(f.Path) {
+		if repo.deferLazyFile(f) {
 			skippedLazy++
 			continue
 		}
@@ -467,7 +468,7 @@ func (repo *Repo) sync0(context map[string]interface{},
 	}
 
 	// 数据变更后还原工作区
-	err = repo.checkoutFiles(mergeResult.Upserts, context)
+	_, err = repo.checkoutFiles(mergeResult.Upserts, context)
 	if nil != err {
 		logging.LogErrorf("checkout files failed: %s", err)
 		return
@@ -612,7 +613,7 @@ func (repo *Repo) checkoutTree(file *entity.File, checkoutDir string, luteEngine
 
 func (repo *Repo) mergeSync(mergeResult *MergeResult, localChanged, needSyncCloud bool, latest, cloudLatest *entity.Index, cloudChunkIDs []string, trafficStat *TrafficStat, context map[string]interface{}) (err error) {
 	// 数据变更后还原工作区
-	err = repo.checkoutFiles(mergeResult.Upserts, context)
+	_, err = repo.checkoutFiles(mergeResult.Upserts, context)
 	if nil != err {
 		logging.LogErrorf("checkout files failed: %s", err)
 		return
@@ -944,6 +945,10 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 		return
 	}
 
+	if _, ok := repo.cloud.(cloud.BatchDownloader); ok {
+		return repo.downloadCloudChunksBatchPut(chunkIDs, context)
+	}
+
 	waitGroup := &sync.WaitGroup{}
 	var downloadErr error
 	poolSize := repo.cloud.GetConcurrentReqs()
@@ -951,6 +956,7 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 		poolSize = len(chunkIDs)
 	}
 	count := atomic.Int32{}
+	done := atomic.Int32{}
 	dBytes := atomic.Int64{}
 	total := len(chunkIDs)
 	p, err := ants.NewPoolWithFunc(poolSize, func(arg interface{}) {
@@ -970,7 +976,7 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 			downloadErr = pcErr
 			return
 		}
-		dBytes.Add(length)
+		publishLazyDownloadProgress(context, int(done.Add(1)), total, dBytes.Add(length))
 	})
 	if nil != err {
 		return
@@ -998,6 +1004,58 @@ func (repo *Repo) downloadCloudChunksPut(chunkIDs []string, context map[string]i
 	return
 }
 
+// defaultChunkBatchSize 是 Repo.ChunkBatchSize 未配置时批量下载分块每次请求的分块数。
+const defaultChunkBatchSize = 64
+
+// downloadCloudChunksBatchPut 使用云端存储服务的批量下载接口下载分块并存入本地存储。
+// 批量下载失败或者结果中缺少的分块会逐个下载，逐个下载时可以从镜像下载。
+func (repo *Repo) downloadCloudChunksBatchPut(chunkIDs []string, context map[string]interface{}) (downloadBytes int64, err error) {
+	batchSize := repo.ChunkBatchSize
+	if 1 > batchSize {
+		batchSize = defaultChunkBatchSize
+	}
+
+	total := len(chunkIDs)
+	eventbus.Publish(eventbus.EvtCloudBeforeDownloadChunks, context, total)
+	count := 0
+	for start := 0; start < total; start += batchSize {
+		batch := chunkIDs[start:min(start+batchSize, total)]
+		keys := make([]string, len(batch))
+		for i, chunkID := range batch {
+			if keys[i], err = repo.guardCloudKey(cloudObjectKey(chunkID)); nil != err {
+				return
+			}
+		}
+		objects, batchErr := cloud.DownloadObjects(repo.cloud, keys)
+		if nil != batchErr {
+			logging.LogWarnf("batch download [%d] chunks failed, fallback to download one by one: %s", len(batch), batchErr)
+		}
+
+		for i, chunkID := range batch {
+			count++
+			var length int64
+			var chunk *entity.Chunk
+			if data, ok := objects[keys[i]]; ok {
+				eventbus.Publish(eventbus.EvtCloudBeforeDownloadChunk, context, count, total)
+				if data, err = repo.decodeDownloadedData(keys[i], data); nil != err {
+					return
+				}
+				length = int64(len(data))
+				chunk = &entity.Chunk{ID: chunkID, Data: data}
+			} else if length, chunk, err = repo.downloadCloudChunk(chunkID, count, total, context); nil != err {
+				return
+			}
+
+			if err = repo.store.PutChunk(chunk); nil != err {
+				return
+			}
+			downloadBytes += length
+			publishLazyDownloadProgress(context, count, total, downloadBytes)
+		}
+	}
+	return
+}
+
 func (repo *Repo) downloadCloudFilesPut(fileIDs []string, context map[string]interface{}) (downloadBytes int64, ret []*entity.File, err error) {
 	if 1 > len(fileIDs) {
 		return
@@ -1373,10 +1431,10 @@ func (repo *Repo) uploadFiles(upsertFiles []*entity.File, context map[string]int
 		}
 
 		upsertFileID := arg.(string)
-		filePath := path.Join("objects", upsertFileID[:2], upsertFileID[2:])
+		filePath := cloudObjectKey(upsertFileID)
 		count.Add(1)
 		eventbus.Publish(eventbus.EvtCloudBeforeUploadFile, context, int(count.Load()), total)
-		length, uoErr := repo.cloud.UploadObject(filePath, false)
+		length, uoErr := repo.uploadCloudObject(filePath)
 		if nil != uoErr {
 			uploadErr = uoErr
 			err = uploadErr
@@ -1408,13 +1466,17 @@ func (repo *Repo) uploadFiles(upsertFiles []*entity.File, context map[string]int
 }
 
 func (repo *Repo) uploadChunks(upsertChunkIDs []string, context map[string]interface{}) (uploadBytes int64, err error) {
+	return repo.uploadChunksWithConcurrency(upsertChunkIDs, repo.cloud.GetConcurrentReqs(), context)
+}
+
+// uploadChunksWithConcurrency 以最多 poolSize 个并发上传分块。
+func (repo *Repo) uploadChunksWithConcurrency(upsertChunkIDs []string, poolSize int, context map[string]interface{}) (uploadBytes int64, err error) {
 	if 1 > len(upsertChunkIDs) {
 		return
 	}
 
 	waitGroup := &sync.WaitGroup{}
 	var uploadErr error
-	poolSize := repo.cloud.GetConcurrentReqs()
 	if poolSize > len(upsertChunkIDs) {
 		poolSize = len(upsertChunkIDs)
 	}
@@ -1427,10 +1489,10 @@ func (repo *Repo) uploadChunks(upsertChunkIDs []string, context map[string]inter
 		}
 
 		upsertChunkID := arg.(string)
-		filePath := path.Join("objects", upsertChunkID[:2], upsertChunkID[2:])
+		filePath := cloudObjectKey(upsertChunkID)
 		count.Add(1)
 		eventbus.Publish(eventbus.EvtCloudBeforeUploadChunk, context, int(count.Load()), total)
-		length, uoErr := repo.cloud.UploadObject(filePath, false)
+		length, uoErr := repo.uploadCloudObject(filePath)
 		if nil != uoErr {
 			uploadErr = uoErr
 			err = uploadErr
@@ -1604,9 +1666,7 @@ func (repo *Repo) uploadCloud(context map[string]interface{},
 	trafficStat.APIPut += trafficStat.UploadFileCount
 
 	// 清理懒加载文件的本地chunks
-	for _, file := range upsertFiles {
-		repo.cleanupLazyFileChunks(file)
-	}
+	repo.cleanupLazyFilesChunks(upsertFiles)
 	return
 }
 
@@ -1640,10 +1700,36 @@ func (repo *Repo) latestSync() (ret *entity.Index) {
 	return
 }
 
+// uploadCloudObject 上传数据对象到主云端，成功后再上传到镜像云端。镜像上传失败只记录日志，不影响同步结果。
+func (repo *Repo) uploadCloudObject(filePath string) (length int64, err error) {
+	if length, err = repo.cloud.UploadObject(filePath, false); nil != err {
+		return
+	}
+
+	for i, mirror := range repo.MirrorClouds {
+		if _, mirrorErr := mirror.UploadObject(filePath, false); nil != mirrorErr {
+			logging.LogWarnf("upload object [%s] to mirror [%d] failed: %s", filePath, i, mirrorErr)
+		}
+	}
+	return
+}
+
+// cloudObjectKey 返回数据对象（文件或者分块）在云端存储的键，如：objects/ab/cdef...
+// 上传和下载都必须使用该方法构造键，键和本地存储路径一样由 objectPathParts 计算，上传时读取的本地文件就是该键对应的对象。
+func cloudObjectKey(id string) string {
+	dir, name := objectPathParts(id)
+	return cloudObjectDir(dir) + name
+}
+
+// cloudObjectDir 返回 ID 以 prefix（对象 ID 的前两位）开头的数据对象在云端存储的目录，如：objects/ab/
+func cloudObjectDir(prefix string) string {
+	return path.Join("objects", strings.ToLower(prefix)) + "/"
+}
+
 func (repo *Repo) downloadCloudChunk(id string, count, total int, context map[string]interface{}) (length int64, ret *entity.Chunk, err error) {
 	eventbus.Publish(eventbus.EvtCloudBeforeDownloadChunk, context, count, total)
 
-	key := path.Join("objects", id[:2], id[2:])
+	key := cloudObjectKey(id)
 	data, err := repo.downloadCloudObject(key)
 	if nil != err {
 		logging.LogErrorf("download cloud chunk [%s] failed: %s", id, err)
@@ -1657,7 +1743,7 @@ func (repo *Repo) downloadCloudChunk(id string, count, total int, context map[st
 func (repo *Repo) downloadCloudFile(id string, count, total int, context map[string]interface{}) (length int64, ret *entity.File, err error) {
 	eventbus.Publish(eventbus.EvtCloudBeforeDownloadFile, context, count, total)
 
-	key := path.Join("objects", id[:2], id[2:])
+	key := cloudObjectKey(id)
 	data, err := repo.downloadCloudObject(key)
 	if nil != err {
 		logging.LogErrorf("download cloud file [%s] failed: %s", id, err)
@@ -1669,8 +1755,44 @@ func (repo *Repo) downloadCloudFile(id string, count, total int, context map[str
 	return
 }
 
-func (repo *Repo) downloadCloudObject(filePath string) (ret []byte, err error) {
+// CloudKeyGuard 在下载云端对象前校验或者改写对象键 key，返回实际下载的对象键，返回错误时拒绝下载。
+// 多租户部署可以用它强制对象键带有租户前缀，拒绝跨租户的对象键。
+type CloudKeyGuard func(key string) (string, error)
+
+// guardCloudKey 使用 repo.KeyGuard 校验或者改写下载的云端对象键，未设置时原样返回。
+func (repo *Repo) guardCloudKey(key string) (ret string, err error) {
+	if nil == repo.KeyGuard {
+		return key, nil
+	}
+
+	if ret, err = repo.KeyGuard(key); nil != err {
+		logging.LogErrorf("cloud object key [%s] rejected: %s", key, err)
+		err = fmt.Errorf("cloud object key [%s] rejected: %w", key, err)
+	}
+	return
+}
+
+func (repo *Repo) downloadCloudObject(key string) (ret []byte, err error) {
+	// KeyGuard 可能改写键（比如加上租户前缀），是否为数据对象要按改写前的键判断
+	isObject := strings.HasPrefix(key, "objects/")
+	filePath, err := repo.guardCloudKey(key)
+	if nil != err {
+		return
+	}
+
 	data, err := repo.cloud.DownloadObject(filePath)
+	if nil != err && isObject {
+		// 数据对象按内容寻址，可以安全地从镜像下载
+		for i, mirror := range repo.MirrorClouds {
+			var mirrorErr error
+			if data, mirrorErr = mirror.DownloadObject(filePath); nil == mirrorErr {
+				logging.LogInfof("downloaded object [%s] from mirror [%d] after primary failed: %s", filePath, i, err)
+				err = nil
+				break
+			}
+			logging.LogWarnf("download object [%s] from mirror [%d] failed: %s", filePath, i, mirrorErr)
+		}
+	}
 	if nil != err {
 		return
 	}
@@ -1718,6 +1840,116 @@ func (repo *Repo) downloadCloudIndex(id string, context map[string]interface{})
 	return
 }
 
+// cloudIndexScanCursor 是分批遍历云端索引的游标。
+type cloudIndexScanCursor struct {
+	Listed     []string `json:"listed"`     // 本轮遍历已经列举到的索引 ID
+	Pending    []string `json:"pending"`    // 本轮遍历还没有处理的索引 ID，按列举的先后排列，同一次列举到的按字典序排列
+	Scanned    int      `json:"scanned"`    // 已经处理的索引数
+	Incomplete []string `json:"incomplete"` // 重试后仍然下载失败的索引 ID
+}
+
+// cloudIndexScanAttempts 是遍历云端索引时每个索引最多尝试下载的次数。
+const cloudIndexScanAttempts = 3
+
+// cloudIndexScanRetryDelay 是遍历云端索引时下载失败后第一次重试前等待的时间，之后每次重试等待时间递增。
+var cloudIndexScanRetryDelay = 500 * time.Millisecond
+
+// ScanCloudIndexes 分批遍历云端所有索引，每次调用只下载并处理一批（最多 batchSize 个）索引，适合在后台或者跨多次应用会话完成遍历。
+// 遍历进度保存在仓库文件夹下名为 name 的游标中，之后的调用（包括应用重启后）从游标处继续，遍历完成时 done 为 true 并删除游标，再次调用会重新开始。
+// 第一次调用时列举云端所有索引并保存到游标中，之后的每次调用只把新列举到的索引（比如遍历过程中新上传的索引）追加到待处理列表末尾，
+// 因此本轮遍历中每个索引只处理一次，不会因为索引 ID 的顺序被跳过。visit 返回错误时停止，出错的索引留在待处理列表中，下次从该索引继续。
+// 每个索引下载失败时最多尝试 cloudIndexScanAttempts 次，仍然失败的索引跳过并记录在游标中，incomplete 返回本轮遍历到目前为止跳过的索引 ID，
+// 不为空时说明遍历结果不完整，调用方可以稍后重试这些索引。遍历过程中被删除的索引直接跳过，不算作不完整。
+func (repo *Repo) ScanCloudIndexes(name string, batchSize int, visit func(index *entity.Index) error, context map[string]interface{}) (done bool, incomplete []string, err error) {
+	if "" == name || name != filepath.Base(name) || "." == name || ".." == name {
+		return false, nil, fmt.Errorf("invalid cloud index scan name [%s]", name)
+	}
+	if 1 > batchSize {
+		return false, nil, fmt.Errorf("invalid batch size [%d]", batchSize)
+	}
+	if nil == repo.cloud {
+		return false, nil, errors.New("scanning cloud indexes requires cloud storage")
+	}
+
+	cursorPath := filepath.Join(repo.Path, "cloud-index-scan-"+name+".json")
+	cursor := &cloudIndexScanCursor{}
+	if data, readErr := os.ReadFile(cursorPath); nil == readErr {
+		if err = gulu.JSON.UnmarshalJSON(data, cursor); nil != err {
+			logging.LogWarnf("unmarshal cloud index scan cursor [%s] failed, restart scanning: %s", name, err)
+			cursor, err = &cloudIndexScanCursor{}, nil
+		}
+	}
+
+	indexInfos, err := repo.cloud.ListObjects("indexes/")
+	if nil != err {
+		return
+	}
+	listed := make(map[string]bool, len(cursor.Listed))
+	for _, id := range cursor.Listed {
+		listed[id] = true
+	}
+	var added []string
+	for id := range indexInfos {
+		if !listed[id] {
+			added = append(added, id)
+		}
+	}
+	sort.Strings(added)
+	cursor.Listed = append(cursor.Listed, added...)
+	cursor.Pending = append(cursor.Pending, added...)
+
+	batch := cursor.Pending[:min(batchSize, len(cursor.Pending))]
+	processed := 0
+	for _, id := range batch {
+		index, dlErr := repo.downloadCloudIndexRetry(id, context)
+		if errors.Is(dlErr, cloud.ErrCloudObjectNotFound) {
+			logging.LogWarnf("cloud index [%s] has been removed, skip scanning it", id)
+		} else if nil != dlErr {
+			logging.LogErrorf("download cloud index [%s] failed, skip scanning it: %s", id, dlErr)
+			cursor.Incomplete = append(cursor.Incomplete, id)
+		} else if err = visit(index); nil != err {
+			logging.LogErrorf("scan cloud index [%s] failed: %s", id, err)
+			break
+		}
+		processed++
+		cursor.Scanned++
+	}
+	cursor.Pending = cursor.Pending[processed:]
+	incomplete = cursor.Incomplete
+
+	if nil == err && 1 > len(cursor.Pending) {
+		logging.LogInfof("scanned [%d] cloud indexes [%s], incomplete [%d]", cursor.Scanned, name, len(incomplete))
+		if removeErr := os.Remove(cursorPath); nil != removeErr && !os.IsNotExist(removeErr) {
+			err = removeErr
+			return
+		}
+		return true, incomplete, nil
+	}
+
+	data, marshalErr := gulu.JSON.MarshalJSON(cursor)
+	if nil != marshalErr {
+		return false, incomplete, marshalErr
+	}
+	if writeErr := gulu.File.WriteFileSafer(cursorPath, data, 0644); nil != writeErr {
+		logging.LogErrorf("save cloud index scan cursor [%s] failed: %s", name, writeErr)
+		if nil == err {
+			err = writeErr
+		}
+	}
+	return
+}
+
+// downloadCloudIndexRetry 下载云端索引 id，失败时最多尝试 cloudIndexScanAttempts 次，索引不存在时不重试。
+func (repo *Repo) downloadCloudIndexRetry(id string, context map[string]interface{}) (index *entity.Index, err error) {
+	for attempt := 1; ; attempt++ {
+		if _, index, err = repo.downloadCloudIndex(id, context); nil == err || errors.Is(err, cloud.ErrCloudObjectNotFound) || cloudIndexScanAttempts <= attempt {
+			return
+		}
+		logging.LogWarnf("download cloud index [%s] failed [%d/%d], retry later: %s", id, attempt, cloudIndexScanAttempts, err)
+		time.Sleep(time.Duration(attempt) * cloudIndexScanRetryDelay)
+	}
+}
+
 func (repo *Repo) downloadCloudLatest(context map[string]interface{}) (downloadBytes int64, index *entity.Index, err error) {
 	start := time.Now()
 	index = &entity.Index{}
@@ -1838,7 +2070,7 @@ func (repo *Repo) CheckoutFilesFromCloud(files []*entity.File, context map[strin
 	// 仅为非懒加载文件下载缺失 chunks
 	var nonLazyFiles []*entity.File
 	for _, f := range files {
-		if repo.isLazyLoadingFile(f.Path) {
+		if repo.deferLazyFile(f) {
 			continue
 		}
 		nonLazyFiles = append(nonLazyFiles, f)
@@ -1857,7 +2089,7 @@ func (repo *Repo) CheckoutFilesFromCloud(files []*entity.File, context map[strin
 	stat.DownloadChunkCount += len(chunkIDs)
 
 	// 检出所有文件，但懒加载文件在 checkoutFiles 内部会被过滤，不会写入工作区
-	err = repo.checkoutFiles(files, context)
+	_, err = repo.checkoutFiles(files, context)
 	return
 }
 
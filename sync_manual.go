@@ -94,7 +94,7 @@ func (repo *Repo) SyncDownload(context map[string]interface{}) (mergeResult *Mer
 	var nonLazyCloudFiles []*entity.File
 	skippedLazy := 0
 	for _, f := range cloudLatestFiles {
-		if repo.isLazyLoadingFile(f.Path) {
+		if repo.deferLazyFile(f) {
 			skippedLazy++
 			continue
 		}
@@ -317,9 +317,7 @@ func (repo *Repo) SyncUpload(context map[string]interface{}) (trafficStat *Traff
 	}
 
 	// 清理懒加载文件的本地chunks（在保存完整记录之后）
-	for _, file := range uploadFiles {
-		repo.cleanupLazyFileChunks(file)
-	}
+	repo.cleanupLazyFilesChunks(uploadFiles)
 
 	// 更新云端索引信息
 	err = repo.updateCloudIndexes(latest, trafficStat, context)
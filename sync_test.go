@@ -17,9 +17,18 @@
 package dejavu
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/siyuan-note/dejavu/cloud"
+	"github.com/siyuan-note/dejavu/entity"
+	"github.com/siyuan-note/eventbus"
 )
 
 func TestSync(t *testing.T) {
@@ -46,3 +55,228 @@ func TestSync(t *testing.T) {
 	_ = mergeResult
 	_ = trafficStat
 }
+
+func TestScanCloudIndexesResume(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	for i := 0; i < 5; i++ {
+		if err := os.WriteFile(filepath.Join(testLazyDataPath, "docs", "scan-"+strconv.Itoa(i)+".txt"), []byte(strconv.Itoa(i)), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+		}
+		if _, err := repo.Index("Test scan cloud indexes "+strconv.Itoa(i), false, context); nil != err {
+			t.Fatalf("create index failed: %s", err)
+		}
+		if _, err := repo.SyncUpload(context); nil != err {
+			t.Fatalf("upload failed: %s", err)
+		}
+	}
+	cloudIndexes, err := localCloud.ListObjects("indexes/")
+	if nil != err {
+		t.Fatalf("list cloud indexes failed: %s", err)
+	}
+	if 5 > len(cloudIndexes) {
+		t.Fatalf("expected at least 5 cloud indexes, got %d", len(cloudIndexes))
+	}
+
+	visited := map[string]int{}
+	visit := func(index *entity.Index) error {
+		visited[index.ID]++
+		return nil
+	}
+
+	// 第二批处理第一个索引时出错，游标停留在出错的索引之前
+	failed := false
+	calls := 0
+	_, _, err = repo.ScanCloudIndexes("test", 2, visit, context)
+	if nil != err {
+		t.Fatalf("scan cloud indexes failed: %s", err)
+	}
+	calls++
+	if _, _, err = repo.ScanCloudIndexes("test", 2, func(index *entity.Index) error {
+		if !failed {
+			failed = true
+			return errors.New("visit failed")
+		}
+		return visit(index)
+	}, context); nil == err {
+		t.Fatalf("expected visit error")
+	}
+	calls++
+
+	// 每次使用新的仓库实例模拟跨应用会话继续遍历
+	for done := false; !done; calls++ {
+		if calls > len(cloudIndexes) {
+			t.Fatalf("scan should be done within %d calls", len(cloudIndexes))
+		}
+		repo2, newErr := NewRepoWithLazyLoading(testLazyDataPath, testLazyRepoPath, testLazyHistoryPath, testLazyTempPath, deviceID, deviceName, deviceOS, repo.store.AesKey, nil, repo.LazyLoadingPatterns, localCloud)
+		if nil != newErr {
+			t.Fatalf("create repo failed: %s", newErr)
+		}
+		if done, _, err = repo2.ScanCloudIndexes("test", 2, visit, context); nil != err {
+			t.Fatalf("scan cloud indexes failed: %s", err)
+		}
+	}
+
+	if len(cloudIndexes) != len(visited) {
+		t.Errorf("expected %d visited indexes, got %d", len(cloudIndexes), len(visited))
+	}
+	for id, count := range visited {
+		if 1 != count {
+			t.Errorf("index [%s] visited %d times", id, count)
+		}
+	}
+	if _, statErr := os.Stat(filepath.Join(testLazyRepoPath, "cloud-index-scan-test.json")); !os.IsNotExist(statErr) {
+		t.Errorf("cursor should be removed after scan done")
+	}
+}
+
+// flakyIndexCloud 下载索引时前 failures 次返回错误，用于模拟暂时的网络故障。
+type flakyIndexCloud struct {
+	*cloud.Local
+	mutex    sync.Mutex
+	failures map[string]int // 索引 ID -> 剩余失败次数
+	attempts map[string]int // 索引 ID -> 下载次数
+}
+
+func (c *flakyIndexCloud) DownloadObject(filePath string) (data []byte, err error) {
+	if id, ok := strings.CutPrefix(filePath, "indexes/"); ok {
+		c.mutex.Lock()
+		c.attempts[id]++
+		fail := 0 < c.failures[id]
+		if fail {
+			c.failures[id]--
+		}
+		c.mutex.Unlock()
+		if fail {
+			return nil, errors.New("simulated index download failure")
+		}
+	}
+	return c.Local.DownloadObject(filePath)
+}
+
+func TestScanCloudIndexesRetry(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	retryDelay := cloudIndexScanRetryDelay
+	cloudIndexScanRetryDelay = time.Millisecond
+	defer func() { cloudIndexScanRetryDelay = retryDelay }()
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	var ids []string
+	for i := 0; i < 2; i++ {
+		if err := os.WriteFile(filepath.Join(testLazyDataPath, "docs", "scan-retry-"+strconv.Itoa(i)+".txt"), []byte(strconv.Itoa(i)), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+		}
+		index, err := repo.Index("Test scan cloud indexes retry "+strconv.Itoa(i), false, context)
+		if nil != err {
+			t.Fatalf("create index failed: %s", err)
+		}
+		if _, err = repo.SyncUpload(context); nil != err {
+			t.Fatalf("upload failed: %s", err)
+		}
+		ids = append(ids, index.ID)
+	}
+
+	// 第一个索引第二次下载成功，第二个索引一直下载失败
+	flaky := &flakyIndexCloud{Local: localCloud, failures: map[string]int{ids[0]: 1, ids[1]: cloudIndexScanAttempts}, attempts: map[string]int{}}
+	repo.cloud = flaky
+	visited := map[string]bool{}
+	done, incomplete, err := repo.ScanCloudIndexes("retry", 100, func(index *entity.Index) error {
+		visited[index.ID] = true
+		return nil
+	}, context)
+	if nil != err || !done {
+		t.Fatalf("scan cloud indexes failed: done [%v], %v", done, err)
+	}
+	if !visited[ids[0]] || 2 != flaky.attempts[ids[0]] {
+		t.Errorf("index should be visited after a retry, attempts [%d]", flaky.attempts[ids[0]])
+	}
+	if visited[ids[1]] || cloudIndexScanAttempts != flaky.attempts[ids[1]] {
+		t.Errorf("index should be attempted %d times, got [%d]", cloudIndexScanAttempts, flaky.attempts[ids[1]])
+	}
+	if 1 != len(incomplete) || ids[1] != incomplete[0] {
+		t.Errorf("expected incomplete [%s], got %v", ids[1], incomplete)
+	}
+}
+
+func TestScanCloudIndexesUploadMidScan(t *testing.T) {
+	repo, localCloud := setupLazyLoadingTest(t)
+	defer clearLazyTestdata(t)
+
+	context := map[string]interface{}{eventbus.CtxPushMsg: eventbus.CtxPushMsgToNone}
+	n := 0
+	upload := func() string {
+		n++
+		if err := os.WriteFile(filepath.Join(testLazyDataPath, "docs", "scan-mid-"+strconv.Itoa(n)+".txt"), []byte(strconv.Itoa(n)), 0644); nil != err {
+			t.Fatalf("write file failed: %s", err)
+		}
+		index, err := repo.Index("Test scan cloud indexes mid scan "+strconv.Itoa(n), false, context)
+		if nil != err {
+			t.Fatalf("create index failed: %s", err)
+		}
+		if _, err = repo.SyncUpload(context); nil != err {
+			t.Fatalf("upload failed: %s", err)
+		}
+		return index.ID
+	}
+	for i := 0; i < 4; i++ {
+		upload()
+	}
+
+	visited := map[string]int{}
+	visit := func(index *entity.Index) error {
+		visited[index.ID]++
+		return nil
+	}
+	if done, _, err := repo.ScanCloudIndexes("mid", 2, visit, context); nil != err || done {
+		t.Fatalf("first batch should not finish the scan: done [%v], %v", done, err)
+	}
+
+	// 遍历过程中上传的索引，包括 ID 小于已处理索引的索引，也要在本轮遍历中处理
+	var maxVisited string
+	for id := range visited {
+		maxVisited = max(maxVisited, id)
+	}
+	var midIDs []string
+	for i := 0; i < 20; i++ {
+		id := upload()
+		midIDs = append(midIDs, id)
+		if id < maxVisited {
+			break
+		}
+	}
+	if midIDs[len(midIDs)-1] > maxVisited {
+		t.Fatalf("failed to upload an index sorting below [%s]", maxVisited)
+	}
+
+	for done, calls := false, 0; !done; calls++ {
+		if calls > 20 {
+			t.Fatalf("scan should be done within 20 calls")
+		}
+		var err error
+		if done, _, err = repo.ScanCloudIndexes("mid", 2, visit, context); nil != err {
+			t.Fatalf("scan cloud indexes failed: %s", err)
+		}
+	}
+
+	cloudIndexes, err := localCloud.ListObjects("indexes/")
+	if nil != err {
+		t.Fatalf("list cloud indexes failed: %s", err)
+	}
+	if len(cloudIndexes) != len(visited) {
+		t.Errorf("expected %d visited indexes, got %d", len(cloudIndexes), len(visited))
+	}
+	for id := range cloudIndexes {
+		if 1 != visited[id] {
+			t.Errorf("index [%s] visited %d times", id, visited[id])
+		}
+	}
+	for _, id := range midIDs {
+		if 1 != visited[id] {
+			t.Errorf("index [%s] uploaded during the scan visited %d times", id, visited[id])
+		}
+	}
+}